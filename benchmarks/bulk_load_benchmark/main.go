@@ -56,7 +56,7 @@ func main() {
 	}
 
 	path := dir + "/bulk_load_benchmark"
-	tree, err := index.BulkLoadNewBPlusTree(path, entries, 1)
+	tree, err := index.BulkLoadNewBPlusTree(path, zdb2.Int32, entries, 1)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -25,10 +25,10 @@ func main() {
 	t := &zdb2.TableHeader{
 		Name: "ratings",
 		Fields: []*zdb2.Field{
-			{"userId", zdb2.Int32},
-			{"movieId", zdb2.Int32},
-			{"rating", zdb2.Float64},
-			{"timestamp", zdb2.Int32},
+			{"userId", zdb2.Int32, false, 0, 0},
+			{"movieId", zdb2.Int32, false, 0, 0},
+			{"rating", zdb2.Float64, false, 0, 0},
+			{"timestamp", zdb2.Timestamp, false, 0, 0},
 		},
 	}
 	r, err := executor.NewCSVScan(flagPath, t)
@@ -10,6 +10,7 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/buffer_pool"
 	"github.com/robot-dreams/zdb2/executor"
 	"github.com/robot-dreams/zdb2/heap_file"
 )
@@ -21,13 +22,29 @@ func main() {
 	var flagHeapFile string
 	var flagIndexFile string
 	var flagMovieId int
+	var flagNumFrames int
+	var flagEvictionPolicy string
 	flag.StringVar(&flagHeapFile, "heap_file", "", "path to ratings table (heap file)")
 	flag.StringVar(&flagIndexFile, "index_file", "", "path to ratings index on movieId (B+ tree)")
 	flag.IntVar(&flagMovieId, "movieId", 5000, "movieId to look up")
+	flag.IntVar(&flagNumFrames, "num_frames", buffer_pool.DefaultNumFrames, "number of buffer pool frames")
+	flag.StringVar(&flagEvictionPolicy, "eviction_policy", "lru", "buffer pool eviction policy (lru, clock, or lru-2)")
 	flag.Parse()
 	if flagHeapFile == "" || flagIndexFile == "" {
 		log.Fatal("heap_file and index_file flags must both be provided")
 	}
+	var policy buffer_pool.EvictionPolicy
+	switch flagEvictionPolicy {
+	case "lru":
+		policy = buffer_pool.NewLRU()
+	case "clock":
+		policy = buffer_pool.NewClock()
+	case "lru-2":
+		policy = buffer_pool.NewLRUK(2)
+	default:
+		log.Fatalf("Unknown eviction policy %v", flagEvictionPolicy)
+	}
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(flagNumFrames, policy))
 
 	fmt.Println("Starting timer...")
 	start := time.Now()
@@ -65,6 +82,7 @@ func main() {
 	fmt.Printf(
 		"Done with index scan strategy after %v\n",
 		time.Since(start))
+	fmt.Printf("Buffer pool stats: %+v\n", buffer_pool.Default().Stats())
 }
 
 func printAverageRatingsByMovieID(ratingsIter zdb2.Iterator) error {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+// Bulk loads the same string keys into a B+ tree with and without key
+// compression, and compares the shape of the two trees.
+func main() {
+	var flagNumKeys int
+	var flagLoadingFactor float64
+	flag.IntVar(
+		&flagNumKeys,
+		"num_keys",
+		1000000,
+		"number of distinct keys to load")
+	flag.Float64Var(
+		&flagLoadingFactor,
+		"loading_factor",
+		1,
+		"fraction of each leaf node to fill")
+	flag.Parse()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// URLs share long prefixes, but still differ near the end.
+	entries := make([]index.Entry, 0, flagNumKeys)
+	for i := 0; i < flagNumKeys; i++ {
+		entries = append(entries, index.Entry{
+			Key: fmt.Sprintf(
+				"https://www.example.com/users/%d/posts/%09d",
+				i%97,
+				i),
+			RID: zdb2.RecordID{
+				PageID: int32(i),
+				SlotID: uint16(i),
+			},
+		})
+	}
+	index.SortEntries(zdb2.String, entries)
+
+	for _, compression := range []bool{false, true} {
+		index.SetKeyCompression(compression)
+		path := fmt.Sprintf("%v/key_compression_benchmark_%v", dir, compression)
+		tree, err := index.BulkLoadNewBPlusTree(
+			path,
+			zdb2.String,
+			entries,
+			flagLoadingFactor)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stats, err := tree.Stats()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = tree.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Key compression %v:\n", compression)
+		fmt.Printf("  height: %d\n", stats.Height)
+		fmt.Printf("  internal nodes: %d\n", stats.NumInternalNodes)
+		fmt.Printf("  leaf nodes: %d\n", stats.NumLeafNodes)
+		fmt.Printf("  average fanout: %.1f\n", stats.AverageFanout)
+		fmt.Printf("  average leaf entries: %.1f\n", stats.AverageLeafEntries)
+		fmt.Printf(
+			"  leaf key bytes: %d (%d uncompressed)\n",
+			stats.LeafKeyBytes,
+			stats.UncompressedLeafKeyBytes)
+		fmt.Printf("  router key bytes: %d\n", stats.RouterKeyBytes)
+	}
+}
@@ -29,10 +29,10 @@ func main() {
 		&zdb2.TableHeader{
 			Name: "ratings",
 			Fields: []*zdb2.Field{
-				{"userId", zdb2.Int32},
-				{"movieId", zdb2.Int32},
-				{"rating", zdb2.Float64},
-				{"timestamp", zdb2.Int32},
+				{"userId", zdb2.Int32, false, 0, 0},
+				{"movieId", zdb2.Int32, false, 0, 0},
+				{"rating", zdb2.Float64, false, 0, 0},
+				{"timestamp", zdb2.Timestamp, false, 0, 0},
 			},
 		})
 	if err != nil {
@@ -43,9 +43,9 @@ func main() {
 		&zdb2.TableHeader{
 			Name: "movies",
 			Fields: []*zdb2.Field{
-				{"movieId", zdb2.Int32},
-				{"title", zdb2.String},
-				{"genres", zdb2.String},
+				{"movieId", zdb2.Int32, false, 0, 0},
+				{"title", zdb2.String, false, 0, 0},
+				{"genres", zdb2.String, false, 0, 0},
 			},
 		})
 	if err != nil {
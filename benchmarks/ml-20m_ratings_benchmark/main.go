@@ -27,17 +27,17 @@ func main() {
 		&zdb2.TableHeader{
 			Name: "ratings",
 			Fields: []*zdb2.Field{
-				{"userId", zdb2.Int32},
-				{"movieId", zdb2.Int32},
-				{"rating", zdb2.Float64},
-				{"timestamp", zdb2.Int32},
+				{"userId", zdb2.Int32, false, 0, 0},
+				{"movieId", zdb2.Int32, false, 0, 0},
+				{"rating", zdb2.Float64, false, 0, 0},
+				{"timestamp", zdb2.Timestamp, false, 0, 0},
 			},
 		})
 	if err != nil {
 		log.Fatal(err)
 	}
 	movieIDRating := executor.NewProjection(ratings, []string{"movieId", "rating"})
-	byMovieID, err := executor.NewSortOnDisk(movieIDRating, "movieId", false)
+	byMovieID, err := executor.NewSortOnDisk(movieIDRating, "movieId", false, false)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -45,7 +45,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	byRatingDescending, err := executor.NewSortInMemory(averageRating, "average", true)
+	byRatingDescending, err := executor.NewSortInMemory(averageRating, "average", true, false)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,34 +1,216 @@
 package block_file
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
 
 	"github.com/dropbox/godropbox/errors"
 )
 
 const InvalidBlockID = -1
 
+// Files with checksums start with a header, which isn't part of any block:
+//
+//     magic (uint32):     fileMagic
+//     version (uint32):   the layout of the rest of the file
+//     blockSize (uint32): the size of each block, excluding its trailer
+//     checksum (uint32):  a CRC32C of the preceding fields
+//
+// The only layout version so far is layoutVersion_Checksums, where each block
+// is followed on disk by a trailer that stores checksumMagic (uint32) and a
+// CRC32C (uint32) of the block's contents and its blockID, so that torn or
+// misdirected writes are caught as well as bit rot.  Neither the header nor
+// the trailers are visible to callers, who still see blocks of exactly
+// BlockSize bytes.
+//
+// Files created before checksums were added don't start with a header, and
+// don't have trailers; AddChecksums converts them to the new layout.
+const (
+	fileMagic               uint32 = 0x5a424631
+	layoutVersion_Checksums uint32 = 1
+	headerWidth                    = 16
+
+	checksumMagic        uint32 = 0x5a434b31
+	checksumTrailerWidth        = 8
+)
+
+var (
+	byteOrder     = binary.LittleEndian
+	checksumTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// CorruptBlockError is returned by ReadBlock if a block doesn't match its
+// checksum.
+type CorruptBlockError struct {
+	Path     string
+	BlockID  int32
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *CorruptBlockError) Error() string {
+	return fmt.Sprintf(
+		"Block %d of %v is corrupt: expected checksum %#08x; got %#08x",
+		e.BlockID,
+		e.Path,
+		e.Expected,
+		e.Actual)
+}
+
 type BlockFile struct {
 	File      *os.File
 	BlockSize int
 	NumBlocks int32
+
+	// Whether each block is stored with a checksum.
+	Checksums bool
 }
 
+// OpenBlockFile opens the block file at path, creating it if it doesn't exist
+// yet.  New files store a checksum with each block.
 func OpenBlockFile(path string, blockSize int) (*BlockFile, error) {
+	return openBlockFile(path, blockSize, true)
+}
+
+// Like OpenBlockFile, but new files are created without checksums (like files
+// created before checksums were added).
+func OpenBlockFileWithoutChecksums(
+	path string,
+	blockSize int,
+) (*BlockFile, error) {
+	return openBlockFile(path, blockSize, false)
+}
+
+func openBlockFile(
+	path string,
+	blockSize int,
+	checksums bool,
+) (*BlockFile, error) {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
 	stat, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	numBlocks := int32(stat.Size() / int64(blockSize))
-	return &BlockFile{
+	size := stat.Size()
+	if size < headerWidth {
+		// The file is new (or was created right before a crash, before its
+		// header was written); blocks are always larger than the header, so it
+		// can't be a file without checksums that has any blocks.
+		if checksums {
+			err = writeHeader(f, blockSize)
+		} else {
+			err = f.Truncate(0)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		size = 0
+	} else {
+		checksums, err = readHeader(f, blockSize)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	bf := &BlockFile{
 		File:      f,
 		BlockSize: blockSize,
-		NumBlocks: numBlocks,
-	}, nil
+		Checksums: checksums,
+	}
+	bf.NumBlocks = int32(
+		(size - bf.Offset(0)) / bf.physicalBlockSize())
+	return bf, nil
+}
+
+// Writes the header for a (new) file with checksums.
+func writeHeader(f *os.File, blockSize int) error {
+	err := f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	var header [headerWidth]byte
+	byteOrder.PutUint32(header[0:4], fileMagic)
+	byteOrder.PutUint32(header[4:8], layoutVersion_Checksums)
+	byteOrder.PutUint32(header[8:12], uint32(blockSize))
+	byteOrder.PutUint32(
+		header[12:16],
+		crc32.Checksum(header[:12], checksumTable))
+	_, err = f.WriteAt(header[:], 0)
+	return err
+}
+
+// Returns whether the (non-empty) file starts with a header, and so has a
+// checksum trailer after each block.
+func readHeader(f *os.File, blockSize int) (bool, error) {
+	var header [headerWidth]byte
+	_, err := f.ReadAt(header[:], 0)
+	if err != nil {
+		return false, err
+	}
+	if byteOrder.Uint32(header[0:4]) != fileMagic {
+		return false, nil
+	}
+	expected := byteOrder.Uint32(header[12:16])
+	if crc32.Checksum(header[:12], checksumTable) != expected {
+		return false, errors.Newf("%v has a corrupt header", f.Name())
+	}
+	version := byteOrder.Uint32(header[4:8])
+	if version != layoutVersion_Checksums {
+		return false, errors.Newf(
+			"%v has unknown layout version %d",
+			f.Name(),
+			version)
+	}
+	actualBlockSize := int(byteOrder.Uint32(header[8:12]))
+	if actualBlockSize != blockSize {
+		return false, errors.Newf(
+			"%v has block size %d; got %d",
+			f.Name(),
+			actualBlockSize,
+			blockSize)
+	}
+	return true, nil
+}
+
+// The number of bytes taken up by each block on disk.
+func (bf *BlockFile) physicalBlockSize() int64 {
+	if bf.Checksums {
+		return int64(bf.BlockSize + checksumTrailerWidth)
+	}
+	return int64(bf.BlockSize)
+}
+
+// Offset returns the position in the file at which the given block starts.
+func (bf *BlockFile) Offset(blockID int32) int64 {
+	if bf.Checksums {
+		return headerWidth + int64(blockID)*bf.physicalBlockSize()
+	}
+	return int64(blockID) * bf.physicalBlockSize()
+}
+
+func checksum(b []byte, blockID int32) uint32 {
+	var id [4]byte
+	byteOrder.PutUint32(id[:], uint32(blockID))
+	return crc32.Update(crc32.Checksum(b, checksumTable), checksumTable, id[:])
+}
+
+// Writes the checksum trailer for a block with the given contents.
+func (bf *BlockFile) writeTrailer(b []byte, blockID int32) error {
+	var trailer [checksumTrailerWidth]byte
+	byteOrder.PutUint32(trailer[0:4], checksumMagic)
+	byteOrder.PutUint32(trailer[4:8], checksum(b, blockID))
+	_, err := bf.File.WriteAt(
+		trailer[:],
+		bf.Offset(blockID)+int64(bf.BlockSize))
+	return err
 }
 
 // Returns blockID of the newly allocated block; it's guaranteed that the next
@@ -36,13 +218,38 @@ func OpenBlockFile(path string, blockSize int) (*BlockFile, error) {
 func (bf *BlockFile) AllocateBlock() (int32, error) {
 	blockID := bf.NumBlocks
 	bf.NumBlocks++
-	err := bf.File.Truncate(int64(bf.NumBlocks) * int64(bf.BlockSize))
+	err := bf.File.Truncate(bf.Offset(bf.NumBlocks))
 	if err != nil {
 		return InvalidBlockID, err
 	}
+	if bf.Checksums {
+		// The new block is zeroed.
+		err = bf.writeTrailer(make([]byte, bf.BlockSize), blockID)
+		if err != nil {
+			return InvalidBlockID, err
+		}
+	}
 	return blockID, nil
 }
 
+// Truncate discards every block with blockID >= numBlocks.
+func (bf *BlockFile) Truncate(numBlocks int32) error {
+	if numBlocks < 0 || numBlocks > bf.NumBlocks {
+		return errors.Newf("numBlocks must be in [0, %d]; got %d", bf.NumBlocks, numBlocks)
+	}
+	err := bf.File.Truncate(bf.Offset(numBlocks))
+	if err != nil {
+		return err
+	}
+	bf.NumBlocks = numBlocks
+	return nil
+}
+
+// Sync commits the file's contents to stable storage.
+func (bf *BlockFile) Sync() error {
+	return bf.File.Sync()
+}
+
 func (bf *BlockFile) ReadBlock(b []byte, blockID int32) error {
 	if blockID < 0 || blockID >= bf.NumBlocks {
 		return errors.Newf("blockID must be in [0, %d); got %d", bf.NumBlocks, blockID)
@@ -50,13 +257,48 @@ func (bf *BlockFile) ReadBlock(b []byte, blockID int32) error {
 	if len(b) != bf.BlockSize {
 		return errors.Newf("len(b) must be %d; got %d", bf.BlockSize, len(b))
 	}
-	_, err := bf.File.ReadAt(b, int64(blockID)*int64(bf.BlockSize))
+	_, err := bf.File.ReadAt(b, bf.Offset(blockID))
 	if err != nil {
 		return err
 	}
+	if !bf.Checksums {
+		return nil
+	}
+	var trailer [checksumTrailerWidth]byte
+	_, err = bf.File.ReadAt(
+		trailer[:],
+		bf.Offset(blockID)+int64(bf.BlockSize))
+	if err != nil {
+		return err
+	}
+	magic := byteOrder.Uint32(trailer[0:4])
+	expected := byteOrder.Uint32(trailer[4:8])
+	// A crash right after the file was extended can leave a zeroed block
+	// without a trailer.
+	if magic == 0 && expected == 0 && isZero(b) {
+		return nil
+	}
+	actual := checksum(b, blockID)
+	if magic != checksumMagic || actual != expected {
+		return &CorruptBlockError{
+			Path:     bf.File.Name(),
+			BlockID:  blockID,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
 	return nil
 }
 
+func isZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (bf *BlockFile) WriteBlock(b []byte, blockID int32) error {
 	if blockID < 0 || blockID >= bf.NumBlocks {
 		return errors.Newf("blockID must be in [0, %d); got %d", bf.NumBlocks, blockID)
@@ -64,10 +306,68 @@ func (bf *BlockFile) WriteBlock(b []byte, blockID int32) error {
 	if len(b) != bf.BlockSize {
 		return errors.Newf("len(b) must be %d; got %d", bf.BlockSize, len(b))
 	}
-	_, err := bf.File.WriteAt(b, int64(blockID)*int64(bf.BlockSize))
-	return err
+	_, err := bf.File.WriteAt(b, bf.Offset(blockID))
+	if err != nil || !bf.Checksums {
+		return err
+	}
+	return bf.writeTrailer(b, blockID)
 }
 
 func (bf *BlockFile) Close() error {
 	return bf.File.Close()
 }
+
+// AddChecksums converts the block file at path to the layout with a checksum
+// after each block (if it doesn't have one already), by copying it and then
+// swapping the copy into place.  The file can't be in use while this is
+// running.
+func AddChecksums(path string, blockSize int) error {
+	src, err := OpenBlockFile(path, blockSize)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if src.Checksums {
+		return nil
+	}
+	tmpPath := path + ".checksums"
+	err = os.Remove(tmpPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dst, err := OpenBlockFile(tmpPath, blockSize)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	b := make([]byte, blockSize)
+	for blockID := int32(0); blockID < src.NumBlocks; blockID++ {
+		err = src.ReadBlock(b, blockID)
+		if err != nil {
+			return err
+		}
+		_, err = dst.AllocateBlock()
+		if err != nil {
+			return err
+		}
+		err = dst.WriteBlock(b, blockID)
+		if err != nil {
+			return err
+		}
+	}
+	err = dst.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	// Make the rename durable.
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,158 @@
+package block_file
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+)
+
+type BlockFileSuite struct{}
+
+var _ = Suite(&BlockFileSuite{})
+
+const testBlockSize = 1 << 6
+
+// Creates a block file where the i-th block is filled with byte(i).
+func newTestFile(c *C, path string, numBlocks int, checksums bool) {
+	var bf *BlockFile
+	var err error
+	if checksums {
+		bf, err = OpenBlockFile(path, testBlockSize)
+	} else {
+		bf, err = OpenBlockFileWithoutChecksums(path, testBlockSize)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(bf.Checksums, Equals, checksums)
+	b := make([]byte, testBlockSize)
+	for i := 0; i < numBlocks; i++ {
+		blockID, err := bf.AllocateBlock()
+		c.Assert(err, IsNil)
+		for j := range b {
+			b[j] = byte(i)
+		}
+		c.Assert(bf.WriteBlock(b, blockID), IsNil)
+	}
+	c.Assert(bf.Close(), IsNil)
+}
+
+func checkTestFile(c *C, path string, numBlocks int, checksums bool) {
+	bf, err := OpenBlockFile(path, testBlockSize)
+	c.Assert(err, IsNil)
+	defer bf.Close()
+	c.Assert(bf.Checksums, Equals, checksums)
+	c.Assert(bf.NumBlocks, Equals, int32(numBlocks))
+	b := make([]byte, testBlockSize)
+	for i := 0; i < numBlocks; i++ {
+		c.Assert(bf.ReadBlock(b, int32(i)), IsNil)
+		c.Assert(b[0], Equals, byte(i))
+		c.Assert(b[testBlockSize-1], Equals, byte(i))
+	}
+}
+
+func (s *BlockFileSuite) TestChecksums(c *C) {
+	path := c.MkDir() + "/block_file_test"
+	newTestFile(c, path, 3, true)
+	checkTestFile(c, path, 3, true)
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(
+		stat.Size(),
+		Equals,
+		int64(headerWidth+3*(testBlockSize+checksumTrailerWidth)))
+
+	// Flip a bit in the middle block.
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	c.Assert(err, IsNil)
+	offset := int64(headerWidth+testBlockSize+checksumTrailerWidth) + 10
+	_, err = f.WriteAt([]byte{1 ^ 1<<4}, offset)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	bf, err := OpenBlockFile(path, testBlockSize)
+	c.Assert(err, IsNil)
+	b := make([]byte, testBlockSize)
+	c.Assert(bf.ReadBlock(b, 0), IsNil)
+	c.Assert(bf.ReadBlock(b, 2), IsNil)
+	err = bf.ReadBlock(b, 1)
+	corrupt, ok := err.(*CorruptBlockError)
+	c.Assert(ok, IsTrue)
+	c.Assert(corrupt.Path, Equals, path)
+	c.Assert(corrupt.BlockID, Equals, int32(1))
+
+	// Blocks written to the wrong place are caught as well.
+	c.Assert(bf.ReadBlock(b, 2), IsNil)
+	_, err = bf.File.WriteAt(b, bf.Offset(0))
+	c.Assert(err, IsNil)
+	_, ok = bf.ReadBlock(b, 0).(*CorruptBlockError)
+	c.Assert(ok, IsTrue)
+
+	// A block that was allocated right before a crash might not have a
+	// trailer yet.
+	c.Assert(bf.File.Truncate(bf.Offset(4)), IsNil)
+	c.Assert(bf.Close(), IsNil)
+	bf, err = OpenBlockFile(path, testBlockSize)
+	c.Assert(err, IsNil)
+	defer bf.Close()
+	c.Assert(bf.NumBlocks, Equals, int32(4))
+	c.Assert(bf.ReadBlock(b, 3), IsNil)
+	c.Assert(isZero(b), IsTrue)
+}
+
+func (s *BlockFileSuite) TestAddChecksums(c *C) {
+	path := c.MkDir() + "/block_file_test"
+	newTestFile(c, path, 5, false)
+	checkTestFile(c, path, 5, false)
+	stat, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Size(), Equals, int64(5*testBlockSize))
+
+	c.Assert(AddChecksums(path, testBlockSize), IsNil)
+	checkTestFile(c, path, 5, true)
+	// Converting a file again does nothing.
+	c.Assert(AddChecksums(path, testBlockSize), IsNil)
+	checkTestFile(c, path, 5, true)
+}
+
+func (s *BlockFileSuite) TestHeader(c *C) {
+	dir := c.MkDir()
+
+	// Files without a header don't have checksums, even if their blocks happen
+	// to look like they're followed by trailers.
+	path := dir + "/without_checksums"
+	numBlocks := testBlockSize + checksumTrailerWidth
+	newTestFile(c, path, numBlocks, false)
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	c.Assert(err, IsNil)
+	var trailer [4]byte
+	byteOrder.PutUint32(trailer[:], checksumMagic)
+	_, err = f.WriteAt(trailer[:], testBlockSize)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	bf, err := OpenBlockFile(path, testBlockSize)
+	c.Assert(err, IsNil)
+	c.Assert(bf.Checksums, IsFalse)
+	c.Assert(bf.NumBlocks, Equals, int32(numBlocks))
+	c.Assert(bf.Close(), IsNil)
+
+	// The header records the block size.
+	path = dir + "/with_checksums"
+	newTestFile(c, path, 2, true)
+	_, err = OpenBlockFile(path, 2*testBlockSize)
+	c.Assert(err, NotNil)
+
+	// A file that was created right before a crash might not have its header
+	// yet.
+	c.Assert(os.Truncate(path, headerWidth-1), IsNil)
+	checkTestFile(c, path, 0, true)
+
+	// Corrupt headers are caught rather than mistaken for the original layout.
+	newTestFile(c, path, 2, true)
+	f, err = os.OpenFile(path, os.O_RDWR, 0644)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte{2}, 4)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	_, err = OpenBlockFile(path, testBlockSize)
+	c.Assert(err, NotNil)
+}
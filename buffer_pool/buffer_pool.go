@@ -0,0 +1,415 @@
+package buffer_pool
+
+import (
+	"os"
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2/block_file"
+)
+
+var NoFreeFrames = errors.New("All frames in the buffer pool are pinned")
+
+// A Frame holds the contents of a single block.  The Data slice is only valid
+// while the Frame is pinned.
+type Frame struct {
+	Data []byte
+
+	bf       *block_file.BlockFile
+	blockID  int32
+	frameID  int
+	pinCount int
+	dirty    bool
+}
+
+func (f *Frame) BlockID() int32 {
+	return f.blockID
+}
+
+type pageKey struct {
+	bf      *block_file.BlockFile
+	blockID int32
+}
+
+// A file that has been opened through the BufferPool (see OpenFile), along with
+// the number of Files that still refer to it.
+type openFile struct {
+	info     os.FileInfo
+	numOpens int
+}
+
+// BufferPool caches blocks from any number of BlockFiles in a fixed number of
+// frames.  Callers pin a block before using its contents and unpin it when
+// they're done; only unpinned frames can be chosen for eviction, and dirty
+// frames are written back before they're reused.
+//
+// Each file is only opened once per BufferPool, no matter how many times (or
+// via which path) OpenFile is called for it, so that every File for the same
+// file shares the same cached blocks.
+type BufferPool struct {
+	mu             sync.Mutex
+	frames         []*Frame
+	freeFrameIDs   []int
+	pageToFrameID  map[pageKey]int
+	writeBackHooks map[*block_file.BlockFile]func([]byte) error
+	openFiles      map[*block_file.BlockFile]*openFile
+	policy         EvictionPolicy
+	numBlockReads  int
+	numBlockWrites int
+}
+
+func NewBufferPool(numFrames int, policy EvictionPolicy) *BufferPool {
+	frames := make([]*Frame, numFrames)
+	freeFrameIDs := make([]int, numFrames)
+	for i := 0; i < numFrames; i++ {
+		frames[i] = &Frame{
+			frameID: i,
+			blockID: block_file.InvalidBlockID,
+		}
+		// Hand out low frameIDs first.
+		freeFrameIDs[i] = numFrames - i - 1
+	}
+	policy.Init(numFrames)
+	return &BufferPool{
+		frames:         frames,
+		freeFrameIDs:   freeFrameIDs,
+		pageToFrameID:  make(map[pageKey]int),
+		writeBackHooks: make(map[*block_file.BlockFile]func([]byte) error),
+		openFiles:      make(map[*block_file.BlockFile]*openFile),
+		policy:         policy,
+	}
+}
+
+const DefaultNumFrames = 1024
+
+var (
+	defaultMu   sync.Mutex
+	defaultPool = NewBufferPool(DefaultNumFrames, NewLRU())
+)
+
+// Default returns the BufferPool shared by heap files and indexes.
+func Default() *BufferPool {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultPool
+}
+
+// SetDefault replaces the shared BufferPool; it should only be called before
+// any files have been opened.
+func SetDefault(bp *BufferPool) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultPool = bp
+}
+
+// Returns the BlockFile for the file at path, which is only opened (or created)
+// if no other File refers to it yet.  Every call must be matched by a call to
+// closeBlockFile.
+func (bp *BufferPool) openBlockFile(
+	path string,
+	blockSize int,
+) (*block_file.BlockFile, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err == nil {
+		for bf, of := range bp.openFiles {
+			if !os.SameFile(of.info, info) {
+				continue
+			}
+			if bf.BlockSize != blockSize {
+				return nil, errors.Newf(
+					"%v is already open with block size %d; got %d",
+					path,
+					bf.BlockSize,
+					blockSize)
+			}
+			of.numOpens++
+			return bf, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	bf, err := block_file.OpenBlockFile(path, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	info, err = bf.File.Stat()
+	if err != nil {
+		bf.Close()
+		return nil, err
+	}
+	bp.openFiles[bf] = &openFile{
+		info:     info,
+		numOpens: 1,
+	}
+	return bf, nil
+}
+
+// Releases a BlockFile returned by openBlockFile.  Once nothing refers to it
+// anymore, its Frames are written back and dropped (see DropFile), and the
+// file is closed.
+func (bp *BufferPool) closeBlockFile(bf *block_file.BlockFile) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	of, ok := bp.openFiles[bf]
+	if !ok {
+		return errors.Newf("%v is not open", bf.File.Name())
+	}
+	if of.numOpens > 1 {
+		of.numOpens--
+		return nil
+	}
+	err := bp.dropFileLocked(bf)
+	if err != nil {
+		return err
+	}
+	delete(bp.openFiles, bf)
+	return bf.Close()
+}
+
+// Pin returns a Frame holding the given block, reading it from disk if it isn't
+// already cached.  Every call to Pin must be matched by a call to Unpin.
+func (bp *BufferPool) Pin(
+	bf *block_file.BlockFile,
+	blockID int32,
+) (*Frame, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	key := pageKey{bf, blockID}
+	if frameID, ok := bp.pageToFrameID[key]; ok {
+		frame := bp.frames[frameID]
+		bp.pinLocked(frame)
+		return frame, nil
+	}
+	frame, err := bp.claimFrameLocked(bf, blockID)
+	if err != nil {
+		return nil, err
+	}
+	err = bf.ReadBlock(frame.Data, blockID)
+	bp.numBlockReads++
+	if err != nil {
+		bp.releaseFrameLocked(frame)
+		return nil, err
+	}
+	bp.pinLocked(frame)
+	return frame, nil
+}
+
+// Allocate appends a new block to the given BlockFile and returns a pinned
+// Frame for it; the Frame is zeroed and already marked dirty.
+func (bp *BufferPool) Allocate(bf *block_file.BlockFile) (*Frame, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	// Make sure there's room before growing the file.
+	frame, err := bp.claimFrameLocked(bf, bf.NumBlocks)
+	if err != nil {
+		return nil, err
+	}
+	blockID, err := bf.AllocateBlock()
+	if err != nil {
+		bp.releaseFrameLocked(frame)
+		return nil, err
+	}
+	if blockID != frame.blockID {
+		bp.releaseFrameLocked(frame)
+		return nil, errors.Newf(
+			"Expected to allocate blockID %d; got %d",
+			frame.blockID,
+			blockID)
+	}
+	for i := range frame.Data {
+		frame.Data[i] = 0
+	}
+	frame.dirty = true
+	bp.pinLocked(frame)
+	return frame, nil
+}
+
+// Unpin releases a Frame returned by Pin or Allocate.  If dirty is true, then
+// the Frame's contents will be written back before it's evicted.
+func (bp *BufferPool) Unpin(frame *Frame, dirty bool) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if frame.pinCount <= 0 {
+		panic(errors.Newf(
+			"Unpin called on unpinned frame for blockID %d",
+			frame.blockID))
+	}
+	frame.dirty = frame.dirty || dirty
+	frame.pinCount--
+	if frame.pinCount == 0 {
+		bp.policy.SetEvictable(frame.frameID, true)
+	}
+}
+
+// SetWriteBackHook registers a function that will be called with the contents
+// of each dirty block from the given BlockFile just before the block is written
+// back; if the hook returns an error, then the block won't be written.  This is
+// how the write-ahead log makes sure that log records reach disk before the
+// pages they describe.
+func (bp *BufferPool) SetWriteBackHook(
+	bf *block_file.BlockFile,
+	hook func([]byte) error,
+) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.writeBackHooks[bf] = hook
+}
+
+// FlushFile writes back every dirty Frame belonging to the given BlockFile.
+func (bp *BufferPool) FlushFile(bf *block_file.BlockFile) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for key, frameID := range bp.pageToFrameID {
+		if key.bf != bf {
+			continue
+		}
+		err := bp.flushLocked(bp.frames[frameID])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropFile writes back and then evicts every Frame belonging to the given
+// BlockFile; it fails if any of those Frames are still pinned.
+func (bp *BufferPool) DropFile(bf *block_file.BlockFile) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	return bp.dropFileLocked(bf)
+}
+
+func (bp *BufferPool) dropFileLocked(bf *block_file.BlockFile) error {
+	for key, frameID := range bp.pageToFrameID {
+		if key.bf != bf {
+			continue
+		}
+		frame := bp.frames[frameID]
+		if frame.pinCount > 0 {
+			return errors.Newf(
+				"Cannot drop %v while blockID %d is pinned",
+				bf.File.Name(),
+				frame.blockID)
+		}
+		err := bp.flushLocked(frame)
+		if err != nil {
+			return err
+		}
+		bp.releaseFrameLocked(frame)
+	}
+	delete(bp.writeBackHooks, bf)
+	return nil
+}
+
+type Stats struct {
+	NumFrames      int
+	NumCached      int
+	NumPinned      int
+	NumDirty       int
+	NumBlockReads  int
+	NumBlockWrites int
+}
+
+func (bp *BufferPool) Stats() Stats {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	stats := Stats{
+		NumFrames:      len(bp.frames),
+		NumCached:      len(bp.pageToFrameID),
+		NumBlockReads:  bp.numBlockReads,
+		NumBlockWrites: bp.numBlockWrites,
+	}
+	for _, frameID := range bp.pageToFrameID {
+		frame := bp.frames[frameID]
+		if frame.pinCount > 0 {
+			stats.NumPinned++
+		}
+		if frame.dirty {
+			stats.NumDirty++
+		}
+	}
+	return stats
+}
+
+func (bp *BufferPool) pinLocked(frame *Frame) {
+	frame.pinCount++
+	bp.policy.RecordAccess(frame.frameID)
+	bp.policy.SetEvictable(frame.frameID, false)
+}
+
+// Returns an unpinned Frame that has been reassigned to the given block, with
+// len(frame.Data) == bf.BlockSize.  The Frame's contents are unspecified.
+func (bp *BufferPool) claimFrameLocked(
+	bf *block_file.BlockFile,
+	blockID int32,
+) (*Frame, error) {
+	var frame *Frame
+	if n := len(bp.freeFrameIDs); n > 0 {
+		frame = bp.frames[bp.freeFrameIDs[n-1]]
+		bp.freeFrameIDs = bp.freeFrameIDs[:n-1]
+	} else {
+		frameID, ok := bp.policy.Victim()
+		if !ok {
+			return nil, NoFreeFrames
+		}
+		frame = bp.frames[frameID]
+		err := bp.flushLocked(frame)
+		if err != nil {
+			// The frame is still valid, so make sure it can be chosen again.
+			bp.policy.RecordAccess(frameID)
+			bp.policy.SetEvictable(frameID, true)
+			return nil, err
+		}
+		delete(bp.pageToFrameID, pageKey{frame.bf, frame.blockID})
+	}
+	if len(frame.Data) != bf.BlockSize {
+		frame.Data = make([]byte, bf.BlockSize)
+	}
+	frame.bf = bf
+	frame.blockID = blockID
+	frame.pinCount = 0
+	frame.dirty = false
+	bp.pageToFrameID[pageKey{bf, blockID}] = frame.frameID
+	return frame, nil
+}
+
+// Returns a Frame (which must not be pinned) to the free list.
+func (bp *BufferPool) releaseFrameLocked(frame *Frame) {
+	delete(bp.pageToFrameID, pageKey{frame.bf, frame.blockID})
+	bp.policy.Remove(frame.frameID)
+	frame.bf = nil
+	frame.blockID = block_file.InvalidBlockID
+	frame.pinCount = 0
+	frame.dirty = false
+	bp.freeFrameIDs = append(bp.freeFrameIDs, frame.frameID)
+}
+
+func (bp *BufferPool) flushLocked(frame *Frame) error {
+	if !frame.dirty {
+		return nil
+	}
+	if hook, ok := bp.writeBackHooks[frame.bf]; ok {
+		err := hook(frame.Data)
+		if err != nil {
+			return err
+		}
+	}
+	err := frame.bf.WriteBlock(frame.Data, frame.blockID)
+	if err != nil {
+		return err
+	}
+	bp.numBlockWrites++
+	frame.dirty = false
+	return nil
+}
@@ -0,0 +1,169 @@
+package buffer_pool
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2/block_file"
+)
+
+type BufferPoolSuite struct{}
+
+var _ = Suite(&BufferPoolSuite{})
+
+const testBlockSize = 1 << 6
+
+func newTestFile(c *C, bp *BufferPool, numBlocks int) *File {
+	f, err := OpenFile(bp, c.MkDir()+"/buffer_pool_test", testBlockSize)
+	c.Assert(err, IsNil)
+	for i := 0; i < numBlocks; i++ {
+		frame, err := f.Allocate()
+		c.Assert(err, IsNil)
+		frame.Data[0] = byte(i)
+		f.Unpin(frame, true)
+	}
+	return f
+}
+
+func (s *BufferPoolSuite) TestPinUnpin(c *C) {
+	for _, policy := range []EvictionPolicy{NewLRU(), NewClock(), NewLRUK(2)} {
+		bp := NewBufferPool(3, policy)
+		f := newTestFile(c, bp, 10)
+
+		// Every block should be readable, even though there are fewer frames
+		// than blocks.
+		for i := int32(0); i < 10; i++ {
+			frame, err := f.Pin(i)
+			c.Assert(err, IsNil)
+			c.Assert(frame.BlockID(), Equals, i)
+			c.Assert(frame.Data[0], Equals, byte(i))
+			f.Unpin(frame, false)
+		}
+
+		// Once every frame is pinned, pinning another block should fail.
+		var pinned []*Frame
+		for i := int32(0); i < 3; i++ {
+			frame, err := f.Pin(i)
+			c.Assert(err, IsNil)
+			pinned = append(pinned, frame)
+		}
+		_, err := f.Pin(3)
+		c.Assert(err, Equals, NoFreeFrames)
+
+		// Pinning a cached block doesn't need a free frame.
+		frame, err := f.Pin(0)
+		c.Assert(err, IsNil)
+		c.Assert(frame, Equals, pinned[0])
+		f.Unpin(frame, false)
+
+		for _, frame := range pinned {
+			f.Unpin(frame, false)
+		}
+		c.Assert(bp.Stats().NumPinned, Equals, 0)
+		err = f.Close()
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *BufferPoolSuite) TestDirtyWriteBack(c *C) {
+	bp := NewBufferPool(2, NewLRU())
+	f := newTestFile(c, bp, 4)
+
+	// Modify each block; since there are only 2 frames, most of the writes
+	// must happen during eviction.
+	for i := int32(0); i < 4; i++ {
+		frame, err := f.Pin(i)
+		c.Assert(err, IsNil)
+		frame.Data[1] = 42
+		f.Unpin(frame, true)
+	}
+	c.Assert(bp.Stats().NumDirty <= 2, IsTrue)
+	err := f.Flush()
+	c.Assert(err, IsNil)
+	c.Assert(bp.Stats().NumDirty, Equals, 0)
+
+	// Bypass the buffer pool to make sure the changes made it to disk.
+	b := make([]byte, testBlockSize)
+	for i := int32(0); i < 4; i++ {
+		err = f.BlockFile.ReadBlock(b, i)
+		c.Assert(err, IsNil)
+		c.Assert(b[0], Equals, byte(i))
+		c.Assert(b[1], Equals, byte(42))
+	}
+
+	// A pinned block can't be dropped.
+	frame, err := f.Pin(0)
+	c.Assert(err, IsNil)
+	err = f.Close()
+	c.Assert(err, NotNil)
+	f.Unpin(frame, false)
+	err = f.Close()
+	c.Assert(err, IsNil)
+	c.Assert(bp.Stats().NumCached, Equals, 0)
+}
+
+func (s *BufferPoolSuite) TestSharedAcrossFiles(c *C) {
+	bp := NewBufferPool(4, NewClock())
+	f1 := newTestFile(c, bp, 3)
+	f2 := newTestFile(c, bp, 3)
+	for i := int32(0); i < 3; i++ {
+		b := make([]byte, testBlockSize)
+		err := f1.ReadBlock(b, i)
+		c.Assert(err, IsNil)
+		c.Assert(b[0], Equals, byte(i))
+		b[0] = byte(10 + i)
+		err = f2.WriteBlock(b, i)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(f1.Close(), IsNil)
+	c.Assert(f2.Close(), IsNil)
+
+	bf, err := block_file.OpenBlockFile(f2.File.Name(), testBlockSize)
+	c.Assert(err, IsNil)
+	b := make([]byte, testBlockSize)
+	for i := int32(0); i < 3; i++ {
+		err = bf.ReadBlock(b, i)
+		c.Assert(err, IsNil)
+		c.Assert(b[0], Equals, byte(10+i))
+	}
+	c.Assert(bf.Close(), IsNil)
+}
+
+func (s *BufferPoolSuite) TestSameFile(c *C) {
+	bp := NewBufferPool(4, NewLRU())
+	f1 := newTestFile(c, bp, 3)
+	path := f1.File.Name()
+	f2, err := OpenFile(bp, path, testBlockSize)
+	c.Assert(err, IsNil)
+	c.Assert(f2.BlockFile, Equals, f1.BlockFile)
+
+	// Changes made through one File are visible through the other one, even
+	// before they're written back.
+	b := make([]byte, testBlockSize)
+	b[0] = 42
+	c.Assert(f1.WriteBlock(b, 1), IsNil)
+	blockID, err := f1.AllocateBlock()
+	c.Assert(err, IsNil)
+	c.Assert(f2.NumBlocks, Equals, int32(4))
+	c.Assert(f2.ReadBlock(b, 1), IsNil)
+	c.Assert(b[0], Equals, byte(42))
+	c.Assert(f2.ReadBlock(b, blockID), IsNil)
+
+	// The file stays open until every File is closed, and closing a File
+	// again doesn't do anything.
+	c.Assert(f1.Close(), IsNil)
+	c.Assert(f1.Close(), IsNil)
+	c.Assert(bp.Stats().NumCached > 0, IsTrue)
+	_, err = OpenFile(bp, path, 2*testBlockSize)
+	c.Assert(err, NotNil)
+	c.Assert(f2.ReadBlock(b, 1), IsNil)
+	c.Assert(f2.Close(), IsNil)
+	c.Assert(bp.Stats().NumCached, Equals, 0)
+
+	bf, err := block_file.OpenBlockFile(path, testBlockSize)
+	c.Assert(err, IsNil)
+	c.Assert(bf.NumBlocks, Equals, int32(4))
+	c.Assert(bf.ReadBlock(b, 1), IsNil)
+	c.Assert(b[0], Equals, byte(42))
+	c.Assert(bf.Close(), IsNil)
+}
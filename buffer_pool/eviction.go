@@ -0,0 +1,218 @@
+package buffer_pool
+
+import (
+	"container/list"
+)
+
+// EvictionPolicy decides which unpinned frame should be reused when the
+// BufferPool runs out of free frames.  A policy starts tracking a frame the
+// first time RecordAccess is called for it, and stops tracking it after Remove
+// is called or after the frame is returned by Victim.
+//
+// The BufferPool serializes all calls, so implementations don't need to do
+// their own locking.
+type EvictionPolicy interface {
+	// Init is called exactly once, before any other method.
+	Init(numFrames int)
+
+	RecordAccess(frameID int)
+
+	// Only evictable frames may be returned by Victim; frames start out as
+	// not evictable.
+	SetEvictable(frameID int, evictable bool)
+
+	// Returns (frameID, true) for the chosen frame, or (0, false) if no frame
+	// is evictable.
+	Victim() (int, bool)
+
+	Remove(frameID int)
+}
+
+// lru evicts the frame whose most recent access is the oldest.
+type lru struct {
+	// Front of the list is the most recently used frame.
+	order     *list.List
+	elements  map[int]*list.Element
+	evictable map[int]bool
+}
+
+var _ EvictionPolicy = (*lru)(nil)
+
+func NewLRU() *lru {
+	return &lru{}
+}
+
+func (l *lru) Init(numFrames int) {
+	l.order = list.New()
+	l.elements = make(map[int]*list.Element, numFrames)
+	l.evictable = make(map[int]bool, numFrames)
+}
+
+func (l *lru) RecordAccess(frameID int) {
+	if e, ok := l.elements[frameID]; ok {
+		l.order.MoveToFront(e)
+	} else {
+		l.elements[frameID] = l.order.PushFront(frameID)
+	}
+}
+
+func (l *lru) SetEvictable(frameID int, evictable bool) {
+	if _, ok := l.elements[frameID]; ok {
+		l.evictable[frameID] = evictable
+	}
+}
+
+func (l *lru) Victim() (int, bool) {
+	for e := l.order.Back(); e != nil; e = e.Prev() {
+		frameID := e.Value.(int)
+		if l.evictable[frameID] {
+			l.Remove(frameID)
+			return frameID, true
+		}
+	}
+	return 0, false
+}
+
+func (l *lru) Remove(frameID int) {
+	if e, ok := l.elements[frameID]; ok {
+		l.order.Remove(e)
+		delete(l.elements, frameID)
+		delete(l.evictable, frameID)
+	}
+}
+
+// clock approximates LRU by sweeping a "hand" over the frames, giving each
+// recently referenced frame a second chance before evicting it.
+type clock struct {
+	tracked    []bool
+	referenced []bool
+	evictable  []bool
+	hand       int
+}
+
+var _ EvictionPolicy = (*clock)(nil)
+
+func NewClock() *clock {
+	return &clock{}
+}
+
+func (c *clock) Init(numFrames int) {
+	c.tracked = make([]bool, numFrames)
+	c.referenced = make([]bool, numFrames)
+	c.evictable = make([]bool, numFrames)
+}
+
+func (c *clock) RecordAccess(frameID int) {
+	c.tracked[frameID] = true
+	c.referenced[frameID] = true
+}
+
+func (c *clock) SetEvictable(frameID int, evictable bool) {
+	if c.tracked[frameID] {
+		c.evictable[frameID] = evictable
+	}
+}
+
+func (c *clock) Victim() (int, bool) {
+	n := len(c.tracked)
+	// Two full sweeps are enough: the first clears every reference bit.
+	for i := 0; i < 2*n; i++ {
+		frameID := c.hand
+		c.hand = (c.hand + 1) % n
+		if !c.tracked[frameID] || !c.evictable[frameID] {
+			continue
+		}
+		if c.referenced[frameID] {
+			c.referenced[frameID] = false
+			continue
+		}
+		c.Remove(frameID)
+		return frameID, true
+	}
+	return 0, false
+}
+
+func (c *clock) Remove(frameID int) {
+	c.tracked[frameID] = false
+	c.referenced[frameID] = false
+	c.evictable[frameID] = false
+}
+
+// lruK evicts the frame whose K-th most recent access is the oldest (i.e. the
+// frame with the largest "backward K-distance"), as described in "The LRU-K
+// Page Replacement Algorithm for Database Disk Buffering" (O'Neil et al.).
+//
+// Frames with fewer than K recorded accesses have infinite backward
+// K-distance; ties among them are broken by evicting the frame whose earliest
+// recorded access is the oldest.  This keeps frequently used blocks (like the
+// upper levels of a B+ tree) cached even when a large scan passes through.
+type lruK struct {
+	k         int
+	now       int64
+	history   map[int][]int64
+	evictable map[int]bool
+}
+
+var _ EvictionPolicy = (*lruK)(nil)
+
+func NewLRUK(k int) *lruK {
+	if k < 1 {
+		k = 1
+	}
+	return &lruK{
+		k: k,
+	}
+}
+
+func (l *lruK) Init(numFrames int) {
+	l.history = make(map[int][]int64, numFrames)
+	l.evictable = make(map[int]bool, numFrames)
+}
+
+func (l *lruK) RecordAccess(frameID int) {
+	l.now++
+	h := append(l.history[frameID], l.now)
+	if len(h) > l.k {
+		h = h[len(h)-l.k:]
+	}
+	l.history[frameID] = h
+}
+
+func (l *lruK) SetEvictable(frameID int, evictable bool) {
+	if _, ok := l.history[frameID]; ok {
+		l.evictable[frameID] = evictable
+	}
+}
+
+func (l *lruK) Victim() (int, bool) {
+	victim := -1
+	victimInfinite := false
+	var victimTimestamp int64
+	for frameID, h := range l.history {
+		if !l.evictable[frameID] {
+			continue
+		}
+		// For frames with K accesses, h[0] is the K-th most recent access;
+		// otherwise it's the earliest access.
+		infinite := len(h) < l.k
+		timestamp := h[0]
+		better := victim == -1 ||
+			(infinite && !victimInfinite) ||
+			(infinite == victimInfinite && timestamp < victimTimestamp)
+		if better {
+			victim = frameID
+			victimInfinite = infinite
+			victimTimestamp = timestamp
+		}
+	}
+	if victim == -1 {
+		return 0, false
+	}
+	l.Remove(victim)
+	return victim, true
+}
+
+func (l *lruK) Remove(frameID int) {
+	delete(l.history, frameID)
+	delete(l.evictable, frameID)
+}
@@ -0,0 +1,74 @@
+package buffer_pool
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type EvictionSuite struct{}
+
+var _ = Suite(&EvictionSuite{})
+
+// Accesses frames 0, 1, ..., n - 1 in order and marks them evictable.
+func accessAll(policy EvictionPolicy, n int) {
+	for i := 0; i < n; i++ {
+		policy.RecordAccess(i)
+		policy.SetEvictable(i, true)
+	}
+}
+
+func (s *EvictionSuite) TestLRU(c *C) {
+	policy := NewLRU()
+	policy.Init(4)
+	accessAll(policy, 4)
+	policy.RecordAccess(0)
+	policy.SetEvictable(1, false)
+	for _, expected := range []int{2, 3, 0} {
+		frameID, ok := policy.Victim()
+		c.Assert(ok, Equals, true)
+		c.Assert(frameID, Equals, expected)
+	}
+	_, ok := policy.Victim()
+	c.Assert(ok, Equals, false)
+}
+
+func (s *EvictionSuite) TestClock(c *C) {
+	policy := NewClock()
+	policy.Init(3)
+	accessAll(policy, 3)
+
+	// Every frame has been referenced, so the hand has to make a full sweep
+	// before evicting frame 0.
+	frameID, ok := policy.Victim()
+	c.Assert(ok, Equals, true)
+	c.Assert(frameID, Equals, 0)
+
+	// Frame 1 gets a second chance.
+	policy.RecordAccess(1)
+	frameID, ok = policy.Victim()
+	c.Assert(ok, Equals, true)
+	c.Assert(frameID, Equals, 2)
+
+	policy.SetEvictable(1, false)
+	_, ok = policy.Victim()
+	c.Assert(ok, Equals, false)
+}
+
+func (s *EvictionSuite) TestLRUK(c *C) {
+	policy := NewLRUK(2)
+	policy.Init(4)
+	accessAll(policy, 4)
+
+	// Frames 0 and 1 have been accessed twice, so they have finite backward
+	// 2-distance and should outlive frames 2 and 3, even though those were
+	// accessed more recently.  Among frames 0 and 1, frame 0 has the oldest
+	// second most recent access, even though its most recent access is newer.
+	policy.RecordAccess(1)
+	policy.RecordAccess(0)
+	for _, expected := range []int{2, 3, 0, 1} {
+		frameID, ok := policy.Victim()
+		c.Assert(ok, Equals, true)
+		c.Assert(frameID, Equals, expected)
+	}
+	_, ok := policy.Victim()
+	c.Assert(ok, Equals, false)
+}
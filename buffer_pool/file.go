@@ -0,0 +1,95 @@
+package buffer_pool
+
+import (
+	"github.com/robot-dreams/zdb2/block_file"
+)
+
+// File is a BlockFile whose reads and writes go through a BufferPool.  The
+// embedded BlockFile should only be used directly for metadata (e.g.
+// NumBlocks); ReadBlock, WriteBlock and AllocateBlock are cached versions.
+//
+// Files opened for the same file share its BlockFile (and cached blocks), so
+// changes made through one of them are visible through the others right away.
+type File struct {
+	*block_file.BlockFile
+	bp     *BufferPool
+	closed bool
+}
+
+func OpenFile(bp *BufferPool, path string, blockSize int) (*File, error) {
+	bf, err := bp.openBlockFile(path, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		BlockFile: bf,
+		bp:        bp,
+	}, nil
+}
+
+func (f *File) Pin(blockID int32) (*Frame, error) {
+	return f.bp.Pin(f.BlockFile, blockID)
+}
+
+func (f *File) Unpin(frame *Frame, dirty bool) {
+	f.bp.Unpin(frame, dirty)
+}
+
+// Allocate returns a pinned, zeroed Frame for a newly allocated block.
+func (f *File) Allocate() (*Frame, error) {
+	return f.bp.Allocate(f.BlockFile)
+}
+
+// AllocateBlock has the same semantics as BlockFile.AllocateBlock, except that
+// the new block is written back lazily.
+func (f *File) AllocateBlock() (int32, error) {
+	frame, err := f.Allocate()
+	if err != nil {
+		return block_file.InvalidBlockID, err
+	}
+	blockID := frame.BlockID()
+	f.Unpin(frame, true)
+	return blockID, nil
+}
+
+// ReadBlock copies the given block into b.
+func (f *File) ReadBlock(b []byte, blockID int32) error {
+	frame, err := f.Pin(blockID)
+	if err != nil {
+		return err
+	}
+	copy(b, frame.Data)
+	f.Unpin(frame, false)
+	return nil
+}
+
+// WriteBlock copies b into the cached copy of the given block; the block will
+// be written to disk when it's evicted, or when Flush or Close is called.
+func (f *File) WriteBlock(b []byte, blockID int32) error {
+	frame, err := f.Pin(blockID)
+	if err != nil {
+		return err
+	}
+	copy(frame.Data, b)
+	f.Unpin(frame, true)
+	return nil
+}
+
+func (f *File) Flush() error {
+	return f.bp.FlushFile(f.BlockFile)
+}
+
+// Close releases the File.  Once no other File refers to the same file, any
+// dirty blocks are written back and removed from the BufferPool, and the
+// underlying BlockFile is closed.
+func (f *File) Close() error {
+	if f.closed {
+		return nil
+	}
+	err := f.bp.closeBlockFile(f.BlockFile)
+	if err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
@@ -4,13 +4,44 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"time"
 
 	"github.com/dropbox/godropbox/errors"
 )
 
 var ByteOrder = binary.LittleEndian
 
+// Nullable fields are encoded with this bit set in their type.
+const nullableTypeFlag = 0x80
+
+// Records can be encoded in two formats, which only differ in how the lengths of
+// String and Bytes values are stored.  (Names in table headers always have
+// their lengths stored in a single byte.)
+type RecordFormat uint8
+
+const (
+	// Lengths are stored in a single byte, so values can't be longer than 255
+	// bytes.
+	RecordFormat_ShortLengths RecordFormat = iota
+	// Lengths are stored as uvarints, so values can be any length.
+	RecordFormat_VarintLengths
+
+	CurrentRecordFormat = RecordFormat_VarintLengths
+)
+
+// Values longer than this are assumed to be corrupt, rather than allocating
+// room for them.
+const maxValueLength = 1 << 30
+
 func ReadValue(r io.Reader, type_ Type) (interface{}, error) {
+	return ReadValueInFormat(r, type_, CurrentRecordFormat)
+}
+
+func ReadValueInFormat(
+	r io.Reader,
+	type_ Type,
+	format RecordFormat,
+) (interface{}, error) {
 	switch type_ {
 	case Int32:
 		var x int32
@@ -27,24 +58,102 @@ func ReadValue(r io.Reader, type_ Type) (interface{}, error) {
 		}
 		return x, nil
 	case String:
-		s, err := ReadString(r)
+		b, err := readBytes(r, format)
 		if err != nil {
 			return nil, err
 		}
-		return s, nil
+		return string(b), nil
+	case Int64:
+		var x int64
+		err := binary.Read(r, ByteOrder, &x)
+		if err != nil {
+			return nil, err
+		}
+		return x, nil
+	case Bool:
+		var x bool
+		err := binary.Read(r, ByteOrder, &x)
+		if err != nil {
+			return nil, err
+		}
+		return x, nil
+	case Bytes:
+		return readBytes(r, format)
+	case Date:
+		var days int32
+		err := binary.Read(r, ByteOrder, &days)
+		if err != nil {
+			return nil, err
+		}
+		return daysToDate(days), nil
+	case Timestamp:
+		var micros int64
+		err := binary.Read(r, ByteOrder, &micros)
+		if err != nil {
+			return nil, err
+		}
+		return microsToTimestamp(micros), nil
+	case Decimal:
+		var d DecimalValue
+		err := binary.Read(r, ByteOrder, &d.Unscaled)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(r, ByteOrder, &d.Scale)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
 	default:
 		return nil, errors.Newf("Unsupported type %v", type_)
 	}
 }
 
-func ReadString(r io.Reader) (string, error) {
-	var n uint8
-	err := binary.Read(r, ByteOrder, &n)
+func readLength(r io.Reader, format RecordFormat) (int, error) {
+	if format == RecordFormat_ShortLengths {
+		var n uint8
+		err := binary.Read(r, ByteOrder, &n)
+		return int(n), err
+	}
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r}
+	}
+	n, err := binary.ReadUvarint(br)
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	if n > maxValueLength {
+		return 0, errors.Newf("Invalid value length %d", n)
+	}
+	return int(n), nil
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+func readBytes(r io.Reader, format RecordFormat) ([]byte, error) {
+	n, err := readLength(r, format)
+	if err != nil {
+		return nil, err
 	}
 	b := make([]byte, n)
-	_, err = r.Read(b)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func ReadString(r io.Reader) (string, error) {
+	b, err := readBytes(r, RecordFormat_ShortLengths)
 	if err != nil {
 		return "", err
 	}
@@ -52,21 +161,8 @@ func ReadString(r io.Reader) (string, error) {
 }
 
 func SerializeValue(type_ Type, value interface{}) ([]byte, error) {
-	var err error
 	var buf bytes.Buffer
-	switch type_ {
-	case Int32, Float64:
-		err = binary.Write(&buf, ByteOrder, value)
-	case String:
-		s := value.(string)
-		err = buf.WriteByte(uint8(len(s)))
-		if err != nil {
-			return nil, err
-		}
-		_, err = buf.WriteString(s)
-	default:
-		err = errors.Newf("Unsupported type %v", type_)
-	}
+	err := WriteValue(&buf, type_, value)
 	if err != nil {
 		return nil, err
 	}
@@ -74,20 +170,58 @@ func SerializeValue(type_ Type, value interface{}) ([]byte, error) {
 }
 
 func WriteValue(w io.Writer, type_ Type, value interface{}) error {
+	return WriteValueInFormat(w, type_, value, CurrentRecordFormat)
+}
+
+func WriteValueInFormat(
+	w io.Writer,
+	type_ Type,
+	value interface{},
+	format RecordFormat,
+) error {
 	switch type_ {
 	case Int32:
 		return binary.Write(w, ByteOrder, value)
 	case Float64:
 		return binary.Write(w, ByteOrder, value)
 	case String:
-		return WriteString(w, value.(string))
+		return writeString(w, value.(string), format)
+	case Int64:
+		return binary.Write(w, ByteOrder, value)
+	case Bool:
+		return binary.Write(w, ByteOrder, value)
+	case Bytes:
+		return writeString(w, string(value.([]byte)), format)
+	case Date:
+		return binary.Write(w, ByteOrder, dateToDays(value.(time.Time)))
+	case Timestamp:
+		micros := timestampToMicros(value.(time.Time))
+		return binary.Write(w, ByteOrder, micros)
+	case Decimal:
+		d := value.(DecimalValue)
+		err := binary.Write(w, ByteOrder, d.Unscaled)
+		if err != nil {
+			return err
+		}
+		return binary.Write(w, ByteOrder, d.Scale)
 	default:
 		return errors.Newf("Unsupported type %v", type_)
 	}
 }
 
-func WriteString(w io.Writer, s string) error {
-	err := binary.Write(w, ByteOrder, uint8(len(s)))
+func writeString(w io.Writer, s string, format RecordFormat) error {
+	var err error
+	if format == RecordFormat_ShortLengths {
+		if len(s) > 0xFF {
+			return errors.Newf(
+				"Cannot write string of length %d (the maximum is 255)",
+				len(s))
+		}
+		err = binary.Write(w, ByteOrder, uint8(len(s)))
+	} else {
+		b := make([]byte, binary.MaxVarintLen64)
+		_, err = w.Write(b[:binary.PutUvarint(b, uint64(len(s)))])
+	}
 	if err != nil {
 		return err
 	}
@@ -95,6 +229,10 @@ func WriteString(w io.Writer, s string) error {
 	return err
 }
 
+func WriteString(w io.Writer, s string) error {
+	return writeString(w, s, RecordFormat_ShortLengths)
+}
+
 func ReadField(r io.Reader) (*Field, error) {
 	name, err := ReadString(r)
 	if err != nil {
@@ -105,18 +243,54 @@ func ReadField(r io.Reader) (*Field, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Field{
-		Name: name,
-		Type: Type(b),
-	}, nil
+	f := &Field{
+		Name:     name,
+		Type:     Type(b &^ nullableTypeFlag),
+		Nullable: b&nullableTypeFlag != 0,
+	}
+	if f.Type == Decimal {
+		err = binary.Read(r, ByteOrder, &f.Precision)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(r, ByteOrder, &f.Scale)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = CheckField(f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
+// The type of a decimal field is followed by its precision and scale.
 func WriteField(w io.Writer, f *Field) error {
-	err := WriteString(w, f.Name)
+	err := CheckField(f)
+	if err != nil {
+		return err
+	}
+	err = WriteString(w, f.Name)
+	if err != nil {
+		return err
+	}
+	b := uint8(f.Type)
+	if f.Nullable {
+		b |= nullableTypeFlag
+	}
+	err = binary.Write(w, ByteOrder, b)
+	if err != nil {
+		return err
+	}
+	if f.Type != Decimal {
+		return nil
+	}
+	err = binary.Write(w, ByteOrder, f.Precision)
 	if err != nil {
 		return err
 	}
-	return binary.Write(w, ByteOrder, uint8(f.Type))
+	return binary.Write(w, ByteOrder, f.Scale)
 }
 
 func ReadTableHeader(r io.Reader) (*TableHeader, error) {
@@ -162,10 +336,47 @@ func WriteTableHeader(w io.Writer, t *TableHeader) error {
 	return nil
 }
 
+// HasNullableFields returns true if any of t's fields are nullable.
+func (t *TableHeader) HasNullableFields() bool {
+	for _, field := range t.Fields {
+		if field.Nullable {
+			return true
+		}
+	}
+	return false
+}
+
+// Records of tables with nullable fields start with a bitmap that has the i-th
+// bit set if the i-th field is NULL; NULL values themselves take up no space.
+// Records of other tables have no bitmap, so their encoding is unchanged.
+func nullBitmapWidth(t *TableHeader) int {
+	if !t.HasNullableFields() {
+		return 0
+	}
+	return (len(t.Fields) + 7) / 8
+}
+
 func (t *TableHeader) ReadRecord(r io.Reader) (Record, error) {
+	return t.ReadRecordInFormat(r, CurrentRecordFormat)
+}
+
+func (t *TableHeader) ReadRecordInFormat(
+	r io.Reader,
+	format RecordFormat,
+) (Record, error) {
+	nulls := make([]byte, nullBitmapWidth(t))
+	if len(nulls) > 0 {
+		_, err := io.ReadFull(r, nulls)
+		if err != nil {
+			return nil, err
+		}
+	}
 	record := make(Record, len(t.Fields))
 	for i, fieldHeader := range t.Fields {
-		value, err := ReadValue(r, fieldHeader.Type)
+		if len(nulls) > 0 && nulls[i/8]&(1<<uint(i%8)) != 0 {
+			continue
+		}
+		value, err := ReadValueInFormat(r, fieldHeader.Type, format)
 		if err != nil {
 			return nil, err
 		}
@@ -174,12 +385,45 @@ func (t *TableHeader) ReadRecord(r io.Reader) (Record, error) {
 	return record, nil
 }
 
-// Preconditions:
-//     len(record) == len(t.Fields)
-//     record[i] matches t.Fields[i].Type for 0 <= i < len(record)
+// Values are written as CoerceValue returns them, so decimals are rescaled to
+// their fields' scales.
+//
+// Precondition: len(record) == len(t.Fields)
 func (t *TableHeader) WriteRecord(w io.Writer, record Record) error {
+	return t.WriteRecordInFormat(w, record, CurrentRecordFormat)
+}
+
+// Same preconditions as WriteRecord.
+func (t *TableHeader) WriteRecordInFormat(
+	w io.Writer,
+	record Record,
+	format RecordFormat,
+) error {
+	nulls := make([]byte, nullBitmapWidth(t))
 	for i, value := range record {
-		err := WriteValue(w, t.Fields[i].Type, value)
+		if value != nil {
+			continue
+		}
+		if !t.Fields[i].Nullable {
+			return errors.Newf("Field %v is not nullable", t.Fields[i].Name)
+		}
+		nulls[i/8] |= 1 << uint(i%8)
+	}
+	if len(nulls) > 0 {
+		_, err := w.Write(nulls)
+		if err != nil {
+			return err
+		}
+	}
+	for i, value := range record {
+		if value == nil {
+			continue
+		}
+		value, err := CoerceValue(t.Fields[i], value)
+		if err != nil {
+			return err
+		}
+		err = WriteValueInFormat(w, t.Fields[i].Type, value, format)
 		if err != nil {
 			return err
 		}
@@ -30,6 +30,8 @@ func NewAverage(
 		t, averageFieldName)
 	groupFieldPosition, _ := zdb2.MustFieldPositionAndType(
 		t, groupFieldName)
+	averageField := t.Fields[averageFieldPosition]
+	groupField := t.Fields[groupFieldPosition]
 	name := fmt.Sprintf("average(%v.%v)", t.Name, averageFieldName)
 	record, err := iter.Next()
 	if err == io.EOF {
@@ -42,8 +44,15 @@ func NewAverage(
 		averageTableHeader: &zdb2.TableHeader{
 			Name: name,
 			Fields: []*zdb2.Field{
-				{groupFieldName, t.Fields[groupFieldPosition].Type},
-				{"average", zdb2.Float64},
+				{
+					groupFieldName,
+					groupField.Type,
+					groupField.Nullable,
+					groupField.Precision,
+					groupField.Scale,
+				},
+				// Groups whose values are all NULL have a NULL average.
+				{"average", zdb2.Float64, averageField.Nullable, 0, 0},
 			},
 		},
 		averageFieldPosition: averageFieldPosition,
@@ -61,26 +70,31 @@ func (a *average) Next() (zdb2.Record, error) {
 	if a.nextRecord == nil {
 		return nil, io.EOF
 	}
-	currentGroup := a.nextRecord[a.groupFieldPosition]
-	sum := zdb2.CoerceToFloat64(
-		a.averageFieldType,
-		a.nextRecord[a.averageFieldPosition])
-	count := 1
-	a.nextRecord = nil
+	record := a.nextRecord
+	currentGroup := record[a.groupFieldPosition]
+	// Like SQL's AVG, NULL values are ignored.
+	var sum float64
+	count := 0
 	for {
-		record, err := a.iter.Next()
+		value := record[a.averageFieldPosition]
+		if value != nil {
+			sum += zdb2.CoerceToFloat64(a.averageFieldType, value)
+			count++
+		}
+		var err error
+		record, err = a.iter.Next()
 		if err == io.EOF {
+			a.nextRecord = nil
 			break
 		} else if err != nil {
 			return nil, err
-		} else if record[a.groupFieldPosition] != currentGroup {
+		} else if !zdb2.Equal(record[a.groupFieldPosition], currentGroup) {
 			a.nextRecord = record
 			break
 		}
-		sum += zdb2.CoerceToFloat64(
-			a.averageFieldType,
-			record[a.averageFieldPosition])
-		count++
+	}
+	if count == 0 {
+		return zdb2.Record{currentGroup, nil}, nil
 	}
 	return zdb2.Record{currentGroup, sum / float64(count)}, nil
 }
@@ -17,9 +17,9 @@ func (s *AverageSuite) TestAverage(c *C) {
 	t := &zdb2.TableHeader{
 		Name: "movies",
 		Fields: []*zdb2.Field{
-			{"movie", zdb2.String},
-			{"rating", zdb2.Float64},
-			{"views", zdb2.Int32},
+			{"movie", zdb2.String, false, 0, 0},
+			{"rating", zdb2.Float64, false, 0, 0},
+			{"views", zdb2.Int32, false, 0, 0},
 		},
 	}
 	records := []zdb2.Record{
@@ -36,8 +36,8 @@ func (s *AverageSuite) TestAverage(c *C) {
 		&zdb2.TableHeader{
 			Name: "average(movies.rating)",
 			Fields: []*zdb2.Field{
-				{"views", zdb2.Int32},
-				{"average", zdb2.Float64},
+				{"views", zdb2.Int32, false, 0, 0},
+				{"average", zdb2.Float64, false, 0, 0},
 			},
 		})
 	record, err := average.Next()
@@ -55,3 +55,50 @@ func (s *AverageSuite) TestAverage(c *C) {
 	err = average.Close()
 	c.Assert(err, IsNil)
 }
+
+func (s *AverageSuite) TestAverageNulls(c *C) {
+	t := &zdb2.TableHeader{
+		Name: "movies",
+		Fields: []*zdb2.Field{
+			{"movie", zdb2.String, false, 0, 0},
+			{"rating", zdb2.Float64, true, 0, 0},
+			{"views", zdb2.Int32, true, 0, 0},
+		},
+	}
+	records := []zdb2.Record{
+		{"Leon: The Professional", 4.6, int32(2)},
+		{"Gattaca", nil, int32(2)},
+		{"Hackers", nil, int32(3)},
+		{"Inside Out", 4.7, nil},
+		{"Sneakers", 4.1, nil},
+	}
+	average, err := NewAverage(zdb2.NewInMemoryScan(t, records), "rating", "views")
+	c.Assert(err, IsNil)
+	c.Assert(
+		average.TableHeader().Fields,
+		DeepEquals,
+		[]*zdb2.Field{
+			{"views", zdb2.Int32, true, 0, 0},
+			{"average", zdb2.Float64, true, 0, 0},
+		})
+	// NULL ratings are ignored, so a group with only NULL ratings has a NULL
+	// average; NULL views are grouped together.
+	expected := []zdb2.Record{
+		{int32(2), 4.6},
+		{int32(3), nil},
+		{nil, 4.4},
+	}
+	for _, expectedRecord := range expected {
+		record, err := average.Next()
+		c.Assert(err, IsNil)
+		c.Assert(record[0], Equals, expectedRecord[0])
+		if expectedRecord[1] == nil {
+			c.Assert(record[1], IsNil)
+		} else {
+			c.Assert(record[1], AlmostEqual, expectedRecord[1], 1e-9)
+		}
+	}
+	_, err = average.Next()
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(average.Close(), IsNil)
+}
@@ -3,9 +3,11 @@ package executor
 import (
 	"bufio"
 	"encoding/csv"
+	"encoding/hex"
 	"io"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/dropbox/godropbox/errors"
 	"github.com/robot-dreams/zdb2"
@@ -62,11 +64,18 @@ func (c *csvScan) Next() (zdb2.Record, error) {
 	}
 	record := make(zdb2.Record, len(row))
 	for i, column := range row {
+		// Blank values of nullable fields are NULL.
+		if column == "" && c.t.Fields[i].Nullable {
+			continue
+		}
 		value, err := parseValue(c.t.Fields[i].Type, column)
 		if err != nil {
 			return nil, err
 		}
-		record[i] = value
+		record[i], err = zdb2.CoerceValue(c.t.Fields[i], value)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return record, nil
 }
@@ -87,6 +96,22 @@ func parseValue(type_ zdb2.Type, s string) (interface{}, error) {
 		return x, nil
 	case zdb2.String:
 		return s, nil
+	case zdb2.Int64:
+		return strconv.ParseInt(s, 10, 64)
+	case zdb2.Bool:
+		return strconv.ParseBool(s)
+	case zdb2.Bytes:
+		// Like PostgreSQL, bytes are written in hex, starting with \x.
+		if !strings.HasPrefix(s, `\x`) {
+			return nil, errors.Newf("Invalid bytes %v", s)
+		}
+		return hex.DecodeString(s[2:])
+	case zdb2.Date:
+		return zdb2.ParseDate(s)
+	case zdb2.Timestamp:
+		return zdb2.ParseTimestamp(s)
+	case zdb2.Decimal:
+		return zdb2.ParseDecimal(s)
 	default:
 		return nil, errors.Newf("Unsupported type %v", type_)
 	}
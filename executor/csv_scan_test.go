@@ -3,6 +3,7 @@ package executor
 import (
 	"io"
 	"os"
+	"time"
 
 	"github.com/robot-dreams/zdb2"
 	. "gopkg.in/check.v1"
@@ -16,8 +17,8 @@ func (s *CSVScanSuite) TestCSVScan(c *C) {
 	t := &zdb2.TableHeader{
 		Name: "movies",
 		Fields: []*zdb2.Field{
-			{"title", zdb2.String},
-			{"rating", zdb2.Float64},
+			{"title", zdb2.String, false, 0, 0},
+			{"rating", zdb2.Float64, false, 0, 0},
 		},
 	}
 	csvData := `title,rating
@@ -54,3 +55,79 @@ The Lord of the Rings: The Fellowship of the Ring,8.8`
 	}
 	zdb2.CheckIterator(c, csvScan, expectedRecords)
 }
+
+func (s *CSVScanSuite) TestCSVScanBlanks(c *C) {
+	t := &zdb2.TableHeader{
+		Name: "movies",
+		Fields: []*zdb2.Field{
+			{"title", zdb2.String, false, 0, 0},
+			{"rating", zdb2.Float64, true, 0, 0},
+			{"year", zdb2.Int32, false, 0, 0},
+		},
+	}
+	path := c.MkDir() + "/movies.csv"
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(f, "title,rating,year\nGattaca,,1997\n,7.2,1995\n")
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	// Blank values of nullable fields are NULL.
+	csvScan, err := NewCSVScan(path, t)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, csvScan, []zdb2.Record{
+		{"Gattaca", nil, int32(1997)},
+		{"", 7.2, int32(1995)},
+	})
+
+	// Blank values of other fields must be valid.
+	t.Fields[1].Nullable = false
+	csvScan, err = NewCSVScan(path, t)
+	c.Assert(err, IsNil)
+	_, err = csvScan.Next()
+	c.Assert(err, NotNil)
+	c.Assert(csvScan.Close(), IsNil)
+}
+
+func (s *CSVScanSuite) TestCSVScanTypes(c *C) {
+	t := &zdb2.TableHeader{
+		Name: "accounts",
+		Fields: []*zdb2.Field{
+			{"id", zdb2.Int64, false, 0, 0},
+			{"active", zdb2.Bool, false, 0, 0},
+			{"key", zdb2.Bytes, false, 0, 0},
+			{"opened", zdb2.Date, false, 0, 0},
+			{"last_login", zdb2.Timestamp, false, 0, 0},
+			{"balance", zdb2.Decimal, false, 10, 2},
+		},
+	}
+	path := c.MkDir() + "/accounts.csv"
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(f, `id,active,key,opened,last_login,balance
+4294967296,true,\xdeadbeef,2018-02-01,1517477400,-123.45
+-1,false,\x,1970-01-01,2018-02-01T09:30:00Z,0
+`)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	csvScan, err := NewCSVScan(path, t)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, csvScan, []zdb2.Record{
+		{
+			int64(4294967296),
+			true,
+			[]byte{0xde, 0xad, 0xbe, 0xef},
+			zdb2.NewDate(2018, time.February, 1),
+			time.Date(2018, 2, 1, 9, 30, 0, 0, time.UTC),
+			zdb2.DecimalValue{-12345, 2},
+		},
+		{
+			int64(-1),
+			false,
+			[]byte{},
+			zdb2.NewDate(1970, time.January, 1),
+			time.Date(2018, 2, 1, 9, 30, 0, 0, time.UTC),
+			zdb2.DecimalValue{0, 2},
+		},
+	})
+}
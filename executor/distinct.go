@@ -3,7 +3,8 @@ package executor
 import "github.com/robot-dreams/zdb2"
 
 // distinct discards duplicate Records from the input Iterator; duplicate
-// records must already be grouped.
+// records must already be grouped.  Like SQL's DISTINCT, NULL values are
+// considered to be duplicates of each other.
 type distinct struct {
 	iter       zdb2.Iterator
 	lastRecord zdb2.Record
@@ -13,20 +13,23 @@ func (s *DistinctSuite) TestDistinct(c *C) {
 	t := &zdb2.TableHeader{
 		Name: "users",
 		Fields: []*zdb2.Field{
-			{"first_name", zdb2.String},
-			{"last_name", zdb2.String},
-			{"username", zdb2.String},
+			{"first_name", zdb2.String, false, 0, 0},
+			{"last_name", zdb2.String, true, 0, 0},
+			{"username", zdb2.String, false, 0, 0},
 		},
 	}
 	input := []zdb2.Record{
 		{"Rob", "Pike", "rob"},
 		{"Rob", "Pike", "rob"},
 		{"Robert", "Griesemer", "gri"},
+		{"Ken", nil, "ken"},
+		{"Ken", nil, "ken"},
 	}
 	distinct := NewDistinct(zdb2.NewInMemoryScan(t, input))
 	expected := []zdb2.Record{
 		{"Rob", "Pike", "rob"},
 		{"Robert", "Griesemer", "gri"},
+		{"Ken", nil, "ken"},
 	}
 	zdb2.CheckIterator(c, distinct, expected)
 }
@@ -61,7 +61,8 @@ func (h *hashJoinClassic) start() {
 		rJoinType zdb2.Type,
 		rJoinValue interface{},
 	) error {
-		inMemoryHashTable[rJoinValue] = append(inMemoryHashTable[rJoinValue], rRecord)
+		key := hashKey(rJoinValue)
+		inMemoryHashTable[key] = append(inMemoryHashTable[key], rRecord)
 		return nil
 	}
 	err := forEachRecord(h.r, rJoinPosition, rJoinType, rRecordFunc)
@@ -77,7 +78,7 @@ func (h *hashJoinClassic) start() {
 		sJoinType zdb2.Type,
 		sJoinValue interface{},
 	) error {
-		for _, rRecord := range inMemoryHashTable[sJoinValue] {
+		for _, rRecord := range inMemoryHashTable[hashKey(sJoinValue)] {
 			h.results <- &result{zdb2.JoinedRecord(rRecord, sRecord), nil}
 		}
 		return nil
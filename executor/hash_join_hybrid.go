@@ -190,7 +190,8 @@ func (h *hashJoinHybrid) initialPass() ([]string, []string, error) {
 			inMemoryHashThreshold,
 			rSerializedJoinValue)
 		if partition == h.numPartitions {
-			inMemoryHashTable[rJoinValue] = append(inMemoryHashTable[rJoinValue], rRecord)
+			key := hashKey(rJoinValue)
+			inMemoryHashTable[key] = append(inMemoryHashTable[key], rRecord)
 		} else {
 			err = rPartitionedWrite.WriteRecordToPartition(rRecord, partition)
 			if err != nil {
@@ -240,7 +241,7 @@ func (h *hashJoinHybrid) initialPass() ([]string, []string, error) {
 		if partition == h.numPartitions {
 			// If the join value appears in the in-memory hash table, then we can
 			// process the record right away.
-			for _, rRecord := range inMemoryHashTable[sJoinValue] {
+			for _, rRecord := range inMemoryHashTable[hashKey(sJoinValue)] {
 				h.results <- &result{zdb2.JoinedRecord(rRecord, sRecord), nil}
 			}
 		} else {
@@ -300,7 +301,8 @@ func (h *hashJoinHybrid) processPartition(rPartitionPath, sPartitionPath string)
 		rJoinType zdb2.Type,
 		rJoinValue interface{},
 	) error {
-		inMemoryHashTable[rJoinValue] = append(inMemoryHashTable[rJoinValue], rRecord)
+		key := hashKey(rJoinValue)
+		inMemoryHashTable[key] = append(inMemoryHashTable[key], rRecord)
 		return nil
 	}
 	err = forEachRecord(rScan, rJoinPosition, rJoinType, rRecordFunc)
@@ -321,7 +323,7 @@ func (h *hashJoinHybrid) processPartition(rPartitionPath, sPartitionPath string)
 		sJoinType zdb2.Type,
 		sJoinValue interface{},
 	) error {
-		for _, rRecord := range inMemoryHashTable[sJoinValue] {
+		for _, rRecord := range inMemoryHashTable[hashKey(sJoinValue)] {
 			h.results <- &result{zdb2.JoinedRecord(rRecord, sRecord), nil}
 		}
 		return nil
@@ -20,8 +20,8 @@ func runHashJoinTest(c *C, newHashJoin hashJoinConstructor) {
 	userTable := &zdb2.TableHeader{
 		Name: "user",
 		Fields: []*zdb2.Field{
-			{"username", zdb2.String},
-			{"id", zdb2.Int32},
+			{"username", zdb2.String, false, 0, 0},
+			{"id", zdb2.Int32, false, 0, 0},
 		},
 	}
 	userRecords := []zdb2.Record{
@@ -36,8 +36,8 @@ func runHashJoinTest(c *C, newHashJoin hashJoinConstructor) {
 	loginTable := &zdb2.TableHeader{
 		Name: "login",
 		Fields: []*zdb2.Field{
-			{"user_id", zdb2.Int32},
-			{"timestamp", zdb2.Int32},
+			{"user_id", zdb2.Int32, false, 0, 0},
+			{"timestamp", zdb2.Int32, false, 0, 0},
 		},
 	}
 	var loginRecords []zdb2.Record
@@ -79,6 +79,28 @@ func runHashJoinTest(c *C, newHashJoin hashJoinConstructor) {
 	c.Assert(err, Equals, io.EOF)
 	err = joined.Close()
 	c.Assert(err, IsNil)
+
+	// NULL never joins, even with NULL.
+	userTable.Fields[1].Nullable = true
+	loginTable.Fields[0].Nullable = true
+	userRecords = append(userRecords, zdb2.Record{"bwk", nil})
+	loginRecords = append(loginRecords, zdb2.Record{nil, int32(100)})
+	joined, err = newHashJoin(
+		zdb2.NewInMemoryScan(userTable, userRecords),
+		zdb2.NewInMemoryScan(loginTable, loginRecords),
+		"id",
+		"user_id")
+	c.Assert(err, IsNil)
+	for i := 0; i < 2*(len(loginRecords)-1); i++ {
+		record, err := joined.Next()
+		c.Assert(err, IsNil)
+		c.Assert(record[1], NotNil)
+		c.Assert(record[1], Equals, record[2])
+	}
+	_, err = joined.Next()
+	c.Assert(err, Equals, io.EOF)
+	err = joined.Close()
+	c.Assert(err, IsNil)
 }
 
 func (s *HashJoinSuite) TestHashJoin(c *C) {
@@ -93,3 +115,74 @@ func (s *HashJoinSuite) TestHashJoin(c *C) {
 		runHashJoinTest(c, newHashJoin)
 	}
 }
+
+func (s *HashJoinSuite) TestHashJoinTypes(c *C) {
+	priceTable := &zdb2.TableHeader{
+		Name: "price",
+		Fields: []*zdb2.Field{
+			{"sku", zdb2.Bytes, false, 0, 0},
+			{"amount", zdb2.Decimal, false, 10, 2},
+		},
+	}
+	priceRecords := []zdb2.Record{
+		{[]byte("a"), zdb2.DecimalValue{150, 2}},
+		{[]byte("b"), zdb2.DecimalValue{200, 2}},
+	}
+	couponTable := &zdb2.TableHeader{
+		Name: "coupon",
+		Fields: []*zdb2.Field{
+			{"sku", zdb2.Bytes, false, 0, 0},
+			{"discount", zdb2.Decimal, false, 4, 2},
+		},
+	}
+	couponRecords := []zdb2.Record{
+		{[]byte("a"), zdb2.DecimalValue{150, 2}},
+		{[]byte("c"), zdb2.DecimalValue{200, 2}},
+	}
+	rebateTable := &zdb2.TableHeader{
+		Name: "rebate",
+		Fields: []*zdb2.Field{
+			{"discount", zdb2.Decimal, false, 4, 3},
+		},
+	}
+	for _, newHashJoin := range []hashJoinConstructor{
+		func(r, s zdb2.Iterator, rJoinField, sJoinField string) (zdb2.Iterator, error) {
+			return NewHashJoinClassic(r, s, rJoinField, sJoinField)
+		},
+		func(r, s zdb2.Iterator, rJoinField, sJoinField string) (zdb2.Iterator, error) {
+			return NewHashJoinHybrid(r, s, rJoinField, sJoinField, true, 0.3, 3)
+		},
+	} {
+		// Bytes are compared by value.
+		joined, err := newHashJoin(
+			zdb2.NewInMemoryScan(priceTable, priceRecords),
+			zdb2.NewInMemoryScan(couponTable, couponRecords),
+			"sku",
+			"sku")
+		c.Assert(err, IsNil)
+		zdb2.CheckIterator(c, joined, []zdb2.Record{
+			zdb2.JoinedRecord(priceRecords[0], couponRecords[0]),
+		})
+
+		// Decimal fields can have different precisions.
+		joined, err = newHashJoin(
+			zdb2.NewInMemoryScan(priceTable, priceRecords),
+			zdb2.NewInMemoryScan(couponTable, couponRecords),
+			"amount",
+			"discount")
+		c.Assert(err, IsNil)
+		records, err := zdb2.ReadAll(joined)
+		c.Assert(err, IsNil)
+		c.Assert(records, HasLen, 2)
+		c.Assert(joined.Close(), IsNil)
+
+		// But they need the same scale, so that equal values are represented
+		// the same way.
+		_, err = newHashJoin(
+			zdb2.NewInMemoryScan(priceTable, priceRecords),
+			zdb2.NewInMemoryScan(rebateTable, nil),
+			"amount",
+			"discount")
+		c.Assert(err, NotNil)
+	}
+}
@@ -20,6 +20,7 @@ type merge struct {
 	sortFieldPosition int
 	sortFieldType     zdb2.Type
 	descending        bool
+	nullsFirst        bool
 
 	// We keep track of these so we can close them when the merge is closed.
 	exhaustedIters []zdb2.Iterator
@@ -34,6 +35,7 @@ func NewMerge(
 	t *zdb2.TableHeader,
 	sortField string,
 	descending bool,
+	nullsFirst bool,
 ) (*merge, error) {
 	inputs := make([]*iterWithRecord, 0, len(iters))
 	exhaustedIters := make([]zdb2.Iterator, 0, len(iters))
@@ -54,6 +56,7 @@ func NewMerge(
 		sortFieldPosition: sortFieldPosition,
 		sortFieldType:     sortFieldType,
 		descending:        descending,
+		nullsFirst:        nullsFirst,
 		exhaustedIters:    exhaustedIters,
 	}
 	heap.Init(m)
@@ -71,11 +74,12 @@ func (m *merge) Swap(i, j int) {
 func (m *merge) Less(i, j int) bool {
 	v1 := m.inputs[i].record[m.sortFieldPosition]
 	v2 := m.inputs[j].record[m.sortFieldPosition]
-	if m.descending {
-		return zdb2.Less(m.sortFieldType, v2, v1)
-	} else {
-		return zdb2.Less(m.sortFieldType, v1, v2)
-	}
+	return sortsBefore(
+		m.sortFieldType,
+		v1,
+		v2,
+		m.descending,
+		m.nullsFirst)
 }
 
 func (m *merge) Push(x interface{}) {
@@ -13,9 +13,9 @@ func (s *ProjectionSuite) TestProjection(c *C) {
 	t := &zdb2.TableHeader{
 		Name: "users",
 		Fields: []*zdb2.Field{
-			{"first_name", zdb2.String},
-			{"last_name", zdb2.String},
-			{"username", zdb2.String},
+			{"first_name", zdb2.String, false, 0, 0},
+			{"last_name", zdb2.String, false, 0, 0},
+			{"username", zdb2.String, false, 0, 0},
 		},
 	}
 	records := []zdb2.Record{
@@ -32,8 +32,8 @@ func (s *ProjectionSuite) TestProjection(c *C) {
 		&zdb2.TableHeader{
 			Name: "projection(users, [first_name,username])",
 			Fields: []*zdb2.Field{
-				{"first_name", zdb2.String},
-				{"username", zdb2.String},
+				{"first_name", zdb2.String, false, 0, 0},
+				{"username", zdb2.String, false, 0, 0},
 			},
 		})
 	expected := []zdb2.Record{
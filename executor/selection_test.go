@@ -13,10 +13,10 @@ func (s *SelectionSuite) TestSelection(c *C) {
 	t := &zdb2.TableHeader{
 		Name: "users",
 		Fields: []*zdb2.Field{
-			{"id", zdb2.Int32},
-			{"first_name", zdb2.String},
-			{"last_name", zdb2.String},
-			{"username", zdb2.String},
+			{"id", zdb2.Int32, false, 0, 0},
+			{"first_name", zdb2.String, false, 0, 0},
+			{"last_name", zdb2.String, false, 0, 0},
+			{"username", zdb2.String, false, 0, 0},
 		},
 	}
 	records := []zdb2.Record{
@@ -14,10 +14,14 @@ type sortInMemory struct {
 
 var _ zdb2.Iterator = (*sortInMemory)(nil)
 
+// NewSortInMemory sorts the records of iter by the given field.  Records where
+// the field is NULL are sorted before all others if nullsFirst is set, and after
+// all others otherwise (regardless of descending).
 func NewSortInMemory(
 	iter zdb2.Iterator,
 	sortField string,
 	descending bool,
+	nullsFirst bool,
 ) (*sortInMemory, error) {
 	t := iter.TableHeader()
 	sortFieldPosition, sortFieldType := zdb2.MustFieldPositionAndType(t, sortField)
@@ -31,6 +35,7 @@ func NewSortInMemory(
 		sortFieldPosition: sortFieldPosition,
 		sortFieldType:     sortFieldType,
 		descending:        descending,
+		nullsFirst:        nullsFirst,
 		records:           records,
 	})
 	return &sortInMemory{
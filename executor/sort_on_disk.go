@@ -25,6 +25,7 @@ func NewSortOnDisk(
 	iter zdb2.Iterator,
 	sortField string,
 	descending bool,
+	nullsFirst bool,
 ) (*sortOnDisk, error) {
 	t := iter.TableHeader()
 	sortFieldPosition, sortFieldType := zdb2.MustFieldPositionAndType(t, sortField)
@@ -47,6 +48,7 @@ func NewSortOnDisk(
 			sortFieldPosition: sortFieldPosition,
 			sortFieldType:     sortFieldType,
 			descending:        descending,
+			nullsFirst:        nullsFirst,
 			records:           records,
 		})
 
@@ -68,7 +70,7 @@ func NewSortOnDisk(
 	}
 	// TODO: Is it necessary to merge all sorted runs into a single file before
 	// returning, to limit memory (and file descriptor) usage?
-	merge, err := NewMerge(iters, t, sortField, descending)
+	merge, err := NewMerge(iters, t, sortField, descending, nullsFirst)
 	if err != nil {
 		return nil, err
 	}
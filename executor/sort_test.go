@@ -11,7 +11,12 @@ type SortSuite struct{}
 
 var _ = Suite(&SortSuite{})
 
-type sortConstructor func(zdb2.Iterator, string, bool) (zdb2.Iterator, error)
+type sortConstructor func(
+	iter zdb2.Iterator,
+	sortField string,
+	descending bool,
+	nullsFirst bool,
+) (zdb2.Iterator, error)
 
 func checkSort(
 	c *C,
@@ -19,8 +24,9 @@ func checkSort(
 	iter zdb2.Iterator,
 	sortField string,
 	descending bool,
+	nullsFirst bool,
 ) {
-	d, err := newSort(iter, sortField, descending)
+	d, err := newSort(iter, sortField, descending, nullsFirst)
 	c.Assert(err, IsNil)
 	records, err := zdb2.ReadAll(d)
 	c.Assert(err, IsNil)
@@ -31,7 +37,13 @@ func checkSort(
 	for i := 1; i < len(records); i++ {
 		v1 := records[i-1][sortFieldPosition]
 		v2 := records[i][sortFieldPosition]
-		if descending {
+		if v1 == nil || v2 == nil {
+			if nullsFirst {
+				c.Assert(v1 != nil && v2 == nil, IsFalse)
+			} else {
+				c.Assert(v1 == nil && v2 != nil, IsFalse)
+			}
+		} else if descending {
 			c.Assert(zdb2.Less(sortFieldType, v1, v2), IsFalse)
 		} else {
 			c.Assert(zdb2.Less(sortFieldType, v2, v1), IsFalse)
@@ -51,19 +63,29 @@ func (s *SortSuite) TestSort(c *C) {
 	}()
 
 	for _, newSort := range []sortConstructor{
-		func(iter zdb2.Iterator, sortField string, descending bool) (zdb2.Iterator, error) {
-			return NewSortOnDisk(iter, sortField, descending)
+		func(
+			iter zdb2.Iterator,
+			sortField string,
+			descending bool,
+			nullsFirst bool,
+		) (zdb2.Iterator, error) {
+			return NewSortOnDisk(iter, sortField, descending, nullsFirst)
 		},
-		func(iter zdb2.Iterator, sortField string, descending bool) (zdb2.Iterator, error) {
-			return NewSortInMemory(iter, sortField, descending)
+		func(
+			iter zdb2.Iterator,
+			sortField string,
+			descending bool,
+			nullsFirst bool,
+		) (zdb2.Iterator, error) {
+			return NewSortInMemory(iter, sortField, descending, nullsFirst)
 		},
 	} {
 		t := &zdb2.TableHeader{
 			Name: "movies",
 			Fields: []*zdb2.Field{
-				{"movie", zdb2.String},
-				{"rating", zdb2.Float64},
-				{"year", zdb2.Int32},
+				{"movie", zdb2.String, false, 0, 0},
+				{"rating", zdb2.Float64, false, 0, 0},
+				{"year", zdb2.Int32, false, 0, 0},
 			},
 		}
 		records := []zdb2.Record{
@@ -74,24 +96,62 @@ func (s *SortSuite) TestSort(c *C) {
 		}
 		for _, fieldName := range []string{"movie", "rating", "year"} {
 			for _, descending := range []bool{false, true} {
-				checkSort(c, newSort, zdb2.NewInMemoryScan(t, records), fieldName, descending)
+				checkSort(c, newSort, zdb2.NewInMemoryScan(t, records), fieldName, descending, false)
 			}
 		}
 
 		t = &zdb2.TableHeader{
 			Name: "movies",
 			Fields: []*zdb2.Field{
-				{"movieId", zdb2.Int32},
-				{"title", zdb2.String},
-				{"genres", zdb2.String},
+				{"movieId", zdb2.Int32, false, 0, 0},
+				{"title", zdb2.String, false, 0, 0},
+				{"genres", zdb2.String, false, 0, 0},
 			},
 		}
 		for _, fieldName := range []string{"movieId", "title", "genres"} {
 			for _, descending := range []bool{false, true} {
 				iter, err := NewCSVScan("test_data/movies.csv", t)
 				c.Assert(err, IsNil)
-				checkSort(c, newSort, iter, fieldName, descending)
+				checkSort(c, newSort, iter, fieldName, descending, false)
+			}
+		}
+
+		// NULLs are sorted together at one end, whichever direction the other
+		// values are sorted in.
+		t = &zdb2.TableHeader{
+			Name: "movies",
+			Fields: []*zdb2.Field{
+				{"movie", zdb2.String, false, 0, 0},
+				{"rating", zdb2.Float64, true, 0, 0},
+			},
+		}
+		records = []zdb2.Record{
+			{"Leon: The Professional", 4.6},
+			{"Gattaca", nil},
+			{"Hackers", 3.7},
+			{"Inside Out", nil},
+			{"Sneakers", 4.1},
+		}
+		for _, descending := range []bool{false, true} {
+			for _, nullsFirst := range []bool{false, true} {
+				checkSort(
+					c,
+					newSort,
+					zdb2.NewInMemoryScan(t, records),
+					"rating",
+					descending,
+					nullsFirst)
 			}
 		}
+		sorted, err := newSort(
+			zdb2.NewInMemoryScan(t, records), "rating", true, true)
+		c.Assert(err, IsNil)
+		zdb2.CheckIterator(c, sorted, []zdb2.Record{
+			{"Gattaca", nil},
+			{"Inside Out", nil},
+			{"Leon: The Professional", 4.6},
+			{"Sneakers", 4.1},
+			{"Hackers", 3.7},
+		})
 	}
 }
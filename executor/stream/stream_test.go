@@ -16,9 +16,9 @@ func (s *StreamSuite) TestStream(c *C) {
 	expectedTableHeader := &zdb2.TableHeader{
 		Name: "movies",
 		Fields: []*zdb2.Field{
-			{"title", zdb2.String},
-			{"rating", zdb2.Float64},
-			{"views", zdb2.Int32},
+			{"title", zdb2.String, false, 0, 0},
+			{"rating", zdb2.Float64, false, 0, 0},
+			{"views", zdb2.Int32, false, 0, 0},
 		},
 	}
 	expectedRecords := []zdb2.Record{
@@ -45,12 +45,43 @@ func (s *StreamSuite) TestStream(c *C) {
 	zdb2.CheckIterator(c, scan, expectedRecords)
 }
 
+func (s *StreamSuite) TestStreamNulls(c *C) {
+	expectedTableHeader := &zdb2.TableHeader{
+		Name: "movies",
+		Fields: []*zdb2.Field{
+			{"title", zdb2.String, false, 0, 0},
+			{"rating", zdb2.Float64, true, 0, 0},
+			{"views", zdb2.Int32, true, 0, 0},
+		},
+	}
+	expectedRecords := []zdb2.Record{
+		{"Leon: The Professional", 4.6, int32(2)},
+		{"Gattaca", nil, int32(2)},
+		{"Hackers", 3.7, nil},
+		{"Inside Out", nil, nil},
+	}
+	path := c.MkDir() + "/movies.zt"
+	w, err := NewWrite(path, expectedTableHeader)
+	c.Assert(err, IsNil)
+	for _, record := range expectedRecords {
+		c.Assert(w.WriteRecord(record), IsNil)
+	}
+	// Only nullable fields can be NULL.
+	c.Assert(w.WriteRecord(zdb2.Record{nil, 4.5, int32(1)}), NotNil)
+	c.Assert(w.Close(), IsNil)
+
+	scan, err := NewScan(path)
+	c.Assert(err, IsNil)
+	c.Assert(scan.TableHeader(), DeepEquals, expectedTableHeader)
+	zdb2.CheckIterator(c, scan, expectedRecords)
+}
+
 func (s *StreamSuite) TestPartitionedWrite(c *C) {
 	expectedTableHeader := &zdb2.TableHeader{
 		Name: "movies",
 		Fields: []*zdb2.Field{
-			{"title", zdb2.String},
-			{"rating", zdb2.Float64},
+			{"title", zdb2.String, false, 0, 0},
+			{"rating", zdb2.Float64, false, 0, 0},
 		},
 	}
 	expectedRecords := []zdb2.Record{
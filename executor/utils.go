@@ -3,6 +3,7 @@ package executor
 import (
 	"io"
 	"sort"
+	"time"
 
 	"github.com/robot-dreams/zdb2"
 )
@@ -14,6 +15,10 @@ type result struct {
 	err    error
 }
 
+// Calls recordFunc for each record in iter, except for records whose join value
+// is NULL; NULL isn't equal to anything (not even NULL), so they never join.
+// Equal decimal join values are represented the same way, since they're stored
+// with their fields' scales, which zdb2.JoinedHeader requires to match.
 func forEachRecord(
 	iter zdb2.Iterator,
 	joinPosition int,
@@ -28,6 +33,9 @@ func forEachRecord(
 			return err
 		}
 		joinValue := record[joinPosition]
+		if joinValue == nil {
+			continue
+		}
 		err = recordFunc(record, joinType, joinValue)
 		if err != nil {
 			return err
@@ -35,10 +43,46 @@ func forEachRecord(
 	}
 }
 
+// Returns true if v1 should be sorted before v2, where either might be NULL.
+func sortsBefore(
+	type_ zdb2.Type,
+	v1 interface{},
+	v2 interface{},
+	descending bool,
+	nullsFirst bool,
+) bool {
+	if v1 == nil || v2 == nil {
+		if nullsFirst {
+			return v1 == nil && v2 != nil
+		} else {
+			return v1 != nil && v2 == nil
+		}
+	}
+	if descending {
+		return zdb2.Less(type_, v2, v1)
+	} else {
+		return zdb2.Less(type_, v1, v2)
+	}
+}
+
+// Returns a key for the given join value that can be used in a map, such that
+// equal join values have equal keys.
+func hashKey(joinValue interface{}) interface{} {
+	switch v := joinValue.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UnixNano()
+	default:
+		return joinValue
+	}
+}
+
 type byField struct {
 	sortFieldPosition int
 	sortFieldType     zdb2.Type
 	descending        bool
+	nullsFirst        bool
 	records           []zdb2.Record
 }
 
@@ -55,9 +99,10 @@ func (b *byField) Swap(i, j int) {
 func (b *byField) Less(i, j int) bool {
 	v1 := b.records[i][b.sortFieldPosition]
 	v2 := b.records[j][b.sortFieldPosition]
-	if b.descending {
-		return zdb2.Less(b.sortFieldType, v2, v1)
-	} else {
-		return zdb2.Less(b.sortFieldType, v1, v2)
-	}
+	return sortsBefore(
+		b.sortFieldType,
+		v1,
+		v2,
+		b.descending,
+		b.nullsFirst)
 }
@@ -0,0 +1,12 @@
+package fsck
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Initialize gocheck.
+func Test(t *testing.T) {
+	TestingT(t)
+}
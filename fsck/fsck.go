@@ -0,0 +1,151 @@
+package fsck
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/heap_file"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+// A Violation is a problem found in a block of a file (or in the file as a
+// whole, if BlockID is block_file.InvalidBlockID).
+type Violation struct {
+	Path    string
+	BlockID int32
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.BlockID == block_file.InvalidBlockID {
+		return fmt.Sprintf("%v: %v", v.Path, v.Message)
+	}
+	return fmt.Sprintf("%v: block %d: %v", v.Path, v.BlockID, v.Message)
+}
+
+// CheckHeapFile returns every problem with the structure of the heap file at
+// path (see heap_file.Verify).
+func CheckHeapFile(path string) ([]Violation, error) {
+	var violations []Violation
+	err := heap_file.Verify(path, reporter(path, &violations))
+	if err != nil {
+		return nil, err
+	}
+	return violations, nil
+}
+
+// CheckBPlusTree returns every problem with the structure of the B+ tree at
+// path (see index.Verify).
+func CheckBPlusTree(path string) ([]Violation, error) {
+	var violations []Violation
+	err := index.Verify(path, reporter(path, &violations), nil)
+	if err != nil {
+		return nil, err
+	}
+	return violations, nil
+}
+
+// CheckIndex checks the structure of the B+ tree at indexPath, and that it
+// indexes the heap file at heapFilePath: every entry must point to a live
+// record, and every live record must have exactly one entry.  Since entries
+// don't identify the column that they're keyed by, keys aren't checked against
+// the records.
+//
+// The heap file isn't checked (see CheckHeapFile), but records that can't be
+// read are reported.
+func CheckIndex(heapFilePath string, indexPath string) ([]Violation, error) {
+	var violations []Violation
+	report := reporter(indexPath, &violations)
+	// Keep track of where each RecordID's entries are, so that dangling
+	// entries can be reported with the leaf nodes that store them.
+	entryBlockIDs := make(map[zdb2.RecordID][]int32)
+	err := index.Verify(
+		indexPath,
+		report,
+		func(blockID int32, entry index.Entry) {
+			entryBlockIDs[entry.RID] = append(
+				entryBlockIDs[entry.RID],
+				blockID)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	scan, err := heap_file.NewFileScan(heapFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer scan.Close()
+	live := make(map[zdb2.RecordID]bool)
+	for {
+		_, recordID, err := scan.NextWithID()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			violations = append(violations, Violation{
+				Path:    heapFilePath,
+				BlockID: block_file.InvalidBlockID,
+				Message: fmt.Sprintf("Cannot scan heap file: %v", err),
+			})
+			return violations, nil
+		}
+		live[recordID] = true
+		switch blockIDs := entryBlockIDs[recordID]; len(blockIDs) {
+		case 0:
+			violations = append(violations, Violation{
+				Path:    heapFilePath,
+				BlockID: recordID.PageID,
+				Message: fmt.Sprintf(
+					"Record %+v doesn't have an entry in %v",
+					recordID,
+					indexPath),
+			})
+		case 1:
+		default:
+			for _, blockID := range blockIDs {
+				report(blockID, fmt.Sprintf(
+					"Record %+v has %d entries",
+					recordID,
+					len(blockIDs)))
+			}
+		}
+	}
+
+	var dangling []zdb2.RecordID
+	for recordID := range entryBlockIDs {
+		if !live[recordID] {
+			dangling = append(dangling, recordID)
+		}
+	}
+	sort.Slice(dangling, func(i, j int) bool {
+		if dangling[i].PageID != dangling[j].PageID {
+			return dangling[i].PageID < dangling[j].PageID
+		}
+		return dangling[i].SlotID < dangling[j].SlotID
+	})
+	for _, recordID := range dangling {
+		for _, blockID := range entryBlockIDs[recordID] {
+			report(blockID, fmt.Sprintf(
+				"Entry points to %+v, which isn't a live record in %v",
+				recordID,
+				heapFilePath))
+		}
+	}
+	return violations, nil
+}
+
+func reporter(
+	path string,
+	violations *[]Violation,
+) func(blockID int32, message string) {
+	return func(blockID int32, message string) {
+		*violations = append(*violations, Violation{
+			Path:    path,
+			BlockID: blockID,
+			Message: message,
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package fsck
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/heap_file"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+type FsckSuite struct{}
+
+var _ = Suite(&FsckSuite{})
+
+var t = &zdb2.TableHeader{
+	Name: "movies",
+	Fields: []*zdb2.Field{
+		{"title", zdb2.String, false, 0, 0},
+		{"views", zdb2.Int32, false, 0, 0},
+	},
+}
+
+func (s *FsckSuite) TestViolation(c *C) {
+	v := Violation{
+		Path:    "movies",
+		BlockID: 3,
+		Message: "Something is wrong",
+	}
+	c.Assert(v.String(), Equals, "movies: block 3: Something is wrong")
+	v.BlockID = block_file.InvalidBlockID
+	c.Assert(v.String(), Equals, "movies: Something is wrong")
+}
+
+func (s *FsckSuite) TestCheckIndex(c *C) {
+	dir := c.MkDir()
+	heapFilePath := dir + "/movies"
+	indexPath := dir + "/movies_views"
+	hf, err := heap_file.NewHeapFile(heapFilePath, t)
+	c.Assert(err, IsNil)
+	tree, err := index.OpenBPlusTree(indexPath, zdb2.Int32)
+	c.Assert(err, IsNil)
+	var entries []index.Entry
+	for i := 0; i < 1000; i++ {
+		views := int32(i % 100)
+		recordID, err := hf.Insert(zdb2.Record{"Heat", views})
+		c.Assert(err, IsNil)
+		entry := index.Entry{Key: views, RID: recordID}
+		c.Assert(tree.AddEntry(entry), IsNil)
+		entries = append(entries, entry)
+	}
+	c.Assert(tree.Close(), IsNil)
+
+	check := func() []Violation {
+		violations, err := CheckIndex(heapFilePath, indexPath)
+		c.Assert(err, IsNil)
+		return violations
+	}
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(check(), HasLen, 0)
+
+	// A deleted record leaves behind a dangling entry.
+	hf, err = heap_file.OpenHeapFile(heapFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(hf.Delete(entries[10].RID), IsNil)
+	c.Assert(hf.Close(), IsNil)
+	violations := check()
+	c.Assert(violations, HasLen, 1)
+	c.Assert(violations[0].Path, Equals, indexPath)
+	c.Assert(violations[0].BlockID > 0, IsTrue)
+
+	// A record without an entry is reported with the heap page storing it.
+	hf, err = heap_file.OpenHeapFile(heapFilePath)
+	c.Assert(err, IsNil)
+	recordID, err := hf.Insert(zdb2.Record{"Ronin", int32(5)})
+	c.Assert(err, IsNil)
+	c.Assert(hf.Close(), IsNil)
+	violations = check()
+	c.Assert(violations, HasLen, 2)
+	c.Assert(violations[0].Path, Equals, heapFilePath)
+	c.Assert(violations[0].BlockID, Equals, recordID.PageID)
+
+	// Each record should only have one entry.
+	tree, err = index.OpenBPlusTree(indexPath, zdb2.Int32)
+	c.Assert(err, IsNil)
+	c.Assert(
+		tree.AddEntry(index.Entry{Key: int32(5), RID: recordID}),
+		IsNil)
+	c.Assert(tree.AddEntry(entries[20]), IsNil)
+	c.Assert(tree.Close(), IsNil)
+	violations = check()
+	c.Assert(violations, HasLen, 3)
+	for _, v := range violations[:2] {
+		c.Assert(v.Path, Equals, indexPath)
+	}
+
+	// The files are still structurally sound.
+	violations, err = CheckHeapFile(heapFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 0)
+	violations, err = CheckBPlusTree(indexPath)
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 0)
+}
@@ -0,0 +1,75 @@
+package heap_file
+
+import (
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+// An index on the heap file, whose entries are removed before the RecordIDs
+// they refer to can be reused (see AttachIndex).
+type attachedIndex struct {
+	bpt *index.BPlusTree
+	key func(zdb2.Record) (interface{}, error)
+}
+
+// AttachIndex registers an index whose entries map key(record) to each record's
+// RecordID.  Whenever the space used by a deleted record is about to be
+// reclaimed (which lets its RecordID be reused), the record's entry is removed
+// from the index first, unless it was already removed (e.g. by the txn_mgr
+// package); that way, an entry never refers to a record other than the one it
+// was added for.
+//
+// Attached indexes aren't saved in the heap file, so every index on the heap
+// file should be attached each time it's opened (before any records are
+// inserted, updated or vacuumed).
+func (hf *heapFile) AttachIndex(
+	bpt *index.BPlusTree,
+	key func(zdb2.Record) (interface{}, error),
+) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	hf.indexes = append(hf.indexes, attachedIndex{bpt, key})
+}
+
+// Removes the entries for the given record from every attached index.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) removeEntries(
+	record zdb2.Record,
+	recordID zdb2.RecordID,
+) error {
+	for _, ai := range hf.indexes {
+		key, err := ai.key(record)
+		if err != nil {
+			return err
+		}
+		err = ai.bpt.DeleteEntry(index.Entry{Key: key, RID: recordID})
+		if err != nil && err != index.EntryNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the entries for the version in the given slot, if it's still
+// stored in the page; the version will be reclaimed (or marked as dead).
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) removeVersionEntries(hp *heapPage, slotID uint16) error {
+	if len(hf.indexes) == 0 {
+		return nil
+	}
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil || vh.dead || vh.forwarded {
+		return err
+	}
+	record, err := hp.readFullRecord(slotID)
+	if err != nil {
+		return err
+	}
+	return hf.removeEntries(record, zdb2.RecordID{
+		PageID: hp.pageID,
+		SlotID: slotID,
+	})
+}
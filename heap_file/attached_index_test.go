@@ -0,0 +1,99 @@
+package heap_file
+
+import (
+	"io"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+// Checks that every entry in the index refers to either a deleted record, or a
+// record with the entry's key, and returns the number of entries of the latter
+// kind.
+func checkEntries(c *C, hf *heapFile, bpt *index.BPlusTree) int {
+	iter, err := bpt.FindAll()
+	c.Assert(err, IsNil)
+	n := 0
+	for {
+		entry, err := iter.Next()
+		if err == io.EOF {
+			return n
+		}
+		c.Assert(err, IsNil)
+		record, err := hf.Get(entry.RID)
+		c.Assert(err, IsNil)
+		if record != nil {
+			c.Assert(record[2], Equals, entry.Key)
+			n++
+		}
+	}
+}
+
+func (s *HeapFileSuite) TestAttachIndex(c *C) {
+	dir := c.MkDir()
+	hf, err := NewHeapFile(dir+"/heap_file_test", t)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	bpt, err := index.OpenBPlusTree(dir+"/heap_file_test_index", zdb2.Int32)
+	c.Assert(err, IsNil)
+	defer bpt.Close()
+	hf.AttachIndex(bpt, func(record zdb2.Record) (interface{}, error) {
+		return record[2], nil
+	})
+
+	// Long titles make the records fill several pages.
+	title := strings.Repeat("Gattaca ", 25)
+	var recordIDs []zdb2.RecordID
+	insert := func(views int32) {
+		recordID, err := hf.Insert(zdb2.Record{title, 4.5, views})
+		c.Assert(err, IsNil)
+		err = bpt.AddEntry(index.Entry{Key: views, RID: recordID})
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	for i := 0; i < 600; i++ {
+		insert(int32(i))
+	}
+
+	// Deleting half of the records leaves their entries behind, but the
+	// entries are removed before the new records reuse their slots.
+	var surviving []zdb2.RecordID
+	for i, recordID := range recordIDs {
+		if i%2 == 0 {
+			c.Assert(hf.Delete(recordID), IsNil)
+		} else {
+			surviving = append(surviving, recordID)
+		}
+	}
+	recordIDs = surviving
+	for i := 0; i < 300; i++ {
+		insert(int32(10000 + i))
+	}
+	reused := false
+	for _, recordID := range recordIDs[300:] {
+		reused = reused || recordID.PageID < hf.lastPage.pageID
+	}
+	c.Assert(reused, Equals, true)
+	c.Assert(checkEntries(c, hf, bpt), Equals, 600)
+
+	// Vacuum removes the entries for the versions that it reclaims.
+	m, err := mvcc.OpenManager(dir + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+	for _, recordID := range recordIDs[:200] {
+		c.Assert(hf.Delete(recordID), IsNil)
+	}
+	txn, err := m.Begin()
+	c.Assert(err, IsNil)
+	for _, recordID := range recordIDs[200:400] {
+		c.Assert(hf.DeleteTxn(txn, recordID), IsNil)
+	}
+	c.Assert(txn.Commit(), IsNil)
+	_, err = hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	c.Assert(checkEntries(c, hf, bpt), Equals, 200)
+}
@@ -3,5 +3,32 @@ package heap_file
 const (
 	pageSize               = 1 << 16
 	lookupTableEntryWidth  = 2
-	lookupTableFooterWidth = 4
+	lookupTableFooterWidth = 12
+
+	// The footer also stores the page LSN used by the write-ahead log.
+	pageLSNOffset = pageSize - lookupTableFooterWidth
+
+	// Each record version starts with a flags byte, followed by the TxnIDs
+	// (as int64s) of the transactions that created and deleted it.
+	versionHeaderWidth = 17
+)
+
+const (
+	versionFlag_Dead byte = 1 << iota
+	versionFlag_Forwarded
+	versionFlag_Moved
+	versionFlag_Toasted
+)
+
+const (
+	// Each free space map page covers the heap pages that follow it, with one
+	// entry per page (leaving room for the page LSN at the end).  Each entry
+	// stores the number of bytes available in its page as a uint16.
+	freeSpaceMapEntryWidth     = 2
+	freeSpaceMapEntriesPerPage = pageLSNOffset / freeSpaceMapEntryWidth
+	freeSpaceMapGroupSize      = freeSpaceMapEntriesPerPage + 1
+
+	// The entry for a page that has been freed, and can be reused as either a
+	// heap page or an overflow page.
+	freePageEntry = pageSize - 1
 )
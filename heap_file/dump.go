@@ -0,0 +1,259 @@
+package heap_file
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/mvcc"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// Kinds of pages in a heap file.
+const (
+	PageKind_Header        = "header"
+	PageKind_FreeSpaceMap  = "free_space_map"
+	PageKind_Heap          = "heap"
+	PageKind_Overflow      = "overflow"
+	PageKind_Uninitialized = "uninitialized"
+)
+
+// States of the slots in a heap page.
+const (
+	// The version's space has been reclaimed.
+	SlotState_Reclaimed = "reclaimed"
+	// The version was marked dead (e.g. by an aborted transaction).
+	SlotState_Dead = "dead"
+	// The record was moved to another slot (see SlotDump.ForwardTo).
+	SlotState_Forwarded = "forwarded"
+	// The version was deleted by a transaction (or via Delete, if xmax is
+	// mvcc.FrozenTxnID).
+	SlotState_Deleted = "deleted"
+	SlotState_Live    = "live"
+)
+
+type FileDump struct {
+	Path          string        `json:"path"`
+	FormatVersion uint32        `json:"formatVersion"`
+	SchemaVersion uint32        `json:"schemaVersion"`
+	Columns       []*ColumnDump `json:"columns"`
+	NumRecords    int64         `json:"numRecords"`
+	Dirty         bool          `json:"dirty"`
+	NumPages      int32         `json:"numPages"`
+	FirstHeapPage int32         `json:"firstHeapPage"`
+	Pages         []*PageDump   `json:"pages"`
+}
+
+type ColumnDump struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+type PageDump struct {
+	PageID int32  `json:"pageID"`
+	Kind   string `json:"kind"`
+
+	// Only set for heap pages.
+	SchemaVersion uint32 `json:"schemaVersion,omitempty"`
+	NumSlots      int    `json:"numSlots,omitempty"`
+	// The number of slots that don't hold a live record.
+	NumTombstones int `json:"numTombstones,omitempty"`
+	// The number of contiguous bytes between the records and the lookup table,
+	// and the number of bytes that would be free after compacting the page.
+	FreeSpace      int         `json:"freeSpace,omitempty"`
+	AvailableSpace int         `json:"availableSpace,omitempty"`
+	Slots          []*SlotDump `json:"slots,omitempty"`
+
+	// Only set for overflow pages.
+	NextOverflowPage int32 `json:"nextOverflowPage,omitempty"`
+	OverflowLength   int   `json:"overflowLength,omitempty"`
+
+	// Set if the page couldn't be decoded.
+	Error string `json:"error,omitempty"`
+}
+
+type SlotDump struct {
+	SlotID    uint16         `json:"slotID"`
+	Offset    int            `json:"offset"`
+	Size      int            `json:"size"`
+	State     string         `json:"state"`
+	Moved     bool           `json:"moved,omitempty"`
+	Toasted   bool           `json:"toasted,omitempty"`
+	Xmin      mvcc.TxnID     `json:"xmin,omitempty"`
+	Xmax      mvcc.TxnID     `json:"xmax,omitempty"`
+	ForwardTo *zdb2.RecordID `json:"forwardTo,omitempty"`
+	// The record's values (under the latest schema), formatted by DumpValue.
+	Record []interface{} `json:"record,omitempty"`
+
+	// Set if the slot couldn't be decoded.
+	Error string `json:"error,omitempty"`
+}
+
+// Dump describes the heap file at path, including the contents of the pages
+// with pageIDs in [firstPageID, lastPageID] (a negative lastPageID stands for
+// the last page in the file).  Pages that can't be decoded are still included,
+// with an error message; see Verify for a thorough check.
+//
+// Opening the file recovers it, unless it's already open (in which case the
+// open wal.File is shared; see wal.OpenFile).  The file isn't modified
+// otherwise.
+func Dump(path string, firstPageID int32, lastPageID int32) (*FileDump, error) {
+	bf, err := wal.OpenFile(path, pageSize, pageLSNOffset)
+	if err != nil {
+		return nil, err
+	}
+	defer bf.Close()
+	h, err := readFileHeader(bf)
+	if err != nil {
+		return nil, err
+	}
+	d := &FileDump{
+		Path:          path,
+		FormatVersion: h.formatVersion,
+		SchemaVersion: h.schemaVersion,
+		NumRecords:    h.numRecords,
+		Dirty:         h.dirty,
+		NumPages:      bf.NumBlocks,
+		FirstHeapPage: h.firstHeapPageID(),
+	}
+	for _, field := range h.t.Fields {
+		d.Columns = append(d.Columns, &ColumnDump{
+			Name:     field.Name,
+			Type:     field.Type.String(),
+			Nullable: field.Nullable,
+		})
+	}
+	if firstPageID < 0 {
+		firstPageID = 0
+	}
+	if lastPageID < 0 || lastPageID >= bf.NumBlocks {
+		lastPageID = bf.NumBlocks - 1
+	}
+	for pageID := firstPageID; pageID <= lastPageID; pageID++ {
+		d.Pages = append(d.Pages, dumpPage(bf, h, pageID))
+	}
+	return d, nil
+}
+
+func dumpPage(bf *wal.File, h *fileHeader, pageID int32) *PageDump {
+	pd := &PageDump{PageID: pageID}
+	if h.isFreeSpaceMapPage(pageID) {
+		pd.Kind = PageKind_FreeSpaceMap
+		return pd
+	} else if pageID < h.firstHeapPageID() {
+		pd.Kind = PageKind_Header
+		return pd
+	}
+	hp, err := loadHeapPage(bf, pageID, h)
+	if err != nil {
+		pd.Kind = PageKind_Heap
+		pd.Error = err.Error()
+		return pd
+	}
+	defer hp.release(false)
+	if hp.isOverflowPage() {
+		pd.Kind = PageKind_Overflow
+		pd.NextOverflowPage = int32(zdb2.ByteOrder.Uint32(hp.data[4:8]))
+		pd.OverflowLength = int(zdb2.ByteOrder.Uint16(hp.data[8:10]))
+		return pd
+	}
+	// Pages that were freed, or allocated by transactions that were rolled
+	// back, are left zeroed, which isn't a valid heap page (schema versions
+	// start at 1).
+	if hp.schemaVersion() == 0 {
+		pd.Kind = PageKind_Uninitialized
+		return pd
+	}
+	pd.Kind = PageKind_Heap
+	pd.SchemaVersion = hp.schemaVersion()
+	pd.NumSlots = int(hp.numSlots)
+	// The footer might be corrupt, in which case the lookup table can't be
+	// read either.
+	lookupTableSize := lookupTableFooterWidth +
+		lookupTableEntryWidth*int(hp.numSlots)
+	if int(hp.nextSlotOffset)+lookupTableSize > pageSize {
+		pd.Error = "nextSlotOffset is inconsistent with numSlots"
+		return pd
+	}
+	pd.FreeSpace = int(hp.freeSpace())
+	pd.AvailableSpace, err = hp.availableSpace()
+	if err != nil {
+		pd.Error = err.Error()
+		return pd
+	}
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		sd := dumpSlot(hp, slotID)
+		if sd.State != SlotState_Live {
+			pd.NumTombstones++
+		}
+		pd.Slots = append(pd.Slots, sd)
+	}
+	return pd
+}
+
+// Precondition: the page's lookup table is valid
+func dumpSlot(hp *heapPage, slotID uint16) *SlotDump {
+	sd := &SlotDump{SlotID: slotID}
+	i, j, _ := hp.versionBounds(slotID)
+	sd.Offset = i
+	sd.Size = j - i
+	if i == j {
+		sd.State = SlotState_Reclaimed
+		return sd
+	}
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil {
+		sd.Error = err.Error()
+		return sd
+	}
+	sd.Moved = vh.moved
+	sd.Toasted = vh.toasted
+	sd.Xmin = vh.xmin
+	sd.Xmax = vh.xmax
+	if vh.dead {
+		sd.State = SlotState_Dead
+		return sd
+	} else if vh.forwarded {
+		sd.State = SlotState_Forwarded
+		forwardTo := vh.forwardTo
+		sd.ForwardTo = &forwardTo
+		return sd
+	} else if vh.xmax != mvcc.InvalidTxnID {
+		sd.State = SlotState_Deleted
+	} else {
+		sd.State = SlotState_Live
+	}
+	record, err := hp.readFullRecord(slotID)
+	if err != nil {
+		sd.Error = err.Error()
+		return sd
+	}
+	for k, value := range record {
+		type_ := hp.header.t.Fields[k].Type
+		sd.Record = append(sd.Record, DumpValue(type_, value))
+	}
+	return sd
+}
+
+// DumpValue returns a representation of a value of the given type that can be
+// printed or encoded as JSON: byte slices are written in hex (starting with
+// \x, like in csv files), while dates, timestamps and decimals are written as
+// strings.  Other values (including NULL) are returned as they are.
+func DumpValue(type_ zdb2.Type, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch type_ {
+	case zdb2.Bytes:
+		return `\x` + hex.EncodeToString(value.([]byte))
+	case zdb2.Date:
+		return value.(time.Time).Format("2006-01-02")
+	case zdb2.Timestamp:
+		return value.(time.Time).Format(time.RFC3339Nano)
+	case zdb2.Decimal:
+		return value.(zdb2.DecimalValue).String()
+	default:
+		return value
+	}
+}
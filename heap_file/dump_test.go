@@ -0,0 +1,92 @@
+package heap_file
+
+import (
+	"encoding/json"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+func (s *HeapFileSuite) TestDump(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, posters)
+	c.Assert(err, IsNil)
+	var recordIDs []zdb2.RecordID
+	for _, record := range []zdb2.Record{
+		{"Heat", []byte{1, 2, 3}, int32(1)},
+		{"Ronin", nil, int32(2)},
+		{"Thief", []byte{}, int32(3)},
+		{strings.Repeat("Drive ", 4000), nil, int32(4)},
+	} {
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	c.Assert(hf.Delete(recordIDs[1]), IsNil)
+	pageID := recordIDs[0].PageID
+	numPages := hf.bf.NumBlocks
+	c.Assert(hf.Close(), IsNil)
+
+	d, err := Dump(path, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(d.FormatVersion, Equals, currentFormatVersion)
+	c.Assert(d.NumRecords, Equals, int64(3))
+	c.Assert(d.NumPages, Equals, numPages)
+	c.Assert(d.Columns, HasLen, 3)
+	c.Assert(*d.Columns[1], Equals, ColumnDump{"image", "Bytes", true})
+	c.Assert(d.Pages, HasLen, int(numPages))
+	c.Assert(d.Pages[0].Kind, Equals, PageKind_Header)
+	c.Assert(d.Pages[1].Kind, Equals, PageKind_FreeSpaceMap)
+	c.Assert(d.Pages[pageID].Kind, Equals, PageKind_Heap)
+	// The long title is stored in the remaining pages.
+	for _, pd := range d.Pages[pageID+1:] {
+		c.Assert(pd.Kind, Equals, PageKind_Overflow)
+	}
+
+	pd := d.Pages[pageID]
+	c.Assert(pd.NumSlots, Equals, 4)
+	c.Assert(pd.NumTombstones, Equals, 1)
+	c.Assert(pd.AvailableSpace > pd.FreeSpace, IsTrue)
+	c.Assert(pd.Slots, HasLen, 4)
+	c.Assert(pd.Slots[0].State, Equals, SlotState_Live)
+	c.Assert(pd.Slots[0].Xmin, Equals, mvcc.FrozenTxnID)
+	c.Assert(
+		pd.Slots[0].Record,
+		DeepEquals,
+		[]interface{}{"Heat", `\x010203`, int32(1)})
+	c.Assert(pd.Slots[1].State, Equals, SlotState_Deleted)
+	c.Assert(pd.Slots[1].Xmax, Equals, mvcc.FrozenTxnID)
+	c.Assert(pd.Slots[3].Toasted, IsTrue)
+	c.Assert(
+		pd.Slots[3].Record,
+		DeepEquals,
+		[]interface{}{strings.Repeat("Drive ", 4000), nil, int32(4)})
+
+	// Only the requested pages are included.
+	d, err = Dump(path, pageID, pageID)
+	c.Assert(err, IsNil)
+	c.Assert(d.Pages, HasLen, 1)
+	c.Assert(d.Pages[0].PageID, Equals, pageID)
+	_, err = json.Marshal(d)
+	c.Assert(err, IsNil)
+}
+
+func (s *HeapFileSuite) TestDumpValue(c *C) {
+	for _, test := range []struct {
+		type_    zdb2.Type
+		value    interface{}
+		expected interface{}
+	}{
+		{zdb2.Int32, int32(7), int32(7)},
+		{zdb2.String, nil, nil},
+		{zdb2.Bytes, []byte{0xab, 0x01}, `\xab01`},
+		{zdb2.Date, zdb2.NewDate(1995, 12, 15), "1995-12-15"},
+		{zdb2.Decimal, zdb2.DecimalValue{1250, 2}, "12.50"},
+	} {
+		c.Assert(DumpValue(test.type_, test.value), Equals, test.expected)
+	}
+}
@@ -0,0 +1,345 @@
+package heap_file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+	"github.com/robot-dreams/zdb2/mvcc"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// Page 0 of a heap file is a header block that describes the file as a whole:
+//
+//   - magic number (uint32)
+//   - format version (uint32)
+//   - page size (uint32)
+//   - schema version (uint32)
+//   - record count (int64)
+//   - flags (byte)
+//   - the table name (as written by zdb2.WriteString)
+//   - the number of schema versions (uint16)
+//   - each version of the schema (see schema.go)
+//
+// Like every other page, the header block ends with a page LSN.  The free
+// space map and heap pages follow the header block (see free_space_map.go).
+// Each heap page starts with the schema version (uint32) that its records were
+// encoded under, followed by the records themselves.  Records are encoded in
+// zdb2.RecordFormat_VarintLengths, and large values are stored in chains of
+// overflow pages, which are mixed in with the heap pages (see overflow.go).
+//
+// Heap files in the original layout (format version 0) can only be read; see
+// original_layout.go.  RewriteHeapFile converts them to the current format.
+
+const (
+	heapFileMagic uint32 = 0x7a646268
+
+	formatVersion_Original uint32 = 0
+	formatVersion_Current  uint32 = 1
+
+	currentFormatVersion = formatVersion_Current
+
+	// Set while the heap file is open, so that we can tell whether the record
+	// count was saved when the heap file was last closed.
+	headerFlag_Dirty byte = 1
+
+	headerBlockID = 0
+
+	// Heap pages start with their schema version.
+	pageSchemaVersionWidth = 4
+)
+
+type fileHeader struct {
+	formatVersion uint32
+
+	// Every version of the schema that might still be used by a heap page; the
+	// other fields are derived from these by setSchemas.
+	schemas []*schema
+
+	// The latest version of the schema.
+	schemaVersion uint32
+	t             *zdb2.TableHeader
+
+	// Keyed by the older schema versions.
+	conversions map[uint32]*conversion
+
+	// The number of record versions that haven't been deleted via Delete or
+	// reclaimed by Vacuum.  Only kept up to date in memory while the heap file
+	// is open; it's written to the header block when the heap file is closed.
+	numRecords int64
+
+	dirty bool
+}
+
+// Returns the first page of the free space map.
+func (h *fileHeader) firstFreeSpaceMapPageID() int32 {
+	return headerBlockID + 1
+}
+
+func (h *fileHeader) firstHeapPageID() int32 {
+	return h.firstFreeSpaceMapPageID() + 1
+}
+
+func (h *fileHeader) encode() ([]byte, error) {
+	var flags byte
+	if h.dirty {
+		flags |= headerFlag_Dirty
+	}
+	var buf bytes.Buffer
+	// err is always nil when writing to a bytes.Buffer.
+	_ = binary.Write(&buf, zdb2.ByteOrder, heapFileMagic)
+	_ = binary.Write(&buf, zdb2.ByteOrder, h.formatVersion)
+	_ = binary.Write(&buf, zdb2.ByteOrder, uint32(pageSize))
+	_ = binary.Write(&buf, zdb2.ByteOrder, h.schemaVersion)
+	_ = binary.Write(&buf, zdb2.ByteOrder, h.numRecords)
+	_ = binary.Write(&buf, zdb2.ByteOrder, flags)
+	err := h.encodeSchemas(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() > pageLSNOffset {
+		return nil, errors.Newf(
+			"Schema for %v doesn't fit in the header block",
+			h.t.Name)
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *fileHeader) encodeSchemas(w io.Writer) error {
+	err := zdb2.WriteString(w, h.t.Name)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, zdb2.ByteOrder, uint16(len(h.schemas)))
+	if err != nil {
+		return err
+	}
+	for _, s := range h.schemas {
+		err = writeSchema(w, s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *fileHeader) decodeSchemas(r io.Reader) error {
+	name, err := zdb2.ReadString(r)
+	if err != nil {
+		return err
+	}
+	var numSchemas uint16
+	err = binary.Read(r, zdb2.ByteOrder, &numSchemas)
+	if err != nil {
+		return err
+	}
+	if numSchemas == 0 {
+		return errors.New("Heap file doesn't have a schema")
+	}
+	schemas := make([]*schema, numSchemas)
+	for i := range schemas {
+		schemas[i], err = readSchema(r)
+		if err != nil {
+			return err
+		}
+	}
+	h.setSchemas(name, schemas)
+	return nil
+}
+
+// Writes h to the header block, allocating it if the file is empty.
+//
+// Precondition: a transaction is active
+func writeFileHeader(bf *wal.File, h *fileHeader) error {
+	b, err := h.encode()
+	if err != nil {
+		return err
+	}
+	var frame *buffer_pool.Frame
+	before := make([]byte, pageSize)
+	if bf.NumBlocks == 0 {
+		// The block starts out zeroed.
+		frame, err = bf.Allocate()
+	} else {
+		frame, err = bf.Pin(headerBlockID)
+		if err == nil {
+			copy(before, frame.Data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	copy(frame.Data, b)
+	// Clear whatever was left over from a longer table header.
+	for i := len(b); i < pageLSNOffset; i++ {
+		frame.Data[i] = 0
+	}
+	err = bf.LogUpdate(frame, before)
+	if err != nil {
+		bf.Unpin(frame, false)
+		return err
+	}
+	bf.Unpin(frame, true)
+	return nil
+}
+
+// Reads the header of a heap file.  Heap files in the original layout don't
+// have a header block (see original_layout.go).
+func readFileHeader(bf *wal.File) (*fileHeader, error) {
+	if bf.NumBlocks == 0 {
+		return nil, errors.New("Cannot read header of empty heap file")
+	}
+	frame, err := bf.Pin(headerBlockID)
+	if err != nil {
+		return nil, err
+	}
+	defer bf.Unpin(frame, false)
+	r := bytes.NewReader(frame.Data)
+	var magic uint32
+	err = binary.Read(r, zdb2.ByteOrder, &magic)
+	if err != nil {
+		return nil, err
+	}
+	if magic != heapFileMagic {
+		if isOriginalLayout(frame.Data) {
+			return nil, errOriginalLayout
+		}
+		return nil, errors.New("Heap file doesn't have a header block")
+	}
+	h := &fileHeader{}
+	var size uint32
+	var schemaVersion uint32
+	var flags byte
+	for _, value := range []interface{}{
+		&h.formatVersion,
+		&size,
+		&schemaVersion,
+		&h.numRecords,
+		&flags,
+	} {
+		err = binary.Read(r, zdb2.ByteOrder, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.formatVersion != currentFormatVersion {
+		return nil, errors.Newf(
+			"Unsupported heap file format version %d",
+			h.formatVersion)
+	}
+	if size != pageSize {
+		return nil, errors.Newf(
+			"Expected page size %d; got %d",
+			pageSize,
+			size)
+	}
+	h.dirty = flags&headerFlag_Dirty != 0
+	err = h.decodeSchemas(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.schemaVersion != schemaVersion {
+		return nil, errors.Newf(
+			"Expected schema version %d; got %d",
+			schemaVersion,
+			h.schemaVersion)
+	}
+	return h, nil
+}
+
+// Returns whether a version counts towards fileHeader.numRecords.
+func isCountedVersion(vh versionHeader) bool {
+	return !vh.dead && !vh.forwarded && vh.xmax != mvcc.FrozenTxnID
+}
+
+// Counts the record versions in the heap file, for when the saved record count
+// can't be trusted.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) countRecords() (int64, error) {
+	var n int64
+	for pageID := hf.header.firstHeapPageID(); ; pageID++ {
+		if pageID > hf.lastPage.pageID {
+			return n, nil
+		} else if hf.header.isFreeSpaceMapPage(pageID) {
+			continue
+		}
+		hp, err := hf.loadPage(pageID)
+		if err != nil {
+			return 0, err
+		}
+		for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+			vh, err := hp.getVersionHeader(slotID)
+			if err != nil {
+				hf.releasePage(hp, false)
+				return 0, err
+			}
+			if isCountedVersion(vh) {
+				n++
+			}
+		}
+		hf.releasePage(hp, false)
+	}
+}
+
+// Sets the dirty flag in the header block before the heap file is first
+// modified, so that the record count is recomputed if the heap file isn't
+// closed cleanly.
+//
+// Precondition: hf.mu is held, and no transaction is active
+func (hf *heapFile) markDirty() error {
+	if hf.header.dirty {
+		return nil
+	}
+	hf.header.dirty = true
+	err := hf.saveFileHeader()
+	if err != nil {
+		hf.header.dirty = false
+	}
+	return err
+}
+
+// Writes the header block as a separate transaction.
+//
+// Precondition: hf.mu is held, and no transaction is active
+func (hf *heapFile) saveFileHeader() error {
+	err := hf.bf.Begin()
+	if err != nil {
+		return err
+	}
+	err = writeFileHeader(hf.bf, hf.header)
+	if err != nil {
+		hf.bf.Abort()
+		return err
+	}
+	return hf.bf.Commit()
+}
+
+// NumRecords returns the number of records in the heap file.  Record versions
+// created via the mvcc methods are counted until they're deleted and vacuumed.
+func (hf *heapFile) NumRecords() int64 {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.header.numRecords
+}
+
+// SchemaVersion returns the latest version of the heap file's schema, which
+// starts at 1 and is incremented whenever a column is added or dropped.
+func (hf *heapFile) SchemaVersion() uint32 {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.header.schemaVersion
+}
+
+// FormatVersion returns the version of the heap file's on-disk format.
+func (hf *heapFile) FormatVersion() uint32 {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.header.formatVersion
+}
@@ -0,0 +1,70 @@
+package heap_file
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+func (s *HeapFileSuite) TestFileHeader(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	c.Assert(hf.FormatVersion(), Equals, currentFormatVersion)
+	c.Assert(hf.SchemaVersion(), Equals, uint32(1))
+	var recordIDs []zdb2.RecordID
+	for i := 0; i < 10; i++ {
+		recordID, err := hf.Insert(records[i%len(records)])
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	for _, recordID := range recordIDs[:3] {
+		c.Assert(hf.Delete(recordID), IsNil)
+	}
+	// Deletes are idempotent, so the record shouldn't be counted twice.
+	c.Assert(hf.Delete(recordIDs[0]), IsNil)
+	c.Assert(hf.NumRecords(), Equals, int64(7))
+	c.Assert(hf.Close(), IsNil)
+
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.header.dirty, IsFalse)
+	c.Assert(hf.NumRecords(), Equals, int64(7))
+	c.Assert(hf.TableHeader(), DeepEquals, t)
+	// Records are stored right after each heap page's schema version.
+	c.Assert(recordIDs[0].PageID, Equals, int32(2))
+	hp, err := hf.loadPage(recordIDs[0].PageID)
+	c.Assert(err, IsNil)
+	c.Assert(hp.schemaVersion(), Equals, uint32(1))
+	c.Assert(hp.recordOffset(0), Equals, uint16(pageSchemaVersionWidth))
+	hf.releasePage(hp, false)
+	c.Assert(hf.Close(), IsNil)
+
+	// The heap file must be in the current format, and match our page size.
+	for _, offset := range []int{4, 8} {
+		bf, err := wal.OpenFile(path, pageSize, pageLSNOffset)
+		c.Assert(err, IsNil)
+		frame, err := bf.Pin(headerBlockID)
+		c.Assert(err, IsNil)
+		b := frame.Data[offset : offset+4]
+		value := zdb2.ByteOrder.Uint32(b)
+		zdb2.ByteOrder.PutUint32(b, value+1)
+		bf.Unpin(frame, true)
+		c.Assert(bf.Close(), IsNil)
+		_, err = OpenHeapFile(path)
+		c.Assert(err, NotNil)
+
+		bf, err = wal.OpenFile(path, pageSize, pageLSNOffset)
+		c.Assert(err, IsNil)
+		frame, err = bf.Pin(headerBlockID)
+		c.Assert(err, IsNil)
+		zdb2.ByteOrder.PutUint32(frame.Data[offset:offset+4], value)
+		bf.Unpin(frame, true)
+		c.Assert(bf.Close(), IsNil)
+	}
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.Close(), IsNil)
+}
@@ -5,7 +5,8 @@ import (
 
 	"github.com/dropbox/godropbox/errors"
 	"github.com/robot-dreams/zdb2"
-	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/mvcc"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
 type result struct {
@@ -15,42 +16,69 @@ type result struct {
 }
 
 type fileScan struct {
-	bf         *block_file.BlockFile
-	t          *zdb2.TableHeader
+	bf         *wal.File
+	header     *fileHeader
+	snapshot   *mvcc.Snapshot
 	resultChan chan *result
 	closed     bool
 	done       chan struct{}
+
+	// Closed when the scan goroutine exits (and no longer has a page pinned).
+	finished chan struct{}
 }
 
-var _ zdb2.Iterator = (*fileScan)(nil)
+var _ zdb2.RecordIterator = (*fileScan)(nil)
 
 func NewFileScan(path string) (*fileScan, error) {
-	bf, err := block_file.OpenBlockFile(path, pageSize)
+	return NewFileScanSnapshot(path, nil)
+}
+
+// NewFileScanSnapshot returns a scan over every record version that's visible
+// to the given snapshot (or every record that hasn't been deleted, if the
+// snapshot is nil).
+func NewFileScanSnapshot(
+	path string,
+	snapshot *mvcc.Snapshot,
+) (*fileScan, error) {
+	err := finishRewrite(path)
+	if err != nil {
+		return nil, err
+	}
+	bf, err := wal.OpenFile(path, pageSize, pageLSNOffset)
 	if err != nil {
 		return nil, err
 	}
 	if bf.NumBlocks == 0 {
+		bf.Close()
 		return nil, errors.Newf("%v is not a valid heap file", path)
 	}
-	hp, err := loadHeapPage(bf, 0)
+	header, err := readFileHeader(bf)
 	if err != nil {
+		bf.Close()
 		return nil, err
 	}
 	s := &fileScan{
 		bf:         bf,
-		t:          hp.t,
+		header:     header,
+		snapshot:   snapshot,
 		resultChan: make(chan *result),
 		closed:     false,
 		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
 	}
 	go s.startScan()
 	return s, nil
 }
 
 func (s *fileScan) startScan() {
+	defer close(s.finished)
 	defer close(s.resultChan)
-	for pageID := int32(0); pageID < s.bf.NumBlocks; pageID++ {
-		hp, err := loadHeapPage(s.bf, pageID)
+	h := s.header
+	for pageID := h.firstHeapPageID(); pageID < s.bf.NumBlocks; pageID++ {
+		if h.isFreeSpaceMapPage(pageID) {
+			continue
+		}
+		hp, err := loadHeapPage(s.bf, pageID, h)
 		if err != nil {
 			select {
 			case <-s.done:
@@ -58,35 +86,55 @@ func (s *fileScan) startScan() {
 			}
 			return
 		}
-		numSlots := hp.getNumSlots()
-		for slotID := uint16(0); slotID < numSlots; slotID++ {
-			record, err := hp.get(slotID)
-			if err != nil {
-				select {
-				case <-s.done:
-				case s.resultChan <- &result{nil, zdb2.RecordID{}, err}:
-				}
-				return
-			}
-			// Records marked as deleted shouldn't be returned.
-			if record == nil {
-				continue
-			}
-			recordID := zdb2.RecordID{
-				PageID: pageID,
-				SlotID: slotID,
-			}
+		ok := s.scanPage(hp)
+		hp.release(false)
+		if !ok {
+			return
+		}
+	}
+}
+
+// Sends every live record in hp to s.resultChan; returns false if the scan
+// should stop.
+func (s *fileScan) scanPage(hp *heapPage) bool {
+	pageID := hp.pageID
+	numSlots := hp.getNumSlots()
+	for slotID := uint16(0); slotID < numSlots; slotID++ {
+		record, err := hp.getForScan(
+			slotID,
+			s.snapshot,
+			func(pageID int32) (*heapPage, error) {
+				return loadHeapPage(s.bf, pageID, s.header)
+			},
+			func(hp *heapPage) {
+				hp.release(false)
+			})
+		if err != nil {
 			select {
 			case <-s.done:
-				return
-			case s.resultChan <- &result{record, recordID, nil}:
+			case s.resultChan <- &result{nil, zdb2.RecordID{}, err}:
 			}
+			return false
+		}
+		// Records marked as deleted shouldn't be returned.
+		if record == nil {
+			continue
+		}
+		recordID := zdb2.RecordID{
+			PageID: pageID,
+			SlotID: slotID,
+		}
+		select {
+		case <-s.done:
+			return false
+		case s.resultChan <- &result{record, recordID, nil}:
 		}
 	}
+	return true
 }
 
 func (s *fileScan) TableHeader() *zdb2.TableHeader {
-	return s.t
+	return s.header.t
 }
 
 func (s *fileScan) Next() (zdb2.Record, error) {
@@ -118,5 +166,6 @@ func (s *fileScan) Close() error {
 		s.closed = true
 	}()
 	close(s.done)
+	<-s.finished
 	return s.bf.Close()
 }
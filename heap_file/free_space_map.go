@@ -0,0 +1,159 @@
+package heap_file
+
+import (
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// A heap file keeps track of the space available in each of its pages (after
+// compaction) in a free space map, so that inserts can reuse the space left
+// behind by deletes.  The free space map is stored in the heap file itself,
+// starting right after the header block: page 1 is a free space map page
+// covering pages [2, N + 1], page N + 2 covers pages [N + 3, 2N + 2], and so on.
+//
+// Entries only need to be approximate, since inserts check the actual free
+// space before using a page (and fix the page's entry if it was too high).  In
+// particular, the entry for the last page isn't updated as records are
+// appended to it.  Pages that have been freed (see overflow.go) have the entry
+// freePageEntry, which is more than any heap page can have available.
+
+// Returns whether the given page belongs to the free space map (rather than
+// storing records).
+func (h *fileHeader) isFreeSpaceMapPage(pageID int32) bool {
+	i := pageID - h.firstFreeSpaceMapPageID()
+	return i >= 0 && i%freeSpaceMapGroupSize == 0
+}
+
+// Returns the free space map page that covers the given heap page, and the
+// offset of the page's entry within it.
+//
+// Precondition: pageID isn't a free space map page
+func (h *fileHeader) freeSpaceMapLocation(pageID int32) (int32, int) {
+	i := pageID - h.firstFreeSpaceMapPageID()
+	fsmPageID := pageID - i%freeSpaceMapGroupSize
+	return fsmPageID, int(pageID-fsmPageID-1) * freeSpaceMapEntryWidth
+}
+
+func getFreeSpaceMapEntry(frame *buffer_pool.Frame, i int) int {
+	return int(zdb2.ByteOrder.Uint16(frame.Data[i : i+freeSpaceMapEntryWidth]))
+}
+
+// Records the number of bytes available in the given page.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) setFreeSpace(pageID int32, numBytes int) error {
+	return hf.updateFreeSpace(pageID, func(int) int {
+		return numBytes
+	})
+}
+
+// Adjusts the number of bytes available in the given page by delta.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) addFreeSpace(pageID int32, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	return hf.updateFreeSpace(pageID, func(numBytes int) int {
+		return numBytes + delta
+	})
+}
+
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) updateFreeSpace(pageID int32, f func(int) int) error {
+	fsmPageID, i := hf.header.freeSpaceMapLocation(pageID)
+	frame, err := hf.bf.Pin(fsmPageID)
+	if err != nil {
+		return err
+	}
+	oldEntry := getFreeSpaceMapEntry(frame, i)
+	entry := f(oldEntry)
+	if entry < 0 {
+		entry = 0
+	} else if entry > pageSize-1 {
+		entry = pageSize - 1
+	}
+	if entry == oldEntry {
+		hf.bf.Unpin(frame, false)
+		return nil
+	}
+	var before []byte
+	if hf.bf.Logging() {
+		before = make([]byte, len(frame.Data))
+		copy(before, frame.Data)
+	}
+	zdb2.ByteOrder.PutUint16(
+		frame.Data[i:i+freeSpaceMapEntryWidth],
+		uint16(entry))
+	if before != nil {
+		err = hf.bf.LogUpdate(frame, before)
+		if err != nil {
+			hf.bf.Unpin(frame, false)
+			return err
+		}
+	}
+	hf.bf.Unpin(frame, true)
+	return nil
+}
+
+// Returns the first page that the free space map says has at least numBytes
+// available, or false if there isn't one.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) findFreeSpace(numBytes int) (int32, bool, error) {
+	return hf.findFreeSpaceFrom(
+		hf.header.firstHeapPageID(),
+		hf.lastPage.pageID,
+		numBytes)
+}
+
+// Like findFreeSpace, but only pages in [firstPageID, lastPageID] are
+// considered.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) findFreeSpaceFrom(
+	firstPageID int32,
+	lastPageID int32,
+	numBytes int,
+) (int32, bool, error) {
+	for pageID := firstPageID; pageID <= lastPageID; {
+		if hf.header.isFreeSpaceMapPage(pageID) {
+			pageID++
+			continue
+		}
+		fsmPageID, _ := hf.header.freeSpaceMapLocation(pageID)
+		frame, err := hf.bf.Pin(fsmPageID)
+		if err != nil {
+			return 0, false, err
+		}
+		for ; pageID <= lastPageID; pageID++ {
+			if hf.header.isFreeSpaceMapPage(pageID) {
+				break
+			}
+			_, i := hf.header.freeSpaceMapLocation(pageID)
+			if getFreeSpaceMapEntry(frame, i) >= numBytes {
+				hf.bf.Unpin(frame, false)
+				return pageID, true, nil
+			}
+		}
+		hf.bf.Unpin(frame, false)
+	}
+	return 0, false, nil
+}
+
+// Allocates a new page, along with a new free space map page if the current
+// one is full.
+//
+// Precondition: a transaction is active
+func allocatePage(bf *wal.File, h *fileHeader) (*buffer_pool.Frame, error) {
+	if h.isFreeSpaceMapPage(bf.NumBlocks) {
+		// Free space map pages start out zeroed, so there's nothing to log.
+		frame, err := bf.Allocate()
+		if err != nil {
+			return nil, err
+		}
+		bf.Unpin(frame, true)
+	}
+	return bf.Allocate()
+}
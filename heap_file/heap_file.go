@@ -2,38 +2,97 @@ package heap_file
 
 import (
 	"io"
+	"sync"
 
 	"github.com/dropbox/godropbox/errors"
 	"github.com/robot-dreams/zdb2"
-	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/mvcc"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
+// Every Insert and Delete is a separate transaction in the write-ahead log, so
+// once it returns, the change will survive a crash.
+//
+// The space used by deleted records is reclaimed by later inserts (see
+// free_space_map.go), without changing the RecordIDs of other records.  Once a
+// deleted record's space has been reclaimed, its RecordID can be reused for a
+// new record, so any references to it (e.g. index entries) have to be removed
+// first; indexes registered via AttachIndex are taken care of automatically.
+//
+// A heapFile can be shared by multiple goroutines; each method call is atomic,
+// but isolation between longer sequences of calls is up to the caller.  There
+// are two options:
+//
+//   - Insert, Delete, Get and Scan ignore transactions; records are visible as
+//     soon as they're inserted, and hidden as soon as they're deleted.  These
+//     can be combined with locking (see the txn_mgr package).
+//   - InsertTxn, DeleteTxn, UpdateTxn, GetSnapshot and ScanSnapshot implement
+//     multi-version concurrency control (see the mvcc package).
+//
+// The two options shouldn't be mixed within a single heap file, except that
+// records inserted via Insert are visible to every snapshot.
 type heapFile struct {
-	bf *block_file.BlockFile
+	mu   sync.Mutex
+	path string
+	bf   *wal.File
 
-	// Caching the last page lets us look up the TableHeader and perform bulk
-	// inserts more efficiently.
+	header *fileHeader
+
+	indexes []attachedIndex
+
+	// The number of heap pages that use each version of the schema, or nil if
+	// they haven't been counted yet (see countPageVersions).
+	pageVersions map[uint32]int
+
+	// Only set for heap files in the original layout, which are read-only (and
+	// don't have a bf or lastPage).
+	original *originalFile
+
+	// Caching the last page lets us perform bulk inserts more efficiently.  The
+	// last page stays pinned until the heap file is closed.
 	lastPage *heapPage
 
 	closed bool
 }
 
 func NewHeapFile(path string, t *zdb2.TableHeader) (*heapFile, error) {
-	bf, err := block_file.OpenBlockFile(path, pageSize)
+	header := &fileHeader{formatVersion: currentFormatVersion}
+	header.setSchemas(t.Name, []*schema{newSchema(t)})
+	return newHeapFile(path, header)
+}
+
+// Creates an empty heap file with the given header.
+func newHeapFile(path string, header *fileHeader) (*heapFile, error) {
+	bf, err := wal.OpenFile(path, pageSize, pageLSNOffset)
 	if err != nil {
 		return nil, err
 	}
 	if bf.NumBlocks > 0 {
+		bf.Close()
 		return nil, errors.Newf(
 			"Cannot create new heap file at non-empty file %v",
 			path)
 	}
-	hp, err := newHeapPage(bf, t)
+	err = bf.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileHeader(bf, header)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := newHeapPage(bf, header)
+	if err != nil {
+		return nil, err
+	}
+	err = bf.Commit()
 	if err != nil {
 		return nil, err
 	}
 	return &heapFile{
+		path:     path,
 		bf:       bf,
+		header:   header,
 		lastPage: hp,
 		closed:   false,
 	}, nil
@@ -47,6 +106,12 @@ func BulkLoadNewHeapFile(
 	if err != nil {
 		return err
 	}
+	// Logging every insert would be wasteful, since there's nothing to recover
+	// if the bulk load doesn't finish.  The file is made durable by Close.
+	err = hf.bf.SetLogging(false)
+	if err != nil {
+		return err
+	}
 	for {
 		record, err := iter.Next()
 		if err == io.EOF {
@@ -62,56 +127,368 @@ func BulkLoadNewHeapFile(
 }
 
 func OpenHeapFile(path string) (*heapFile, error) {
-	bf, err := block_file.OpenBlockFile(path, pageSize)
+	err := finishRewrite(path)
+	if err != nil {
+		return nil, err
+	}
+	original, err := isOriginalHeapFile(path)
+	if err != nil {
+		return nil, err
+	} else if original {
+		return openOriginalHeapFile(path)
+	}
+	bf, err := wal.OpenFile(path, pageSize, pageLSNOffset)
 	if err != nil {
 		return nil, err
 	}
 	if bf.NumBlocks == 0 {
+		bf.Close()
 		return nil, errors.Newf(
 			"Cannot open heap file from empty file at %v",
 			path)
 	}
-	hp, err := loadHeapPage(bf, bf.NumBlocks-1)
+	header, err := readFileHeader(bf)
 	if err != nil {
+		bf.Close()
 		return nil, err
 	}
-	return &heapFile{
+	hp, err := loadLastPage(bf, header)
+	if err != nil {
+		bf.Close()
+		return nil, err
+	}
+	hf := &heapFile{
+		path:     path,
 		bf:       bf,
+		header:   header,
 		lastPage: hp,
 		closed:   false,
-	}, nil
+	}
+	// The record count might be out of date if the heap file wasn't closed
+	// cleanly.
+	if header.dirty {
+		header.numRecords, err = hf.countRecords()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hf, nil
+}
+
+// Returns the last heap page, which isn't necessarily the last page in the file
+// (since overflow pages, and free space map pages, can be allocated after it,
+// and overflow pages can be freed).  The first heap page is allocated along
+// with the file, so there's always one.
+func loadLastPage(bf *wal.File, h *fileHeader) (*heapPage, error) {
+	pageID := bf.NumBlocks - 1
+	for ; pageID > h.firstHeapPageID(); pageID-- {
+		if h.isFreeSpaceMapPage(pageID) {
+			continue
+		}
+		hp, err := loadHeapPage(bf, pageID, h)
+		if err != nil {
+			return nil, err
+		}
+		if hp.usesSchema() {
+			return hp, nil
+		}
+		hp.release(false)
+	}
+	return loadHeapPage(bf, pageID, h)
+}
+
+// Returns a page to replace the last page: a page after it that was freed by
+// freeOverflowChain, if there is one, or a new page otherwise.  (Freed pages
+// before the last page are reused by insert, via the free space map.)
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) newLastPage() (*heapPage, error) {
+	frame, ok, err := hf.reuseFreePage(hf.lastPage.pageID + 1)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return newHeapPage(hf.bf, hf.header)
+	}
+	hp := &heapPage{
+		bf:     hf.bf,
+		frame:  frame,
+		pageID: frame.BlockID(),
+		header: hf.header,
+		data:   frame.Data,
+	}
+	before := hp.snapshot()
+	hp.initialize()
+	err = hp.logUpdate(before)
+	if err != nil {
+		hp.release(false)
+		return nil, err
+	}
+	return hp, nil
+}
+
+func (hf *heapFile) Path() string {
+	return hf.path
 }
 
 func (hf *heapFile) TableHeader() *zdb2.TableHeader {
-	return hf.lastPage.t
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.header.t
+}
+
+// Runs f as a single transaction, which is rolled back if f fails.
+func (hf *heapFile) runTxn(f func() error) error {
+	err := hf.checkWritable()
+	if err != nil {
+		return err
+	}
+	err = hf.markDirty()
+	if err != nil {
+		return err
+	}
+	err = hf.bf.Begin()
+	if err != nil {
+		return err
+	}
+	schemas := hf.header.schemas
+	err = f()
+	if err != nil {
+		// Changes made while logging is off (during a bulk load) can't be
+		// rolled back, but the original error is more useful in that case.
+		abortErr := hf.bf.Abort()
+		if abortErr != nil && hf.bf.Logging() {
+			return abortErr
+		}
+		// The rollback might have changed the values cached by the last page,
+		// and undone page upgrades (along with the schema versions that they
+		// dropped).
+		hf.lastPage.nextSlotOffset = hf.lastPage.getNextSlotOffset()
+		hf.lastPage.numSlots = hf.lastPage.getNumSlots()
+		hf.header.setSchemas(hf.header.t.Name, schemas)
+		hf.pageVersions = nil
+		return err
+	}
+	return hf.bf.Commit()
 }
 
 func (hf *heapFile) Insert(record zdb2.Record) (zdb2.RecordID, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.insertVersion(record, mvcc.FrozenTxnID)
+}
+
+// InsertLogged is like Insert, but logInsert is called with the new RecordID
+// before the insert is committed (and the insert is rolled back if logInsert
+// fails).  So once logInsert has been called, either the insert survives a
+// crash, or it's rolled back (in which case the RecordID is still free, and
+// HasRecordID might return false for it).
+func (hf *heapFile) InsertLogged(
+	record zdb2.Record,
+	logInsert func(zdb2.RecordID) error,
+) (zdb2.RecordID, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.insertVersionLogged(record, mvcc.FrozenTxnID, logInsert)
+}
+
+// Precondition: hf.mu is held
+func (hf *heapFile) insertVersion(
+	record zdb2.Record,
+	xmin mvcc.TxnID,
+) (zdb2.RecordID, error) {
+	return hf.insertVersionLogged(record, xmin, nil)
+}
+
+// Precondition: hf.mu is held
+func (hf *heapFile) insertVersionLogged(
+	record zdb2.Record,
+	xmin mvcc.TxnID,
+	logInsert func(zdb2.RecordID) error,
+) (zdb2.RecordID, error) {
+	var recordID zdb2.RecordID
+	err := hf.runTxn(func() error {
+		record, err := hf.toastRecord(record)
+		if err != nil {
+			return err
+		}
+		recordID, err = hf.insert(record, versionHeader{
+			xmin: xmin,
+			xmax: mvcc.InvalidTxnID,
+		})
+		if err != nil {
+			return err
+		}
+		if logInsert != nil {
+			return logInsert(recordID)
+		}
+		return nil
+	})
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	hf.header.numRecords++
+	return recordID, nil
+}
+
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) insert(
+	record zdb2.Record,
+	vh versionHeader,
+) (zdb2.RecordID, error) {
+	b, err := hf.lastPage.encodeVersion(record, vh)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+
+	// Appending to the last page is cheapest (especially for bulk loads), so we
+	// only look for space elsewhere once the last page is full.
+	slotID, ok, err := hf.insertLastPage(b)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	if ok {
+		return zdb2.RecordID{
+			PageID: hf.lastPage.pageID,
+			SlotID: slotID,
+		}, nil
+	}
+
+	needed := len(b) + lookupTableEntryWidth
 	for {
-		ok, err := hf.lastPage.insert(record)
+		pageID, ok, err := hf.findFreeSpace(needed)
 		if err != nil {
 			return zdb2.RecordID{}, err
 		}
-		if ok {
-			return zdb2.RecordID{
-				PageID: hf.lastPage.pageID,
-				SlotID: hf.lastPage.numSlots - 1,
-			}, nil
+		if !ok {
+			break
 		}
-		err = hf.flush()
+		// If the record doesn't fit after all, then the page's entry in the
+		// free space map is corrected, so it won't be chosen again.
+		var inserted bool
+		err = hf.updatePageInTxn(pageID, func(hp *heapPage) error {
+			// A freed page is reused as a new heap page.
+			if isFreePage(hp.data) {
+				hp.initialize()
+				err := hf.setPageVersion(0)
+				if err != nil {
+					return err
+				}
+			}
+			current := hp.schemaVersion() == hf.header.schemaVersion
+			if current && int(hp.freeSpace()) >= needed {
+				before := int(hp.freeSpace())
+				slotID, inserted = hp.insertVersion(b, true)
+				return hf.addFreeSpace(pageID, int(hp.freeSpace())-before)
+			}
+			// Compacting (or upgrading) the page tells us exactly how much
+			// space is available.
+			err := hf.releaseReclaimedVersions(hp)
+			if err != nil {
+				return err
+			}
+			if current {
+				_, err := hp.compact()
+				if err != nil {
+					return err
+				}
+			} else {
+				ok, err := hf.upgradePage(hp)
+				if err != nil {
+					return err
+				}
+				// The page won't be chosen again until enough of its records
+				// are deleted.
+				if !ok {
+					return hf.setFreeSpace(pageID, 0)
+				}
+			}
+			slotID, inserted = hp.insertVersion(b, true)
+			return hf.setFreeSpace(pageID, int(hp.freeSpace()))
+		})
 		if err != nil {
 			return zdb2.RecordID{}, err
 		}
-		hp, err := newHeapPage(hf.bf, hf.lastPage.t)
+		if inserted {
+			return zdb2.RecordID{
+				PageID: pageID,
+				SlotID: slotID,
+			}, nil
+		}
+	}
+
+	// The old last page won't be appended to anymore, so its entry in the free
+	// space map needs to be accurate from now on.
+	numBytes, err := hf.lastPage.availableSpace()
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	err = hf.setFreeSpace(hf.lastPage.pageID, numBytes)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	hp, err := hf.newLastPage()
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	err = hf.setPageVersion(0)
+	if err != nil {
+		hp.release(false)
+		return zdb2.RecordID{}, err
+	}
+	hf.lastPage.release(true)
+	hf.lastPage = hp
+	slotID, ok, err = hf.insertLastPage(b)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	if !ok {
+		return zdb2.RecordID{}, errors.Newf(
+			"Record of size %d doesn't fit in an empty page",
+			len(b))
+	}
+	return zdb2.RecordID{
+		PageID: hf.lastPage.pageID,
+		SlotID: slotID,
+	}, nil
+}
+
+// Appends an encoded version to the last page, if there's room.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) insertLastPage(b []byte) (uint16, bool, error) {
+	if hf.lastPage.schemaVersion() != hf.header.schemaVersion {
+		err := hf.releaseReclaimedVersions(hf.lastPage)
 		if err != nil {
-			return zdb2.RecordID{}, err
+			return 0, false, err
 		}
-		hf.lastPage = hp
 	}
+	before := hf.lastPage.snapshot()
+	ok, err := hf.upgradePage(hf.lastPage)
+	if err != nil {
+		return 0, false, err
+	}
+	var slotID uint16
+	if ok {
+		slotID, ok = hf.lastPage.insertVersion(b, false)
+	}
+	// The page might have been upgraded even if the version didn't fit.
+	err = hf.lastPage.logUpdate(before)
+	if err != nil {
+		return 0, false, err
+	}
+	return slotID, ok, nil
 }
 
+// Every page returned by loadPage must be passed to releasePage.
 func (hf *heapFile) loadPage(pageID int32) (*heapPage, error) {
-	if pageID == hf.lastPage.pageID {
+	if hf.header.isFreeSpaceMapPage(pageID) {
+		return nil, errors.Newf(
+			"Invalid pageID %d belongs to the free space map",
+			pageID)
+	} else if pageID == hf.lastPage.pageID {
 		return hf.lastPage, nil
 	} else if pageID > hf.lastPage.pageID {
 		return nil, errors.Newf(
@@ -119,49 +496,368 @@ func (hf *heapFile) loadPage(pageID int32) (*heapPage, error) {
 			pageID,
 			hf.lastPage.pageID)
 	}
-	hp, err := loadHeapPage(hf.bf, pageID)
+	hp, err := loadHeapPage(hf.bf, pageID, hf.header)
 	if err != nil {
 		return nil, err
 	}
 	return hp, nil
 }
 
+func (hf *heapFile) releasePage(hp *heapPage, dirty bool) {
+	// The last page is released when the heap file is closed.
+	if hp != hf.lastPage {
+		hp.release(dirty)
+	}
+}
+
 func (hf *heapFile) Delete(recordID zdb2.RecordID) error {
+	return hf.DeleteAll([]zdb2.RecordID{recordID})
+}
+
+// DeleteAll deletes the given records as a single transaction, so either all of
+// them are deleted, or (after an error or a crash) none of them are.
+func (hf *heapFile) DeleteAll(recordIDs []zdb2.RecordID) error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	numCounted := 0
+	err := hf.runTxn(func() error {
+		for _, recordID := range recordIDs {
+			location, err := hf.resolve(recordID)
+			if err != nil {
+				return err
+			}
+			// A moved record's forwarding pointer is kept (until Vacuum
+			// removes it), so that the record can still be undeleted.
+			err = hf.updateVersionHeader(location, func(
+				vh versionHeader,
+			) (versionHeader, error) {
+				if isCountedVersion(vh) {
+					numCounted++
+				}
+				// Deletes are idempotent.
+				if !vh.dead {
+					vh.xmax = mvcc.FrozenTxnID
+				}
+				return vh, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	hf.header.numRecords -= int64(numCounted)
+	return nil
+}
+
+// Undelete restores a record that was deleted via Delete, which is only
+// possible until the record's space has been reclaimed.
+func (hf *heapFile) Undelete(recordID zdb2.RecordID) error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	restored := false
+	err := hf.runTxn(func() error {
+		location, err := hf.resolve(recordID)
+		if err != nil {
+			return err
+		}
+		return hf.updateVersionHeader(location, func(
+			vh versionHeader,
+		) (versionHeader, error) {
+			if vh.dead {
+				return vh, errors.Newf(
+					"Cannot undelete record %+v, since its space has been "+
+						"reclaimed",
+					recordID)
+			}
+			if vh.xmax == mvcc.FrozenTxnID {
+				vh.xmax = mvcc.InvalidTxnID
+				restored = true
+			}
+			return vh, nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if restored {
+		hf.header.numRecords++
+	}
+	return nil
+}
+
+// Replaces the header of the version with the given location by the result of
+// f (unless it's unchanged), and updates the free space map to account for any
+// space that can now be reclaimed (or that's needed again).
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) updateVersionHeader(
+	location zdb2.RecordID,
+	f func(versionHeader) (versionHeader, error),
+) error {
+	var freed int
+	err := hf.updatePageInTxn(location.PageID, func(hp *heapPage) error {
+		vh, err := hp.getVersionHeader(location.SlotID)
+		if err != nil {
+			return err
+		}
+		newVH, err := f(vh)
+		if err != nil || newVH == vh {
+			return err
+		}
+		i, j, err := hp.versionBounds(location.SlotID)
+		if err != nil {
+			return err
+		}
+		freed = compactedSize(vh, j-i) - compactedSize(newVH, j-i)
+		return hp.setVersionHeader(location.SlotID, newVH)
+	})
+	if err != nil {
+		return err
+	}
+	return hf.addFreeSpace(location.PageID, freed)
+}
+
+// Update replaces a record without changing its RecordID.  If the new record
+// fits in the old record's page, then it's overwritten in place; otherwise, the
+// record is moved to a new slot, and its original slot is forwarded to the new
+// slot.  Either way, the update is a single transaction.
+func (hf *heapFile) Update(recordID zdb2.RecordID, record zdb2.Record) error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.runTxn(func() error {
+		record, err := hf.toastRecord(record)
+		if err != nil {
+			return err
+		}
+		location, err := hf.resolve(recordID)
+		if err != nil {
+			return err
+		}
+		var vh versionHeader
+		var old zdb2.Record
+		var ok bool
+		var upgraded bool
+		var freed int
+		err = hf.updatePageInTxn(location.PageID, func(hp *heapPage) error {
+			vh, err = hp.getVersionHeader(location.SlotID)
+			if err != nil {
+				return err
+			}
+			if vh.dead {
+				return errors.Newf("Cannot update dead record %+v", recordID)
+			}
+			if vh.toasted {
+				old, err = hp.readRecord(location.SlotID)
+				if err != nil {
+					return err
+				}
+			}
+			// The record can only be overwritten under the latest schema.
+			upgraded = hp.schemaVersion() != hf.header.schemaVersion
+			if upgraded {
+				err = hf.releaseReclaimedVersions(hp)
+				if err != nil {
+					return err
+				}
+			}
+			ok, err = hf.upgradePage(hp)
+			if err != nil || !ok {
+				return err
+			}
+			before := int(hp.freeSpace())
+			ok, err = hp.overwrite(location.SlotID, record)
+			freed = int(hp.freeSpace()) - before
+			if err != nil || !upgraded {
+				return err
+			}
+			// Upgrading the page compacted it, so the free space is exact.
+			return hf.setFreeSpace(location.PageID, int(hp.freeSpace()))
+		})
+		if err != nil {
+			return err
+		}
+		// The old version's overflow pages aren't needed anymore, whether it
+		// was overwritten or is about to be moved.
+		err = hf.freeOverflowChains(old)
+		if err != nil {
+			return err
+		}
+		if ok && !upgraded {
+			return hf.addFreeSpace(location.PageID, freed)
+		} else if ok {
+			return nil
+		}
+
+		vh.moved = true
+		newLocation, err := hf.insert(record, vh)
+		if err != nil {
+			return err
+		}
+		// Only the original slot ever forwards, so there's at most one hop.
+		if location != recordID {
+			err = hf.updateVersionHeader(location, func(
+				versionHeader,
+			) (versionHeader, error) {
+				return versionHeader{dead: true}, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return hf.updateVersionHeader(recordID, func(
+			versionHeader,
+		) (versionHeader, error) {
+			return versionHeader{
+				forwarded: true,
+				forwardTo: newLocation,
+			}, nil
+		})
+	})
+}
+
+// Returns the location where the record with the given RecordID is actually
+// stored, which is different if the record has been moved by Update.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) resolve(recordID zdb2.RecordID) (zdb2.RecordID, error) {
 	hp, err := hf.loadPage(recordID.PageID)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	defer hf.releasePage(hp, false)
+	vh, err := hp.getVersionHeader(recordID.SlotID)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	if vh.forwarded {
+		return vh.forwardTo, nil
+	}
+	return recordID, nil
+}
+
+// Applies f to the given page as a single transaction.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) updatePage(pageID int32, f func(*heapPage) error) error {
+	return hf.runTxn(func() error {
+		return hf.updatePageInTxn(pageID, f)
+	})
+}
+
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) updatePageInTxn(
+	pageID int32,
+	f func(*heapPage) error,
+) error {
+	hp, err := hf.loadPage(pageID)
 	if err != nil {
 		return err
 	}
-	err = hp.delete(recordID.SlotID)
+	before := hp.snapshot()
+	err = f(hp)
+	if err == nil {
+		err = hp.logUpdate(before)
+	}
 	if err != nil {
+		hf.releasePage(hp, false)
 		return err
 	}
-	// TODO: Can we switch to a lazier flush strategy?
-	return hf.bf.WriteBlock(hp.data[:], hp.pageID)
+	hf.releasePage(hp, true)
+	return nil
 }
 
-func (hf *heapFile) Get(recordID zdb2.RecordID) (zdb2.Record, error) {
+// HasRecordID returns whether the RecordID refers to a slot in the heap file,
+// whether or not the slot holds a record.
+func (hf *heapFile) HasRecordID(recordID zdb2.RecordID) (bool, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	if hf.original != nil {
+		return hf.original.hasRecordID(recordID)
+	}
+	if hf.header.isFreeSpaceMapPage(recordID.PageID) ||
+		recordID.PageID < hf.header.firstHeapPageID() ||
+		recordID.PageID > hf.lastPage.pageID {
+		return false, nil
+	}
 	hp, err := hf.loadPage(recordID.PageID)
+	if err != nil {
+		return false, err
+	}
+	defer hf.releasePage(hp, false)
+	return recordID.SlotID < hp.numSlots, nil
+}
+
+func (hf *heapFile) Get(recordID zdb2.RecordID) (zdb2.Record, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	if hf.original != nil {
+		return hf.original.get(recordID)
+	}
+	location, err := hf.resolve(recordID)
 	if err != nil {
 		return nil, err
 	}
-	return hp.get(recordID.SlotID)
+	hp, err := hf.loadPage(location.PageID)
+	if err != nil {
+		return nil, err
+	}
+	defer hf.releasePage(hp, false)
+	return hp.get(location.SlotID)
 }
 
-func (hf *heapFile) flush() error {
+// Flush writes all pending changes to disk (so the log can be truncated).
+func (hf *heapFile) Flush() error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	// Heap files in the original layout are never modified.
+	if hf.original != nil {
+		return nil
+	}
 	hf.lastPage.flush()
-	return hf.bf.WriteBlock(hf.lastPage.data[:], hf.lastPage.pageID)
+	return hf.bf.Checkpoint()
 }
 
 func (hf *heapFile) Close() error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
 	if hf.closed {
 		return nil
+	} else if hf.original != nil {
+		hf.closed = true
+		return hf.original.bf.Close()
 	}
-	err := hf.flush()
+	// The record count is up to date now.
+	hf.header.dirty = false
+	err := hf.saveFileHeader()
 	if err != nil {
 		return err
 	}
+	hf.lastPage.release(true)
 	defer func() {
 		hf.closed = true
 	}()
 	return hf.bf.Close()
 }
+
+// AddChecksums converts a heap file created before block checksums were added,
+// so that corrupt pages are detected when they're read.  Unlike
+// RewriteHeapFile, RecordIDs don't change, so indexes on the heap file are
+// still valid.  The heap file can't be in use while this is running.
+func AddChecksums(path string) error {
+	err := finishRewrite(path)
+	if err != nil {
+		return err
+	}
+	return wal.AddChecksums(path, pageSize, pageLSNOffset)
+}
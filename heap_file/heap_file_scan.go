@@ -0,0 +1,93 @@
+package heap_file
+
+import (
+	"io"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+// A heapFileScan iterates over the live records of an open heap file.  Unlike
+// fileScan, it shares the heap file's pages (including any changes that haven't
+// been flushed yet), so it's safe to use while the heap file is being modified.
+type heapFileScan struct {
+	hf     *heapFile
+	pageID int32
+	slotID uint16
+
+	// If nil, then every record that hasn't been deleted is returned.
+	snapshot *mvcc.Snapshot
+}
+
+var _ zdb2.RecordIterator = (*heapFileScan)(nil)
+
+// Scan returns an iterator over every record in the heap file that hasn't been
+// deleted.  Records inserted after the scan starts may or may not be returned.
+func (hf *heapFile) Scan() zdb2.RecordIterator {
+	if hf.original != nil {
+		return hf.original.scan()
+	}
+	return &heapFileScan{
+		hf:     hf,
+		pageID: hf.header.firstHeapPageID(),
+	}
+}
+
+func (s *heapFileScan) TableHeader() *zdb2.TableHeader {
+	return s.hf.TableHeader()
+}
+
+func (s *heapFileScan) Next() (zdb2.Record, error) {
+	record, _, err := s.NextWithID()
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *heapFileScan) NextWithID() (zdb2.Record, zdb2.RecordID, error) {
+	s.hf.mu.Lock()
+	defer s.hf.mu.Unlock()
+
+	for s.pageID <= s.hf.lastPage.pageID {
+		if s.hf.header.isFreeSpaceMapPage(s.pageID) {
+			s.pageID++
+			continue
+		}
+		hp, err := s.hf.loadPage(s.pageID)
+		if err != nil {
+			return nil, zdb2.RecordID{}, err
+		}
+		for s.slotID < hp.numSlots {
+			recordID := zdb2.RecordID{
+				PageID: s.pageID,
+				SlotID: s.slotID,
+			}
+			record, err := hp.getForScan(
+				s.slotID,
+				s.snapshot,
+				s.hf.loadPage,
+				func(hp *heapPage) {
+					s.hf.releasePage(hp, false)
+				})
+			if err != nil {
+				s.hf.releasePage(hp, false)
+				return nil, zdb2.RecordID{}, err
+			}
+			s.slotID++
+			// Records marked as deleted shouldn't be returned.
+			if record != nil {
+				s.hf.releasePage(hp, false)
+				return record, recordID, nil
+			}
+		}
+		s.hf.releasePage(hp, false)
+		s.pageID++
+		s.slotID = 0
+	}
+	return nil, zdb2.RecordID{}, io.EOF
+}
+
+func (s *heapFileScan) Close() error {
+	return nil
+}
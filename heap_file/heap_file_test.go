@@ -1,11 +1,22 @@
 package heap_file
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
 	. "gopkg.in/check.v1"
 
+	"github.com/dropbox/godropbox/errors"
 	. "github.com/dropbox/godropbox/gocheck2"
 	"github.com/dropbox/godropbox/math2/rand2"
 	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+	"github.com/robot-dreams/zdb2/mvcc"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
 type HeapFileSuite struct{}
@@ -15,9 +26,9 @@ var _ = Suite(&HeapFileSuite{})
 var t = &zdb2.TableHeader{
 	Name: "movies",
 	Fields: []*zdb2.Field{
-		{"title", zdb2.String},
-		{"rating", zdb2.Float64},
-		{"views", zdb2.Int32},
+		{"title", zdb2.String, false, 0, 0},
+		{"rating", zdb2.Float64, false, 0, 0},
+		{"views", zdb2.Int32, false, 0, 0},
 	},
 }
 
@@ -48,7 +59,7 @@ func (s *HeapFileSuite) TestCreateAndOpen(c *C) {
 
 	hf, err = OpenHeapFile(path)
 	c.Assert(err, IsNil)
-	c.Assert(hf.lastPage.t, DeepEquals, t)
+	c.Assert(hf.TableHeader(), DeepEquals, t)
 	// Calling Close() multiple times is valid.
 	err = hf.Close()
 	c.Assert(err, IsNil)
@@ -74,7 +85,7 @@ func (s *HeapFileSuite) TestHeapFile(c *C) {
 	}
 
 	// Make sure we've added enough test data to check an "interesting" case.
-	c.Assert(hf.bf.NumBlocks > 2, IsTrue)
+	c.Assert(hf.bf.NumBlocks > 3, IsTrue)
 
 	// Make sure that some of the records we've added can be found.
 	start := rand2.Intn(len(recordIDs) - 10)
@@ -118,6 +129,10 @@ func (s *HeapFileSuite) TestHeapFile(c *C) {
 	})
 	c.Assert(err, NotNil)
 
+	// Scanning the open heap file should see the same records, including
+	// changes that haven't been flushed.
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+
 	// Flush all updates to disk.
 	err = hf.Close()
 	c.Assert(err, IsNil)
@@ -126,6 +141,263 @@ func (s *HeapFileSuite) TestHeapFile(c *C) {
 	heapFileScan, err := NewFileScan(path)
 	c.Assert(err, IsNil)
 	zdb2.CheckIterator(c, heapFileScan, expectedRecords)
+
+	// The record count wasn't saved, so it's recomputed.
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	c.Assert(hf.NumRecords(), Equals, int64(len(expectedRecords)))
+}
+
+func (s *HeapFileSuite) TestUpdate(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+
+	// Fill up more than one page (after the header block and the free space
+	// map page).
+	var expectedRecords []zdb2.Record
+	var recordIDs []zdb2.RecordID
+	for hf.bf.NumBlocks < 4 {
+		record := records[len(recordIDs)%len(records)]
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		expectedRecords = append(expectedRecords, record)
+		recordIDs = append(recordIDs, recordID)
+	}
+	checkRecords := func() {
+		for i, recordID := range recordIDs {
+			record, err := hf.Get(recordID)
+			c.Assert(err, IsNil)
+			c.Assert(record, DeepEquals, expectedRecords[i])
+		}
+		iter := hf.Scan().(*heapFileScan)
+		for i, recordID := range recordIDs {
+			record, actualRecordID, err := iter.NextWithID()
+			c.Assert(err, IsNil)
+			c.Assert(actualRecordID, Equals, recordID)
+			c.Assert(record, DeepEquals, expectedRecords[i])
+		}
+		_, err = iter.Next()
+		c.Assert(err, Equals, io.EOF)
+	}
+	update := func(i int, record zdb2.Record) {
+		c.Assert(hf.Update(recordIDs[i], record), IsNil)
+		expectedRecords[i] = record
+	}
+
+	// A record that doesn't grow is updated in place.
+	numSlots := hf.lastPage.numSlots
+	update(0, zdb2.Record{"Leon", 5.0, int32(10)})
+	checkRecords()
+	c.Assert(hf.lastPage.numSlots, Equals, numSlots)
+
+	// A record that grows is moved (since the first page is full)...
+	update(1, zdb2.Record{"Gattaca: The Director's Cut", 4.9, int32(11)})
+	checkRecords()
+	c.Assert(hf.lastPage.numSlots, Equals, numSlots+1)
+
+	// Since it was moved to the last slot, it can keep growing in place.
+	update(1, zdb2.Record{"Gattaca: The Director's Cut!", 4.9, int32(12)})
+	checkRecords()
+	c.Assert(hf.lastPage.numSlots, Equals, numSlots+1)
+
+	// Otherwise, it's moved again if it grows, but it's still updated in place
+	// if it fits in the slot that it was moved to.
+	recordID, err := hf.Insert(records[0])
+	c.Assert(err, IsNil)
+	expectedRecords = append(expectedRecords, records[0])
+	recordIDs = append(recordIDs, recordID)
+	update(1, zdb2.Record{
+		"Gattaca: The Director's Cut (Remastered)",
+		5.0,
+		int32(13),
+	})
+	checkRecords()
+	c.Assert(hf.lastPage.numSlots, Equals, numSlots+3)
+	update(1, zdb2.Record{"Gattaca", 5.0, int32(14)})
+	checkRecords()
+	c.Assert(hf.lastPage.numSlots, Equals, numSlots+3)
+
+	// Deletes also follow forwarding pointers.
+	c.Assert(hf.Delete(recordIDs[1]), IsNil)
+	record, err := hf.Get(recordIDs[1])
+	c.Assert(err, IsNil)
+	c.Assert(record, IsNil)
+	c.Assert(hf.Undelete(recordIDs[1]), IsNil)
+	checkRecords()
+
+	// Vacuuming reclaims the space left behind by moved records.
+	m, err := mvcc.OpenManager(c.MkDir() + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+	stats, err := hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	c.Assert(stats.NumBytesReclaimed > 0, IsTrue)
+	checkRecords()
+
+	// Moved records are only returned once by a file scan, too.
+	c.Assert(hf.Close(), IsNil)
+	heapFileScan, err := NewFileScan(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, heapFileScan, expectedRecords)
+
+	// The record count wasn't saved, so it's recomputed.
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	c.Assert(hf.NumRecords(), Equals, int64(len(expectedRecords)))
+}
+
+func (s *HeapFileSuite) TestUndelete(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	var recordIDs []zdb2.RecordID
+	for _, record := range records {
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	// Move the second record, so that it's forwarded.
+	c.Assert(hf.Update(recordIDs[1], zdb2.Record{
+		"Gattaca: The Director's Cut",
+		4.9,
+		int32(11),
+	}), IsNil)
+	location, err := hf.resolve(recordIDs[1])
+	c.Assert(err, IsNil)
+	c.Assert(location, Not(Equals), recordIDs[1])
+
+	// Deleted records can be undeleted until Vacuum runs.
+	c.Assert(hf.DeleteAll(recordIDs[:2]), IsNil)
+	c.Assert(hf.NumRecords(), Equals, int64(len(records)-2))
+	c.Assert(hf.Undelete(recordIDs[0]), IsNil)
+	c.Assert(hf.Undelete(recordIDs[0]), IsNil)
+	c.Assert(hf.NumRecords(), Equals, int64(len(records)-1))
+	record, err := hf.Get(recordIDs[0])
+	c.Assert(err, IsNil)
+	c.Assert(record, DeepEquals, records[0])
+
+	m, err := mvcc.OpenManager(c.MkDir() + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+	c.Assert(hf.Delete(recordIDs[0]), IsNil)
+	stats, err := hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	c.Assert(stats.NumVersionsReclaimed, Equals, 1)
+	for _, recordID := range recordIDs[:2] {
+		c.Assert(hf.Undelete(recordID), NotNil)
+		record, err := hf.Get(recordID)
+		c.Assert(err, IsNil)
+		c.Assert(record, IsNil)
+	}
+	c.Assert(hf.NumRecords(), Equals, int64(len(records)-2))
+
+	// Vacuum removed the forwarding pointer along with the moved record.
+	vh, err := hf.lastPage.getVersionHeader(recordIDs[1].SlotID)
+	c.Assert(err, IsNil)
+	c.Assert(vh.dead, IsTrue)
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(verify(c, path), HasLen, 0)
+}
+
+func (s *HeapFileSuite) TestFreeSpace(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+
+	var expectedRecords []zdb2.Record
+	var recordIDs []zdb2.RecordID
+	insert := func(record zdb2.Record) {
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		expectedRecords = append(expectedRecords, record)
+		recordIDs = append(recordIDs, recordID)
+	}
+	checkRecords := func() {
+		for i, recordID := range recordIDs {
+			record, err := hf.Get(recordID)
+			c.Assert(err, IsNil)
+			c.Assert(record, DeepEquals, expectedRecords[i])
+		}
+		// Scans return records in RecordID order, which changes once the
+		// slots of deleted records are reused.
+		sortByRecordID(expectedRecords, recordIDs)
+		zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+	}
+	for i := 0; i < 4000; i++ {
+		insert(records[i%len(records)])
+	}
+	numBlocks := hf.bf.NumBlocks
+	c.Assert(numBlocks > 3, IsTrue)
+
+	// Repeatedly delete half of the records and replace them.  The surviving
+	// records keep their RecordIDs, and the heap file doesn't grow, since the
+	// space left behind by deleted records is reused.
+	for round := 0; round < 4; round++ {
+		if round == 2 {
+			// The free space map is persisted.
+			c.Assert(hf.Close(), IsNil)
+			hf, err = OpenHeapFile(path)
+			c.Assert(err, IsNil)
+		}
+		var survivingRecords []zdb2.Record
+		var survivingRecordIDs []zdb2.RecordID
+		for i, recordID := range recordIDs {
+			if (i+round)%2 == 0 {
+				c.Assert(hf.Delete(recordID), IsNil)
+			} else {
+				survivingRecords = append(survivingRecords, expectedRecords[i])
+				survivingRecordIDs = append(survivingRecordIDs, recordID)
+			}
+		}
+		numDeleted := len(recordIDs) - len(survivingRecordIDs)
+		expectedRecords = survivingRecords
+		recordIDs = survivingRecordIDs
+		checkRecords()
+		for i := 0; i < numDeleted; i++ {
+			insert(records[(i+round)%len(records)])
+		}
+		c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+	}
+
+	checkRecords()
+	c.Assert(hf.Close(), IsNil)
+	heapFileScan, err := NewFileScan(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, heapFileScan, expectedRecords)
+
+	// The record count wasn't saved, so it's recomputed.
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	c.Assert(hf.NumRecords(), Equals, int64(len(expectedRecords)))
+}
+
+func sortByRecordID(records []zdb2.Record, recordIDs []zdb2.RecordID) {
+	sort.Sort(byRecordID{records, recordIDs})
+}
+
+type byRecordID struct {
+	records   []zdb2.Record
+	recordIDs []zdb2.RecordID
+}
+
+func (b byRecordID) Len() int {
+	return len(b.records)
+}
+
+func (b byRecordID) Less(i, j int) bool {
+	if b.recordIDs[i].PageID != b.recordIDs[j].PageID {
+		return b.recordIDs[i].PageID < b.recordIDs[j].PageID
+	}
+	return b.recordIDs[i].SlotID < b.recordIDs[j].SlotID
+}
+
+func (b byRecordID) Swap(i, j int) {
+	b.records[i], b.records[j] = b.records[j], b.records[i]
+	b.recordIDs[i], b.recordIDs[j] = b.recordIDs[j], b.recordIDs[i]
 }
 
 func (s *HeapFileSuite) TestBulkLoad(c *C) {
@@ -140,3 +412,234 @@ func (s *HeapFileSuite) TestBulkLoad(c *C) {
 	err := BulkLoadNewHeapFile(path, zdb2.NewInMemoryScan(t, expectedRecords))
 	c.Assert(err, IsNil)
 }
+
+func (s *HeapFileSuite) TestCrashRecovery(c *C) {
+	defaultPool := buffer_pool.Default()
+	defer buffer_pool.SetDefault(defaultPool)
+	defer wal.ClearCrashPoints()
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(4, buffer_pool.NewLRU()))
+
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	var expectedRecords []zdb2.Record
+	var recordIDs []zdb2.RecordID
+	for i := 0; i < 10000; i++ {
+		record := records[i%len(records)]
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		expectedRecords = append(expectedRecords, record)
+		recordIDs = append(recordIDs, recordID)
+	}
+
+	// Crash partway through a sequence of deletes; the 100th delete never
+	// commits.
+	wal.SetCrashPoint(wal.CrashPoint_Commit, 100)
+	func() {
+		defer func() {
+			c.Assert(recover(), Equals, wal.Crash)
+		}()
+		for i := len(recordIDs) - 1; ; i-- {
+			err := hf.Delete(recordIDs[i])
+			c.Assert(err, IsNil)
+			expectedRecords = expectedRecords[:i]
+		}
+	}()
+	// Throw away all cached pages.
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(4, buffer_pool.NewLRU()))
+
+	heapFileScan, err := NewFileScan(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, heapFileScan, expectedRecords)
+
+	// The record count wasn't saved, so it's recomputed.
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	c.Assert(hf.NumRecords(), Equals, int64(len(expectedRecords)))
+}
+
+func (s *HeapFileSuite) TestInsertLogged(c *C) {
+	hf, err := NewHeapFile(c.MkDir()+"/heap_file_test", t)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+
+	var logged []zdb2.RecordID
+	logInsert := func(recordID zdb2.RecordID) error {
+		logged = append(logged, recordID)
+		return nil
+	}
+	recordID, err := hf.InsertLogged(records[0], logInsert)
+	c.Assert(err, IsNil)
+	c.Assert(logged, DeepEquals, []zdb2.RecordID{recordID})
+	ok, err := hf.HasRecordID(recordID)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+
+	// The insert is rolled back if it can't be logged, which leaves its
+	// RecordID unused.
+	failed := errors.New("Cannot log insert")
+	_, err = hf.InsertLogged(records[1], func(recordID zdb2.RecordID) error {
+		logged = append(logged, recordID)
+		return failed
+	})
+	c.Assert(err, Equals, failed)
+	c.Assert(logged, HasLen, 2)
+	ok, err = hf.HasRecordID(logged[1])
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	c.Assert(hf.NumRecords(), Equals, int64(1))
+	for _, recordID := range []zdb2.RecordID{
+		{PageID: -1, SlotID: 0},
+		{PageID: recordID.PageID + 1, SlotID: 0},
+	} {
+		ok, err = hf.HasRecordID(recordID)
+		c.Assert(err, IsNil)
+		c.Assert(ok, IsFalse)
+	}
+}
+
+func (s *HeapFileSuite) TestScanWhileOpen(c *C) {
+	defaultPool := buffer_pool.Default()
+	defer buffer_pool.SetDefault(defaultPool)
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(4, buffer_pool.NewLRU()))
+
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	var expectedRecords []zdb2.Record
+	insert := func(n int) {
+		for i := 0; i < n; i++ {
+			record := records[len(expectedRecords)%len(records)]
+			_, err := hf.Insert(record)
+			c.Assert(err, IsNil)
+			expectedRecords = append(expectedRecords, record)
+		}
+	}
+	insert(10)
+
+	// The scan shares the heap file's cached pages (so nothing has to be
+	// flushed first) and its log (so the file isn't recovered again).
+	fileScan, err := NewFileScan(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, fileScan, expectedRecords)
+	insert(10)
+	fileScan, err = NewFileScan(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, fileScan, expectedRecords)
+
+	// Every committed insert survives a crash.
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(4, buffer_pool.NewLRU()))
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	c.Assert(hf.NumRecords(), Equals, int64(len(expectedRecords)))
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+}
+
+// Copies the file at path into the layout used before block checksums were
+// added.
+func removeChecksums(c *C, path string) {
+	src, err := block_file.OpenBlockFile(path, pageSize)
+	c.Assert(err, IsNil)
+	c.Assert(src.Checksums, IsTrue)
+	tmpPath := path + ".tmp"
+	dst, err := block_file.OpenBlockFileWithoutChecksums(tmpPath, pageSize)
+	c.Assert(err, IsNil)
+	b := make([]byte, pageSize)
+	for blockID := int32(0); blockID < src.NumBlocks; blockID++ {
+		c.Assert(src.ReadBlock(b, blockID), IsNil)
+		_, err = dst.AllocateBlock()
+		c.Assert(err, IsNil)
+		c.Assert(dst.WriteBlock(b, blockID), IsNil)
+	}
+	c.Assert(src.Close(), IsNil)
+	c.Assert(dst.Close(), IsNil)
+	c.Assert(os.Rename(tmpPath, path), IsNil)
+}
+
+func (s *HeapFileSuite) TestChecksums(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	c.Assert(hf.bf.Checksums, IsTrue)
+	var recordIDs []zdb2.RecordID
+	for i := 0; i < 10; i++ {
+		recordID, err := hf.Insert(records[i%len(records)])
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	c.Assert(hf.Close(), IsNil)
+
+	// Files without checksums can still be used, and converted in place.
+	removeChecksums(c, path)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.bf.Checksums, IsFalse)
+	c.Assert(hf.NumRecords(), Equals, int64(10))
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(AddChecksums(path), IsNil)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.bf.Checksums, IsTrue)
+	for i, recordID := range recordIDs {
+		record, err := hf.Get(recordID)
+		c.Assert(err, IsNil)
+		c.Assert(record, DeepEquals, records[i%len(records)])
+	}
+	c.Assert(hf.Close(), IsNil)
+
+	// Corrupting a record is caught when its page is read.
+	bf, err := block_file.OpenBlockFile(path, pageSize)
+	c.Assert(err, IsNil)
+	pageID := recordIDs[0].PageID
+	_, err = bf.File.WriteAt(
+		[]byte("Hackers"),
+		bf.Offset(pageID)+pageSchemaVersionWidth+versionHeaderWidth)
+	c.Assert(err, IsNil)
+	c.Assert(bf.Close(), IsNil)
+	_, err = OpenHeapFile(path)
+	corrupt, ok := err.(*block_file.CorruptBlockError)
+	c.Assert(ok, IsTrue)
+	c.Assert(corrupt.Path, Equals, path)
+	c.Assert(corrupt.BlockID, Equals, pageID)
+}
+
+func (s *HeapFileSuite) TestAddChecksumsOriginalLayout(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	copyTestData(c, "original_movies", path)
+	original, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	// The pages are unchanged by the conversion.
+	c.Assert(AddChecksums(path), IsNil)
+	bf, err := block_file.OpenBlockFile(path, pageSize)
+	c.Assert(err, IsNil)
+	c.Assert(bf.Checksums, IsTrue)
+	c.Assert(bf.NumBlocks, Equals, int32(len(original)/pageSize))
+	data := make([]byte, pageSize)
+	for pageID := int32(0); pageID < bf.NumBlocks; pageID++ {
+		c.Assert(bf.ReadBlock(data, pageID), IsNil)
+		i := int(pageID) * pageSize
+		c.Assert(bytes.Equal(data, original[i:i+pageSize]), IsTrue)
+	}
+	c.Assert(bf.Close(), IsNil)
+
+	// The heap file can still be read, but has to be rewritten before it can
+	// be modified.
+	hf, err := OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.NumRecords(), Equals, int64(2700))
+	_, err = hf.Insert(records[0])
+	c.Assert(err, Equals, errOriginalLayout)
+	c.Assert(hf.Close(), IsNil)
+	mapping, err := RewriteHeapFile(path, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mapping.Len(), Equals, 2700)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.bf.Checksums, IsTrue)
+	c.Assert(hf.NumRecords(), Equals, int64(2700))
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(verify(c, path), HasLen, 0)
+}
@@ -6,41 +6,43 @@ import (
 
 	"github.com/dropbox/godropbox/errors"
 	"github.com/robot-dreams/zdb2"
-	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+	"github.com/robot-dreams/zdb2/mvcc"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
+// A heapPage is backed by a pinned buffer pool frame; release must be called
+// once the page is no longer needed.
 type heapPage struct {
+	bf     *wal.File
+	frame  *buffer_pool.Frame
 	pageID int32
 	data   []byte
 
+	// Shared with the heap file, so that schema changes take effect right away.
+	header *fileHeader
+
 	// We cache these values only as a performance optimization.
-	t              *zdb2.TableHeader
 	nextSlotOffset uint16
 	numSlots       uint16
 }
 
-func (hp *heapPage) setTableHeader(t *zdb2.TableHeader) (int, error) {
-	var buf bytes.Buffer
-	err := zdb2.WriteTableHeader(&buf, t)
-	if err != nil {
-		return 0, err
-	}
-	b := buf.Bytes()
-	copy(hp.data, b)
-	return len(b), nil
-}
-
 func (hp *heapPage) getUint16(offset int) uint16 {
-	r := bytes.NewReader(hp.data[offset : offset+2])
-	var result uint16
-	_ = binary.Read(r, zdb2.ByteOrder, &result)
-	return result
+	return zdb2.ByteOrder.Uint16(hp.data[offset : offset+2])
 }
 
 func (hp *heapPage) setUint16(offset int, value uint16) {
-	var buf bytes.Buffer
-	_ = binary.Write(&buf, zdb2.ByteOrder, value)
-	copy(hp.data[offset:offset+2], buf.Bytes())
+	zdb2.ByteOrder.PutUint16(hp.data[offset:offset+2], value)
+}
+
+// Returns the version of the schema that the page's records were encoded
+// under.
+func (hp *heapPage) schemaVersion() uint32 {
+	return zdb2.ByteOrder.Uint32(hp.data[:pageSchemaVersionWidth])
+}
+
+func (hp *heapPage) setSchemaVersion(version uint32) {
+	zdb2.ByteOrder.PutUint32(hp.data[:pageSchemaVersionWidth], version)
 }
 
 func (hp *heapPage) getNextSlotOffset() uint16 {
@@ -61,46 +63,59 @@ func (hp *heapPage) setNumSlots(numSlots uint16) {
 	hp.setUint16(pageSize-2, numSlots)
 }
 
+// Allocates a new heap page.
+//
+// Precondition: a transaction is active
 func newHeapPage(
-	bf *block_file.BlockFile,
-	t *zdb2.TableHeader,
+	bf *wal.File,
+	h *fileHeader,
 ) (*heapPage, error) {
-	pageID, err := bf.AllocateBlock()
+	frame, err := allocatePage(bf, h)
 	if err != nil {
 		return nil, err
 	}
-	data := make([]byte, pageSize)
 	hp := &heapPage{
-		pageID: pageID,
-		t:      t,
-		data:   data,
+		bf:     bf,
+		frame:  frame,
+		pageID: frame.BlockID(),
+		header: h,
+		data:   frame.Data,
 	}
-	n, err := hp.setTableHeader(t)
+	hp.initialize()
+	// The page started out zeroed.
+	err = bf.LogUpdate(frame, make([]byte, pageSize))
 	if err != nil {
+		hp.release(false)
 		return nil, err
 	}
-	hp.setNextSlotOffset(uint16(n))
-	hp.setNumSlots(0)
 	return hp, nil
 }
 
+// Sets up an empty page that stores records under the latest version of the
+// schema.
+func (hp *heapPage) initialize() {
+	// Records start after the page's schema version.
+	hp.setSchemaVersion(hp.header.schemaVersion)
+	hp.setNextSlotOffset(pageSchemaVersionWidth)
+	hp.setNumSlots(0)
+}
+
+// The schema comes from the heap file's header.
 func loadHeapPage(
-	bf *block_file.BlockFile,
+	bf *wal.File,
 	pageID int32,
+	h *fileHeader,
 ) (*heapPage, error) {
-	data := make([]byte, pageSize)
-	err := bf.ReadBlock(data, pageID)
-	if err != nil {
-		return nil, err
-	}
-	t, err := zdb2.ReadTableHeader(bytes.NewReader(data))
+	frame, err := bf.Pin(pageID)
 	if err != nil {
 		return nil, err
 	}
 	hp := &heapPage{
+		bf:     bf,
+		frame:  frame,
 		pageID: pageID,
-		data:   data,
-		t:      t,
+		data:   frame.Data,
+		header: h,
 	}
 	hp.nextSlotOffset = hp.getNextSlotOffset()
 	hp.numSlots = hp.getNumSlots()
@@ -137,61 +152,215 @@ func (hp *heapPage) extendLookupTable(offset uint16) {
 //
 // Precondition: slotID is in [0, numSlots)
 func (hp *heapPage) recordOffset(slotID uint16) uint16 {
-	i := int(hp.lookupOffset(slotID))
-	r := bytes.NewReader(hp.data[i : i+lookupTableEntryWidth])
-	var offset uint16
-	_ = binary.Read(r, zdb2.ByteOrder, &offset)
-	return offset
+	return hp.getUint16(int(hp.lookupOffset(slotID)))
+}
+
+// Precondition: slotID is in [0, numSlots)
+func (hp *heapPage) setRecordOffset(slotID uint16, offset uint16) {
+	hp.setUint16(int(hp.lookupOffset(slotID)), offset)
 }
 
 func (hp *heapPage) freeSpace() uint16 {
 	return hp.lookupTableOffset() - hp.nextSlotOffset
 }
 
-// If there was no room for the record in this page, then the return value will
-// be (false, nil).
-//
-// Precondition: the input is a valid record for the table described by hp.t
-func (hp *heapPage) insert(record zdb2.Record) (bool, error) {
-	var buf bytes.Buffer
-	// The heapPage representation includes a "tombstone" byte for each record
-	// to indicate whether it's deleted.
-	_ = binary.Write(&buf, zdb2.ByteOrder, false)
-	err := hp.t.WriteRecord(&buf, record)
-	if err != nil {
-		return false, err
+// Returns the number of bytes that would be free after compacting the page,
+// which is what the free space map tracks.
+func (hp *heapPage) availableSpace() (int, error) {
+	n := int(hp.freeSpace())
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		vh, err := hp.getVersionHeader(slotID)
+		if err != nil {
+			return 0, err
+		}
+		i, j, err := hp.versionBounds(slotID)
+		if err != nil {
+			return 0, err
+		}
+		n += j - i - compactedSize(vh, j-i)
 	}
-	b := buf.Bytes()
+	return n, nil
+}
 
+// Stores an encoded version in a new slot, and returns its slotID.  If
+// reuseSlots is true, then a slot whose space has been reclaimed is used
+// instead (if there is one); finding such a slot requires reading the whole
+// lookup table, so it's only worth trying for pages that had records deleted.
+//
+// If there was no room for the version in this page, then the return value
+// will be (0, false).
+func (hp *heapPage) insertVersion(b []byte, reuseSlots bool) (uint16, bool) {
+	if reuseSlots {
+		for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+			if hp.isReclaimed(slotID) {
+				return slotID, hp.replaceVersion(slotID, b)
+			}
+		}
+	}
 	// Inserting a record also requires us to add an entry to the lookup table.
-	if hp.freeSpace() < uint16(len(b))+lookupTableEntryWidth {
-		return false, nil
+	if int(hp.freeSpace()) < len(b)+lookupTableEntryWidth {
+		return 0, false
 	}
 	copy(hp.data[hp.nextSlotOffset:], b)
 	hp.extendLookupTable(hp.nextSlotOffset)
 	hp.nextSlotOffset += uint16(len(b))
-	return true, nil
+	return hp.numSlots - 1, true
 }
 
-func (hp *heapPage) delete(slotID uint16) error {
-	if slotID >= hp.numSlots {
-		return errors.Newf(
-			"Expected slotID in [0, %d); got %d",
-			hp.numSlots,
-			slotID)
+// Returns whether the version with the given slotID takes up zero bytes.
+//
+// Precondition: slotID is in [0, numSlots)
+func (hp *heapPage) isReclaimed(slotID uint16) bool {
+	if slotID == hp.numSlots-1 {
+		return hp.recordOffset(slotID) == hp.nextSlotOffset
+	}
+	return hp.recordOffset(slotID) == hp.recordOffset(slotID+1)
+}
+
+// Replaces the version stored in the given slot with b, sliding the versions
+// in later slots over to make room (or to close the gap), so that versions stay
+// in slot order.  Returns false (without changing anything) if there wasn't
+// enough free space.
+//
+// Precondition: slotID is in [0, numSlots)
+func (hp *heapPage) replaceVersion(slotID uint16, b []byte) bool {
+	i, j, _ := hp.versionBounds(slotID)
+	delta := len(b) - (j - i)
+	if delta > int(hp.freeSpace()) {
+		return false
+	}
+	end := int(hp.nextSlotOffset)
+	copy(hp.data[j+delta:], hp.data[j:end])
+	copy(hp.data[i:], b)
+	// Leave the free space zeroed, just like in a newly allocated page.
+	for k := end + delta; k < end; k++ {
+		hp.data[k] = 0
+	}
+	for s := slotID + 1; s < hp.numSlots; s++ {
+		hp.setRecordOffset(s, uint16(int(hp.recordOffset(s))+delta))
 	}
+	hp.nextSlotOffset = uint16(end + delta)
+	return true
+}
+
+// Overwrites the record stored in the version with the given slotID (keeping
+// its header), if the new record fits in the version's current space; the
+// version in the last slot can also grow into the page's free space.  If there
+// wasn't enough room, then the return value will be (false, nil).
+//
+// Precondition: the version isn't dead or forwarded
+func (hp *heapPage) overwrite(slotID uint16, record zdb2.Record) (bool, error) {
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil {
+		return false, err
+	}
+	b, err := hp.encodeVersion(record, vh)
+	if err != nil {
+		return false, err
+	}
+	i, j, err := hp.versionBounds(slotID)
+	if err != nil {
+		return false, err
+	}
+	if slotID == hp.numSlots-1 {
+		if i+len(b) > int(hp.lookupTableOffset()) {
+			return false, nil
+		}
+		// Any space that's no longer needed goes back to the free space.
+		for k := i + len(b); k < j; k++ {
+			hp.data[k] = 0
+		}
+		hp.nextSlotOffset = uint16(i + len(b))
+	} else if len(b) > j-i {
+		return false, nil
+	}
+	copy(hp.data[i:], b)
+	return true, nil
+}
+
+// Encodes a version under the latest schema, which can only be stored in the
+// page once it's been upgraded.  The record's large values should already have
+// been replaced by toastPointers.
+func (hp *heapPage) encodeVersion(
+	record zdb2.Record,
+	vh versionHeader,
+) ([]byte, error) {
 	var buf bytes.Buffer
-	_ = binary.Write(&buf, zdb2.ByteOrder, true)
-	b := buf.Bytes()
-	i := int(hp.recordOffset(slotID))
-	copy(hp.data[i:i+len(b)], b)
-	return nil
+	vh.toasted = hasToastPointers(record)
+	writeVersionHeader(&buf, vh)
+	err := writeStoredRecord(
+		&buf,
+		hp.header.t,
+		record,
+		zdb2.RecordFormat_VarintLengths,
+		vh.toasted)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func (hp *heapPage) get(slotID uint16) (zdb2.Record, error) {
+// Every record version in a heap page has a header that tracks its lifetime.
+// Vacuum marks versions that are no longer visible to any snapshot as dead, and
+// then reclaims their space (as does inserting into a page that's short on
+// space).  A version whose space has been reclaimed takes up zero bytes, so
+// that the slotIDs of other records don't change; its slot can later be reused
+// by a new record.
+//
+// When an update doesn't fit in a record's current space, the record is moved
+// to a new slot, and its original slot is "forwarded" to the new one (so that
+// its RecordID doesn't change).  Forwarded slots don't store any TxnIDs or
+// record; instead, their headers store the new location.
+type versionHeader struct {
+	dead bool
+
+	forwarded bool
+	forwardTo zdb2.RecordID
+
+	// Set for versions stored in a slot that was forwarded to; they should only
+	// be reached through the original slot.
+	moved bool
+
+	xmin mvcc.TxnID
+	xmax mvcc.TxnID
+
+	// Set if some of the record's values are stored in overflow pages (see
+	// overflow.go).
+	toasted bool
+}
+
+func writeVersionHeader(buf *bytes.Buffer, vh versionHeader) {
+	var flags byte
+	if vh.dead {
+		flags |= versionFlag_Dead
+	}
+	if vh.forwarded {
+		flags |= versionFlag_Forwarded
+	}
+	if vh.moved {
+		flags |= versionFlag_Moved
+	}
+	if vh.toasted {
+		flags |= versionFlag_Toasted
+	}
+	// err is always nil when writing to a bytes.Buffer.
+	_ = binary.Write(buf, zdb2.ByteOrder, flags)
+	if vh.forwarded {
+		_ = binary.Write(buf, zdb2.ByteOrder, vh.forwardTo.PageID)
+		_ = binary.Write(buf, zdb2.ByteOrder, vh.forwardTo.SlotID)
+		_ = binary.Write(buf, zdb2.ByteOrder, make([]byte, 10))
+	} else {
+		_ = binary.Write(buf, zdb2.ByteOrder, int64(vh.xmin))
+		_ = binary.Write(buf, zdb2.ByteOrder, int64(vh.xmax))
+	}
+}
+
+// Returns the range [i, j) of hp.data in which the version with the given
+// slotID is stored.
+func (hp *heapPage) versionBounds(slotID uint16) (int, int, error) {
 	numSlots := hp.numSlots
 	if slotID >= numSlots {
-		return nil, errors.Newf(
+		return 0, 0, errors.Newf(
 			"Expected slotID in [0, %d); got %d",
 			numSlots,
 			slotID)
@@ -203,19 +372,315 @@ func (hp *heapPage) get(slotID uint16) (zdb2.Record, error) {
 	} else {
 		j = int(hp.recordOffset(slotID + 1))
 	}
+	return i, j, nil
+}
+
+func (hp *heapPage) getVersionHeader(slotID uint16) (versionHeader, error) {
+	i, j, err := hp.versionBounds(slotID)
+	if err != nil {
+		return versionHeader{}, err
+	}
+	if i == j {
+		return versionHeader{dead: true}, nil
+	}
 	r := bytes.NewReader(hp.data[i:j])
-	var deleted bool
-	err := binary.Read(r, zdb2.ByteOrder, &deleted)
+	var flags byte
+	err = binary.Read(r, zdb2.ByteOrder, &flags)
+	if err != nil {
+		return versionHeader{}, err
+	}
+	vh := versionHeader{
+		dead:      flags&versionFlag_Dead != 0,
+		forwarded: flags&versionFlag_Forwarded != 0,
+		moved:     flags&versionFlag_Moved != 0,
+		toasted:   flags&versionFlag_Toasted != 0,
+	}
+	var values []interface{}
+	var xmin, xmax int64
+	if vh.forwarded {
+		values = []interface{}{&vh.forwardTo.PageID, &vh.forwardTo.SlotID}
+	} else {
+		values = []interface{}{&xmin, &xmax}
+	}
+	for _, value := range values {
+		err := binary.Read(r, zdb2.ByteOrder, value)
+		if err != nil {
+			return versionHeader{}, err
+		}
+	}
+	vh.xmin = mvcc.TxnID(xmin)
+	vh.xmax = mvcc.TxnID(xmax)
+	return vh, nil
+}
+
+// Precondition: the version's space hasn't been reclaimed
+func (hp *heapPage) setVersionHeader(slotID uint16, vh versionHeader) error {
+	i, j, err := hp.versionBounds(slotID)
+	if err != nil {
+		return err
+	}
+	if j-i < versionHeaderWidth {
+		return errors.Newf(
+			"Cannot update version with reclaimed slotID %d",
+			slotID)
+	}
+	var buf bytes.Buffer
+	writeVersionHeader(&buf, vh)
+	copy(hp.data[i:i+versionHeaderWidth], buf.Bytes())
+	return nil
+}
+
+// Sets the TxnID of the transaction that deleted the given version; deleting
+// with mvcc.FrozenTxnID hides the version from every reader, and allows its
+// space to be reclaimed.
+func (hp *heapPage) setXmax(slotID uint16, xmax mvcc.TxnID) error {
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil {
+		return err
+	}
+	vh.xmax = xmax
+	return hp.setVersionHeader(slotID, vh)
+}
+
+// Returns the record stored in the version with the given slotID, whether or
+// not it's visible.  Values stored in overflow pages are left as toastPointers.
+//
+// Precondition: the version isn't dead
+func (hp *heapPage) readRecord(slotID uint16) (zdb2.Record, error) {
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil {
+		return nil, err
+	}
+	i, j, err := hp.versionBounds(slotID)
+	if err != nil {
+		return nil, err
+	}
+	return hp.header.readRecord(
+		hp.data[i+versionHeaderWidth:j],
+		hp.schemaVersion(),
+		vh.toasted)
+}
+
+// Like readRecord, but values stored in overflow pages are read as well.
+func (hp *heapPage) readFullRecord(slotID uint16) (zdb2.Record, error) {
+	record, err := hp.readRecord(slotID)
+	if err != nil {
+		return nil, err
+	}
+	err = detoastRecord(hp.bf, hp.header.t, record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Returns nil if the record has been deleted (by any transaction).
+//
+// Precondition: the version isn't forwarded
+func (hp *heapPage) get(slotID uint16) (zdb2.Record, error) {
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil {
+		return nil, err
+	}
+	if vh.dead || vh.xmax != mvcc.InvalidTxnID {
+		return nil, nil
+	}
+	return hp.readFullRecord(slotID)
+}
+
+// Returns nil if the record version isn't visible to the given snapshot.
+//
+// Precondition: the version isn't forwarded
+func (hp *heapPage) getVisible(
+	slotID uint16,
+	s *mvcc.Snapshot,
+) (zdb2.Record, error) {
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil {
+		return nil, err
+	}
+	if vh.dead || !s.IsVisible(vh.xmin, vh.xmax) {
+		return nil, nil
+	}
+	return hp.readFullRecord(slotID)
+}
+
+// Returns get(slotID) if the snapshot is nil, or getVisible(slotID, s)
+// otherwise.
+func (hp *heapPage) getForSnapshot(
+	slotID uint16,
+	s *mvcc.Snapshot,
+) (zdb2.Record, error) {
+	if s == nil {
+		return hp.get(slotID)
+	}
+	return hp.getVisible(slotID, s)
+}
+
+// Returns the record that a scan should return for the given slotID (or nil if
+// there isn't one).  Forwarded slots are followed (using load and release for
+// the page that the record was moved to), while records that were moved are
+// skipped, so that each record is returned exactly once.
+func (hp *heapPage) getForScan(
+	slotID uint16,
+	s *mvcc.Snapshot,
+	load func(pageID int32) (*heapPage, error),
+	release func(*heapPage),
+) (zdb2.Record, error) {
+	vh, err := hp.getVersionHeader(slotID)
 	if err != nil {
 		return nil, err
 	}
-	if deleted {
+	if vh.moved {
 		return nil, nil
 	}
-	return hp.t.ReadRecord(r)
+	if vh.forwarded {
+		target, err := load(vh.forwardTo.PageID)
+		if err != nil {
+			return nil, err
+		}
+		defer release(target)
+		return target.getForSnapshot(vh.forwardTo.SlotID, s)
+	}
+	return hp.getForSnapshot(slotID, s)
+}
+
+// Returns the number of bytes that a version of the given size takes up once
+// its page has been compacted.  Dead versions and records deleted via
+// heapFile.Delete don't need any space, while forwarded slots only need their
+// headers.  Deleted records that were moved by heapFile.Update keep their space
+// until Vacuum removes their forwarding pointers (see vacuumForwarded), so that
+// a forwarding pointer never refers to a reused slot.
+func compactedSize(vh versionHeader, size int) int {
+	if vh.dead || (!vh.forwarded && !vh.moved && vh.xmax == mvcc.FrozenTxnID) {
+		return 0
+	} else if vh.forwarded {
+		return versionHeaderWidth
+	}
+	return size
+}
+
+// Slides the remaining versions together to reclaim the space that isn't
+// needed (see compactedSize), and returns the number of bytes reclaimed.
+// SlotIDs are preserved, since reclaimed versions keep their lookup table
+// entries (but take up zero bytes).
+func (hp *heapPage) compact() (int, error) {
+	if hp.numSlots == 0 {
+		return 0, nil
+	}
+	start := int(hp.recordOffset(0))
+	compacted := make([]byte, 0, int(hp.nextSlotOffset)-start)
+	offsets := make([]uint16, hp.numSlots)
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		offsets[slotID] = uint16(start + len(compacted))
+		vh, err := hp.getVersionHeader(slotID)
+		if err != nil {
+			return 0, err
+		}
+		i, j, err := hp.versionBounds(slotID)
+		if err != nil {
+			return 0, err
+		}
+		compacted = append(compacted, hp.data[i:i+compactedSize(vh, j-i)]...)
+	}
+	reclaimed := int(hp.nextSlotOffset) - start - len(compacted)
+	copy(hp.data[start:], compacted)
+	hp.nextSlotOffset = uint16(start + len(compacted))
+	for slotID, offset := range offsets {
+		hp.setRecordOffset(uint16(slotID), offset)
+	}
+	// Leave the free space zeroed, just like in a newly allocated page.
+	for i := int(hp.nextSlotOffset); i < int(hp.lookupTableOffset()); i++ {
+		hp.data[i] = 0
+	}
+	return reclaimed, nil
+}
+
+// Re-encodes every record in the page under the latest version of the schema,
+// compacting the page at the same time (see compact).  Returns false (without
+// changing anything) if the records would no longer fit.
+func (hp *heapPage) upgrade() (bool, error) {
+	version := hp.header.schemaVersion
+	if hp.schemaVersion() == version {
+		return true, nil
+	}
+	start := pageSchemaVersionWidth
+	upgraded := make([]byte, 0, int(hp.nextSlotOffset)-start)
+	offsets := make([]uint16, hp.numSlots)
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		offsets[slotID] = uint16(start + len(upgraded))
+		vh, err := hp.getVersionHeader(slotID)
+		if err != nil {
+			return false, err
+		}
+		i, j, err := hp.versionBounds(slotID)
+		if err != nil {
+			return false, err
+		}
+		// Reclaimed and forwarded slots don't store records.
+		size := compactedSize(vh, j-i)
+		if size <= versionHeaderWidth {
+			upgraded = append(upgraded, hp.data[i:i+size]...)
+			continue
+		}
+		record, err := hp.readRecord(slotID)
+		if err != nil {
+			return false, err
+		}
+		b, err := hp.encodeVersion(record, vh)
+		if err != nil {
+			return false, err
+		}
+		upgraded = append(upgraded, b...)
+	}
+	if start+len(upgraded) > int(hp.lookupTableOffset()) {
+		return false, nil
+	}
+	copy(hp.data[start:], upgraded)
+	hp.nextSlotOffset = uint16(start + len(upgraded))
+	for slotID, offset := range offsets {
+		hp.setRecordOffset(uint16(slotID), offset)
+	}
+	for i := int(hp.nextSlotOffset); i < int(hp.lookupTableOffset()); i++ {
+		hp.data[i] = 0
+	}
+	hp.setSchemaVersion(version)
+	return true, nil
 }
 
 func (hp *heapPage) flush() {
 	hp.setNextSlotOffset(hp.nextSlotOffset)
 	hp.setNumSlots(hp.numSlots)
 }
+
+// Returns a copy of the page's contents for logging purposes, or nil if logging
+// is off.
+func (hp *heapPage) snapshot() []byte {
+	if !hp.bf.Logging() {
+		return nil
+	}
+	hp.flush()
+	before := make([]byte, len(hp.data))
+	copy(before, hp.data)
+	return before
+}
+
+// Logs the changes made since before was returned by snapshot.
+func (hp *heapPage) logUpdate(before []byte) error {
+	if before == nil {
+		return nil
+	}
+	hp.flush()
+	return hp.bf.LogUpdate(hp.frame, before)
+}
+
+// release unpins the page's frame; if dirty is true, then the cached values are
+// written back to the page first.  The page must not be used afterwards.
+func (hp *heapPage) release(dirty bool) {
+	if dirty {
+		hp.flush()
+	}
+	hp.bf.Unpin(hp.frame, dirty)
+	hp.frame = nil
+	hp.data = nil
+}
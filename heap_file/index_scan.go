@@ -15,19 +15,22 @@ type indexScan struct {
 func newIndexScan(
 	indexPath string,
 	heapFilePath string,
-	key int32,
-	findFunc func(*index.BPlusTree, int32) (index.Iterator, error),
+	find func(*index.BPlusTree) (index.Iterator, error),
 ) (*indexScan, error) {
-	bpt, err := index.OpenBPlusTree(indexPath)
+	bpt, err := index.OpenExistingBPlusTree(indexPath)
 	if err != nil {
 		return nil, err
 	}
 	hf, err := OpenHeapFile(heapFilePath)
 	if err != nil {
+		bpt.Close()
 		return nil, err
 	}
-	iter, err := findFunc(bpt, key)
+	// The key's type is checked against the index's key type.
+	iter, err := find(bpt)
 	if err != nil {
+		bpt.Close()
+		hf.Close()
 		return nil, err
 	}
 	return &indexScan{
@@ -41,25 +44,85 @@ func newIndexScan(
 func NewIndexScanGreaterEqual(
 	indexPath string,
 	heapFilePath string,
-	key int32,
+	key interface{},
 ) (*indexScan, error) {
 	return newIndexScan(
 		indexPath,
 		heapFilePath,
-		key,
-		(*index.BPlusTree).FindGreaterEqual)
+		func(bpt *index.BPlusTree) (index.Iterator, error) {
+			return bpt.FindGreaterEqual(key)
+		})
 }
 
 func NewIndexScanEqual(
 	indexPath string,
 	heapFilePath string,
-	key int32,
+	key interface{},
+) (*indexScan, error) {
+	return newIndexScan(
+		indexPath,
+		heapFilePath,
+		func(bpt *index.BPlusTree) (index.Iterator, error) {
+			return bpt.FindEqual(key)
+		})
+}
+
+// NewIndexScanRange returns the records with keys between lo and hi (see
+// index.BPlusTree.FindRange), in key order, or in reverse key order if
+// descending is true.
+func NewIndexScanRange(
+	indexPath string,
+	heapFilePath string,
+	lo index.Bound,
+	hi index.Bound,
+	descending bool,
 ) (*indexScan, error) {
 	return newIndexScan(
+		indexPath,
+		heapFilePath,
+		func(bpt *index.BPlusTree) (index.Iterator, error) {
+			if descending {
+				return bpt.FindRangeReverse(lo, hi)
+			}
+			return bpt.FindRange(lo, hi)
+		})
+}
+
+// NewIndexScanPrefix returns the records whose composite keys (see
+// index.CompositeKey) start with the given values, in key order.  The index's
+// keys have to have been encoded by key.
+func NewIndexScanPrefix(
+	indexPath string,
+	heapFilePath string,
+	key *index.CompositeKey,
+	prefix ...interface{},
+) (*indexScan, error) {
+	return NewIndexScanPrefixRange(
 		indexPath,
 		heapFilePath,
 		key,
-		(*index.BPlusTree).FindEqual)
+		prefix,
+		nil,
+		nil)
+}
+
+// NewIndexScanPrefixRange is like NewIndexScanPrefix, but the field after the
+// prefix is also limited to [lower, upper), where a nil bound is unbounded.
+// Records where that field is NULL are only returned if both bounds are nil.
+func NewIndexScanPrefixRange(
+	indexPath string,
+	heapFilePath string,
+	key *index.CompositeKey,
+	prefix []interface{},
+	lower interface{},
+	upper interface{},
+) (*indexScan, error) {
+	return newIndexScan(
+		indexPath,
+		heapFilePath,
+		func(bpt *index.BPlusTree) (index.Iterator, error) {
+			return bpt.FindPrefix(key, prefix, lower, upper)
+		})
 }
 
 func (s *indexScan) TableHeader() *zdb2.TableHeader {
@@ -0,0 +1,140 @@
+package heap_file
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+type IndexScanSuite struct{}
+
+var _ = Suite(&IndexScanSuite{})
+
+func (s *IndexScanSuite) TestStringKeys(c *C) {
+	dir := c.MkDir()
+	path := dir + "/heap_file_test"
+	indexPath := dir + "/heap_file_test_title"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	bpt, err := index.OpenBPlusTree(indexPath, zdb2.String)
+	c.Assert(err, IsNil)
+	for _, record := range records {
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		c.Assert(bpt.AddEntry(index.Entry{
+			Key: record[0],
+			RID: recordID,
+		}), IsNil)
+	}
+	c.Assert(bpt.Close(), IsNil)
+	c.Assert(hf.Close(), IsNil)
+
+	scan, err := NewIndexScanEqual(indexPath, path, "Gattaca")
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{records[1]})
+
+	// Records come out in title order.
+	scan, err = NewIndexScanGreaterEqual(indexPath, path, "I")
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{records[3], records[0]})
+
+	scan, err = NewIndexScanRange(
+		indexPath,
+		path,
+		index.Exclusive("Gattaca"),
+		index.Inclusive("Inside Out"),
+		false)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{records[2], records[3]})
+
+	// A descending scan starts from the end of the range.
+	scan, err = NewIndexScanRange(
+		indexPath,
+		path,
+		index.Inclusive("Gattaca"),
+		index.Bound{},
+		true)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(
+		c,
+		scan,
+		[]zdb2.Record{records[0], records[3], records[2], records[1]})
+
+	// The key has to have the index's key type.
+	_, err = NewIndexScanEqual(indexPath, path, int32(2))
+	c.Assert(err, NotNil)
+}
+
+func (s *IndexScanSuite) TestCompositeKeys(c *C) {
+	ratings := &zdb2.TableHeader{
+		Name: "ratings",
+		Fields: []*zdb2.Field{
+			{"userId", zdb2.Int32, false, 0, 0},
+			{"movieId", zdb2.Int32, false, 0, 0},
+			{"rating", zdb2.Float64, false, 0, 0},
+		},
+	}
+	ratingRecords := []zdb2.Record{
+		{int32(2), int32(10), 4.0},
+		{int32(1), int32(30), 3.5},
+		{int32(1), int32(10), 5.0},
+		{int32(3), int32(10), 1.0},
+		{int32(1), int32(20), 2.5},
+	}
+	dir := c.MkDir()
+	path := dir + "/heap_file_test"
+	indexPath := dir + "/heap_file_test_user_movie"
+	hf, err := NewHeapFile(path, ratings)
+	c.Assert(err, IsNil)
+	key, err := index.NewCompositeKey(ratings, "userId", "movieId")
+	c.Assert(err, IsNil)
+	bpt, err := index.OpenBPlusTree(indexPath, zdb2.Bytes)
+	c.Assert(err, IsNil)
+	for _, record := range ratingRecords {
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		k, err := key.Key(record)
+		c.Assert(err, IsNil)
+		c.Assert(bpt.AddEntry(index.Entry{Key: k, RID: recordID}), IsNil)
+	}
+	c.Assert(bpt.Close(), IsNil)
+	c.Assert(hf.Close(), IsNil)
+
+	// A user's ratings come out in movie order.
+	scan, err := NewIndexScanPrefix(indexPath, path, key, int32(1))
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		ratingRecords[2],
+		ratingRecords[4],
+		ratingRecords[1],
+	})
+
+	scan, err = NewIndexScanPrefix(indexPath, path, key, int32(1), int32(20))
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{ratingRecords[4]})
+
+	scan, err = NewIndexScanPrefixRange(
+		indexPath,
+		path,
+		key,
+		[]interface{}{int32(1)},
+		int32(15),
+		int32(30))
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{ratingRecords[4]})
+
+	// With no prefix, the range is on the first field.
+	scan, err = NewIndexScanPrefixRange(
+		indexPath,
+		path,
+		key,
+		nil,
+		int32(2),
+		nil)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{ratingRecords[0], ratingRecords[3]})
+
+	_, err = NewIndexScanPrefix(indexPath, path, key, "1")
+	c.Assert(err, NotNil)
+}
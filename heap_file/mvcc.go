@@ -0,0 +1,110 @@
+package heap_file
+
+import (
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+// InsertTxn inserts a new record version, which is only visible to txn until
+// txn commits.
+func (hf *heapFile) InsertTxn(
+	txn *mvcc.Txn,
+	record zdb2.Record,
+) (zdb2.RecordID, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.insertVersion(record, txn.ID())
+}
+
+// DeleteTxn marks a record version as deleted by txn; the version stays visible
+// to other snapshots until txn commits (and to older snapshots even after
+// that).  The result is mvcc.NotVisible if the version isn't visible to txn, or
+// mvcc.WriteConflict if the version was deleted by a concurrent transaction.
+func (hf *heapFile) DeleteTxn(txn *mvcc.Txn, recordID zdb2.RecordID) error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	return hf.deleteVersion(txn, recordID)
+}
+
+// Precondition: hf.mu is held
+func (hf *heapFile) deleteVersion(
+	txn *mvcc.Txn,
+	recordID zdb2.RecordID,
+) error {
+	return hf.runTxn(func() error {
+		location, err := hf.resolve(recordID)
+		if err != nil {
+			return err
+		}
+		return hf.updateVersionHeader(location, func(
+			vh versionHeader,
+		) (versionHeader, error) {
+			if vh.dead {
+				return vh, mvcc.NotVisible
+			}
+			err := txn.Snapshot().CheckDelete(vh.xmin, vh.xmax)
+			if err != nil {
+				return vh, err
+			}
+			vh.xmax = txn.ID()
+			return vh, nil
+		})
+	})
+}
+
+// UpdateTxn replaces a record version with a new version, and returns the
+// RecordID of the new version; the old version stays visible to other
+// snapshots (just like with DeleteTxn).
+func (hf *heapFile) UpdateTxn(
+	txn *mvcc.Txn,
+	recordID zdb2.RecordID,
+	record zdb2.Record,
+) (zdb2.RecordID, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	err := hf.deleteVersion(txn, recordID)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	return hf.insertVersion(record, txn.ID())
+}
+
+// GetSnapshot returns (nil, nil) if the record version isn't visible to the
+// given snapshot.
+func (hf *heapFile) GetSnapshot(
+	s *mvcc.Snapshot,
+	recordID zdb2.RecordID,
+) (zdb2.Record, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	if hf.original != nil {
+		return hf.original.get(recordID)
+	}
+	location, err := hf.resolve(recordID)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := hf.loadPage(location.PageID)
+	if err != nil {
+		return nil, err
+	}
+	defer hf.releasePage(hp, false)
+	return hp.getVisible(location.SlotID, s)
+}
+
+// ScanSnapshot returns an iterator over every record version that's visible to
+// the given snapshot.
+func (hf *heapFile) ScanSnapshot(s *mvcc.Snapshot) zdb2.Iterator {
+	if hf.original != nil {
+		return hf.original.scan()
+	}
+	return &heapFileScan{
+		hf:       hf,
+		pageID:   hf.header.firstHeapPageID(),
+		snapshot: s,
+	}
+}
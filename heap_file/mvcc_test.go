@@ -0,0 +1,151 @@
+package heap_file
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+func (s *HeapFileSuite) TestSnapshotIsolation(c *C) {
+	dir := c.MkDir()
+	m, err := mvcc.OpenManager(dir + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+	path := dir + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+
+	writer, err := m.Begin()
+	c.Assert(err, IsNil)
+	var recordIDs []zdb2.RecordID
+	for _, record := range records {
+		recordID, err := hf.InsertTxn(writer, record)
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	c.Assert(writer.Commit(), IsNil)
+
+	// The reader's snapshot is taken before any of the changes below.
+	reader, err := m.Begin()
+	c.Assert(err, IsNil)
+	writer, err = m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(hf.DeleteTxn(writer, recordIDs[0]), IsNil)
+	updated := zdb2.Record{"Gattaca", 4.8, int32(5)}
+	updatedRecordID, err := hf.UpdateTxn(writer, recordIDs[1], updated)
+	c.Assert(err, IsNil)
+
+	// A concurrent writer can't modify the same records.
+	other, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(hf.DeleteTxn(other, recordIDs[0]), Equals, mvcc.WriteConflict)
+	c.Assert(hf.DeleteTxn(other, updatedRecordID), Equals, mvcc.NotVisible)
+	c.Assert(other.Abort(), IsNil)
+
+	// The writer sees its own changes.
+	zdb2.CheckIterator(c, hf.ScanSnapshot(writer.Snapshot()), []zdb2.Record{
+		records[2],
+		records[3],
+		updated,
+	})
+	c.Assert(writer.Commit(), IsNil)
+
+	// The reader still sees the original records, even after the writer
+	// commits; so does a file scan with the reader's snapshot.
+	record, err := hf.GetSnapshot(reader.Snapshot(), recordIDs[0])
+	c.Assert(err, IsNil)
+	c.Assert(record, DeepEquals, records[0])
+	record, err = hf.GetSnapshot(reader.Snapshot(), updatedRecordID)
+	c.Assert(err, IsNil)
+	c.Assert(record, IsNil)
+	zdb2.CheckIterator(c, hf.ScanSnapshot(reader.Snapshot()), records)
+	fileScan, err := NewFileScanSnapshot(path, reader.Snapshot())
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, fileScan, records)
+	c.Assert(reader.Commit(), IsNil)
+
+	// New snapshots see the committed changes.
+	reader, err = m.Begin()
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, hf.ScanSnapshot(reader.Snapshot()), []zdb2.Record{
+		records[2],
+		records[3],
+		updated,
+	})
+	c.Assert(reader.Commit(), IsNil)
+}
+
+func (s *HeapFileSuite) TestVacuum(c *C) {
+	dir := c.MkDir()
+	m, err := mvcc.OpenManager(dir + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+	hf, err := NewHeapFile(dir+"/heap_file_test", t)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+
+	writer, err := m.Begin()
+	c.Assert(err, IsNil)
+	var recordIDs []zdb2.RecordID
+	for _, record := range records {
+		recordID, err := hf.InsertTxn(writer, record)
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	c.Assert(writer.Commit(), IsNil)
+
+	// An aborted insert, and an aborted delete.
+	aborted, err := m.Begin()
+	c.Assert(err, IsNil)
+	_, err = hf.InsertTxn(aborted, records[0])
+	c.Assert(err, IsNil)
+	c.Assert(hf.DeleteTxn(aborted, recordIDs[0]), IsNil)
+	c.Assert(aborted.Abort(), IsNil)
+
+	// A committed delete that's still visible to an older snapshot.
+	reader, err := m.Begin()
+	c.Assert(err, IsNil)
+	deleter, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(hf.DeleteTxn(deleter, recordIDs[1]), IsNil)
+	c.Assert(deleter.Commit(), IsNil)
+
+	stats, err := hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	c.Assert(stats.NumPagesScanned, Equals, 1)
+	c.Assert(stats.NumVersionsReclaimed, Equals, 1)
+	c.Assert(stats.NumVersionsFrozen, Equals, 4)
+	c.Assert(stats.NumBytesReclaimed > 0, IsTrue)
+	zdb2.CheckIterator(c, hf.ScanSnapshot(reader.Snapshot()), records)
+	c.Assert(reader.Commit(), IsNil)
+
+	// Once the older snapshot is gone, the deleted version can be reclaimed.
+	stats, err = hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	c.Assert(stats.NumVersionsReclaimed, Equals, 1)
+	c.Assert(stats.NumVersionsFrozen, Equals, 0)
+	expected := []zdb2.Record{records[0], records[2], records[3]}
+	zdb2.CheckIterator(c, hf.Scan(), expected)
+
+	// Vacuuming again doesn't change anything, and slotIDs are stable.
+	stats, err = hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	c.Assert(stats, Equals, VacuumStats{NumPagesScanned: 1})
+	for i, recordID := range recordIDs {
+		record, err := hf.Get(recordID)
+		c.Assert(err, IsNil)
+		if i == 1 {
+			c.Assert(record, IsNil)
+		} else {
+			c.Assert(record, DeepEquals, records[i])
+		}
+	}
+
+	// The reclaimed space can be reused.
+	_, err = hf.Insert(records[1])
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, hf.Scan(), append(expected, records[1]))
+}
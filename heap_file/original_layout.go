@@ -0,0 +1,346 @@
+package heap_file
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+)
+
+// Heap files in the original layout (from before the write-ahead log was
+// added) have neither a header block nor a free space map.  Every page is a
+// heap page that starts with its own copy of the table header (as written by
+// zdb2.WriteTableHeader), and ends with a footer that only stores the next slot
+// offset and the number of slots (as uint16s); there's no page LSN.  Each
+// record is preceded by a tombstone byte (which is 1 if the record has been
+// deleted) instead of a version header, and is encoded in
+// zdb2.RecordFormat_ShortLengths.
+//
+// Writing a page LSN would overwrite part of the lookup table, so these heap
+// files can't be modified in place.  OpenHeapFile opens them read-only, without
+// changing their RecordIDs (so that indexes on them stay valid), and
+// RewriteHeapFile converts them to the current format (see file_header.go).
+const originalFooterWidth = 4
+
+var errOriginalLayout = errors.New(
+	"Heap file uses the original layout, so it can only be read until it's " +
+		"converted by RewriteHeapFile")
+
+// Returns whether page 0 of a heap file, with the given contents, belongs to a
+// heap file in the original layout.  In every later layout, page 0 is either
+// the header block (which starts with heapFileMagic) or a free space map page,
+// which never uses the bytes after its page LSN.  In the original layout, those
+// bytes store the page's next slot offset and number of slots, and the next
+// slot offset is never 0 (since the page starts with the table header).
+func isOriginalLayout(data []byte) bool {
+	return zdb2.ByteOrder.Uint32(data) != heapFileMagic &&
+		zdb2.ByteOrder.Uint16(data[pageSize-originalFooterWidth:]) != 0
+}
+
+// Returns whether the heap file at path uses the original layout.  The file
+// isn't opened via the write-ahead log, which would create a log for it.
+func isOriginalHeapFile(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	bf, err := block_file.OpenBlockFile(path, pageSize)
+	if err != nil {
+		return false, err
+	}
+	defer bf.Close()
+	if bf.NumBlocks == 0 {
+		return false, nil
+	}
+	data := make([]byte, pageSize)
+	err = bf.ReadBlock(data, headerBlockID)
+	if err != nil {
+		return false, err
+	}
+	return isOriginalLayout(data), nil
+}
+
+// An originalFile is a heap file in the original layout, which is only ever
+// read; it can be shared by multiple goroutines.
+type originalFile struct {
+	bf     *block_file.BlockFile
+	header *fileHeader
+}
+
+func openOriginalFile(path string) (*originalFile, error) {
+	bf, err := block_file.OpenBlockFile(path, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if bf.NumBlocks == 0 {
+		bf.Close()
+		return nil, errors.Newf("%v is not a valid heap file", path)
+	}
+	f := &originalFile{bf: bf}
+	p := &originalPage{}
+	err = f.readPage(p, 0)
+	if err != nil {
+		bf.Close()
+		return nil, err
+	}
+	t, err := zdb2.ReadTableHeader(bytes.NewReader(p.data))
+	if err != nil {
+		bf.Close()
+		return nil, err
+	}
+	// The record count isn't saved.
+	f.header = &fileHeader{
+		formatVersion: formatVersion_Original,
+		numRecords:    -1,
+	}
+	f.header.setSchemas(t.Name, []*schema{newSchema(t)})
+	return f, nil
+}
+
+// A copy of one of an originalFile's pages.
+type originalPage struct {
+	pageID         int32
+	data           []byte
+	nextSlotOffset uint16
+	numSlots       uint16
+}
+
+func (f *originalFile) readPage(p *originalPage, pageID int32) error {
+	if p.data == nil {
+		p.data = make([]byte, pageSize)
+	}
+	err := f.bf.ReadBlock(p.data, pageID)
+	if err != nil {
+		return err
+	}
+	p.pageID = pageID
+	footer := p.data[pageSize-originalFooterWidth:]
+	p.nextSlotOffset = zdb2.ByteOrder.Uint16(footer)
+	p.numSlots = zdb2.ByteOrder.Uint16(footer[2:])
+	return nil
+}
+
+// Returns the offset at which the record with the given slotID starts; the
+// lookup table is stored in reverse slot order, right before the footer.
+//
+// Precondition: slotID is in [0, p.numSlots)
+func (p *originalPage) recordOffset(slotID uint16) int {
+	i := pageSize - originalFooterWidth -
+		(int(slotID)+1)*lookupTableEntryWidth
+	return int(zdb2.ByteOrder.Uint16(p.data[i:]))
+}
+
+// Returns the bounds of the record with the given slotID (including its
+// tombstone byte).
+//
+// Precondition: slotID is in [0, p.numSlots)
+func (p *originalPage) recordBounds(slotID uint16) (int, int, error) {
+	i := p.recordOffset(slotID)
+	var j int
+	if slotID == p.numSlots-1 {
+		j = int(p.nextSlotOffset)
+	} else {
+		j = p.recordOffset(slotID + 1)
+	}
+	lookupTableOffset := pageSize - originalFooterWidth -
+		int(p.numSlots)*lookupTableEntryWidth
+	if i >= j || j > lookupTableOffset {
+		return 0, 0, errors.Newf(
+			"Invalid bounds [%d, %d) for slot %d of page %d",
+			i,
+			j,
+			slotID,
+			p.pageID)
+	}
+	return i, j, nil
+}
+
+// Returns the record with the given slotID, or nil if it was deleted.
+//
+// Precondition: slotID is in [0, p.numSlots)
+func (f *originalFile) readRecord(
+	p *originalPage,
+	slotID uint16,
+) (zdb2.Record, error) {
+	i, j, err := p.recordBounds(slotID)
+	if err != nil {
+		return nil, err
+	}
+	if p.data[i] != 0 {
+		return nil, nil
+	}
+	return f.header.t.ReadRecordInFormat(
+		bytes.NewReader(p.data[i+1:j]),
+		zdb2.RecordFormat_ShortLengths)
+}
+
+func (f *originalFile) hasRecordID(recordID zdb2.RecordID) (bool, error) {
+	if recordID.PageID < 0 || recordID.PageID >= f.bf.NumBlocks {
+		return false, nil
+	}
+	p := &originalPage{}
+	err := f.readPage(p, recordID.PageID)
+	if err != nil {
+		return false, err
+	}
+	return recordID.SlotID < p.numSlots, nil
+}
+
+// Returns nil if the record was deleted.
+func (f *originalFile) get(recordID zdb2.RecordID) (zdb2.Record, error) {
+	if recordID.PageID < 0 || recordID.PageID >= f.bf.NumBlocks {
+		return nil, errors.Newf(
+			"Expected pageID in [0, %d); got %d",
+			f.bf.NumBlocks,
+			recordID.PageID)
+	}
+	p := &originalPage{}
+	err := f.readPage(p, recordID.PageID)
+	if err != nil {
+		return nil, err
+	}
+	if recordID.SlotID >= p.numSlots {
+		return nil, errors.Newf(
+			"Expected slotID in [0, %d); got %d",
+			p.numSlots,
+			recordID.SlotID)
+	}
+	return f.readRecord(p, recordID.SlotID)
+}
+
+func (f *originalFile) countRecords() (int64, error) {
+	s := f.scan()
+	var n int64
+	for {
+		_, _, err := s.NextWithID()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return 0, err
+		}
+		n++
+	}
+}
+
+// Opens a heap file in the original layout.  Every record that hasn't been
+// deleted is visible to every snapshot, just like records inserted via Insert.
+func openOriginalHeapFile(path string) (*heapFile, error) {
+	f, err := openOriginalFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f.header.numRecords, err = f.countRecords()
+	if err != nil {
+		f.bf.Close()
+		return nil, err
+	}
+	return &heapFile{
+		path:     path,
+		header:   f.header,
+		original: f,
+		closed:   false,
+	}, nil
+}
+
+// Returns errOriginalLayout if the heap file is read-only.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) checkWritable() error {
+	if hf.original != nil {
+		return errOriginalLayout
+	}
+	return nil
+}
+
+// originalScan returns every record that hasn't been deleted from a heap file
+// in the original layout, in RecordID order.
+type originalScan struct {
+	f *originalFile
+
+	// Whether the scan opened f (and has to close it).
+	ownsFile bool
+
+	// The page that's currently being scanned; pageID starts out as -1, since
+	// no page has been read yet.
+	page   originalPage
+	slotID uint16
+}
+
+var _ zdb2.RecordIterator = (*originalScan)(nil)
+
+func newOriginalScan(path string) (*originalScan, error) {
+	f, err := openOriginalFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := f.scan()
+	s.ownsFile = true
+	return s, nil
+}
+
+// Returns a scan that shares f, which stays open when the scan is closed.
+func (f *originalFile) scan() *originalScan {
+	return &originalScan{
+		f:    f,
+		page: originalPage{pageID: -1},
+	}
+}
+
+func (s *originalScan) TableHeader() *zdb2.TableHeader {
+	return s.f.header.t
+}
+
+func (s *originalScan) Next() (zdb2.Record, error) {
+	record, _, err := s.NextWithID()
+	return record, err
+}
+
+func (s *originalScan) NextWithID() (zdb2.Record, zdb2.RecordID, error) {
+	if s.f == nil {
+		return nil, zdb2.RecordID{}, errors.New("originalScan was closed")
+	}
+	for {
+		if s.slotID == s.page.numSlots {
+			if s.page.pageID+1 == s.f.bf.NumBlocks {
+				return nil, zdb2.RecordID{}, io.EOF
+			}
+			err := s.f.readPage(&s.page, s.page.pageID+1)
+			if err != nil {
+				return nil, zdb2.RecordID{}, err
+			}
+			s.slotID = 0
+			continue
+		}
+		recordID := zdb2.RecordID{
+			PageID: s.page.pageID,
+			SlotID: s.slotID,
+		}
+		s.slotID++
+		record, err := s.f.readRecord(&s.page, recordID.SlotID)
+		if err != nil {
+			return nil, zdb2.RecordID{}, err
+		}
+		// Records marked as deleted shouldn't be returned.
+		if record == nil {
+			continue
+		}
+		return record, recordID, nil
+	}
+}
+
+func (s *originalScan) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	f := s.f
+	s.f = nil
+	if !s.ownsFile {
+		return nil
+	}
+	return f.bf.Close()
+}
@@ -0,0 +1,491 @@
+package heap_file
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// String and Bytes values that are too large to store in a heap page (or that
+// would take up most of one) are stored out of line instead, in a chain of
+// overflow pages (like TOAST in PostgreSQL).  Within the record, such a value
+// is replaced by a toastPointer to the start of its chain, and the record's
+// version header is flagged so that a bitmap of the replaced values can be
+// found right before the record.  Overflow pages are allocated as needed, in
+// between heap pages; each one is laid out as:
+//
+//   - overflowPageMarker (uint32), where a heap page stores its schema version
+//   - the next page in the chain (int32), or noNextOverflowPage
+//   - the number of bytes of the value stored in this page (uint16)
+//   - the bytes themselves
+//
+// The lookup table footer of an overflow page is left zeroed, so that it looks
+// like an empty heap page to anything that iterates over slots.
+//
+// A chain is freed along with the record version that points to it (see
+// reclaim.go), or as soon as the record is overwritten by Update.  Freed pages
+// are zeroed, and recorded in the free space map (see freePageEntry), so that
+// they can be reused as either overflow pages or heap pages.
+
+const (
+	overflowPageMarker uint32 = 0xFFFFFFFF
+	noNextOverflowPage int32  = -1
+
+	overflowPageHeaderWidth = 10
+	overflowPageCapacity    = pageLSNOffset - overflowPageHeaderWidth
+
+	// Values longer than this are stored in overflow pages.
+	toastThreshold = 2048
+
+	// The encoded size of a toastPointer.
+	toastPointerWidth = 12
+)
+
+// A toastPointer takes the place of a value that's stored in overflow pages.
+type toastPointer struct {
+	pageID int32
+	length int64
+}
+
+func (p toastPointer) encode() []byte {
+	b := make([]byte, toastPointerWidth)
+	zdb2.ByteOrder.PutUint32(b[0:4], uint32(p.pageID))
+	zdb2.ByteOrder.PutUint64(b[4:12], uint64(p.length))
+	return b
+}
+
+func decodeToastPointer(b []byte) (toastPointer, error) {
+	if len(b) != toastPointerWidth {
+		return toastPointer{}, errors.Newf(
+			"Expected toast pointer of size %d; got %d",
+			toastPointerWidth,
+			len(b))
+	}
+	return toastPointer{
+		pageID: int32(zdb2.ByteOrder.Uint32(b[0:4])),
+		length: int64(zdb2.ByteOrder.Uint64(b[4:12])),
+	}, nil
+}
+
+func isOverflowPage(data []byte) bool {
+	return zdb2.ByteOrder.Uint32(data[0:4]) == overflowPageMarker
+}
+
+// Returns whether the page is an overflow page (rather than a heap page).
+func (hp *heapPage) isOverflowPage() bool {
+	return isOverflowPage(hp.data)
+}
+
+func setNextOverflowPage(data []byte, pageID int32) {
+	zdb2.ByteOrder.PutUint32(data[4:8], uint32(pageID))
+}
+
+// Stores b in a new chain of overflow pages, and returns the first one.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) writeOverflowChain(b []byte) (int32, error) {
+	bf := hf.bf
+	firstPageID := noNextOverflowPage
+	var prev *buffer_pool.Frame
+	// Each page is logged once the next one has been allocated (since the
+	// previous page needs to point to it).
+	logPage := func(frame *buffer_pool.Frame) error {
+		// The page started out zeroed.
+		err := bf.LogUpdate(frame, make([]byte, pageSize))
+		if err != nil {
+			bf.Unpin(frame, false)
+			return err
+		}
+		bf.Unpin(frame, true)
+		return nil
+	}
+	for len(b) > 0 {
+		frame, err := hf.allocateOverflowPage()
+		if err != nil {
+			if prev != nil {
+				bf.Unpin(prev, false)
+			}
+			return 0, err
+		}
+		n := len(b)
+		if n > overflowPageCapacity {
+			n = overflowPageCapacity
+		}
+		data := frame.Data
+		zdb2.ByteOrder.PutUint32(data[0:4], overflowPageMarker)
+		setNextOverflowPage(data, noNextOverflowPage)
+		zdb2.ByteOrder.PutUint16(data[8:10], uint16(n))
+		copy(data[overflowPageHeaderWidth:], b[:n])
+		b = b[n:]
+		if prev == nil {
+			firstPageID = frame.BlockID()
+		} else {
+			setNextOverflowPage(prev.Data, frame.BlockID())
+			err = logPage(prev)
+			if err != nil {
+				bf.Unpin(frame, false)
+				return 0, err
+			}
+		}
+		prev = frame
+	}
+	if prev != nil {
+		err := logPage(prev)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return firstPageID, nil
+}
+
+// Returns a page for a new overflow chain: a page that was freed by
+// freeOverflowChain if there is one, or a new page otherwise.  Either way, the
+// page is zeroed.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) allocateOverflowPage() (*buffer_pool.Frame, error) {
+	frame, ok, err := hf.reuseFreePage(hf.header.firstHeapPageID())
+	if err != nil {
+		return nil, err
+	} else if ok {
+		return frame, nil
+	}
+	return allocatePage(hf.bf, hf.header)
+}
+
+// Returns the first page that was freed by freeOverflowChain, starting from
+// the given page, if there is one.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) reuseFreePage(
+	start int32,
+) (*buffer_pool.Frame, bool, error) {
+	for {
+		pageID, ok, err := hf.findFreeSpaceFrom(
+			start,
+			hf.bf.NumBlocks-1,
+			freePageEntry)
+		if err != nil || !ok {
+			return nil, false, err
+		} else if pageID == hf.lastPage.pageID {
+			start = pageID + 1
+			continue
+		}
+		frame, err := hf.bf.Pin(pageID)
+		if err != nil {
+			return nil, false, err
+		}
+		// The page is about to become an overflow page, or the last page
+		// (whose entry isn't kept up to date).  If the page turns out not to
+		// be free, then its entry was out of date anyway.
+		free := isFreePage(frame.Data)
+		if !free {
+			hf.bf.Unpin(frame, false)
+		}
+		err = hf.setFreeSpace(pageID, 0)
+		if err != nil {
+			if free {
+				hf.bf.Unpin(frame, false)
+			}
+			return nil, false, err
+		}
+		if free {
+			return frame, true, nil
+		}
+		start = pageID + 1
+	}
+}
+
+// Returns whether the page has been freed (or was allocated by a transaction
+// that was rolled back), in which case it's zeroed, aside from its page LSN.
+func isFreePage(data []byte) bool {
+	for _, b := range data[:pageLSNOffset] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Frees the chain of overflow pages that p points to.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) freeOverflowChain(p toastPointer) error {
+	pageID := p.pageID
+	for n := int64(0); n < p.length; n += overflowPageCapacity {
+		if pageID == noNextOverflowPage {
+			return errors.Newf(
+				"Overflow chain starting at page %d is too short",
+				p.pageID)
+		}
+		frame, err := hf.bf.Pin(pageID)
+		if err != nil {
+			return err
+		}
+		data := frame.Data
+		if !isOverflowPage(data) {
+			hf.bf.Unpin(frame, false)
+			return errors.Newf("Page %d isn't an overflow page", pageID)
+		}
+		next := int32(zdb2.ByteOrder.Uint32(data[4:8]))
+		before := make([]byte, pageSize)
+		copy(before, data)
+		for i := range data[:pageLSNOffset] {
+			data[i] = 0
+		}
+		err = hf.bf.LogUpdate(frame, before)
+		if err != nil {
+			hf.bf.Unpin(frame, false)
+			return err
+		}
+		hf.bf.Unpin(frame, true)
+		err = hf.setFreeSpace(pageID, freePageEntry)
+		if err != nil {
+			return err
+		}
+		pageID = next
+	}
+	return nil
+}
+
+// Frees the overflow chains that the record's toastPointers point to.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) freeOverflowChains(record zdb2.Record) error {
+	for _, value := range record {
+		p, ok := value.(toastPointer)
+		if !ok {
+			continue
+		}
+		err := hf.freeOverflowChain(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Frees the overflow chains of the version in the given slot, if it's still
+// stored in the page.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) freeVersionOverflowPages(
+	hp *heapPage,
+	slotID uint16,
+) error {
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil || !vh.toasted || vh.dead || vh.forwarded {
+		return err
+	}
+	record, err := hp.readRecord(slotID)
+	if err != nil {
+		return err
+	}
+	return hf.freeOverflowChains(record)
+}
+
+// Reads the value that p points to.
+func readOverflowChain(bf *wal.File, p toastPointer) ([]byte, error) {
+	maxLength := int64(bf.NumBlocks) * overflowPageCapacity
+	if p.length < 0 || p.length > maxLength {
+		return nil, errors.Newf("Invalid toast pointer %+v", p)
+	}
+	b := make([]byte, 0, p.length)
+	pageID := p.pageID
+	for int64(len(b)) < p.length {
+		if pageID == noNextOverflowPage {
+			return nil, errors.Newf(
+				"Overflow chain starting at page %d ended after %d bytes; "+
+					"expected %d",
+				p.pageID,
+				len(b),
+				p.length)
+		}
+		frame, err := bf.Pin(pageID)
+		if err != nil {
+			return nil, err
+		}
+		data := frame.Data
+		if !isOverflowPage(data) {
+			bf.Unpin(frame, false)
+			return nil, errors.Newf("Page %d isn't an overflow page", pageID)
+		}
+		n := int(zdb2.ByteOrder.Uint16(data[8:10]))
+		if n > overflowPageCapacity {
+			n = overflowPageCapacity
+		}
+		start := overflowPageHeaderWidth
+		b = append(b, data[start:start+n]...)
+		pageID = int32(zdb2.ByteOrder.Uint32(data[4:8]))
+		bf.Unpin(frame, false)
+	}
+	if int64(len(b)) != p.length {
+		return nil, errors.Newf(
+			"Overflow chain starting at page %d has %d bytes; expected %d",
+			p.pageID,
+			len(b),
+			p.length)
+	}
+	return b, nil
+}
+
+// Moves the record's large values to overflow pages, and returns a copy of the
+// record with toastPointers in their place (or the record itself, if none of
+// its values are large).
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) toastRecord(record zdb2.Record) (zdb2.Record, error) {
+	t := hf.header.t
+	if len(record) != len(t.Fields) {
+		return nil, errors.Newf(
+			"Expected record with %d values; got %d",
+			len(t.Fields),
+			len(record))
+	}
+	var toasted zdb2.Record
+	for i, field := range t.Fields {
+		var b []byte
+		switch v := record[i].(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		}
+		if field.Type != zdb2.String && field.Type != zdb2.Bytes ||
+			len(b) <= toastThreshold {
+			continue
+		}
+		pageID, err := hf.writeOverflowChain(b)
+		if err != nil {
+			return nil, err
+		}
+		if toasted == nil {
+			toasted = append(zdb2.Record{}, record...)
+		}
+		toasted[i] = toastPointer{
+			pageID: pageID,
+			length: int64(len(b)),
+		}
+	}
+	if toasted == nil {
+		return record, nil
+	}
+	return toasted, nil
+}
+
+// Replaces the record's toastPointers (if any) by the values they point to.
+func detoastRecord(
+	bf *wal.File,
+	t *zdb2.TableHeader,
+	record zdb2.Record,
+) error {
+	for i, value := range record {
+		p, ok := value.(toastPointer)
+		if !ok {
+			continue
+		}
+		b, err := readOverflowChain(bf, p)
+		if err != nil {
+			return err
+		}
+		if t.Fields[i].Type == zdb2.String {
+			record[i] = string(b)
+		} else {
+			record[i] = b
+		}
+	}
+	return nil
+}
+
+func hasToastPointers(record zdb2.Record) bool {
+	for _, value := range record {
+		if _, ok := value.(toastPointer); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func toastBitmapWidth(t *zdb2.TableHeader) int {
+	return (len(t.Fields) + 7) / 8
+}
+
+// Encodes a record (which might contain toastPointers) as it's stored in a
+// heap page; if toasted is true, then the record is preceded by a bitmap with
+// the i-th bit set if the i-th value is a toastPointer.
+func writeStoredRecord(
+	w io.Writer,
+	t *zdb2.TableHeader,
+	record zdb2.Record,
+	format zdb2.RecordFormat,
+	toasted bool,
+) error {
+	if !toasted {
+		return t.WriteRecordInFormat(w, record, format)
+	}
+	bitmap := make([]byte, toastBitmapWidth(t))
+	encoded := make(zdb2.Record, len(record))
+	for i, value := range record {
+		p, ok := value.(toastPointer)
+		if !ok {
+			encoded[i] = value
+			continue
+		}
+		bitmap[i/8] |= 1 << uint(i%8)
+		if t.Fields[i].Type == zdb2.String {
+			encoded[i] = string(p.encode())
+		} else {
+			encoded[i] = p.encode()
+		}
+	}
+	_, err := w.Write(bitmap)
+	if err != nil {
+		return err
+	}
+	return t.WriteRecordInFormat(w, encoded, format)
+}
+
+// Decodes a record written by writeStoredRecord; values stored in overflow
+// pages are returned as toastPointers.
+func readStoredRecord(
+	b []byte,
+	t *zdb2.TableHeader,
+	format zdb2.RecordFormat,
+	toasted bool,
+) (zdb2.Record, error) {
+	r := bytes.NewReader(b)
+	bitmap := make([]byte, toastBitmapWidth(t))
+	if toasted {
+		_, err := io.ReadFull(r, bitmap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	record, err := t.ReadRecordInFormat(r, format)
+	if err != nil || !toasted {
+		return record, err
+	}
+	for i, value := range record {
+		if bitmap[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+		var encoded []byte
+		switch v := value.(type) {
+		case string:
+			encoded = []byte(v)
+		case []byte:
+			encoded = v
+		default:
+			return nil, errors.Newf("Invalid toasted value %#v", value)
+		}
+		record[i], err = decodeToastPointer(encoded)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,243 @@
+package heap_file
+
+import (
+	"bytes"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+var posters = &zdb2.TableHeader{
+	Name: "posters",
+	Fields: []*zdb2.Field{
+		{"title", zdb2.String, false, 0, 0},
+		{"image", zdb2.Bytes, true, 0, 0},
+		{"views", zdb2.Int32, false, 0, 0},
+	},
+}
+
+func checkRecords(
+	c *C,
+	hf *heapFile,
+	recordIDs []zdb2.RecordID,
+	expectedRecords []zdb2.Record,
+) {
+	for i, recordID := range recordIDs {
+		record, err := hf.Get(recordID)
+		c.Assert(err, IsNil)
+		c.Assert(record.Equals(expectedRecords[i]), IsTrue)
+	}
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+}
+
+func (s *HeapFileSuite) TestOverflowPages(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, posters)
+	c.Assert(err, IsNil)
+	// The last value is too large to fit in a single page.
+	expectedRecords := []zdb2.Record{
+		{"Heat", []byte{1, 2, 3}, int32(1)},
+		{strings.Repeat("Ronin ", 100), nil, int32(2)},
+		{"Thief", bytes.Repeat([]byte{0xab}, 5000), int32(3)},
+		{strings.Repeat("Drive ", 4000), []byte{}, int32(4)},
+		{"Collateral", bytes.Repeat([]byte("xyz"), 100000), int32(5)},
+	}
+	var recordIDs []zdb2.RecordID
+	for _, record := range expectedRecords {
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	// Only the values above the threshold are moved out of line.
+	for i, toasted := range []bool{false, false, true, true, true} {
+		c.Assert(recordIDs[i].PageID, Equals, hf.lastPage.pageID)
+		vh, err := hf.lastPage.getVersionHeader(recordIDs[i].SlotID)
+		c.Assert(err, IsNil)
+		c.Assert(vh.toasted, Equals, toasted)
+	}
+	c.Assert(hf.bf.NumBlocks > hf.lastPage.pageID+5, IsTrue)
+	checkRecords(c, hf, recordIDs, expectedRecords)
+
+	// Values can move in and out of overflow pages when records are updated.
+	expectedRecords[0][0] = strings.Repeat("Heat ", 1000)
+	expectedRecords[2][1] = []byte{4, 5, 6}
+	for _, i := range []int{0, 2} {
+		c.Assert(hf.Update(recordIDs[i], expectedRecords[i]), IsNil)
+	}
+	checkRecords(c, hf, recordIDs, expectedRecords)
+	c.Assert(hf.Close(), IsNil)
+
+	// The last page in the file is an overflow page, but new records should
+	// still be appended to the last heap page.
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.lastPage.isOverflowPage(), IsFalse)
+	c.Assert(hf.lastPage.pageID, Equals, recordIDs[0].PageID)
+	record := zdb2.Record{"Miami Vice", nil, int32(6)}
+	recordID, err := hf.Insert(record)
+	c.Assert(err, IsNil)
+	c.Assert(recordID.PageID, Equals, recordIDs[0].PageID)
+	expectedRecords = append(expectedRecords, record)
+	recordIDs = append(recordIDs, recordID)
+	checkRecords(c, hf, recordIDs, expectedRecords)
+
+	// Upgrading a page to a new schema keeps values in overflow pages.
+	c.Assert(
+		hf.AddColumn(&zdb2.Field{"year", zdb2.Int32, false, 0, 0}, int32(0)),
+		IsNil)
+	for i := range expectedRecords {
+		expectedRecords[i] = append(expectedRecords[i], int32(0))
+	}
+	record = zdb2.Record{"Tokyo", nil, int32(7), int32(1995)}
+	recordID, err = hf.Insert(record)
+	c.Assert(err, IsNil)
+	expectedRecords = append(expectedRecords, record)
+	recordIDs = append(recordIDs, recordID)
+	c.Assert(hf.lastPage.schemaVersion(), Equals, hf.SchemaVersion())
+	checkRecords(c, hf, recordIDs, expectedRecords)
+	numBlocks := hf.bf.NumBlocks
+	c.Assert(hf.Close(), IsNil)
+	fileScan, err := NewFileScan(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, fileScan, expectedRecords)
+
+	// Rewriting the heap file reclaims the overflow pages that are no longer
+	// used.
+	_, err = RewriteHeapFile(path, nil)
+	c.Assert(err, IsNil)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	c.Assert(hf.bf.NumBlocks < numBlocks, IsTrue)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+}
+
+func (s *HeapFileSuite) TestFreeOverflowPages(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, posters)
+	c.Assert(err, IsNil)
+	defer func() {
+		c.Assert(hf.Close(), IsNil)
+	}()
+	// Each image takes up three overflow pages.
+	image := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, 3*overflowPageCapacity)
+	}
+	expectedRecords := []zdb2.Record{{"Heat", image(1), int32(1)}}
+	recordID, err := hf.Insert(expectedRecords[0])
+	c.Assert(err, IsNil)
+	recordIDs := []zdb2.RecordID{recordID}
+
+	// The old value is freed once the new one has been written, so updates
+	// alternate between two chains of overflow pages.
+	numBlocks := hf.bf.NumBlocks + 3
+	for i := 2; i < 6; i++ {
+		expectedRecords[0][1] = image(byte(i))
+		c.Assert(hf.Update(recordIDs[0], expectedRecords[0]), IsNil)
+		c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+	}
+	checkRecords(c, hf, recordIDs, expectedRecords)
+
+	// A deleted record's overflow pages are freed once its space is
+	// reclaimed.
+	record := zdb2.Record{"Thief", image(6), int32(2)}
+	recordID, err = hf.Insert(record)
+	c.Assert(err, IsNil)
+	c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+	c.Assert(hf.Delete(recordID), IsNil)
+	record = zdb2.Record{"Ronin", image(7), int32(3)}
+	_, err = hf.Insert(record)
+	c.Assert(err, IsNil)
+	numBlocks += 3
+	c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+	m, err := mvcc.OpenManager(c.MkDir() + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+	_, err = hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	expectedRecords = append(expectedRecords, record)
+	recordID, err = hf.Insert(zdb2.Record{"Drive", image(8), int32(4)})
+	c.Assert(err, IsNil)
+	c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+	c.Assert(hf.Delete(recordID), IsNil)
+
+	// So are the overflow pages of versions reclaimed by Vacuum.  Vacuuming
+	// frees two chains here: the deleted record's, and the updated one's.
+	txn, err := m.Begin()
+	c.Assert(err, IsNil)
+	record = zdb2.Record{"Collateral", image(9), int32(5)}
+	_, err = hf.UpdateTxn(txn, recordIDs[0], record)
+	c.Assert(err, IsNil)
+	c.Assert(txn.Commit(), IsNil)
+	// The new version goes into a slot after Ronin's.
+	expectedRecords = append(expectedRecords[1:], record)
+	numBlocks += 3
+	c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+	_, err = hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	txn, err = m.Begin()
+	c.Assert(err, IsNil)
+	for i := 10; i < 12; i++ {
+		record := zdb2.Record{"Tokyo", image(byte(i)), int32(i)}
+		_, err = hf.InsertTxn(txn, record)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(txn.Abort(), IsNil)
+	c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+	_, err = hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	record = zdb2.Record{"Sicario", image(12), int32(7)}
+	sicarioID, err := hf.Insert(record)
+	c.Assert(err, IsNil)
+	c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+	expectedRecords = append(expectedRecords, record)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(verify(c, path), HasLen, 0)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+
+	// Freed pages can also be reused as heap pages, once the last page is full:
+	// those after the last page replace it, and those before it are found via
+	// the free space map.
+	insertedIDs := make(map[zdb2.RecordID]zdb2.Record)
+	insert := func(i int) int32 {
+		record := zdb2.Record{"Heat", []byte{}, int32(i)}
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		insertedIDs[recordID] = record
+		return recordID.PageID
+	}
+	pageIDs := make(map[int32]bool)
+	i := 0
+	for ; len(pageIDs) < 3; i++ {
+		pageIDs[insert(i)] = true
+	}
+	record = zdb2.Record{"Sicario", []byte{}, int32(7)}
+	c.Assert(hf.Update(sicarioID, record), IsNil)
+	insertedIDs[sicarioID] = record
+	lastPageID := hf.lastPage.pageID
+	for ; ; i++ {
+		pageID := insert(i)
+		c.Assert(hf.bf.NumBlocks, Equals, numBlocks)
+		if pageID < lastPageID && !pageIDs[pageID] {
+			break
+		}
+	}
+	c.Assert(hf.lastPage.pageID, Equals, lastPageID)
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(verify(c, path), HasLen, 0)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	for recordID, expected := range insertedIDs {
+		record, err := hf.Get(recordID)
+		c.Assert(err, IsNil)
+		c.Assert(record.Equals(expected), IsTrue)
+	}
+}
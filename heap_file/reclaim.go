@@ -0,0 +1,43 @@
+package heap_file
+
+import (
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+// Before a version's space is reclaimed (by compacting or upgrading its page),
+// or before it's marked as dead, everything that belongs to it has to be
+// released: its entries in attached indexes (see attached_index.go), and the
+// overflow pages that store its large values (see overflow.go).
+
+// Releases the version in the given slot, if it's still stored in the page.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) releaseVersion(hp *heapPage, slotID uint16) error {
+	// The index keys might be stored in the overflow pages.
+	err := hf.removeVersionEntries(hp, slotID)
+	if err != nil {
+		return err
+	}
+	return hf.freeVersionOverflowPages(hp, slotID)
+}
+
+// Releases every version in the page whose space would be reclaimed by
+// compacting the page (see compactedSize).
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) releaseReclaimedVersions(hp *heapPage) error {
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		vh, err := hp.getVersionHeader(slotID)
+		if err != nil {
+			return err
+		}
+		if vh.dead || vh.forwarded || vh.moved || vh.xmax != mvcc.FrozenTxnID {
+			continue
+		}
+		err = hf.releaseVersion(hp, slotID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package heap_file
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+const (
+	// New files are written next to the files they'll replace, with this
+	// suffix added to their paths.
+	rewriteSuffix = ".rewrite"
+
+	// Lists the files being swapped into place, so that an interrupted swap can
+	// be finished.
+	rewriteManifestSuffix = ".rewrite_manifest"
+
+	// Every file managed by the write-ahead log has a log next to it.
+	walSuffix = ".wal"
+)
+
+// A RecordIDMapping maps the RecordID that each record had before its heap file
+// was rewritten to the record's new RecordID.  Records that had been deleted
+// don't appear in the mapping.
+type RecordIDMapping struct {
+	// Records are copied in RecordID order, so both of these are sorted.
+	oldRecordIDs []zdb2.RecordID
+	newRecordIDs []zdb2.RecordID
+}
+
+func (m *RecordIDMapping) Len() int {
+	return len(m.oldRecordIDs)
+}
+
+// At returns the old and new RecordIDs of the ith record, in RecordID order.
+func (m *RecordIDMapping) At(i int) (zdb2.RecordID, zdb2.RecordID) {
+	return m.oldRecordIDs[i], m.newRecordIDs[i]
+}
+
+// Lookup returns the new RecordID for the given old RecordID, or false if there
+// wasn't a record with that RecordID.
+func (m *RecordIDMapping) Lookup(
+	oldRecordID zdb2.RecordID,
+) (zdb2.RecordID, bool) {
+	i := sort.Search(len(m.oldRecordIDs), func(i int) bool {
+		return !lessRecordID(m.oldRecordIDs[i], oldRecordID)
+	})
+	if i == len(m.oldRecordIDs) || m.oldRecordIDs[i] != oldRecordID {
+		return zdb2.RecordID{}, false
+	}
+	return m.newRecordIDs[i], true
+}
+
+func lessRecordID(r1 zdb2.RecordID, r2 zdb2.RecordID) bool {
+	if r1.PageID != r2.PageID {
+		return r1.PageID < r2.PageID
+	}
+	return r1.SlotID < r2.SlotID
+}
+
+// RewriteHeapFile copies every record in the heap file at path into a new,
+// densely packed heap file (which is as small as possible, since the space left
+// behind by deletes is never returned to the file system otherwise).  Each of
+// the B+ tree indexes at indexPaths, which must refer to records in the heap
+// file, is rebuilt to use the new RecordIDs; entries for records that no
+// longer exist are dropped.  The new heap file is always written in the current
+// format (see file_header.go), and every new file stores a checksum with each
+// block.  This is also how heap files in the original layout are converted
+// (see original_layout.go); indexes from back then are converted first (see
+// index.ConvertInt32Layout).
+//
+// The new files are swapped into place at the end.  If the swap is
+// interrupted by a crash, then it's finished the next time that the heap file
+// is opened (or rewritten).
+//
+// This is an offline operation: none of the files can be in use while they're
+// being rewritten.
+func RewriteHeapFile(
+	path string,
+	indexPaths []string,
+) (*RecordIDMapping, error) {
+	err := finishRewrite(path)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := rewriteHeapFile(path, path+rewriteSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, indexPath := range indexPaths {
+		err = rebuildIndex(indexPath, indexPath+rewriteSuffix, mapping)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = writeRewriteManifest(path, append([]string{path}, indexPaths...))
+	if err != nil {
+		return nil, err
+	}
+	err = finishRewrite(path)
+	if err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// Removes the given file (and its log) if it exists.
+func removeWALFile(path string) error {
+	for _, p := range []string{path, path + walSuffix} {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the records of the heap file at path into a new heap file at newPath.
+func rewriteHeapFile(path string, newPath string) (*RecordIDMapping, error) {
+	// Leftovers from a previous attempt that didn't finish are discarded.
+	err := removeWALFile(newPath)
+	if err != nil {
+		return nil, err
+	}
+	s, oldHeader, err := newRewriteScan(path)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	// Every record is encoded under the latest version of the schema, so the
+	// older versions aren't needed anymore.
+	header := &fileHeader{formatVersion: currentFormatVersion}
+	header.setSchemas(oldHeader.t.Name, []*schema{oldHeader.latestSchema()})
+	hf, err := newHeapFile(newPath, header)
+	if err != nil {
+		return nil, err
+	}
+	defer hf.Close()
+	// Just like with BulkLoadNewHeapFile, there's nothing to recover if the
+	// rewrite doesn't finish.  The file is made durable by Close.
+	err = hf.bf.SetLogging(false)
+	if err != nil {
+		return nil, err
+	}
+	mapping := &RecordIDMapping{}
+	for {
+		record, oldRecordID, err := s.NextWithID()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		newRecordID, err := hf.Insert(record)
+		if err != nil {
+			return nil, err
+		}
+		mapping.oldRecordIDs = append(mapping.oldRecordIDs, oldRecordID)
+		mapping.newRecordIDs = append(mapping.newRecordIDs, newRecordID)
+	}
+	err = hf.Close()
+	if err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// Returns a scan over the records of the heap file at path, along with its
+// header.  Heap files in the original layout can't be scanned like the others
+// (see original_layout.go).
+func newRewriteScan(path string) (zdb2.RecordIterator, *fileHeader, error) {
+	original, err := isOriginalHeapFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if original {
+		s, err := newOriginalScan(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.f.header, nil
+	}
+	s, err := NewFileScan(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, s.header, nil
+}
+
+// Builds a copy of the index at path, with its RecordIDs translated by mapping,
+// at newPath.
+func rebuildIndex(
+	path string,
+	newPath string,
+	mapping *RecordIDMapping,
+) error {
+	err := removeWALFile(newPath)
+	if err != nil {
+		return err
+	}
+	keyType, entries, err := readIndexEntries(path, mapping)
+	if err != nil {
+		return err
+	}
+	var bpt *index.BPlusTree
+	if len(entries) == 0 {
+		// Bulk loading requires at least one entry.
+		bpt, err = index.OpenBPlusTree(newPath, keyType)
+	} else {
+		bpt, err = index.BulkLoadNewBPlusTree(newPath, keyType, entries, 1)
+	}
+	if err != nil {
+		return err
+	}
+	return bpt.Close()
+}
+
+// Returns the key type and entries of the index at path, with their RecordIDs
+// translated by mapping.
+func readIndexEntries(
+	path string,
+	mapping *RecordIDMapping,
+) (zdb2.Type, []index.Entry, error) {
+	err := index.ConvertInt32Layout(path)
+	if err != nil {
+		return zdb2.UnknownType, nil, err
+	}
+	bpt, err := index.OpenExistingBPlusTree(path)
+	if err != nil {
+		return zdb2.UnknownType, nil, err
+	}
+	defer bpt.Close()
+	iter, err := bpt.FindAll()
+	if err != nil {
+		return zdb2.UnknownType, nil, err
+	}
+	// Entries come out in key order, and translating their RecordIDs doesn't
+	// change that.
+	var entries []index.Entry
+	for {
+		entry, err := iter.Next()
+		if err == io.EOF {
+			return bpt.KeyType(), entries, nil
+		} else if err != nil {
+			return zdb2.UnknownType, nil, err
+		}
+		rid, ok := mapping.Lookup(entry.RID)
+		if !ok {
+			continue
+		}
+		entries = append(entries, index.Entry{
+			Key: entry.Key,
+			RID: rid,
+		})
+	}
+}
+
+// Records that each of the given files (along with its log) should be replaced
+// by the rewritten copy next to it.  The rewritten copies must already be
+// durable.
+func writeRewriteManifest(path string, paths []string) error {
+	for _, p := range paths {
+		err := syncDir(p)
+		if err != nil {
+			return err
+		}
+	}
+	manifestPath := path + rewriteManifestSuffix
+	tmpPath := manifestPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(paths, "\n") + "\n")
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	// The manifest only takes effect once it's complete.
+	err = os.Rename(tmpPath, manifestPath)
+	if err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// Finishes swapping rewritten files into place, if the heap file at path has a
+// rewrite manifest.  Files that were already swapped (before a crash) are
+// skipped, since their rewritten copies no longer exist.
+func finishRewrite(path string) error {
+	manifestPath := path + rewriteManifestSuffix
+	f, err := os.Open(manifestPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		paths = append(paths, scanner.Text())
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		for _, suffix := range []string{"", walSuffix} {
+			err = os.Rename(p+rewriteSuffix+suffix, p+suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for _, p := range paths {
+		err = syncDir(p)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Remove(manifestPath)
+	if err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// Makes changes to the entries of the directory containing path durable.
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
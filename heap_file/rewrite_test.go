@@ -0,0 +1,324 @@
+package heap_file
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+// Creates a heap file with an index on it (keyed by insertion order), and then
+// deletes most of the records.  Returns the RecordIDs and the expected contents
+// of the surviving records, along with the number of blocks in the heap file.
+func setUpRewrite(
+	c *C,
+	path string,
+	indexPath string,
+) ([]zdb2.RecordID, []zdb2.Record, int32) {
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	bpt, err := index.OpenBPlusTree(indexPath, zdb2.Int32)
+	c.Assert(err, IsNil)
+	var allRecordIDs []zdb2.RecordID
+	for i := 0; i < 2500; i++ {
+		recordID, err := hf.Insert(records[i%len(records)])
+		c.Assert(err, IsNil)
+		c.Assert(bpt.AddEntry(index.Entry{
+			Key: int32(i),
+			RID: recordID,
+		}), IsNil)
+		allRecordIDs = append(allRecordIDs, recordID)
+	}
+	var recordIDs []zdb2.RecordID
+	var expectedRecords []zdb2.Record
+	for i, recordID := range allRecordIDs {
+		if i%10 == 0 {
+			recordIDs = append(recordIDs, recordID)
+			expectedRecords = append(expectedRecords, records[i%len(records)])
+		} else {
+			c.Assert(hf.Delete(recordID), IsNil)
+		}
+	}
+	// Moved records are copied, too.
+	expectedRecords[0] = zdb2.Record{
+		strings.Repeat("Leon: The Professional ", 5),
+		4.6,
+		int32(2),
+	}
+	c.Assert(hf.Update(recordIDs[0], expectedRecords[0]), IsNil)
+	numBlocks := hf.bf.NumBlocks
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(bpt.Close(), IsNil)
+	return recordIDs, expectedRecords, numBlocks
+}
+
+// Checks that the heap file and index were rewritten, given the RecordIDs and
+// contents of the surviving records (from setUpRewrite).
+func checkRewrite(
+	c *C,
+	path string,
+	indexPath string,
+	mapping *RecordIDMapping,
+	recordIDs []zdb2.RecordID,
+	expectedRecords []zdb2.Record,
+	oldNumBlocks int32,
+) {
+	hf, err := OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	c.Assert(hf.bf.NumBlocks < oldNumBlocks, IsTrue)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+
+	c.Assert(mapping.Len(), Equals, len(recordIDs))
+	var newRecordIDs []zdb2.RecordID
+	for i, recordID := range recordIDs {
+		oldRecordID, newRecordID := mapping.At(i)
+		c.Assert(oldRecordID, Equals, recordID)
+		actual, ok := mapping.Lookup(recordID)
+		c.Assert(ok, IsTrue)
+		c.Assert(actual, Equals, newRecordID)
+		record, err := hf.Get(newRecordID)
+		c.Assert(err, IsNil)
+		c.Assert(record, DeepEquals, expectedRecords[i])
+		newRecordIDs = append(newRecordIDs, newRecordID)
+	}
+	// Deleted records aren't in the mapping.
+	_, ok := mapping.Lookup(zdb2.RecordID{
+		PageID: recordIDs[0].PageID,
+		SlotID: recordIDs[0].SlotID + 1,
+	})
+	c.Assert(ok, IsFalse)
+
+	// The index only has entries for the surviving records.
+	bpt, err := index.OpenBPlusTree(indexPath, zdb2.Int32)
+	c.Assert(err, IsNil)
+	defer bpt.Close()
+	iter, err := bpt.FindGreaterEqual(int32(math.MinInt32))
+	c.Assert(err, IsNil)
+	for i, newRecordID := range newRecordIDs {
+		entry, err := iter.Next()
+		c.Assert(err, IsNil)
+		c.Assert(entry, Equals, index.Entry{
+			Key: int32(10 * i),
+			RID: newRecordID,
+		})
+	}
+	_, err = iter.Next()
+	c.Assert(err, Equals, io.EOF)
+
+	// Nothing is left behind.
+	for _, p := range []string{
+		path + rewriteSuffix,
+		indexPath + rewriteSuffix,
+		path + rewriteManifestSuffix,
+	} {
+		_, err := os.Stat(p)
+		c.Assert(os.IsNotExist(err), IsTrue)
+	}
+}
+
+func (s *HeapFileSuite) TestRewrite(c *C) {
+	dir := c.MkDir()
+	path := dir + "/heap_file_test"
+	indexPath := dir + "/index_test"
+	recordIDs, expectedRecords, numBlocks := setUpRewrite(c, path, indexPath)
+
+	mapping, err := RewriteHeapFile(path, []string{indexPath})
+	c.Assert(err, IsNil)
+	checkRewrite(
+		c,
+		path,
+		indexPath,
+		mapping,
+		recordIDs,
+		expectedRecords,
+		numBlocks)
+}
+
+func (s *HeapFileSuite) TestRewriteInterrupted(c *C) {
+	dir := c.MkDir()
+	path := dir + "/heap_file_test"
+	indexPath := dir + "/index_test"
+	recordIDs, expectedRecords, numBlocks := setUpRewrite(c, path, indexPath)
+
+	// Simulate a crash after the heap file (but not the index) was swapped
+	// into place.
+	mapping, err := rewriteHeapFile(path, path+rewriteSuffix)
+	c.Assert(err, IsNil)
+	c.Assert(
+		rebuildIndex(indexPath, indexPath+rewriteSuffix, mapping),
+		IsNil)
+	c.Assert(writeRewriteManifest(path, []string{path, indexPath}), IsNil)
+	for _, suffix := range []string{"", walSuffix} {
+		c.Assert(os.Rename(path+rewriteSuffix+suffix, path+suffix), IsNil)
+	}
+
+	// Opening the heap file finishes the swap.
+	checkRewrite(
+		c,
+		path,
+		indexPath,
+		mapping,
+		recordIDs,
+		expectedRecords,
+		numBlocks)
+}
+
+// Copies a gzipped file from test_data to path.
+func copyTestData(c *C, name string, path string) {
+	f, err := os.Open("test_data/" + name + ".gz")
+	c.Assert(err, IsNil)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	c.Assert(err, IsNil)
+	out, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer out.Close()
+	_, err = io.Copy(out, r)
+	c.Assert(err, IsNil)
+}
+
+func (s *HeapFileSuite) TestRewriteOriginalLayout(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	copyTestData(c, "original_movies", path)
+	var expectedRecords []zdb2.Record
+	for i := 0; i < 3000; i++ {
+		if i%10 != 0 {
+			expectedRecords = append(expectedRecords, zdb2.Record{
+				records[i%len(records)][0],
+				records[i%len(records)][1],
+				int32(i),
+			})
+		}
+	}
+
+	// The heap file can be read without being converted, and its RecordIDs
+	// don't change.
+	hf, err := OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.FormatVersion(), Equals, formatVersion_Original)
+	c.Assert(hf.NumRecords(), Equals, int64(len(expectedRecords)))
+	c.Assert(hf.TableHeader(), DeepEquals, t)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+	var originalIDs []zdb2.RecordID
+	iter := hf.Scan()
+	for {
+		_, recordID, err := iter.NextWithID()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		originalIDs = append(originalIDs, recordID)
+	}
+	c.Assert(iter.Close(), IsNil)
+	for i, recordID := range originalIDs {
+		record, err := hf.Get(recordID)
+		c.Assert(err, IsNil)
+		c.Assert(record, DeepEquals, expectedRecords[i])
+	}
+	// The first record was deleted, but its slot still exists.
+	deletedID := zdb2.RecordID{PageID: 0, SlotID: 0}
+	record, err := hf.Get(deletedID)
+	c.Assert(err, IsNil)
+	c.Assert(record, IsNil)
+	ok, err := hf.HasRecordID(deletedID)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	ok, err = hf.HasRecordID(zdb2.RecordID{PageID: 1 << 20, SlotID: 0})
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	// Every record is visible to every snapshot.
+	m, err := mvcc.OpenManager(c.MkDir() + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+	txn, err := m.Begin()
+	c.Assert(err, IsNil)
+	record, err = hf.GetSnapshot(txn.Snapshot(), originalIDs[0])
+	c.Assert(err, IsNil)
+	c.Assert(record, DeepEquals, expectedRecords[0])
+	zdb2.CheckIterator(c, hf.ScanSnapshot(txn.Snapshot()), expectedRecords)
+
+	// The heap file has to be converted before it can be modified.
+	_, err = hf.Insert(expectedRecords[0])
+	c.Assert(err, Equals, errOriginalLayout)
+	c.Assert(hf.Delete(originalIDs[0]), Equals, errOriginalLayout)
+	c.Assert(
+		hf.Update(originalIDs[0], expectedRecords[0]),
+		Equals,
+		errOriginalLayout)
+	_, err = hf.InsertTxn(txn, expectedRecords[0])
+	c.Assert(err, Equals, errOriginalLayout)
+	c.Assert(hf.RenameColumn("views", "num_views"), Equals, errOriginalLayout)
+	_, err = hf.Vacuum(m)
+	c.Assert(err, Equals, errOriginalLayout)
+	c.Assert(hf.Flush(), IsNil)
+	c.Assert(hf.Close(), IsNil)
+	_, err = NewFileScan(path)
+	c.Assert(err, Equals, errOriginalLayout)
+
+	// The index on views was written along with the heap file, and still uses
+	// the fixed-size int32 layout.
+	indexPath := path + "_views"
+	copyTestData(c, "../../index/test_data/original_movies_views", indexPath)
+	mapping, err := RewriteHeapFile(path, []string{indexPath})
+	c.Assert(err, IsNil)
+	c.Assert(mapping.Len(), Equals, len(expectedRecords))
+	// The first record was deleted.
+	_, ok = mapping.Lookup(deletedID)
+	c.Assert(ok, IsFalse)
+	_, newRecordID := mapping.At(0)
+	actual, ok := mapping.Lookup(originalIDs[0])
+	c.Assert(ok, IsTrue)
+	c.Assert(actual, Equals, newRecordID)
+
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.NumRecords(), Equals, int64(len(expectedRecords)))
+	c.Assert(hf.TableHeader(), DeepEquals, t)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+	for i := 0; i < mapping.Len(); i++ {
+		_, newRecordID := mapping.At(i)
+		record, err := hf.Get(newRecordID)
+		c.Assert(err, IsNil)
+		c.Assert(record, DeepEquals, expectedRecords[i])
+	}
+	// Entries for deleted records were dropped from the index.
+	bpt, err := index.OpenBPlusTree(indexPath, zdb2.Int32)
+	c.Assert(err, IsNil)
+	entries, err := bpt.FindAll()
+	c.Assert(err, IsNil)
+	for _, expected := range expectedRecords {
+		entry, err := entries.Next()
+		c.Assert(err, IsNil)
+		c.Assert(entry.Key, Equals, expected[2])
+		record, err := hf.Get(entry.RID)
+		c.Assert(err, IsNil)
+		c.Assert(record, DeepEquals, expected)
+	}
+	_, err = entries.Next()
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(bpt.Close(), IsNil)
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(verify(c, path), HasLen, 0)
+
+	// A heap file with a single page is converted, too.
+	copyTestData(c, "original_movies", path)
+	c.Assert(os.Truncate(path, pageSize), IsNil)
+	// The log of the converted heap file doesn't belong to it anymore.
+	c.Assert(os.Remove(path+walSuffix), IsNil)
+	mapping, err = RewriteHeapFile(path, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mapping.Len() > 0, IsTrue)
+	c.Assert(mapping.Len() < len(expectedRecords), IsTrue)
+	scan, err := NewFileScan(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, expectedRecords[:mapping.Len()])
+}
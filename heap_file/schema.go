@@ -0,0 +1,472 @@
+package heap_file
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+)
+
+// A heap file's schema can change while it's in use: columns can be added,
+// dropped and renamed without rewriting any records.  Adding or dropping a
+// column creates a new schema version; every heap page records the version
+// that its records were encoded under, and the header block keeps every
+// version that's still in use.  Records are upgraded to the latest version
+// when they're read: added columns are filled in with their default values,
+// and dropped columns are skipped.  A page is upgraded as a whole the next time
+// that a record is written to it (or that it's vacuumed), and older versions
+// are dropped once no page uses them.
+//
+// Renaming a column doesn't change how records are encoded, so it only changes
+// the latest version.
+//
+// Heap files in the original layout can't change their schemas until they're
+// converted with RewriteHeapFile.
+
+// A column is a field of the table, along with an ID that never changes (even
+// if the column is renamed), so that records encoded under one version of the
+// schema can be decoded under another.
+type column struct {
+	id    uint16
+	field zdb2.Field
+
+	// The value of the column for records that were written before the column
+	// was added; only set for columns that were added to an existing table.
+	defaultValue interface{}
+}
+
+type schema struct {
+	version uint32
+	columns []*column
+}
+
+// Returns the first version of the schema for a new table.
+func newSchema(t *zdb2.TableHeader) *schema {
+	s := &schema{version: 1}
+	for i, field := range t.Fields {
+		s.columns = append(s.columns, &column{
+			id:    uint16(i),
+			field: *field,
+		})
+	}
+	return s
+}
+
+func (s *schema) tableHeader(name string) *zdb2.TableHeader {
+	fields := make([]*zdb2.Field, len(s.columns))
+	for i, c := range s.columns {
+		field := c.field
+		fields[i] = &field
+	}
+	return &zdb2.TableHeader{
+		Name:   name,
+		Fields: fields,
+	}
+}
+
+// Returns the index of the column with the given name, or -1 if there isn't
+// one.
+func (s *schema) findColumn(name string) int {
+	for i, c := range s.columns {
+		if c.field.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *schema) findColumnID(id uint16) int {
+	for i, c := range s.columns {
+		if c.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func writeSchema(w io.Writer, s *schema) error {
+	err := binary.Write(w, zdb2.ByteOrder, s.version)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, zdb2.ByteOrder, uint8(len(s.columns)))
+	if err != nil {
+		return err
+	}
+	for _, c := range s.columns {
+		err = binary.Write(w, zdb2.ByteOrder, c.id)
+		if err != nil {
+			return err
+		}
+		err = zdb2.WriteField(w, &c.field)
+		if err != nil {
+			return err
+		}
+		hasDefault := c.defaultValue != nil
+		err = binary.Write(w, zdb2.ByteOrder, hasDefault)
+		if err != nil {
+			return err
+		}
+		if hasDefault {
+			err = zdb2.WriteValueInFormat(
+				w,
+				c.field.Type,
+				c.defaultValue,
+				zdb2.RecordFormat_VarintLengths)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readSchema(r io.Reader) (*schema, error) {
+	s := &schema{}
+	err := binary.Read(r, zdb2.ByteOrder, &s.version)
+	if err != nil {
+		return nil, err
+	}
+	var numColumns uint8
+	err = binary.Read(r, zdb2.ByteOrder, &numColumns)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(numColumns); i++ {
+		c := &column{}
+		err = binary.Read(r, zdb2.ByteOrder, &c.id)
+		if err != nil {
+			return nil, err
+		}
+		field, err := zdb2.ReadField(r)
+		if err != nil {
+			return nil, err
+		}
+		c.field = *field
+		var hasDefault bool
+		err = binary.Read(r, zdb2.ByteOrder, &hasDefault)
+		if err != nil {
+			return nil, err
+		}
+		if hasDefault {
+			c.defaultValue, err = zdb2.ReadValueInFormat(
+				r,
+				c.field.Type,
+				zdb2.RecordFormat_VarintLengths)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.columns = append(s.columns, c)
+	}
+	return s, nil
+}
+
+// A conversion upgrades records that were encoded under an older version of the
+// schema to the latest version.
+type conversion struct {
+	t *zdb2.TableHeader
+
+	// For each of the latest version's columns, its index in the older
+	// version, or -1 if it was added later.
+	indexes []int
+}
+
+// Sets the versions of the schema that might still be in use (in order, with
+// the latest version last), and derives everything else from them.
+func (h *fileHeader) setSchemas(name string, schemas []*schema) {
+	latest := schemas[len(schemas)-1]
+	h.schemas = schemas
+	h.schemaVersion = latest.version
+	h.t = latest.tableHeader(name)
+	h.conversions = make(map[uint32]*conversion, len(schemas)-1)
+	for _, s := range schemas[:len(schemas)-1] {
+		conv := &conversion{
+			t:       s.tableHeader(name),
+			indexes: make([]int, len(latest.columns)),
+		}
+		for i, c := range latest.columns {
+			conv.indexes[i] = s.findColumnID(c.id)
+		}
+		h.conversions[s.version] = conv
+	}
+}
+
+func (h *fileHeader) latestSchema() *schema {
+	return h.schemas[len(h.schemas)-1]
+}
+
+// Decodes a record that was encoded under the given schema version (see
+// readStoredRecord), and upgrades it to the latest version.
+func (h *fileHeader) readRecord(
+	b []byte,
+	version uint32,
+	toasted bool,
+) (zdb2.Record, error) {
+	if version == h.schemaVersion {
+		return readStoredRecord(
+			b,
+			h.t,
+			zdb2.RecordFormat_VarintLengths,
+			toasted)
+	}
+	conv, ok := h.conversions[version]
+	if !ok {
+		return nil, errors.Newf("Unknown schema version %d", version)
+	}
+	record, err := readStoredRecord(
+		b,
+		conv.t,
+		zdb2.RecordFormat_VarintLengths,
+		toasted)
+	if err != nil {
+		return nil, err
+	}
+	latest := h.latestSchema()
+	upgraded := make(zdb2.Record, len(latest.columns))
+	for i, j := range conv.indexes {
+		if j < 0 {
+			upgraded[i] = latest.columns[i].defaultValue
+		} else {
+			upgraded[i] = record[j]
+		}
+	}
+	return upgraded, nil
+}
+
+// Returns an error unless the heap file's schema can be changed.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) checkSchemaChange() error {
+	return hf.checkWritable()
+}
+
+// Replaces the latest version of the schema by s, which becomes a new version
+// unless it has the same version number.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) setLatestSchema(s *schema) error {
+	return hf.runTxn(func() error {
+		err := hf.pruneSchemas()
+		if err != nil {
+			return err
+		}
+		schemas := append([]*schema{}, hf.header.schemas...)
+		if s.version == hf.header.schemaVersion {
+			schemas[len(schemas)-1] = s
+		} else {
+			schemas = append(schemas, s)
+		}
+		hf.header.setSchemas(hf.header.t.Name, schemas)
+		return writeFileHeader(hf.bf, hf.header)
+	})
+}
+
+// Returns whether the page stores records under some version of the schema;
+// overflow pages don't, and neither do pages that were allocated by
+// transactions that were rolled back (which are left zeroed).
+func (hp *heapPage) usesSchema() bool {
+	return !hp.isOverflowPage() && hp.schemaVersion() != 0
+}
+
+// Counts the heap pages that use each version of the schema, unless they've
+// already been counted.
+//
+// Precondition: hf.mu is held
+func (hf *heapFile) countPageVersions() error {
+	if hf.pageVersions != nil {
+		return nil
+	}
+	pageVersions := make(map[uint32]int)
+	firstPageID := hf.header.firstHeapPageID()
+	for pageID := firstPageID; pageID <= hf.lastPage.pageID; pageID++ {
+		if hf.header.isFreeSpaceMapPage(pageID) {
+			continue
+		}
+		hp, err := hf.loadPage(pageID)
+		if err != nil {
+			return err
+		}
+		if hp.usesSchema() {
+			pageVersions[hp.schemaVersion()]++
+		}
+		hf.releasePage(hp, false)
+	}
+	hf.pageVersions = pageVersions
+	return nil
+}
+
+// Records that a heap page now uses the latest version of the schema, instead
+// of oldVersion (which is 0 for a new page).  The old version is dropped once
+// no page uses it.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) setPageVersion(oldVersion uint32) error {
+	if oldVersion == 0 {
+		if hf.pageVersions != nil {
+			hf.pageVersions[hf.header.schemaVersion]++
+		}
+		return nil
+	} else if hf.pageVersions == nil {
+		// Counting the pages takes this one into account.
+		return hf.pruneSchemas()
+	}
+	hf.pageVersions[hf.header.schemaVersion]++
+	hf.pageVersions[oldVersion]--
+	if hf.pageVersions[oldVersion] > 0 {
+		return nil
+	}
+	delete(hf.pageVersions, oldVersion)
+	return hf.pruneSchemas()
+}
+
+// Upgrades the page to the latest version of the schema, if its records fit
+// (see heapPage.upgrade); otherwise, the page is only compacted.  Either way,
+// versions released by releaseReclaimedVersions are reclaimed.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) upgradePage(hp *heapPage) (bool, error) {
+	version := hp.schemaVersion()
+	ok, err := hp.upgrade()
+	if err != nil {
+		return false, err
+	} else if !ok {
+		_, err = hp.compact()
+		return false, err
+	} else if version == hf.header.schemaVersion {
+		return true, nil
+	}
+	return true, hf.setPageVersion(version)
+}
+
+// Drops the older versions of the schema that no heap page uses anymore, so
+// that the header block doesn't fill up with them.
+//
+// Precondition: hf.mu is held, and a transaction is active
+func (hf *heapFile) pruneSchemas() error {
+	err := hf.countPageVersions()
+	if err != nil {
+		return err
+	}
+	oldSchemas := hf.header.schemas
+	var schemas []*schema
+	for _, s := range oldSchemas[:len(oldSchemas)-1] {
+		if hf.pageVersions[s.version] > 0 {
+			schemas = append(schemas, s)
+		}
+	}
+	if len(schemas) == len(oldSchemas)-1 {
+		return nil
+	}
+	schemas = append(schemas, hf.header.latestSchema())
+	hf.header.setSchemas(hf.header.t.Name, schemas)
+	return writeFileHeader(hf.bf, hf.header)
+}
+
+// AddColumn adds a column to the end of the table.  Existing records get the
+// given default value for the new column, which can only be nil if the column
+// is nullable.
+func (hf *heapFile) AddColumn(
+	field *zdb2.Field,
+	defaultValue interface{},
+) error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	err := hf.checkSchemaChange()
+	if err != nil {
+		return err
+	}
+	latest := hf.header.latestSchema()
+	if latest.findColumn(field.Name) >= 0 {
+		return errors.Newf("Column %v already exists", field.Name)
+	}
+	if len(latest.columns) == 0xFF {
+		return errors.Newf("Cannot add column %v to full table", field.Name)
+	}
+	err = zdb2.CheckField(field)
+	if err != nil {
+		return err
+	}
+	// Existing records are NULL in an added nullable column unless a default
+	// value is given.
+	defaultValue, err = zdb2.CoerceValue(field, defaultValue)
+	if err != nil {
+		return err
+	}
+	// Column IDs are never reused, since older versions of the schema might
+	// still refer to them.
+	var id uint16
+	for _, s := range hf.header.schemas {
+		for _, c := range s.columns {
+			if c.id >= id {
+				id = c.id + 1
+			}
+		}
+	}
+	s := &schema{
+		version: latest.version + 1,
+		columns: append([]*column{}, latest.columns...),
+	}
+	s.columns = append(s.columns, &column{
+		id:           id,
+		field:        *field,
+		defaultValue: defaultValue,
+	})
+	return hf.setLatestSchema(s)
+}
+
+// DropColumn removes a column from the table.  The column's values aren't
+// removed from existing records until their pages are next written to.
+func (hf *heapFile) DropColumn(name string) error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	err := hf.checkSchemaChange()
+	if err != nil {
+		return err
+	}
+	latest := hf.header.latestSchema()
+	i := latest.findColumn(name)
+	if i < 0 {
+		return errors.Newf("Column %v doesn't exist", name)
+	}
+	if len(latest.columns) == 1 {
+		return errors.Newf("Cannot drop column %v, which is the only one", name)
+	}
+	s := &schema{
+		version: latest.version + 1,
+		columns: append([]*column{}, latest.columns[:i]...),
+	}
+	s.columns = append(s.columns, latest.columns[i+1:]...)
+	return hf.setLatestSchema(s)
+}
+
+// RenameColumn changes the name of a column.  Existing records don't need to
+// change, so the schema version stays the same.
+func (hf *heapFile) RenameColumn(oldName string, newName string) error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	err := hf.checkSchemaChange()
+	if err != nil {
+		return err
+	}
+	latest := hf.header.latestSchema()
+	i := latest.findColumn(oldName)
+	if i < 0 {
+		return errors.Newf("Column %v doesn't exist", oldName)
+	}
+	if latest.findColumn(newName) >= 0 {
+		return errors.Newf("Column %v already exists", newName)
+	}
+	renamed := *latest.columns[i]
+	renamed.field.Name = newName
+	s := &schema{
+		version: latest.version,
+		columns: append([]*column{}, latest.columns...),
+	}
+	s.columns[i] = &renamed
+	return hf.setLatestSchema(s)
+}
@@ -0,0 +1,217 @@
+package heap_file
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+func (s *HeapFileSuite) TestSchemaChanges(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	defer func() {
+		c.Assert(hf.Close(), IsNil)
+	}()
+
+	// Fill up the first heap page.
+	var expectedRecords []zdb2.Record
+	var recordIDs []zdb2.RecordID
+	for hf.bf.NumBlocks < 4 {
+		record := records[len(recordIDs)%len(records)]
+		recordID, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		expectedRecords = append(expectedRecords, record)
+		recordIDs = append(recordIDs, recordID)
+	}
+	checkRecords := func() {
+		for i, recordID := range recordIDs {
+			record, err := hf.Get(recordID)
+			c.Assert(err, IsNil)
+			c.Assert(record, DeepEquals, expectedRecords[i])
+		}
+		sortByRecordID(expectedRecords, recordIDs)
+		zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+	}
+	checkSchemaVersion := func(recordID zdb2.RecordID, version uint32) {
+		hp, err := hf.loadPage(recordID.PageID)
+		c.Assert(err, IsNil)
+		defer hf.releasePage(hp, false)
+		c.Assert(hp.schemaVersion(), Equals, version)
+	}
+
+	// Existing records get the default value for an added column.
+	c.Assert(hf.AddColumn(&zdb2.Field{"year", zdb2.Int32, false, 0, 0}, int32(1994)), IsNil)
+	c.Assert(hf.SchemaVersion(), Equals, uint32(2))
+	c.Assert(hf.TableHeader(), DeepEquals, &zdb2.TableHeader{
+		Name: "movies",
+		Fields: []*zdb2.Field{
+			{"title", zdb2.String, false, 0, 0},
+			{"rating", zdb2.Float64, false, 0, 0},
+			{"views", zdb2.Int32, false, 0, 0},
+			{"year", zdb2.Int32, false, 0, 0},
+		},
+	})
+	for i, record := range expectedRecords {
+		expectedRecords[i] = append(record[:3:3], int32(1994))
+	}
+	checkRecords()
+	c.Assert(hf.AddColumn(&zdb2.Field{"year", zdb2.Int32, false, 0, 0}, int32(0)), NotNil)
+	c.Assert(hf.AddColumn(&zdb2.Field{"genre", zdb2.String, false, 0, 0}, int32(0)), NotNil)
+	c.Assert(hf.SchemaVersion(), Equals, uint32(2))
+
+	// The first page is full, so it can't be upgraded; instead, the updated
+	// record is moved to another page.
+	first := recordIDs[0]
+	checkSchemaVersion(first, 1)
+	expectedRecords[0] = zdb2.Record{
+		"Leon: The Professional",
+		4.6,
+		int32(3),
+		int32(1994),
+	}
+	c.Assert(hf.Update(first, expectedRecords[0]), IsNil)
+	location, err := hf.resolve(first)
+	c.Assert(err, IsNil)
+	c.Assert(location, Not(Equals), first)
+	checkSchemaVersion(first, 1)
+	checkRecords()
+
+	// Dropping a column makes room to upgrade the first page.
+	c.Assert(hf.DropColumn("rating"), IsNil)
+	c.Assert(hf.DropColumn("rating"), NotNil)
+	c.Assert(hf.SchemaVersion(), Equals, uint32(3))
+	for i, record := range expectedRecords {
+		expectedRecords[i] = zdb2.Record{record[0], record[2], record[3]}
+	}
+	checkRecords()
+	expectedRecords[1] = zdb2.Record{"Gattaca", int32(5), int32(1997)}
+	c.Assert(hf.Update(recordIDs[1], expectedRecords[1]), IsNil)
+	checkSchemaVersion(recordIDs[1], 3)
+	checkRecords()
+
+	// Renames don't change the schema version.
+	c.Assert(hf.RenameColumn("views", "year"), NotNil)
+	c.Assert(hf.RenameColumn("num_views", "views"), NotNil)
+	c.Assert(hf.RenameColumn("views", "num_views"), IsNil)
+	c.Assert(hf.SchemaVersion(), Equals, uint32(3))
+	expectedHeader := &zdb2.TableHeader{
+		Name: "movies",
+		Fields: []*zdb2.Field{
+			{"title", zdb2.String, false, 0, 0},
+			{"num_views", zdb2.Int32, false, 0, 0},
+			{"year", zdb2.Int32, false, 0, 0},
+		},
+	}
+	c.Assert(hf.TableHeader(), DeepEquals, expectedHeader)
+
+	// New records are encoded under the latest schema.
+	record := zdb2.Record{"Hackers", int32(3), int32(1995)}
+	recordID, err := hf.Insert(record)
+	c.Assert(err, IsNil)
+	checkSchemaVersion(recordID, 3)
+	expectedRecords = append(expectedRecords, record)
+	recordIDs = append(recordIDs, recordID)
+	checkRecords()
+
+	// Every page has been upgraded, so the older versions were dropped.
+	c.Assert(hf.Close(), IsNil)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.SchemaVersion(), Equals, uint32(3))
+	c.Assert(hf.TableHeader(), DeepEquals, expectedHeader)
+	c.Assert(hf.header.schemas, HasLen, 1)
+	checkRecords()
+	fileScan, err := NewFileScan(path)
+	c.Assert(err, IsNil)
+	c.Assert(fileScan.TableHeader(), DeepEquals, expectedHeader)
+	zdb2.CheckIterator(c, fileScan, expectedRecords)
+
+	// Rewriting the heap file upgrades every record, but keeps the schema
+	// version.
+	c.Assert(hf.Close(), IsNil)
+	_, err = RewriteHeapFile(path, nil)
+	c.Assert(err, IsNil)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.SchemaVersion(), Equals, uint32(3))
+	c.Assert(hf.header.schemas, HasLen, 1)
+	c.Assert(hf.TableHeader(), DeepEquals, expectedHeader)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+	c.Assert(hf.AddColumn(&zdb2.Field{"genre", zdb2.String, false, 0, 0}, "Thriller"), IsNil)
+	for i, record := range expectedRecords {
+		expectedRecords[i] = append(record[:3:3], "Thriller")
+	}
+
+	// Nullable columns can be added without a default value, in which case
+	// existing records are NULL.
+	c.Assert(hf.AddColumn(&zdb2.Field{"budget", zdb2.Int32, false, 0, 0}, nil), NotNil)
+	c.Assert(hf.AddColumn(&zdb2.Field{"budget", zdb2.Int32, true, 0, 0}, nil), IsNil)
+	for i, record := range expectedRecords {
+		expectedRecords[i] = append(record[:4:4], nil)
+	}
+	record = zdb2.Record{"Sneakers", nil, int32(1992), "Caper", nil}
+	_, err = hf.Insert(record)
+	c.Assert(err, NotNil)
+	record[1] = int32(4)
+	_, err = hf.Insert(record)
+	c.Assert(err, IsNil)
+	expectedRecords = append(expectedRecords, record)
+	c.Assert(hf.Close(), IsNil)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+}
+
+func (s *HeapFileSuite) TestPruneSchemas(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	defer func() {
+		c.Assert(hf.Close(), IsNil)
+	}()
+	var expectedRecords []zdb2.Record
+	for hf.bf.NumBlocks < 4 {
+		record := records[len(expectedRecords)%len(records)]
+		_, err := hf.Insert(record)
+		c.Assert(err, IsNil)
+		expectedRecords = append(expectedRecords, record)
+	}
+
+	// Versions that no page uses are dropped whenever the schema changes, so
+	// the header block doesn't fill up; only the first version (which the
+	// pages use) and the latest two are kept.
+	field := &zdb2.Field{"year", zdb2.Int32, true, 0, 0}
+	for i := 0; i < 10; i++ {
+		c.Assert(hf.AddColumn(field, nil), IsNil)
+		c.Assert(hf.DropColumn("year"), IsNil)
+	}
+	c.Assert(hf.SchemaVersion(), Equals, uint32(21))
+	var versions []uint32
+	for _, s := range hf.header.schemas {
+		versions = append(versions, s.version)
+	}
+	c.Assert(versions, DeepEquals, []uint32{1, 20, 21})
+	c.Assert(hf.Close(), IsNil)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.header.schemas, HasLen, 3)
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+
+	// Vacuuming upgrades every page, after which the first version isn't
+	// needed anymore.
+	m, err := mvcc.OpenManager(c.MkDir() + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+	_, err = hf.Vacuum(m)
+	c.Assert(err, IsNil)
+	c.Assert(hf.header.schemas, HasLen, 1)
+	c.Assert(hf.Close(), IsNil)
+	hf, err = OpenHeapFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(hf.header.schemas, HasLen, 1)
+	c.Assert(hf.SchemaVersion(), Equals, uint32(21))
+	zdb2.CheckIterator(c, hf.Scan(), expectedRecords)
+	c.Assert(verify(c, path), HasLen, 0)
+}
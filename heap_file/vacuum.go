@@ -0,0 +1,285 @@
+package heap_file
+
+import (
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/mvcc"
+)
+
+type VacuumStats struct {
+	NumPagesScanned      int
+	NumVersionsReclaimed int
+	NumVersionsFrozen    int
+	NumBytesReclaimed    int
+}
+
+// Vacuum reclaims the space used by record versions that are no longer visible
+// to any current or future snapshot: versions created by transactions that
+// aborted, and versions deleted by transactions that committed before the
+// oldest active snapshot was taken.  Versions created by such transactions are
+// frozen, so that their visibility no longer depends on the commit log.
+//
+// The space used by records deleted via Delete is reclaimed as well (at which
+// point they can no longer be undeleted), and pages are upgraded to the latest
+// version of the schema.
+//
+// Each page is vacuumed separately, so the heap file can still be used while
+// Vacuum is running.
+func (hf *heapFile) Vacuum(m *mvcc.Manager) (VacuumStats, error) {
+	hf.mu.Lock()
+	err := hf.checkWritable()
+	hf.mu.Unlock()
+	if err != nil {
+		return VacuumStats{}, err
+	}
+	horizon := m.Horizon()
+	var stats VacuumStats
+	for pageID := hf.header.firstHeapPageID(); ; pageID++ {
+		if hf.header.isFreeSpaceMapPage(pageID) {
+			continue
+		}
+		ok, err := hf.vacuumPage(m, horizon, pageID, &stats)
+		if err != nil {
+			return VacuumStats{}, err
+		}
+		if !ok {
+			return stats, nil
+		}
+		err = hf.vacuumForwarded(pageID, &stats)
+		if err != nil {
+			return VacuumStats{}, err
+		}
+	}
+}
+
+// Removes the forwarding pointers in the given page that point to records
+// deleted via Delete, and marks those records as dead (so that their space can
+// be reclaimed), freeing their overflow pages.  These changes are made as a
+// single transaction, so there's never a forwarding pointer to a reclaimed
+// slot.
+func (hf *heapFile) vacuumForwarded(pageID int32, stats *VacuumStats) error {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	hp, err := hf.loadPage(pageID)
+	if err != nil {
+		return err
+	}
+	var forwarded []zdb2.RecordID
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		vh, err := hp.getVersionHeader(slotID)
+		if err != nil {
+			hf.releasePage(hp, false)
+			return err
+		}
+		if vh.forwarded {
+			forwarded = append(forwarded, zdb2.RecordID{
+				PageID: pageID,
+				SlotID: slotID,
+			})
+		}
+	}
+	hf.releasePage(hp, false)
+
+	for _, recordID := range forwarded {
+		location, err := hf.resolve(recordID)
+		if err != nil {
+			return err
+		}
+		target, err := hf.loadPage(location.PageID)
+		if err != nil {
+			return err
+		}
+		vh, err := target.getVersionHeader(location.SlotID)
+		hf.releasePage(target, false)
+		if err != nil {
+			return err
+		}
+		if vh.xmax != mvcc.FrozenTxnID {
+			continue
+		}
+		// Index entries refer to the original RecordID.
+		if len(hf.indexes) > 0 {
+			target, err := hf.loadPage(location.PageID)
+			if err != nil {
+				return err
+			}
+			record, err := target.readFullRecord(location.SlotID)
+			hf.releasePage(target, false)
+			if err != nil {
+				return err
+			}
+			err = hf.removeEntries(record, recordID)
+			if err != nil {
+				return err
+			}
+		}
+		err = hf.runTxn(func() error {
+			target, err := hf.loadPage(location.PageID)
+			if err != nil {
+				return err
+			}
+			err = hf.freeVersionOverflowPages(target, location.SlotID)
+			hf.releasePage(target, false)
+			if err != nil {
+				return err
+			}
+			for _, id := range []zdb2.RecordID{location, recordID} {
+				err := hf.updateVersionHeader(id, func(
+					versionHeader,
+				) (versionHeader, error) {
+					return versionHeader{dead: true}, nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stats.NumVersionsReclaimed++
+	}
+	return nil
+}
+
+// Returns false if the page doesn't exist.
+func (hf *heapFile) vacuumPage(
+	m *mvcc.Manager,
+	horizon mvcc.TxnID,
+	pageID int32,
+	stats *VacuumStats,
+) (bool, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	if pageID > hf.lastPage.pageID {
+		return false, nil
+	}
+	stats.NumPagesScanned++
+
+	// Only pages that need to change are written.
+	hp, err := hf.loadPage(pageID)
+	if err != nil {
+		return false, err
+	}
+	// Pages that use an older version of the schema are upgraded.
+	outdated := hp.usesSchema() && hp.schemaVersion() != hf.header.schemaVersion
+	changed := outdated
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		vh, err := hp.getVersionHeader(slotID)
+		if err != nil {
+			hf.releasePage(hp, false)
+			return false, err
+		}
+		if vacuumVersion(m, horizon, vh) != vh {
+			changed = true
+			break
+		}
+		// Records deleted via Delete or moved by Update might have left space
+		// to reclaim.
+		i, j, err := hp.versionBounds(slotID)
+		if err != nil {
+			hf.releasePage(hp, false)
+			return false, err
+		}
+		if compactedSize(vh, j-i) < j-i {
+			changed = true
+			break
+		}
+	}
+	hf.releasePage(hp, false)
+	if !changed {
+		return true, nil
+	}
+
+	err = hf.updatePage(pageID, func(hp *heapPage) error {
+		numReclaimed := 0
+		numFrozen := 0
+		for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+			vh, err := hp.getVersionHeader(slotID)
+			if err != nil {
+				return err
+			}
+			newVH := vacuumVersion(m, horizon, vh)
+			if newVH == vh {
+				continue
+			}
+			if newVH.dead {
+				err = hf.releaseVersion(hp, slotID)
+				if err != nil {
+					return err
+				}
+				numReclaimed++
+			} else if newVH.xmin != vh.xmin {
+				numFrozen++
+			}
+			err = hp.setVersionHeader(slotID, newVH)
+			if err != nil {
+				return err
+			}
+		}
+		err := hf.releaseReclaimedVersions(hp)
+		if err != nil {
+			return err
+		}
+		numBytes, err := hp.compact()
+		if err != nil {
+			return err
+		}
+		// The page keeps its old version if its records don't fit under the
+		// latest one.
+		if outdated {
+			_, err = hf.upgradePage(hp)
+			if err != nil {
+				return err
+			}
+		}
+		err = hf.setFreeSpace(pageID, int(hp.freeSpace()))
+		if err != nil {
+			return err
+		}
+		hf.header.numRecords -= int64(numReclaimed)
+		stats.NumVersionsReclaimed += numReclaimed
+		stats.NumVersionsFrozen += numFrozen
+		stats.NumBytesReclaimed += numBytes
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the header that a version should have after being vacuumed.
+func vacuumVersion(
+	m *mvcc.Manager,
+	horizon mvcc.TxnID,
+	vh versionHeader,
+) versionHeader {
+	// Records moved by Update aren't versioned.
+	if vh.dead || vh.forwarded || vh.moved {
+		return vh
+	}
+	if vh.xmin != mvcc.FrozenTxnID {
+		switch m.Status(vh.xmin) {
+		case mvcc.Status_Aborted:
+			return versionHeader{dead: true}
+		case mvcc.Status_Committed:
+			if vh.xmin < horizon {
+				vh.xmin = mvcc.FrozenTxnID
+			}
+		}
+	}
+	if vh.xmax != mvcc.InvalidTxnID && vh.xmax != mvcc.FrozenTxnID {
+		switch m.Status(vh.xmax) {
+		case mvcc.Status_Aborted:
+			vh.xmax = mvcc.InvalidTxnID
+		case mvcc.Status_Committed:
+			if vh.xmax < horizon {
+				return versionHeader{dead: true}
+			}
+		}
+	}
+	return vh
+}
@@ -0,0 +1,251 @@
+package heap_file
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/mvcc"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// Verify checks the structure of the heap file at path, and calls report with
+// the pageID and a description of each problem that it finds (or with
+// block_file.InvalidBlockID, for problems with the file as a whole).  Every
+// page is checked, even after a problem has been found:
+//
+//   - the header block can be parsed, and its record count matches the pages
+//   - each heap page's schema version is known
+//   - the lookup table doesn't overlap the records, and its offsets are in
+//     order and in bounds
+//   - each version header can be parsed, forwarded slots point to moved
+//     versions (and vice versa), and each record can be decoded (including any
+//     values stored in overflow pages)
+//
+// The returned error is only non-nil if the file couldn't be checked at all.
+// Opening the file recovers it, unless it's already open (in which case the
+// open wal.File is shared; see wal.OpenFile).  The file isn't modified
+// otherwise.
+func Verify(path string, report func(pageID int32, message string)) error {
+	bf, err := wal.OpenFile(path, pageSize, pageLSNOffset)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+	if bf.NumBlocks == 0 {
+		report(block_file.InvalidBlockID, "File is empty")
+		return nil
+	}
+	h, err := readFileHeader(bf)
+	if err != nil {
+		report(headerBlockID, fmt.Sprintf("Cannot read file header: %v", err))
+		return nil
+	}
+	v := &verifier{
+		bf:             bf,
+		header:         h,
+		report:         report,
+		moved:          make(map[zdb2.RecordID]bool),
+		forwardTargets: make(map[zdb2.RecordID]zdb2.RecordID),
+	}
+	for pageID := int32(0); pageID < bf.NumBlocks; pageID++ {
+		if pageID < h.firstHeapPageID() || h.isFreeSpaceMapPage(pageID) {
+			// There's nothing to check besides the checksum.
+			frame, err := bf.Pin(pageID)
+			if err != nil {
+				v.reportf(pageID, "Cannot read page: %v", err)
+				continue
+			}
+			bf.Unpin(frame, false)
+			continue
+		}
+		hp, err := loadHeapPage(bf, pageID, h)
+		if err != nil {
+			v.reportf(pageID, "Cannot read page: %v", err)
+			continue
+		}
+		// There's nothing to check in a free page.
+		if hp.isOverflowPage() {
+			v.verifyOverflowPage(hp)
+		} else if !isFreePage(hp.data) {
+			v.verifyHeapPage(hp)
+		}
+		hp.release(false)
+	}
+	v.verifyForwarding()
+	if h.numRecords >= 0 && !h.dirty && h.numRecords != v.numRecords {
+		v.reportf(
+			headerBlockID,
+			"Header has record count %d; found %d records",
+			h.numRecords,
+			v.numRecords)
+	}
+	return nil
+}
+
+type verifier struct {
+	bf     *wal.File
+	header *fileHeader
+	report func(pageID int32, message string)
+
+	numRecords int64
+
+	// Every version with the moved flag (mapped to whether it hasn't been
+	// deleted), and the slot forwarded to each location (keyed by the
+	// location).
+	moved          map[zdb2.RecordID]bool
+	forwardTargets map[zdb2.RecordID]zdb2.RecordID
+}
+
+func (v *verifier) reportf(pageID int32, format string, args ...interface{}) {
+	v.report(pageID, fmt.Sprintf(format, args...))
+}
+
+func (v *verifier) verifyOverflowPage(hp *heapPage) {
+	n := int(zdb2.ByteOrder.Uint16(hp.data[8:10]))
+	if n > overflowPageCapacity {
+		v.reportf(
+			hp.pageID,
+			"Overflow page stores %d bytes; expected at most %d",
+			n,
+			overflowPageCapacity)
+	}
+	next := int32(zdb2.ByteOrder.Uint32(hp.data[4:8]))
+	if next != noNextOverflowPage &&
+		(next < v.header.firstHeapPageID() || next >= v.bf.NumBlocks) {
+		v.reportf(hp.pageID, "Next overflow page %d is out of bounds", next)
+	}
+}
+
+func (v *verifier) verifyHeapPage(hp *heapPage) {
+	pageID := hp.pageID
+	start := pageSchemaVersionWidth
+	version := hp.schemaVersion()
+	_, known := v.header.conversions[version]
+	if version != v.header.schemaVersion && !known {
+		v.reportf(pageID, "Unknown schema version %d", version)
+		return
+	}
+	// The lookup table grows down from the footer, towards the records.
+	lookupTableSize := lookupTableFooterWidth +
+		lookupTableEntryWidth*int(hp.numSlots)
+	if int(hp.nextSlotOffset) < start ||
+		int(hp.nextSlotOffset)+lookupTableSize > pageSize {
+		v.reportf(
+			pageID,
+			"nextSlotOffset %d is inconsistent with numSlots %d",
+			hp.nextSlotOffset,
+			hp.numSlots)
+		return
+	}
+	prev := start
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		offset := int(hp.recordOffset(slotID))
+		if offset < prev || offset > int(hp.nextSlotOffset) {
+			v.reportf(
+				pageID,
+				"Slot %d has offset %d; expected offset in [%d, %d]",
+				slotID,
+				offset,
+				prev,
+				hp.nextSlotOffset)
+			return
+		}
+		prev = offset
+	}
+	for slotID := uint16(0); slotID < hp.numSlots; slotID++ {
+		v.verifyVersion(hp, slotID)
+	}
+}
+
+// Precondition: the page's lookup table is valid
+func (v *verifier) verifyVersion(hp *heapPage, slotID uint16) {
+	pageID := hp.pageID
+	recordID := zdb2.RecordID{
+		PageID: pageID,
+		SlotID: slotID,
+	}
+	i, j, _ := hp.versionBounds(slotID)
+	if i != j && j-i < versionHeaderWidth {
+		v.reportf(
+			pageID,
+			"Slot %d has %d bytes; expected at least %d",
+			slotID,
+			j-i,
+			versionHeaderWidth)
+		return
+	}
+	vh, err := hp.getVersionHeader(slotID)
+	if err != nil {
+		v.reportf(pageID, "Cannot read header of slot %d: %v", slotID, err)
+		return
+	}
+	if isCountedVersion(vh) {
+		v.numRecords++
+	}
+	if vh.dead {
+		return
+	} else if vh.forwarded {
+		if other, ok := v.forwardTargets[vh.forwardTo]; ok {
+			v.reportf(
+				pageID,
+				"Slot %d is forwarded to %+v, like %+v",
+				slotID,
+				vh.forwardTo,
+				other)
+		} else {
+			v.forwardTargets[vh.forwardTo] = recordID
+		}
+		return
+	}
+	if vh.moved {
+		v.moved[recordID] = vh.xmax == mvcc.InvalidTxnID
+	}
+	_, err = hp.readFullRecord(slotID)
+	if err != nil {
+		v.reportf(pageID, "Cannot decode record in slot %d: %v", slotID, err)
+	}
+}
+
+// Every forwarded slot should point to a moved version, and every moved version
+// that hasn't been deleted should be pointed to.
+func (v *verifier) verifyForwarding() {
+	var targets []zdb2.RecordID
+	for target := range v.forwardTargets {
+		targets = append(targets, target)
+	}
+	sortRecordIDs(targets)
+	for _, target := range targets {
+		recordID := v.forwardTargets[target]
+		if _, ok := v.moved[target]; !ok {
+			v.reportf(
+				recordID.PageID,
+				"Slot %d is forwarded to %+v, which isn't a moved record",
+				recordID.SlotID,
+				target)
+		}
+	}
+	var moved []zdb2.RecordID
+	for recordID, live := range v.moved {
+		if live {
+			moved = append(moved, recordID)
+		}
+	}
+	sortRecordIDs(moved)
+	for _, recordID := range moved {
+		if _, ok := v.forwardTargets[recordID]; !ok {
+			v.reportf(
+				recordID.PageID,
+				"Slot %d stores a moved record, but no slot is forwarded "+
+					"to it",
+				recordID.SlotID)
+		}
+	}
+}
+
+func sortRecordIDs(recordIDs []zdb2.RecordID) {
+	sort.Slice(recordIDs, func(i, j int) bool {
+		return lessRecordID(recordIDs[i], recordIDs[j])
+	})
+}
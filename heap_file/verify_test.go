@@ -0,0 +1,108 @@
+package heap_file
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// Returns the pageIDs passed to report by Verify, in order.
+func verify(c *C, path string) []int32 {
+	var pageIDs []int32
+	err := Verify(path, func(pageID int32, message string) {
+		pageIDs = append(pageIDs, pageID)
+	})
+	c.Assert(err, IsNil)
+	return pageIDs
+}
+
+// Modifies a page of the heap file at path by calling f on it.
+func corruptPage(c *C, path string, pageID int32, f func(hp *heapPage)) {
+	bf, err := wal.OpenFile(path, pageSize, pageLSNOffset)
+	c.Assert(err, IsNil)
+	h, err := readFileHeader(bf)
+	c.Assert(err, IsNil)
+	c.Assert(bf.Begin(), IsNil)
+	hp, err := loadHeapPage(bf, pageID, h)
+	c.Assert(err, IsNil)
+	before := hp.snapshot()
+	f(hp)
+	c.Assert(hp.logUpdate(before), IsNil)
+	hp.release(true)
+	c.Assert(bf.Commit(), IsNil)
+	c.Assert(bf.Close(), IsNil)
+}
+
+func (s *HeapFileSuite) TestVerify(c *C) {
+	path := c.MkDir() + "/heap_file_test"
+	hf, err := NewHeapFile(path, t)
+	c.Assert(err, IsNil)
+	var recordIDs []zdb2.RecordID
+	for hf.bf.NumBlocks < 4 {
+		recordID, err := hf.Insert(records[len(recordIDs)%len(records)])
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	// Move one record, delete another, and store a value in overflow pages.
+	longTitle := strings.Repeat("Gattaca: The Director's Cut ", 5)
+	c.Assert(
+		hf.Update(recordIDs[1], zdb2.Record{longTitle, 4.9, int32(11)}),
+		IsNil)
+	c.Assert(hf.Delete(recordIDs[2]), IsNil)
+	_, err = hf.Insert(
+		zdb2.Record{strings.Repeat("Hackers ", 2000), 3.7, int32(3)})
+	c.Assert(err, IsNil)
+	overflowPageID := hf.bf.NumBlocks - 1
+	c.Assert(hf.Close(), IsNil)
+	c.Assert(verify(c, path), HasLen, 0)
+
+	// A forwarded slot has to point to a moved record, and vice versa.
+	var forwardTo zdb2.RecordID
+	corruptPage(c, path, recordIDs[1].PageID, func(hp *heapPage) {
+		vh, err := hp.getVersionHeader(recordIDs[1].SlotID)
+		c.Assert(err, IsNil)
+		c.Assert(vh.forwarded, IsTrue)
+		forwardTo = vh.forwardTo
+		vh.forwardTo = recordIDs[0]
+		c.Assert(hp.setVersionHeader(recordIDs[1].SlotID, vh), IsNil)
+	})
+	c.Assert(
+		verify(c, path),
+		DeepEquals,
+		[]int32{recordIDs[1].PageID, forwardTo.PageID})
+	corruptPage(c, path, recordIDs[1].PageID, func(hp *heapPage) {
+		vh, err := hp.getVersionHeader(recordIDs[1].SlotID)
+		c.Assert(err, IsNil)
+		vh.forwardTo = forwardTo
+		c.Assert(hp.setVersionHeader(recordIDs[1].SlotID, vh), IsNil)
+	})
+	c.Assert(verify(c, path), HasLen, 0)
+
+	// The lookup table can't overlap the records.
+	var numSlots uint16
+	corruptPage(c, path, recordIDs[0].PageID, func(hp *heapPage) {
+		numSlots = hp.numSlots
+		hp.numSlots = 2000
+	})
+	// The page's records can't be checked either, so the moved record looks
+	// like it isn't pointed to, and the header's record count looks wrong.
+	c.Assert(
+		verify(c, path),
+		DeepEquals,
+		[]int32{recordIDs[0].PageID, forwardTo.PageID, headerBlockID})
+	corruptPage(c, path, recordIDs[0].PageID, func(hp *heapPage) {
+		hp.numSlots = numSlots
+	})
+	c.Assert(verify(c, path), HasLen, 0)
+
+	// Overflow chains have to stay within the file.
+	corruptPage(c, path, overflowPageID, func(hp *heapPage) {
+		c.Assert(hp.isOverflowPage(), IsTrue)
+		setNextOverflowPage(hp.data, overflowPageID+1)
+	})
+	c.Assert(verify(c, path), DeepEquals, []int32{overflowPageID})
+}
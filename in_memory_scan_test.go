@@ -12,8 +12,8 @@ func (s *InMemoryScanSuite) TestInMemoryScan(c *C) {
 	t := &TableHeader{
 		Name: "users",
 		Fields: []*Field{
-			{"id", Int32},
-			{"name", String},
+			{"id", Int32, false, 0, 0},
+			{"name", String, false, 0, 0},
 		},
 	}
 	records := []Record{
@@ -1,6 +1,7 @@
 package index
 
 import (
+	"fmt"
 	"io"
 	"testing"
 
@@ -108,16 +109,32 @@ func checkIterator(c *C, iter Iterator, expected []Entry) {
 
 	// The returned entries should be sorted by key.
 	for i := 1; i < len(actual); i++ {
-		c.Assert(actual[i-1].Key <= actual[i-1].Key, IsTrue)
+		keyType := testKeyType(actual[i].Key)
+		c.Assert(zdb2.Less(keyType, actual[i].Key, actual[i-1].Key), IsFalse)
 	}
 
-	// The set of returned entries should match the expected entries.
-	expectedSet := make(map[Entry]struct{})
+	// The set of returned entries should match the expected entries.  Entries
+	// with Bytes keys can't be map keys, so their Go syntax is used instead.
+	expectedSet := make(map[string]struct{})
 	for _, entry := range expected {
-		expectedSet[entry] = struct{}{}
+		expectedSet[fmt.Sprintf("%#v", entry)] = struct{}{}
 	}
 	for _, entry := range actual {
-		_, ok := expectedSet[entry]
+		_, ok := expectedSet[fmt.Sprintf("%#v", entry)]
 		c.Assert(ok, IsTrue)
 	}
 }
+
+// Returns the key type of a tree that key could come from.
+func testKeyType(key interface{}) zdb2.Type {
+	switch key.(type) {
+	case int32:
+		return zdb2.Int32
+	case string:
+		return zdb2.String
+	case []byte:
+		return zdb2.Bytes
+	default:
+		panic(fmt.Sprintf("Unexpected key %#v", key))
+	}
+}
@@ -1,21 +1,82 @@
 package index
 
 import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
 	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
+// Every call to AddEntry is a separate transaction in the write-ahead log, so
+// once it returns, the entry will survive a crash.
+//
+// A BPlusTree can be shared by multiple goroutines.
 type BPlusTree struct {
-	bf   *block_file.BlockFile
+	mu   sync.RWMutex
+	path string
+	bf   *wal.File
 	root *internalNode
+	// Incremented by every change, so that iterators can tell when the leaf
+	// nodes they've read might be out of date (see lockedIterator).
+	version uint64
+}
+
+// OpenBPlusTree opens the B+ tree at path, or creates an empty one if the file
+// doesn't exist yet.  Every key in the tree has the given type, which is
+// stored in each node; it has to match the type that the tree was created
+// with.
+func OpenBPlusTree(path string, keyType zdb2.Type) (*BPlusTree, error) {
+	err := checkKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	b, err := openBPlusTree(path, keyType)
+	if err != nil {
+		return nil, err
+	}
+	if b.KeyType() != keyType {
+		b.Close()
+		return nil, errors.Newf(
+			"B+ tree at %v has keys of type %v; expected %v",
+			path,
+			b.KeyType(),
+			keyType)
+	}
+	return b, nil
 }
 
-func OpenBPlusTree(path string) (*BPlusTree, error) {
-	bf, err := block_file.OpenBlockFile(path, blockSize)
+// OpenExistingBPlusTree opens the B+ tree at path with whatever key type it
+// was created with.  Unlike OpenBPlusTree, the file can't be empty.
+func OpenExistingBPlusTree(path string) (*BPlusTree, error) {
+	// Opening a file that doesn't exist would create it.
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return openBPlusTree(path, zdb2.UnknownType)
+}
+
+// Creates an empty B+ tree if the file is empty, unless keyType is
+// zdb2.UnknownType.
+func openBPlusTree(path string, keyType zdb2.Type) (*BPlusTree, error) {
+	bf, err := wal.OpenFile(path, blockSize, pageLSNOffset)
 	if err != nil {
 		return nil, err
 	}
 	var root *internalNode
 	if bf.NumBlocks == 0 {
+		if keyType == zdb2.UnknownType {
+			bf.Close()
+			return nil, errors.Newf("No B+ tree at %v", path)
+		}
+		err = bf.Begin()
+		if err != nil {
+			return nil, err
+		}
 		rootBlockID, err := bf.AllocateBlock()
 		if err != nil {
 			return nil, err
@@ -27,14 +88,18 @@ func OpenBPlusTree(path string) (*BPlusTree, error) {
 		root = &internalNode{
 			bf:               bf,
 			blockID:          rootBlockID,
+			keyType:          keyType,
+			compressKeys:     compressKeysFor(keyType),
 			subtreeHeight:    1,
 			underflowBlockID: leafBlockID,
 		}
 		leaf := &leafNode{
-			bf:          bf,
-			blockID:     leafBlockID,
-			prevBlockID: block_file.InvalidBlockID,
-			nextBlockID: block_file.InvalidBlockID,
+			bf:           bf,
+			blockID:      leafBlockID,
+			keyType:      keyType,
+			compressKeys: compressKeysFor(keyType),
+			prevBlockID:  block_file.InvalidBlockID,
+			nextBlockID:  block_file.InvalidBlockID,
 		}
 		err = root.flush()
 		if err != nil {
@@ -44,6 +109,10 @@ func OpenBPlusTree(path string) (*BPlusTree, error) {
 		if err != nil {
 			return nil, err
 		}
+		err = bf.Commit()
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		n, err := readNode(bf, 0)
 		if err != nil {
@@ -52,12 +121,54 @@ func OpenBPlusTree(path string) (*BPlusTree, error) {
 		root = n.(*internalNode)
 	}
 	return &BPlusTree{
+		path: path,
 		bf:   bf,
 		root: root,
 	}, nil
 }
 
+func (b *BPlusTree) Path() string {
+	return b.path
+}
+
+// KeyType returns the type of every key in the tree.
+func (b *BPlusTree) KeyType() zdb2.Type {
+	return b.root.keyType
+}
+
+// AddEntry returns an error (without changing the tree) if the entry's key
+// doesn't have the tree's key type, or is too long to be stored in a node.
 func (b *BPlusTree) AddEntry(entry Entry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.version++
+
+	err := checkKey(b.root.keyType, entry.Key)
+	if err != nil {
+		return err
+	}
+	err = b.bf.Begin()
+	if err != nil {
+		return err
+	}
+	err = b.addEntry(entry)
+	if err != nil {
+		abortErr := b.bf.Abort()
+		if abortErr != nil {
+			return abortErr
+		}
+		// The cached root might not match what's on disk anymore.
+		n, abortErr := readNode(b.bf, 0)
+		if abortErr != nil {
+			return abortErr
+		}
+		b.root = n.(*internalNode)
+		return err
+	}
+	return b.bf.Commit()
+}
+
+func (b *BPlusTree) addEntry(entry Entry) error {
 	splitRouter, err := b.root.addEntry(entry)
 	if err != nil {
 		return err
@@ -72,18 +183,293 @@ func (b *BPlusTree) AddEntry(entry Entry) error {
 	return nil
 }
 
-func (b *BPlusTree) FindEqual(key int32) (Iterator, error) {
-	return b.root.findEqual(key)
-}
+// DeleteEntry removes the entry with the given key and RecordID, and returns
+// EntryNotFound if there isn't one.  Like AddEntry, every call is a separate
+// transaction in the write-ahead log.
+func (b *BPlusTree) DeleteEntry(entry Entry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.version++
 
-func (b *BPlusTree) FindGreaterEqual(key int32) (Iterator, error) {
-	return b.root.findGreaterEqual(key)
+	err := zdb2.CheckValue(b.root.keyType, entry.Key)
+	if err != nil {
+		return err
+	}
+	err = b.bf.Begin()
+	if err != nil {
+		return err
+	}
+	err = b.deleteEntry(entry)
+	if err != nil {
+		abortErr := b.bf.Abort()
+		if abortErr != nil {
+			return abortErr
+		}
+		// The cached root might not match what's on disk anymore.
+		n, abortErr := readNode(b.bf, 0)
+		if abortErr != nil {
+			return abortErr
+		}
+		b.root = n.(*internalNode)
+		return err
+	}
+	return b.bf.Commit()
 }
 
-func (b *BPlusTree) Close() error {
-	err := b.root.flush()
+// The root is allowed to underflow, as long as it has at least one router (or
+// its only child is a leaf node).
+func (b *BPlusTree) deleteEntry(entry Entry) error {
+	_, err := b.root.deleteEntry(entry)
 	if err != nil {
 		return err
 	}
+	return handleRootCollapse(b.bf, b.root)
+}
+
+// FindEqual returns the entries with the given key, which must have the tree's
+// key type.
+func (b *BPlusTree) FindEqual(key interface{}) (Iterator, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	err := zdb2.CheckValue(b.root.keyType, key)
+	if err != nil {
+		return nil, err
+	}
+	return b.newLockedIterator(func(interface{}) (Iterator, error) {
+		return b.root.findEqual(key)
+	})
+}
+
+// FindGreaterEqual returns the entries with keys greater than or equal to the
+// given key (which must have the tree's key type), in key order.
+func (b *BPlusTree) FindGreaterEqual(key interface{}) (Iterator, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	err := zdb2.CheckValue(b.root.keyType, key)
+	if err != nil {
+		return nil, err
+	}
+	return b.newLockedIterator(func(lastKey interface{}) (Iterator, error) {
+		if lastKey != nil {
+			key = lastKey
+		}
+		return b.root.findGreaterEqual(key)
+	})
+}
+
+// FindAll returns every entry in the tree, in key order.
+func (b *BPlusTree) FindAll() (Iterator, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.newLockedIterator(func(lastKey interface{}) (Iterator, error) {
+		if lastKey != nil {
+			return b.root.findGreaterEqual(lastKey)
+		}
+		ln, err := b.root.firstLeafNode()
+		if err != nil {
+			return nil, err
+		}
+		return &leafNodeIterator{
+			ln:       ln,
+			position: 0,
+		}, nil
+	})
+}
+
+// FindRange returns the entries with keys between lo and hi, in key order.
+// Either bound can be the zero Bound, which leaves that end of the range open;
+// the keys of the others must have the tree's key type.
+func (b *BPlusTree) FindRange(lo, hi Bound) (Iterator, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	err := b.checkBounds(lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	return b.newLockedIterator(func(lastKey interface{}) (Iterator, error) {
+		if lastKey != nil {
+			lo = Inclusive(lastKey)
+		}
+		return b.root.findRange(lo, hi)
+	})
+}
+
+// FindRangeReverse is like FindRange, but returns the entries in reverse key
+// order, starting from hi.
+func (b *BPlusTree) FindRangeReverse(lo, hi Bound) (Iterator, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	err := b.checkBounds(lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	return b.newLockedIterator(func(lastKey interface{}) (Iterator, error) {
+		if lastKey != nil {
+			hi = Inclusive(lastKey)
+		}
+		return b.root.findRangeReverse(lo, hi)
+	})
+}
+
+func (b *BPlusTree) checkBounds(bounds ...Bound) error {
+	for _, bound := range bounds {
+		if bound.Key == nil {
+			continue
+		}
+		err := zdb2.CheckValue(b.root.keyType, bound.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindPrefix returns the entries (in key order) whose composite keys (see
+// CompositeKey) have the given values for their leading fields; there can be
+// fewer values than fields.  If lower or upper isn't nil, then the entries are
+// also limited to the ones where the next field is at least lower, or less
+// than upper (which excludes NULLs in the next field).  The tree's keys have
+// to have been encoded by k.
+func (b *BPlusTree) FindPrefix(
+	k *CompositeKey,
+	prefix []interface{},
+	lower interface{},
+	upper interface{},
+) (Iterator, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.root.keyType != zdb2.Bytes {
+		return nil, errors.Newf(
+			"Composite keys are stored as %v; B+ tree has keys of type %v",
+			zdb2.Bytes,
+			b.root.keyType)
+	}
+	start, done, err := k.prefixRange(prefix, lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	return b.newLockedIterator(func(lastKey interface{}) (Iterator, error) {
+		if lastKey != nil {
+			start = lastKey.([]byte)
+		}
+		iter, err := b.root.findGreaterEqual(start)
+		if err != nil {
+			return nil, err
+		}
+		return &whileIterator{
+			iter: iter,
+			predicate: func(entry Entry) bool {
+				return !done(entry.Key.([]byte))
+			},
+		}, nil
+	})
+}
+
+// Returns the entries from iter up until the first one that doesn't satisfy
+// the predicate.
+type whileIterator struct {
+	iter      Iterator
+	predicate func(Entry) bool
+}
+
+func (iter *whileIterator) Next() (Entry, error) {
+	entry, err := iter.iter.Next()
+	if err != nil {
+		return Entry{}, err
+	}
+	if !iter.predicate(entry) {
+		return Entry{}, io.EOF
+	}
+	return entry, nil
+}
+
+// Iterators read leaf nodes lazily, so they need to hold the tree's read lock
+// while doing so.  The tree can change between calls to Next (and merging leaf
+// nodes frees one of them), so if it has, then the iterator starts over from
+// the last key that it returned, skipping the entries with that key that it
+// already returned.
+type lockedIterator struct {
+	b       *BPlusTree
+	version uint64
+	iter    Iterator
+	// Returns the entries starting from the given key, or all of them if the
+	// key is nil.
+	restart func(lastKey interface{}) (Iterator, error)
+	lastKey interface{}
+	// The RecordIDs of the returned entries with lastKey.
+	lastRIDs map[zdb2.RecordID]bool
+	done     bool
+}
+
+// Precondition: b.mu is held
+func (b *BPlusTree) newLockedIterator(
+	restart func(lastKey interface{}) (Iterator, error),
+) (Iterator, error) {
+	iter, err := restart(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedIterator{
+		b:       b,
+		version: b.version,
+		iter:    iter,
+		restart: restart,
+	}, nil
+}
+
+func (iter *lockedIterator) Next() (Entry, error) {
+	iter.b.mu.RLock()
+	defer iter.b.mu.RUnlock()
+
+	if iter.done {
+		return Entry{}, io.EOF
+	}
+	if iter.version != iter.b.version {
+		next, err := iter.restart(iter.lastKey)
+		if err != nil {
+			return Entry{}, err
+		}
+		iter.iter = next
+		iter.version = iter.b.version
+	}
+	for {
+		entry, err := iter.iter.Next()
+		if err == io.EOF {
+			iter.done = true
+		}
+		if err != nil {
+			return Entry{}, err
+		}
+		if iter.lastKey == nil ||
+			compareKeys(iter.b.root.keyType, entry.Key, iter.lastKey) != 0 {
+			iter.lastKey = entry.Key
+			iter.lastRIDs = make(map[zdb2.RecordID]bool)
+		} else if iter.lastRIDs[entry.RID] {
+			continue
+		}
+		iter.lastRIDs[entry.RID] = true
+		return entry, nil
+	}
+}
+
+// AddChecksums converts a B+ tree created before block checksums were added,
+// so that corrupt nodes are detected when they're read.  The B+ tree can't be
+// in use while this is running.
+func AddChecksums(path string) error {
+	return wal.AddChecksums(path, blockSize, pageLSNOffset)
+}
+
+// Every change is flushed as soon as it's made, so there's nothing to write
+// back for the root.
+func (b *BPlusTree) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	return b.bf.Close()
 }
@@ -1,8 +1,24 @@
 package index
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
 	"github.com/dropbox/godropbox/math2/rand2"
 	. "gopkg.in/check.v1"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
 type BPlusTreeSuite struct{}
@@ -18,7 +34,7 @@ func (e entryShuffle) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
 
 func (s *BPlusTreeSuite) TestBPlusTree(c *C) {
 	path := c.MkDir() + "/b_plus_tree_test"
-	tree, err := OpenBPlusTree(path)
+	tree, err := OpenBPlusTree(path, zdb2.Int32)
 	c.Assert(err, IsNil)
 	numKeys := 100
 	numEntriesPerKey := 10
@@ -35,3 +51,487 @@ func (s *BPlusTreeSuite) TestBPlusTree(c *C) {
 	err = tree.Close()
 	c.Assert(err, IsNil)
 }
+
+func (s *BPlusTreeSuite) TestCrashRecovery(c *C) {
+	defaultPool := buffer_pool.Default()
+	defer buffer_pool.SetDefault(defaultPool)
+	defer wal.ClearCrashPoints()
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(8, buffer_pool.NewLRU()))
+
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, IsNil)
+	testEntries := generateSortedTestEntries(100, 10)
+	rand2.Shuffle(entryShuffle(testEntries))
+
+	// Crash while writing back a block, partway through adding entries.
+	wal.SetCrashPoint(wal.CrashPoint_WriteBack, 200)
+	numAdded := 0
+	func() {
+		defer func() {
+			c.Assert(recover(), Equals, wal.Crash)
+		}()
+		for _, entry := range testEntries {
+			err := tree.AddEntry(entry)
+			c.Assert(err, IsNil)
+			numAdded++
+		}
+	}()
+	c.Assert(numAdded < len(testEntries), Equals, true)
+	// Throw away all cached blocks.
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(8, buffer_pool.NewLRU()))
+
+	// Every entry that was added before the crash should be present.
+	tree, err = OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, IsNil)
+	iter, err := tree.FindGreaterEqual(int32(0))
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, testEntries[:numAdded])
+
+	// The recovered tree should still accept new entries.
+	for _, entry := range testEntries[numAdded:] {
+		err = tree.AddEntry(entry)
+		c.Assert(err, IsNil)
+	}
+	checkTestEntries(c, tree, 100, 10)
+	err = tree.Close()
+	c.Assert(err, IsNil)
+}
+
+func (s *BPlusTreeSuite) TestDeleteEntry(c *C) {
+	// Check trees with unique keys, and with long runs of duplicate keys (which
+	// span multiple leaf nodes).
+	for _, numEntriesPerKey := range []int{1, 10, 50} {
+		testDeleteEntry(c, 1000/numEntriesPerKey, numEntriesPerKey)
+	}
+}
+
+func testDeleteEntry(c *C, numKeys int, numEntriesPerKey int) {
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, IsNil)
+	testEntries := generateSortedTestEntries(numKeys, numEntriesPerKey)
+	rand2.Shuffle(entryShuffle(testEntries))
+	for _, entry := range testEntries {
+		err = tree.AddEntry(entry)
+		c.Assert(err, IsNil)
+	}
+
+	// Entries that aren't in the tree can't be deleted.
+	missing := generateTestEntry(0, numEntriesPerKey)
+	c.Assert(tree.DeleteEntry(missing), Equals, EntryNotFound)
+	missing = generateTestEntry(1, 0)
+	c.Assert(tree.DeleteEntry(missing), Equals, EntryNotFound)
+
+	// Delete the entries in a different random order, checking the tree's
+	// structure along the way.
+	rand2.Shuffle(entryShuffle(testEntries))
+	for len(testEntries) > 0 {
+		n := min(len(testEntries), 97)
+		for _, entry := range testEntries[:n] {
+			err = tree.DeleteEntry(entry)
+			c.Assert(err, IsNil)
+		}
+		c.Assert(tree.DeleteEntry(testEntries[0]), Equals, EntryNotFound)
+		testEntries = testEntries[n:]
+		iter, err := tree.FindGreaterEqual(int32(math.MinInt32))
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, testEntries)
+		for _, entry := range testEntries[:min(len(testEntries), 10)] {
+			iter, err := tree.FindEqual(entry.Key)
+			c.Assert(err, IsNil)
+			var expected []Entry
+			for _, other := range testEntries {
+				if other.Key == entry.Key {
+					expected = append(expected, other)
+				}
+			}
+			checkIterator(c, iter, expected)
+		}
+
+		c.Assert(tree.Close(), IsNil)
+		violations, _ := verify(c, path)
+		c.Assert(violations, HasLen, 0)
+		tree, err = OpenBPlusTree(path, zdb2.Int32)
+		c.Assert(err, IsNil)
+	}
+
+	// Once every entry has been deleted, the root only has an empty leaf node
+	// below it.
+	c.Assert(tree.root.subtreeHeight, Equals, int32(1))
+	c.Assert(tree.root.sortedRouters, HasLen, 0)
+
+	// The tree can still be used afterwards.
+	testEntries = generateSortedTestEntries(numKeys, numEntriesPerKey)
+	rand2.Shuffle(entryShuffle(testEntries))
+	for _, entry := range testEntries {
+		err = tree.AddEntry(entry)
+		c.Assert(err, IsNil)
+	}
+	checkTestEntries(c, tree, numKeys, numEntriesPerKey)
+	c.Assert(tree.Close(), IsNil)
+}
+
+func (s *BPlusTreeSuite) TestIteratorWithDeletes(c *C) {
+	for _, numEntriesPerKey := range []int{1, 50} {
+		testIteratorWithDeletes(c, 1000/numEntriesPerKey, numEntriesPerKey)
+	}
+}
+
+// Iterators pick up where they left off when the tree changes, even if the
+// leaf node that they were reading has been merged away.
+func testIteratorWithDeletes(c *C, numKeys int, numEntriesPerKey int) {
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, IsNil)
+	testEntries := generateSortedTestEntries(numKeys, numEntriesPerKey)
+	for _, entry := range testEntries {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+	forward, err := tree.FindAll()
+	c.Assert(err, IsNil)
+	reverse, err := tree.FindRangeReverse(Bound{}, Bound{})
+	c.Assert(err, IsNil)
+	n := len(testEntries)
+	for i := 0; i < 300; i++ {
+		entry, err := forward.Next()
+		c.Assert(err, IsNil)
+		c.Assert(entry, DeepEquals, testEntries[i])
+		entry, err = reverse.Next()
+		c.Assert(err, IsNil)
+		c.Assert(entry, DeepEquals, testEntries[n-1-i])
+	}
+
+	// Only every tenth entry is left.
+	var expectedForward, expectedReverse []Entry
+	for i, entry := range testEntries {
+		if i%10 != 0 {
+			c.Assert(tree.DeleteEntry(entry), IsNil)
+		} else if i >= 300 {
+			expectedForward = append(expectedForward, entry)
+		}
+	}
+	for i := n - 301; i >= 0; i-- {
+		if i%10 == 0 {
+			expectedReverse = append(expectedReverse, testEntries[i])
+		}
+	}
+	checkIterator(c, forward, expectedForward)
+	c.Assert(collectEntries(c, reverse), DeepEquals, expectedReverse)
+	c.Assert(tree.Close(), IsNil)
+}
+
+func (s *BPlusTreeSuite) TestStringKeys(c *C) {
+	// Use a larger block size, so that there's room for longer keys.
+	oldBlockSize := blockSize
+	setBlockSize(1 << 8)
+	defer setBlockSize(oldBlockSize)
+
+	// Keys have a range of lengths, and many of them share prefixes.
+	var keys []string
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("%v%d", strings.Repeat("ab", i%20), i))
+	}
+	sort.Strings(keys)
+	var testEntries []Entry
+	for _, key := range keys {
+		for j := 0; j < 3; j++ {
+			testEntries = append(testEntries, Entry{
+				Key: key,
+				RID: zdb2.RecordID{PageID: int32(j), SlotID: uint16(j)},
+			})
+		}
+	}
+
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := OpenBPlusTree(path, zdb2.String)
+	c.Assert(err, IsNil)
+	shuffled := append([]Entry(nil), testEntries...)
+	rand2.Shuffle(entryShuffle(shuffled))
+	for _, entry := range shuffled {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+
+	// Keys of the wrong type, and keys that are too long, are rejected.
+	c.Assert(tree.AddEntry(Entry{Key: int32(1)}), NotNil)
+	c.Assert(tree.AddEntry(Entry{Key: strings.Repeat("a", maxKeySize)}), NotNil)
+	_, err = tree.FindEqual(int32(1))
+	c.Assert(err, NotNil)
+	c.Assert(tree.Close(), IsNil)
+
+	// The key type has to match the one that the tree was created with.
+	_, err = OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, NotNil)
+	tree, err = OpenExistingBPlusTree(path)
+	c.Assert(err, IsNil)
+	c.Assert(tree.KeyType(), Equals, zdb2.String)
+
+	for i, key := range keys {
+		iter, err := tree.FindEqual(key)
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, testEntries[3*i:3*i+3])
+		iter, err = tree.FindEqual(key + "!")
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, nil)
+	}
+	iter, err := tree.FindGreaterEqual(keys[100])
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, testEntries[300:])
+	iter, err = tree.FindAll()
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, testEntries)
+
+	// Delete every other key.
+	var remaining []Entry
+	for i, entry := range testEntries {
+		if i/3%2 == 0 {
+			c.Assert(tree.DeleteEntry(entry), IsNil)
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+	iter, err = tree.FindAll()
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, remaining)
+	c.Assert(tree.Close(), IsNil)
+	violations, _ := verify(c, path)
+	c.Assert(violations, HasLen, 0)
+}
+
+func (s *BPlusTreeSuite) TestFindRange(c *C) {
+	// Runs of duplicate keys span multiple leaf nodes.
+	numKeys := 50
+	numEntriesPerKey := 10
+	testEntries := generateSortedTestEntries(numKeys, numEntriesPerKey)
+	dir := c.MkDir()
+	tree, err := OpenBPlusTree(dir+"/b_plus_tree_test", zdb2.Int32)
+	c.Assert(err, IsNil)
+	shuffled := append([]Entry(nil), testEntries...)
+	rand2.Shuffle(entryShuffle(shuffled))
+	for _, entry := range shuffled {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+	checkFindRange(c, tree, testEntries)
+	c.Assert(tree.Close(), IsNil)
+
+	tree, err = BulkLoadNewBPlusTree(
+		dir+"/bulk_load_test",
+		zdb2.Int32,
+		testEntries,
+		0.7)
+	c.Assert(err, IsNil)
+	checkFindRange(c, tree, testEntries)
+
+	// Bounds have to have the tree's key type.
+	_, err = tree.FindRange(Inclusive(int64(0)), Bound{})
+	c.Assert(err, NotNil)
+	_, err = tree.FindRangeReverse(Bound{}, Exclusive("0"))
+	c.Assert(err, NotNil)
+	c.Assert(tree.Close(), IsNil)
+}
+
+// Checks FindRange and FindRangeReverse against every entry in the tree, for
+// bounds at, between, and beyond its keys.
+func checkFindRange(c *C, tree *BPlusTree, sortedEntries []Entry) {
+	bounds := []Bound{{}}
+	lastKey := sortedEntries[len(sortedEntries)-1].Key.(int32)
+	for _, key := range []int32{-1, 0, 3, 5, 60, 62, 100, lastKey, lastKey + 1} {
+		bounds = append(bounds, Inclusive(key), Exclusive(key))
+	}
+	for _, lo := range bounds {
+		for _, hi := range bounds {
+			var expected []Entry
+			for _, entry := range sortedEntries {
+				if aboveLower(zdb2.Int32, lo, entry.Key) &&
+					belowUpper(zdb2.Int32, hi, entry.Key) {
+					expected = append(expected, entry)
+				}
+			}
+			iter, err := tree.FindRange(lo, hi)
+			c.Assert(err, IsNil)
+			forward := collectEntries(c, iter)
+			checkIterator(c, &sliceIterator{entries: forward}, expected)
+
+			// Duplicates come out in the opposite order, too.
+			iter, err = tree.FindRangeReverse(lo, hi)
+			c.Assert(err, IsNil)
+			reverse := collectEntries(c, iter)
+			c.Assert(reverse, HasLen, len(forward), Commentf("%v, %v", lo, hi))
+			for i, entry := range reverse {
+				c.Assert(entry, DeepEquals, forward[len(forward)-1-i])
+			}
+		}
+	}
+}
+
+func collectEntries(c *C, iter Iterator) []Entry {
+	var entries []Entry
+	for {
+		entry, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		entries = append(entries, entry)
+	}
+	_, err := iter.Next()
+	c.Assert(err, Equals, io.EOF)
+	return entries
+}
+
+type sliceIterator struct {
+	entries []Entry
+}
+
+func (iter *sliceIterator) Next() (Entry, error) {
+	if len(iter.entries) == 0 {
+		return Entry{}, io.EOF
+	}
+	entry := iter.entries[0]
+	iter.entries = iter.entries[1:]
+	return entry, nil
+}
+
+func (s *BPlusTreeSuite) TestAddChecksumsOriginalLayout(c *C) {
+	// The B+ tree was written with the default block size.
+	oldBlockSize := blockSize
+	setBlockSize(1 << 16)
+	defer setBlockSize(oldBlockSize)
+
+	path := c.MkDir() + "/b_plus_tree_test"
+	f, err := os.Open("test_data/original_movies_views.gz")
+	c.Assert(err, IsNil)
+	r, err := gzip.NewReader(f)
+	c.Assert(err, IsNil)
+	original, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	c.Assert(ioutil.WriteFile(path, original, 0644), IsNil)
+
+	// The blocks are unchanged by the conversion.
+	c.Assert(AddChecksums(path), IsNil)
+	bf, err := block_file.OpenBlockFile(path, blockSize)
+	c.Assert(err, IsNil)
+	c.Assert(bf.Checksums, Equals, true)
+	c.Assert(bf.NumBlocks, Equals, int32(len(original)/blockSize))
+	b := make([]byte, blockSize)
+	for blockID := int32(0); blockID < bf.NumBlocks; blockID++ {
+		c.Assert(bf.ReadBlock(b, blockID), IsNil)
+		i := int(blockID) * blockSize
+		c.Assert(bytes.Equal(b, original[i:i+blockSize]), Equals, true)
+	}
+	c.Assert(bf.Close(), IsNil)
+	// Converting the B+ tree again does nothing.
+	c.Assert(AddChecksums(path), IsNil)
+
+	// The nodes still use the fixed-size int32 layout, so the B+ tree has to be
+	// converted before it can be used.
+	_, err = OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "has to be converted"), Equals, true)
+	c.Assert(ConvertInt32Layout(path), IsNil)
+	checkOriginalMoviesViews(c, path)
+}
+
+func (s *BPlusTreeSuite) TestConvertInt32Layout(c *C) {
+	oldBlockSize := blockSize
+	setBlockSize(1 << 16)
+	defer setBlockSize(oldBlockSize)
+
+	// A B+ tree from before the write-ahead log was added.
+	path := c.MkDir() + "/b_plus_tree_test"
+	copyOriginalMoviesViews(c, path)
+	c.Assert(ConvertInt32Layout(path), IsNil)
+	checkOriginalMoviesViews(c, path)
+	// Converting the B+ tree again does nothing.
+	c.Assert(ConvertInt32Layout(path), IsNil)
+	checkOriginalMoviesViews(c, path)
+
+	// A B+ tree from after the write-ahead log was added, whose only leaf node
+	// overflows into a second one (since the key at the boundary is
+	// duplicated).
+	path = c.MkDir() + "/b_plus_tree_test"
+	bf, err := wal.OpenFile(path, blockSize, pageLSNOffset)
+	c.Assert(err, IsNil)
+	c.Assert(bf.Begin(), IsNil)
+	var expected []Entry
+	var cells [][]interface{}
+	for i := 0; i < 3000; i++ {
+		entry := generateTestEntry(int32(i/2), i%2)
+		expected = append(expected, entry)
+		cells = append(cells, []interface{}{
+			entry.Key,
+			entry.RID.PageID,
+			entry.RID.SlotID,
+		})
+	}
+	for blockID, values := range [][]interface{}{
+		{blockType_Int32InternalNode, uint16(0), int32(1), int32(1)},
+		{blockType_Int32LeafNode, int32(block_file.InvalidBlockID), int32(2),
+			uint16(2001), cells[:2001], true},
+		{blockType_Int32LeafNode, int32(1), int32(block_file.InvalidBlockID),
+			uint16(999), cells[2001:], false},
+	} {
+		buf := bytes.NewBuffer(make([]byte, 0, blockSize))
+		c.Assert(binary.Write(buf, byteOrder, values[0]), IsNil)
+		c.Assert(binary.Write(buf, byteOrder, int64(0)), IsNil)
+		for _, value := range values[1:] {
+			if cells, ok := value.([][]interface{}); ok {
+				for _, cell := range cells {
+					for _, v := range cell {
+						c.Assert(binary.Write(buf, byteOrder, v), IsNil)
+					}
+				}
+			} else {
+				c.Assert(binary.Write(buf, byteOrder, value), IsNil)
+			}
+		}
+		b := make([]byte, blockSize)
+		copy(b, buf.Bytes())
+		allocated, err := bf.AllocateBlock()
+		c.Assert(err, IsNil)
+		c.Assert(allocated, Equals, int32(blockID))
+		c.Assert(bf.WriteBlock(b, allocated), IsNil)
+	}
+	c.Assert(bf.Commit(), IsNil)
+	c.Assert(bf.Close(), IsNil)
+	c.Assert(ConvertInt32Layout(path), IsNil)
+	tree, err := OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, IsNil)
+	iter, err := tree.FindAll()
+	c.Assert(err, IsNil)
+	c.Assert(collectEntries(c, iter), DeepEquals, expected)
+	c.Assert(tree.Close(), IsNil)
+	violations, _ := verify(c, path)
+	c.Assert(violations, HasLen, 0)
+}
+
+// Copies test_data/original_movies_views.gz (see test_data/README.md) to
+// path.
+func copyOriginalMoviesViews(c *C, path string) {
+	f, err := os.Open("test_data/original_movies_views.gz")
+	c.Assert(err, IsNil)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	c.Assert(err, IsNil)
+	original, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(path, original, 0644), IsNil)
+}
+
+// Checks the converted copy of test_data/original_movies_views.gz, which maps
+// each number of views in [0, 3000) to a record.
+func checkOriginalMoviesViews(c *C, path string) {
+	tree, err := OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, IsNil)
+	iter, err := tree.FindAll()
+	c.Assert(err, IsNil)
+	entries := collectEntries(c, iter)
+	c.Assert(entries, HasLen, 3000)
+	for i, entry := range entries {
+		c.Assert(entry.Key, Equals, int32(i))
+	}
+	c.Assert(tree.Close(), IsNil)
+	violations, _ := verify(c, path)
+	c.Assert(violations, HasLen, 0)
+}
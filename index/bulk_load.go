@@ -1,10 +1,10 @@
 package index
 
 import (
-	"math"
-
 	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
 	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
 func min(a, b int) int {
@@ -15,8 +15,21 @@ func min(a, b int) int {
 	}
 }
 
+func max(a, b int) int {
+	if a >= b {
+		return a
+	} else {
+		return b
+	}
+}
+
+// BulkLoadNewBPlusTree creates a B+ tree at path from entries that are already
+// sorted by key (see SortEntries).  Each leaf node is filled until its entries
+// take up loadingFactor of the space in it, though every leaf node gets at
+// least one entry.
 func BulkLoadNewBPlusTree(
 	path string,
+	keyType zdb2.Type,
 	sortedEntries []Entry,
 	loadingFactor float64,
 ) (*BPlusTree, error) {
@@ -28,12 +41,17 @@ func BulkLoadNewBPlusTree(
 			"Loading factor must be in (0, 1]; got %v",
 			loadingFactor)
 	}
-	if math.Floor(loadingFactor*float64(maxLeafNodeEntries)) == 0 {
-		return nil, errors.Newf(
-			"Loading factor %v would result in no entries per leaf node",
-			loadingFactor)
+	err := checkKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range sortedEntries {
+		err = checkKey(keyType, entry.Key)
+		if err != nil {
+			return nil, err
+		}
 	}
-	bf, err := block_file.OpenBlockFile(path, blockSize)
+	bf, err := wal.OpenFile(path, blockSize, pageLSNOffset)
 	if err != nil {
 		return nil, err
 	}
@@ -42,12 +60,25 @@ func BulkLoadNewBPlusTree(
 			"Cannot bulk load into non-empty B+ tree file at %v",
 			path)
 	}
+	// There's nothing to recover if the bulk load doesn't finish, so the
+	// individual changes aren't logged.
+	err = bf.SetLogging(false)
+	if err != nil {
+		return nil, err
+	}
+	err = bf.Begin()
+	if err != nil {
+		return nil, err
+	}
 	rootBlockID, err := bf.AllocateBlock()
 	if err != nil {
 		return nil, err
 	}
+	compressKeys := compressKeysFor(keyType)
 	leafRouters, err := bulkLoadSequentialLeafNodes(
 		bf,
+		keyType,
+		compressKeys,
 		sortedEntries,
 		loadingFactor)
 	if err != nil {
@@ -56,6 +87,8 @@ func BulkLoadNewBPlusTree(
 	root := &internalNode{
 		bf:               bf,
 		blockID:          rootBlockID,
+		keyType:          keyType,
+		compressKeys:     compressKeys,
 		subtreeHeight:    1,
 		underflowBlockID: leafRouters[0].blockID,
 	}
@@ -88,7 +121,17 @@ func BulkLoadNewBPlusTree(
 			return nil, err
 		}
 	}
+	err = bf.Commit()
+	if err != nil {
+		return nil, err
+	}
+	// Turning logging back on makes the bulk loaded tree durable.
+	err = bf.SetLogging(true)
+	if err != nil {
+		return nil, err
+	}
 	return &BPlusTree{
+		path: path,
 		bf:   bf,
 		root: root,
 	}, nil
@@ -98,34 +141,43 @@ func BulkLoadNewBPlusTree(
 // - Aside from the root (at blockID 0), no other nodes have been created
 // - loadingFactor is in (0, 1]
 func bulkLoadSequentialLeafNodes(
-	bf *block_file.BlockFile,
+	bf *wal.File,
+	keyType zdb2.Type,
+	compressKeys bool,
 	sortedEntries []Entry,
 	loadingFactor float64,
 ) ([]router, error) {
-	numEntriesPerLeafNode := int(math.Floor(
-		loadingFactor * float64(maxLeafNodeEntries)))
-	leafRouters := make(
-		[]router,
-		0,
-		len(sortedEntries)/numEntriesPerLeafNode)
-	prevDuplicateOverflow := false
+	leafNodeFill := int(loadingFactor * float64(leafNodeCapacity))
+	var leafRouters []router
+	var prev *leafNode
 	for len(sortedEntries) > 0 {
 		leafNode, err := bulkLoadLeafNode(
 			bf,
+			keyType,
+			compressKeys,
 			sortedEntries,
-			numEntriesPerLeafNode)
+			leafNodeFill)
 		if err != nil {
 			return nil, err
 		}
-		if !prevDuplicateOverflow {
+		if prev == nil {
+			// The router for the first leaf node is never used for lookups
+			// (see internalNode.underflowBlockID).
 			leafRouters = append(
 				leafRouters,
 				router{
 					key:     leafNode.sortedEntries[0].Key,
 					blockID: leafNode.blockID,
 				})
+		} else if !prev.duplicateOverflow {
+			leafRouters = append(
+				leafRouters,
+				router{
+					key:     prev.separator(leafNode.sortedEntries[0]),
+					blockID: leafNode.blockID,
+				})
 		}
-		prevDuplicateOverflow = leafNode.duplicateOverflow
+		prev = leafNode
 		sortedEntries = sortedEntries[len(leafNode.sortedEntries):]
 	}
 	return leafRouters, nil
@@ -135,11 +187,13 @@ func bulkLoadSequentialLeafNodes(
 // - Aside from the root (at blockID 0), no internal nodes have been created
 // - All entries in remainingSortedEntries have keys greater than entries from
 //   previous calls to bulkLoadLeafNode
-// - numEntriesPerLeafNode is in [1, maxLeafNodeEntries]
+// - leafNodeFill is at most leafNodeCapacity
 func bulkLoadLeafNode(
-	bf *block_file.BlockFile,
+	bf *wal.File,
+	keyType zdb2.Type,
+	compressKeys bool,
 	remainingSortedEntries []Entry,
-	numEntriesPerLeafNode int,
+	leafNodeFill int,
 ) (*leafNode, error) {
 	var blockID int32
 	var prevBlockID int32
@@ -158,24 +212,38 @@ func bulkLoadLeafNode(
 		prevBlockID = blockID - 1
 	}
 
-	if len(remainingSortedEntries) <= numEntriesPerLeafNode {
-		nextBlockID = block_file.InvalidBlockID
-	} else {
-		nextBlockID = blockID + 1
+	// Take entries until the leaf node is filled, but always take at least
+	// one.  The prefix that the keys share only depends on the first and last
+	// key, so the size can be kept track of as entries are taken (see
+	// entryRun).
+	n := 1
+	total := entrySize(keyType, remainingSortedEntries[0])
+	for n < len(remainingSortedEntries) {
+		total += entrySize(keyType, remainingSortedEntries[n])
+		p := prefixLength(compressKeys, remainingSortedEntries[:n+1])
+		if p+total-(n+1)*p > leafNodeFill {
+			break
+		}
+		n++
 	}
-
-	n := min(numEntriesPerLeafNode, len(remainingSortedEntries))
 	sortedEntries = remainingSortedEntries[:n]
 
 	if len(remainingSortedEntries) <= n {
+		nextBlockID = block_file.InvalidBlockID
 		duplicateOverflow = false
-	} else if remainingSortedEntries[n-1].Key == remainingSortedEntries[n].Key {
-		duplicateOverflow = true
+	} else {
+		nextBlockID = blockID + 1
+		duplicateOverflow = compareKeys(
+			keyType,
+			remainingSortedEntries[n-1].Key,
+			remainingSortedEntries[n].Key) == 0
 	}
 
 	leaf := &leafNode{
 		bf:                bf,
 		blockID:           blockID,
+		keyType:           keyType,
+		compressKeys:      compressKeys,
 		prevBlockID:       prevBlockID,
 		nextBlockID:       nextBlockID,
 		sortedEntries:     sortedEntries,
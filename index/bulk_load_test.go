@@ -4,6 +4,7 @@ import (
 	. "gopkg.in/check.v1"
 
 	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
 )
 
 type BulkLoadSuite struct{}
@@ -19,6 +20,7 @@ func (s *BulkLoadSuite) TestBulkLoad(c *C) {
 	for _, loadingFactor := range []float64{1.0, 0.7, 0.4, 0.3} {
 		tree, err := BulkLoadNewBPlusTree(
 			c.MkDir()+"/bulk_load_test",
+			zdb2.Int32,
 			sortedTestEntries,
 			loadingFactor)
 		c.Assert(err, IsNil)
@@ -0,0 +1,365 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+)
+
+// A CompositeKey is a key made up of several fields of a table, in order.  Keys
+// are compared field by field: by the first field, then by the second field
+// among keys with equal first fields, and so on.  NULL comes before every
+// other value.
+//
+// B+ trees store composite keys as Bytes, in an encoding that gives the same
+// order when the bytes are compared:
+//
+//   - each field starts with 0x00 if it's NULL (and nothing else follows), or
+//     0x01 otherwise
+//   - integers are big-endian, with the sign bit flipped so that negative
+//     numbers come first; dates and timestamps are encoded like an int64
+//     number of microseconds since the Unix epoch
+//   - floats are big-endian, with the sign bit flipped for positive numbers
+//     and every bit flipped for negative ones; -0 is encoded like 0, and
+//     every NaN like math.NaN(), which comes after +Inf
+//   - decimals are rescaled to MaxDecimalScale digits after the decimal point,
+//     and encoded like a 128-bit integer
+//   - strings and bytes have each 0x00 escaped as 0x00 0xFF, and end with
+//     0x00 0x01, so that a value never compares greater than one that it's a
+//     prefix of
+//
+// The encoding of some leading fields is a prefix of the encoding of the whole
+// key, which is what makes prefix lookups possible (see BPlusTree.FindPrefix).
+type CompositeKey struct {
+	fields    []*zdb2.Field
+	positions []int
+}
+
+// NewCompositeKey returns the composite key made up of the given fields of t,
+// in order.
+func NewCompositeKey(
+	t *zdb2.TableHeader,
+	fieldNames ...string,
+) (*CompositeKey, error) {
+	if len(fieldNames) == 0 {
+		return nil, errors.New("Composite key has no fields")
+	}
+	k := &CompositeKey{}
+	for _, name := range fieldNames {
+		position := -1
+		for i, field := range t.Fields {
+			if field.Name == name {
+				position = i
+				break
+			}
+		}
+		if position == -1 {
+			return nil, errors.Newf("%v does not have field %v", t.Name, name)
+		}
+		field := t.Fields[position]
+		err := checkKeyType(field.Type)
+		if err != nil {
+			return nil, err
+		}
+		k.fields = append(k.fields, field)
+		k.positions = append(k.positions, position)
+	}
+	return k, nil
+}
+
+// Fields returns the fields that make up the key, in order.
+func (k *CompositeKey) Fields() []*zdb2.Field {
+	return k.fields
+}
+
+// Key returns the key of a record in the table that k was created from.
+func (k *CompositeKey) Key(record zdb2.Record) ([]byte, error) {
+	values := make([]interface{}, len(k.positions))
+	for i, position := range k.positions {
+		if position >= len(record) {
+			return nil, errors.Newf(
+				"Record has %d fields; expected at least %d",
+				len(record),
+				position+1)
+		}
+		values[i] = record[position]
+	}
+	return k.Encode(values...)
+}
+
+// Encode returns the encoding of the given values of the leading fields (which
+// can be all of the fields, or just some of them).
+func (k *CompositeKey) Encode(values ...interface{}) ([]byte, error) {
+	if len(values) > len(k.fields) {
+		return nil, errors.Newf(
+			"Composite key has %d fields; got %d values",
+			len(k.fields),
+			len(values))
+	}
+	var buf bytes.Buffer
+	for i, value := range values {
+		err := k.encodeField(&buf, i, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (k *CompositeKey) encodeField(
+	buf *bytes.Buffer,
+	i int,
+	value interface{},
+) error {
+	field := k.fields[i]
+	if value == nil {
+		if !field.Nullable {
+			return errors.Newf("Field %v is not nullable", field.Name)
+		}
+		buf.WriteByte(0x00)
+		return nil
+	}
+	err := zdb2.CheckValue(field.Type, value)
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(0x01)
+	switch field.Type {
+	case zdb2.Int32:
+		putUint32(buf, uint32(value.(int32))^(1<<31))
+	case zdb2.Int64:
+		putUint64(buf, uint64(value.(int64))^(1<<63))
+	case zdb2.Float64:
+		f := value.(float64)
+		if f == 0 {
+			// -0 and 0 are equal.
+			f = 0
+		} else if math.IsNaN(f) {
+			// NaNs can have any sign and payload; without picking one of
+			// them, equal keys could have different encodings, and negative
+			// NaNs would come before -Inf.
+			f = math.NaN()
+		}
+		bits := math.Float64bits(f)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		putUint64(buf, bits)
+	case zdb2.Bool:
+		if value.(bool) {
+			buf.WriteByte(0x01)
+		} else {
+			buf.WriteByte(0x00)
+		}
+	case zdb2.Date, zdb2.Timestamp:
+		putUint64(buf, uint64(timeToMicros(value.(time.Time)))^(1<<63))
+	case zdb2.Decimal:
+		d := value.(zdb2.DecimalValue)
+		x := big.NewInt(d.Unscaled)
+		x.Mul(x, pow10(zdb2.MaxDecimalScale-int(d.Scale)))
+		x.Add(x, decimalBias)
+		buf.Write(x.FillBytes(make([]byte, 16)))
+	case zdb2.String, zdb2.Bytes:
+		for _, b := range []byte(keyString(value)) {
+			buf.WriteByte(b)
+			if b == 0x00 {
+				buf.WriteByte(0xFF)
+			}
+		}
+		buf.Write([]byte{0x00, 0x01})
+	}
+	return nil
+}
+
+// Decode returns the values of the fields in an encoded key, which can be
+// for just some of the leading fields (see Encode).
+func (k *CompositeKey) Decode(key []byte) ([]interface{}, error) {
+	var values []interface{}
+	r := bytes.NewReader(key)
+	for i := 0; r.Len() > 0; i++ {
+		if i == len(k.fields) {
+			return nil, errors.Newf(
+				"Composite key has more than %d fields",
+				len(k.fields))
+		}
+		value, err := k.decodeField(r, i)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (k *CompositeKey) decodeField(r *bytes.Reader, i int) (interface{}, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if tag == 0x00 {
+		return nil, nil
+	}
+	switch k.fields[i].Type {
+	case zdb2.Int32:
+		var u uint32
+		err = binary.Read(r, binary.BigEndian, &u)
+		return int32(u ^ (1 << 31)), err
+	case zdb2.Int64:
+		var u uint64
+		err = binary.Read(r, binary.BigEndian, &u)
+		return int64(u ^ (1 << 63)), err
+	case zdb2.Float64:
+		var bits uint64
+		err = binary.Read(r, binary.BigEndian, &bits)
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), err
+	case zdb2.Bool:
+		b, err := r.ReadByte()
+		return b == 0x01, err
+	case zdb2.Date, zdb2.Timestamp:
+		var u uint64
+		err = binary.Read(r, binary.BigEndian, &u)
+		return microsToTime(int64(u ^ (1 << 63))), err
+	case zdb2.Decimal:
+		b := make([]byte, 16)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		x := new(big.Int).SetBytes(b)
+		x.Sub(x, decimalBias)
+		// Only the value can be recovered, so it's returned with the smallest
+		// scale that represents it exactly.
+		d := zdb2.DecimalValue{Scale: zdb2.MaxDecimalScale}
+		ten := big.NewInt(10)
+		for d.Scale > 0 && new(big.Int).Rem(x, ten).Sign() == 0 {
+			x.Quo(x, ten)
+			d.Scale--
+		}
+		if !x.IsInt64() {
+			return nil, errors.New("Decimal is out of range")
+		}
+		d.Unscaled = x.Int64()
+		return d, nil
+	default:
+		var s []byte
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == 0x00 {
+				b, err = r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				if b == 0x01 {
+					break
+				}
+				b = 0x00
+			}
+			s = append(s, b)
+		}
+		if k.fields[i].Type == zdb2.String {
+			return string(s), nil
+		}
+		return s, nil
+	}
+}
+
+// Returns the range of encoded keys with the given leading fields, where the
+// next field is in [lower, upper) (either of which can be nil, for no bound):
+// the keys that are at least start, and come before the first key for which
+// done returns true.  Keys where the next field is NULL are only in the range
+// if there are no bounds, since NULL isn't comparable to either bound (even
+// though it's encoded before every other value).
+func (k *CompositeKey) prefixRange(
+	prefix []interface{},
+	lower interface{},
+	upper interface{},
+) ([]byte, func(key []byte) bool, error) {
+	if (lower != nil || upper != nil) && len(prefix) >= len(k.fields) {
+		return nil, nil, errors.Newf(
+			"Composite key has %d fields, so there's no field after the "+
+				"%d in the prefix",
+			len(k.fields),
+			len(prefix))
+	}
+	encodedPrefix, err := k.Encode(prefix...)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := encodedPrefix
+	if lower == nil && upper != nil {
+		// Skip the NULLs.
+		start = append(append([]byte(nil), encodedPrefix...), 0x01)
+	} else if lower != nil {
+		buf := bytes.NewBuffer(append([]byte(nil), encodedPrefix...))
+		err = k.encodeField(buf, len(prefix), lower)
+		if err != nil {
+			return nil, nil, err
+		}
+		start = buf.Bytes()
+	}
+	if upper == nil {
+		return start, func(key []byte) bool {
+			return !bytes.HasPrefix(key, encodedPrefix)
+		}, nil
+	}
+	buf := bytes.NewBuffer(append([]byte(nil), encodedPrefix...))
+	err = k.encodeField(buf, len(prefix), upper)
+	if err != nil {
+		return nil, nil, err
+	}
+	end := buf.Bytes()
+	return start, func(key []byte) bool {
+		return bytes.Compare(key, end) >= 0
+	}, nil
+}
+
+func putUint32(buf *bytes.Buffer, u uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], u)
+	buf.Write(b[:])
+}
+
+func putUint64(buf *bytes.Buffer, u uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], u)
+	buf.Write(b[:])
+}
+
+func timeToMicros(t time.Time) int64 {
+	return t.Unix()*1e6 + int64(t.Nanosecond()/1e3)
+}
+
+func microsToTime(micros int64) time.Time {
+	seconds := micros / 1e6
+	micros %= 1e6
+	// Round down for times before 1970.
+	if micros < 0 {
+		seconds--
+		micros += 1e6
+	}
+	return time.Unix(seconds, micros*1e3).UTC()
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// Decimals rescaled to MaxDecimalScale fit in a signed 128-bit integer, which is
+// shifted up by 2^127 so that it's never negative.
+var decimalBias = new(big.Int).Lsh(big.NewInt(1), 127)
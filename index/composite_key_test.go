@@ -0,0 +1,310 @@
+package index
+
+import (
+	"bytes"
+	"math"
+	"time"
+
+	"github.com/dropbox/godropbox/math2/rand2"
+	. "gopkg.in/check.v1"
+
+	"github.com/robot-dreams/zdb2"
+)
+
+type CompositeKeySuite struct{}
+
+var _ = Suite(&CompositeKeySuite{})
+
+// Values of each type in increasing order.
+var orderedValues = map[zdb2.Type][]interface{}{
+	zdb2.Int32: {
+		int32(math.MinInt32),
+		int32(-1),
+		int32(0),
+		int32(1),
+		int32(math.MaxInt32),
+	},
+	zdb2.Int64: {
+		int64(math.MinInt64),
+		int64(-300),
+		int64(0),
+		int64(7),
+		int64(math.MaxInt64),
+	},
+	zdb2.Float64: {
+		math.Inf(-1), -1e10, -0.5, 0.0, 1e-300, 0.5, 2.0, math.Inf(1),
+	},
+	zdb2.String: {"", "\x00", "\x00\x00", "\x00a", "a", "a\x00", "ab", "b"},
+	zdb2.Bytes: {
+		[]byte{}, []byte{0}, []byte{0, 0xFF}, []byte{1}, []byte{0xFF, 0},
+	},
+	zdb2.Bool: {false, true},
+	zdb2.Date: {
+		zdb2.NewDate(1900, 1, 1),
+		zdb2.NewDate(1970, 1, 1),
+		zdb2.NewDate(2018, 2, 1),
+	},
+	zdb2.Timestamp: {
+		time.Unix(-1, 999999000).UTC(),
+		time.Unix(0, 0).UTC(),
+		time.Unix(0, 1000).UTC(),
+	},
+	zdb2.Decimal: {
+		zdb2.DecimalValue{Unscaled: math.MinInt64, Scale: 0},
+		zdb2.DecimalValue{Unscaled: -15, Scale: 1},
+		zdb2.DecimalValue{Unscaled: -1, Scale: 18},
+		zdb2.DecimalValue{Unscaled: 0, Scale: 3},
+		zdb2.DecimalValue{Unscaled: 1250, Scale: 3},
+		zdb2.DecimalValue{Unscaled: 13, Scale: 1},
+		zdb2.DecimalValue{Unscaled: math.MaxInt64, Scale: 0},
+	},
+}
+
+func (s *CompositeKeySuite) TestOrder(c *C) {
+	for type_, values := range orderedValues {
+		// The second field is what breaks ties in the first one.
+		t := &zdb2.TableHeader{
+			Name: "t",
+			Fields: []*zdb2.Field{
+				{"a", type_, true, 0, 0},
+				{"b", zdb2.String, false, 0, 0},
+			},
+		}
+		k, err := NewCompositeKey(t, "a", "b")
+		c.Assert(err, IsNil)
+		var keys [][]byte
+		var expected [][]interface{}
+		for _, value := range append([]interface{}{nil}, values...) {
+			for _, s := range []string{"", "x", "y"} {
+				key, err := k.Encode(value, s)
+				c.Assert(err, IsNil)
+				keys = append(keys, key)
+				expected = append(expected, []interface{}{value, s})
+			}
+		}
+		for i, key := range keys {
+			if i > 0 {
+				c.Assert(
+					bytes.Compare(keys[i-1], key),
+					Equals,
+					-1,
+					Commentf("%v: %v, %v", type_, expected[i-1], expected[i]))
+			}
+			decoded, err := k.Decode(key)
+			c.Assert(err, IsNil)
+			c.Assert(zdb2.Record(decoded).Equals(expected[i]), Equals, true)
+		}
+	}
+
+	// Equal values have the same encoding, even if they're represented
+	// differently.
+	t := &zdb2.TableHeader{
+		Name: "t",
+		Fields: []*zdb2.Field{
+			{"f", zdb2.Float64, false, 0, 0},
+			{"d", zdb2.Decimal, false, 18, 3},
+		},
+	}
+	k, err := NewCompositeKey(t, "f", "d")
+	c.Assert(err, IsNil)
+	k1, err := k.Encode(
+		math.Copysign(0, -1),
+		zdb2.DecimalValue{Unscaled: 125, Scale: 1})
+	c.Assert(err, IsNil)
+	k2, err := k.Encode(
+		0.0,
+		zdb2.DecimalValue{Unscaled: 12500, Scale: 3})
+	c.Assert(err, IsNil)
+	c.Assert(k1, DeepEquals, k2)
+}
+
+func (s *CompositeKeySuite) TestInvalidKeys(c *C) {
+	t := &zdb2.TableHeader{
+		Name: "ratings",
+		Fields: []*zdb2.Field{
+			{"userId", zdb2.Int32, false, 0, 0},
+			{"movieId", zdb2.Int32, false, 0, 0},
+		},
+	}
+	_, err := NewCompositeKey(t)
+	c.Assert(err, NotNil)
+	_, err = NewCompositeKey(t, "userId", "timestamp")
+	c.Assert(err, NotNil)
+	k, err := NewCompositeKey(t, "userId", "movieId")
+	c.Assert(err, IsNil)
+	_, err = k.Encode(int32(1), int32(2), int32(3))
+	c.Assert(err, NotNil)
+	_, err = k.Encode(int64(1))
+	c.Assert(err, NotNil)
+	_, err = k.Encode(nil)
+	c.Assert(err, NotNil)
+	_, err = k.Key(zdb2.Record{int32(1)})
+	c.Assert(err, NotNil)
+}
+
+func (s *CompositeKeySuite) TestFindPrefix(c *C) {
+	oldBlockSize := blockSize
+	setBlockSize(1 << 8)
+	defer setBlockSize(oldBlockSize)
+
+	t := &zdb2.TableHeader{
+		Name: "ratings",
+		Fields: []*zdb2.Field{
+			{"rating", zdb2.Float64, false, 0, 0},
+			{"movieId", zdb2.Int32, false, 0, 0},
+			{"userId", zdb2.Int32, false, 0, 0},
+		},
+	}
+	k, err := NewCompositeKey(t, "userId", "movieId")
+	c.Assert(err, IsNil)
+	c.Assert(k.Fields(), DeepEquals, []*zdb2.Field{t.Fields[2], t.Fields[1]})
+
+	// Users and movies include negative IDs, whose encodings come first.
+	var entries []Entry
+	for userID := int32(-5); userID < 5; userID++ {
+		for movieID := int32(-30); movieID < 30; movieID += 3 {
+			key, err := k.Key(zdb2.Record{2.5, movieID, userID})
+			c.Assert(err, IsNil)
+			entries = append(entries, Entry{
+				Key: key,
+				RID: zdb2.RecordID{
+					PageID: userID,
+					SlotID: uint16(movieID + 30),
+				},
+			})
+		}
+	}
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := OpenBPlusTree(path, zdb2.Bytes)
+	c.Assert(err, IsNil)
+	shuffled := append([]Entry(nil), entries...)
+	rand2.Shuffle(entryShuffle(shuffled))
+	for _, entry := range shuffled {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+
+	find := func(
+		prefix []interface{},
+		lower interface{},
+		upper interface{},
+		expected []Entry,
+	) {
+		iter, err := tree.FindPrefix(k, prefix, lower, upper)
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, expected)
+	}
+	// Each user has 20 entries, sorted by movie.
+	find(nil, nil, nil, entries)
+	find([]interface{}{int32(-5)}, nil, nil, entries[:20])
+	find([]interface{}{int32(0)}, nil, nil, entries[100:120])
+	find([]interface{}{int32(5)}, nil, nil, nil)
+	find([]interface{}{int32(0), int32(-27)}, nil, nil, entries[101:102])
+	find([]interface{}{int32(0), int32(-26)}, nil, nil, nil)
+	find([]interface{}{int32(0)}, int32(-27), int32(0), entries[101:110])
+	find([]interface{}{int32(0)}, int32(-26), int32(1), entries[102:111])
+	find([]interface{}{int32(0)}, int32(10), nil, entries[114:120])
+	find([]interface{}{int32(4)}, nil, int32(-25), entries[180:182])
+	find(nil, int32(-1), int32(1), entries[80:120])
+
+	// There's no field after a full key, and values have to have the right
+	// types.
+	_, err = tree.FindPrefix(
+		k,
+		[]interface{}{int32(0), int32(0)},
+		int32(0),
+		nil)
+	c.Assert(err, NotNil)
+	_, err = tree.FindPrefix(k, []interface{}{int64(0)}, nil, nil)
+	c.Assert(err, NotNil)
+	c.Assert(tree.Close(), IsNil)
+
+	// Composite keys are stored as Bytes.
+	tree, err = OpenBPlusTree(c.MkDir()+"/int32", zdb2.Int32)
+	c.Assert(err, IsNil)
+	_, err = tree.FindPrefix(k, nil, nil, nil)
+	c.Assert(err, NotNil)
+	c.Assert(tree.Close(), IsNil)
+}
+
+func (s *CompositeKeySuite) TestFindPrefixNulls(c *C) {
+	oldBlockSize := blockSize
+	setBlockSize(1 << 8)
+	defer setBlockSize(oldBlockSize)
+
+	t := &zdb2.TableHeader{
+		Name: "ratings",
+		Fields: []*zdb2.Field{
+			{"userId", zdb2.Int32, false, 0, 0},
+			{"rating", zdb2.Int32, true, 0, 0},
+		},
+	}
+	k, err := NewCompositeKey(t, "userId", "rating")
+	c.Assert(err, IsNil)
+	var entries []Entry
+	for i, record := range []zdb2.Record{
+		{int32(1), nil},
+		{int32(1), int32(-1)},
+		{int32(1), int32(3)},
+		{int32(2), nil},
+		{int32(2), int32(4)},
+	} {
+		key, err := k.Key(record)
+		c.Assert(err, IsNil)
+		entries = append(entries, Entry{
+			Key: key,
+			RID: zdb2.RecordID{PageID: 0, SlotID: uint16(i)},
+		})
+	}
+	tree, err := OpenBPlusTree(c.MkDir()+"/b_plus_tree_test", zdb2.Bytes)
+	c.Assert(err, IsNil)
+	defer tree.Close()
+	for _, entry := range entries {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+
+	find := func(lower interface{}, upper interface{}, expected []Entry) {
+		iter, err := tree.FindPrefix(k, []interface{}{int32(1)}, lower, upper)
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, expected)
+	}
+	// NULL comes first, but it's only in the range if there are no bounds.
+	find(nil, nil, entries[:3])
+	find(nil, int32(3), entries[1:2])
+	find(nil, int32(-1), nil)
+	find(int32(-1), nil, entries[1:3])
+	find(int32(-1), int32(3), entries[1:2])
+}
+
+func (s *CompositeKeySuite) TestNaN(c *C) {
+	t := &zdb2.TableHeader{
+		Name: "t",
+		Fields: []*zdb2.Field{
+			{"f", zdb2.Float64, false, 0, 0},
+		},
+	}
+	k, err := NewCompositeKey(t, "f")
+	c.Assert(err, IsNil)
+	expected, err := k.Encode(math.NaN())
+	c.Assert(err, IsNil)
+	// Every NaN has the same encoding, whatever its sign and payload.
+	for _, bits := range []uint64{
+		0x7FF0000000000001,
+		0x7FFFFFFFFFFFFFFF,
+		0xFFF8000000000000,
+		0xFFF0000000000001,
+	} {
+		f := math.Float64frombits(bits)
+		c.Assert(math.IsNaN(f), Equals, true)
+		key, err := k.Encode(f)
+		c.Assert(err, IsNil)
+		c.Assert(key, DeepEquals, expected)
+	}
+	// NaN comes after every other value.
+	inf, err := k.Encode(math.Inf(1))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Compare(inf, expected), Equals, -1)
+	decoded, err := k.Decode(expected)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, 1)
+	c.Assert(math.IsNaN(decoded[0].(float64)), Equals, true)
+}
@@ -0,0 +1,203 @@
+package index
+
+import (
+	"github.com/robot-dreams/zdb2"
+)
+
+// String and Bytes keys are compared byte by byte, so in trees with those key
+// types:
+//
+//   - each leaf node stores the prefix shared by all of its keys once, and only
+//     the rest of each key in its entries (prefix compression)
+//   - the router for a leaf node created by a split only holds as much of the
+//     key as it takes to tell the leaf nodes apart (suffix truncation)
+//
+// Both leave more room for entries and routers, which increases the fanout
+// and can reduce the height of the tree.  Whether a tree compresses its keys
+// is decided when it's created, and stored in each node.
+var keyCompression = true
+
+// SetKeyCompression turns key compression (see above) on or off for B+ trees
+// that are created afterwards; it's on by default.  Trees that already exist
+// keep doing whatever they were created with.  This is meant for measuring
+// the difference that compression makes (see BPlusTree.Stats).
+func SetKeyCompression(enabled bool) {
+	keyCompression = enabled
+}
+
+// Returns whether a tree that's created now with the given key type should
+// compress its keys.
+func compressKeysFor(keyType zdb2.Type) bool {
+	return keyCompression && isCompressible(keyType)
+}
+
+func isCompressible(keyType zdb2.Type) bool {
+	return keyType == zdb2.String || keyType == zdb2.Bytes
+}
+
+// Precondition: key is a String or Bytes key
+func keyString(key interface{}) string {
+	switch key := key.(type) {
+	case string:
+		return key
+	default:
+		return string(key.([]byte))
+	}
+}
+
+func commonPrefixLength(a, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// Returns key without its first n bytes.
+//
+// Precondition: key is a String or Bytes key
+func trimKeyPrefix(key interface{}, n int) interface{} {
+	switch key := key.(type) {
+	case string:
+		return key[n:]
+	default:
+		return key.([]byte)[n:]
+	}
+}
+
+// The inverse of trimKeyPrefix.
+//
+// Precondition: keyType is String or Bytes, and suffix has that type
+func addKeyPrefix(keyType zdb2.Type, prefix string, suffix interface{}) interface{} {
+	if prefix == "" {
+		return suffix
+	}
+	if keyType == zdb2.String {
+		return prefix + suffix.(string)
+	}
+	return append([]byte(prefix), suffix.([]byte)...)
+}
+
+// Returns the key for a router between two leaf nodes, where left is the last
+// key in the first leaf node and right is the first key in the second.  With
+// compression, that's the shortest key k such that left < k <= right;
+// otherwise it's just right.
+//
+// Precondition: left < right
+func separator(
+	keyType zdb2.Type,
+	compressKeys bool,
+	left interface{},
+	right interface{},
+) interface{} {
+	if !compressKeys {
+		return right
+	}
+	// The first byte where the keys differ (if any) is enough to tell them
+	// apart; if left is a prefix of right, then one more byte than left is.
+	n := commonPrefixLength(keyString(left), keyString(right)) + 1
+	return trimKeySuffix(right, n)
+}
+
+// Returns the first n bytes of key.
+func trimKeySuffix(key interface{}, n int) interface{} {
+	switch key := key.(type) {
+	case string:
+		return key[:n]
+	default:
+		// Don't hold on to the rest of the key.
+		return append([]byte(nil), key.([]byte)[:n]...)
+	}
+}
+
+// The space taken up by a sequence of entries in a leaf node depends on the
+// prefix that their keys share, which only depends on the first and last key
+// (since the keys are sorted).  An entryRun can tell how much space any
+// contiguous part of the sequence would take up in a leaf node without
+// looking at every entry.
+type entryRun struct {
+	keyType      zdb2.Type
+	compressKeys bool
+	entries      []Entry
+	// sizes[i] is the space taken up by the first i entries without
+	// compression.
+	sizes []int
+}
+
+func newEntryRun(keyType zdb2.Type, compressKeys bool, entries []Entry) *entryRun {
+	sizes := make([]int, len(entries)+1)
+	for i, entry := range entries {
+		sizes[i+1] = sizes[i] + entrySize(keyType, entry)
+	}
+	return &entryRun{
+		keyType:      keyType,
+		compressKeys: compressKeys,
+		entries:      entries,
+		sizes:        sizes,
+	}
+}
+
+// Returns the length of the prefix shared by the keys of entries[i:j].
+func (r *entryRun) prefixLength(i, j int) int {
+	return prefixLength(r.compressKeys, r.entries[i:j])
+}
+
+// Returns the length of the prefix that's stored once for a leaf node with the
+// given entries, rather than in each of their keys.
+//
+// Precondition: the entries are sorted by key
+func prefixLength(compressKeys bool, sortedEntries []Entry) int {
+	n := len(sortedEntries)
+	if !compressKeys || n < 2 {
+		// A single key isn't worth splitting into a prefix and the rest.
+		return 0
+	}
+	return commonPrefixLength(
+		keyString(sortedEntries[0].Key),
+		keyString(sortedEntries[n-1].Key))
+}
+
+// Returns the number of bytes taken up by entries[i:j] in a leaf node: the
+// shared prefix, followed by the slots and the entries with the prefix
+// trimmed from their keys.
+func (r *entryRun) size(i, j int) int {
+	p := r.prefixLength(i, j)
+	return p + r.sizes[j] - r.sizes[i] - (j-i)*p
+}
+
+// Returns an index i in [lo, hi] at which the entries can be split into two
+// leaf nodes, such that fits(i, size(0, i), size(i, n)) holds.  If
+// atKeyBoundary, then the entries on either side of i must have different
+// keys.  Out of the possible indexes, the one that leaves the two sides
+// closest in size is returned.
+func (r *entryRun) split(
+	lo int,
+	hi int,
+	atKeyBoundary bool,
+	fits func(i, lSize, rSize int) bool,
+) (int, bool) {
+	n := len(r.entries)
+	best := -1
+	bestDiff := 0
+	for i := max(lo, 1); i <= min(hi, n-1); i++ {
+		if atKeyBoundary &&
+			compareKeys(
+				r.keyType,
+				r.entries[i-1].Key,
+				r.entries[i].Key) == 0 {
+			continue
+		}
+		lSize := r.size(0, i)
+		rSize := r.size(i, n)
+		if !fits(i, lSize, rSize) {
+			continue
+		}
+		if diff := abs(lSize - rSize); best == -1 || diff < bestDiff {
+			best = i
+			bestDiff = diff
+		}
+	}
+	return best, best != -1
+}
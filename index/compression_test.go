@@ -0,0 +1,193 @@
+package index
+
+import (
+	"fmt"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/dropbox/godropbox/math2/rand2"
+
+	"github.com/robot-dreams/zdb2"
+)
+
+type CompressionSuite struct{}
+
+var _ = Suite(&CompressionSuite{})
+
+func (s *CompressionSuite) TestSeparator(c *C) {
+	for _, test := range []struct {
+		left, right, expected string
+	}{
+		{"apple", "banana", "b"},
+		{"apple", "apricot", "apr"},
+		{"app", "apple", "appl"},
+		{"", "a", "a"},
+		{"abc", "abd", "abd"},
+	} {
+		c.Assert(
+			separator(zdb2.String, true, test.left, test.right),
+			Equals,
+			test.expected)
+		c.Assert(
+			separator(zdb2.String, false, test.left, test.right),
+			Equals,
+			test.right)
+	}
+	c.Assert(
+		separator(zdb2.Bytes, true, []byte{1, 2, 3}, []byte{1, 3}),
+		DeepEquals,
+		[]byte{1, 3})
+}
+
+// Keys that share a long prefix, like the URLs in a web crawler's index.
+func generateURLEntries(numKeys int) []Entry {
+	var entries []Entry
+	for i := 0; i < numKeys; i++ {
+		entries = append(entries, Entry{
+			Key: fmt.Sprintf("https://www.example.com/articles/%06d", i*7),
+			RID: zdb2.RecordID{PageID: int32(i), SlotID: uint16(i)},
+		})
+	}
+	return entries
+}
+
+// Adds the entries in random order to a new B+ tree, and returns its stats.
+func buildTree(c *C, path string, sortedEntries []Entry) *TreeStats {
+	tree, err := OpenBPlusTree(path, zdb2.String)
+	c.Assert(err, IsNil)
+	shuffled := append([]Entry(nil), sortedEntries...)
+	rand2.Shuffle(entryShuffle(shuffled))
+	for _, entry := range shuffled {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+	iter, err := tree.FindAll()
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, sortedEntries)
+	stats, err := tree.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(tree.Close(), IsNil)
+	violations, _ := verify(c, path)
+	c.Assert(violations, HasLen, 0)
+	return stats
+}
+
+func (s *CompressionSuite) TestKeyCompression(c *C) {
+	oldBlockSize := blockSize
+	setBlockSize(1 << 8)
+	defer setBlockSize(oldBlockSize)
+	defer SetKeyCompression(true)
+
+	dir := c.MkDir()
+	entries := generateURLEntries(1000)
+	compressed := buildTree(c, dir+"/compressed", entries)
+	SetKeyCompression(false)
+	uncompressed := buildTree(c, dir+"/uncompressed", entries)
+	SetKeyCompression(true)
+
+	c.Assert(compressed.KeyCompression, IsTrue)
+	c.Assert(uncompressed.KeyCompression, IsFalse)
+	for _, stats := range []*TreeStats{compressed, uncompressed} {
+		c.Assert(stats.KeyType, Equals, zdb2.String.String())
+		c.Assert(stats.NumEntries, Equals, len(entries))
+	}
+	c.Assert(
+		uncompressed.LeafKeyBytes,
+		Equals,
+		uncompressed.UncompressedLeafKeyBytes)
+	c.Assert(
+		compressed.UncompressedLeafKeyBytes,
+		Equals,
+		uncompressed.LeafKeyBytes)
+	c.Assert(compressed.LeafKeyBytes < uncompressed.LeafKeyBytes/2, IsTrue)
+	c.Assert(
+		compressed.AverageLeafEntries > 2*uncompressed.AverageLeafEntries,
+		IsTrue)
+	c.Assert(compressed.NumLeafNodes < uncompressed.NumLeafNodes, IsTrue)
+
+	c.Assert(compressed.AverageFanout > uncompressed.AverageFanout, IsTrue)
+	c.Assert(compressed.Height < uncompressed.Height, IsTrue)
+
+	// The keys in a compressed tree are the same when it's opened again, even
+	// though key compression has been turned off since.
+	SetKeyCompression(false)
+	tree, err := OpenBPlusTree(dir+"/compressed", zdb2.String)
+	c.Assert(err, IsNil)
+	stats, err := tree.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats, DeepEquals, compressed)
+	c.Assert(tree.Close(), IsNil)
+	SetKeyCompression(true)
+}
+
+func (s *CompressionSuite) TestShrinkingPrefix(c *C) {
+	oldBlockSize := blockSize
+	setBlockSize(1 << 8)
+	defer setBlockSize(oldBlockSize)
+
+	// Fill a single leaf node with keys that share a long prefix; each new key
+	// that doesn't share it makes the prefix stored in the node shorter, and
+	// takes up more space than the entry itself.
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := OpenBPlusTree(path, zdb2.String)
+	c.Assert(err, IsNil)
+	entries := generateURLEntries(12)
+	for _, entry := range entries {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+	stats, err := tree.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.NumLeafNodes, Equals, 1)
+	for _, key := range []string{"a", "zzz", "https://", "https://www.z"} {
+		entry := Entry{Key: key}
+		c.Assert(tree.AddEntry(entry), IsNil)
+		entries = append(entries, entry)
+	}
+	SortEntries(zdb2.String, entries)
+	iter, err := tree.FindAll()
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, entries)
+
+	// Deleting the keys in the middle merges leaf nodes back together.
+	for _, entry := range entries[1 : len(entries)-1] {
+		c.Assert(tree.DeleteEntry(entry), IsNil)
+	}
+	iter, err = tree.FindAll()
+	c.Assert(err, IsNil)
+	checkIterator(c, iter, []Entry{entries[0], entries[len(entries)-1]})
+	c.Assert(tree.Close(), IsNil)
+	violations, _ := verify(c, path)
+	c.Assert(violations, HasLen, 0)
+}
+
+func (s *CompressionSuite) TestBytesKeys(c *C) {
+	oldBlockSize := blockSize
+	setBlockSize(1 << 8)
+	defer setBlockSize(oldBlockSize)
+
+	var entries []Entry
+	for i := 0; i < 300; i++ {
+		entries = append(entries, Entry{
+			Key: []byte{1, 2, 3, 4, 5, 6, 7, 8, byte(i / 10), byte(i % 10)},
+			RID: zdb2.RecordID{PageID: int32(i)},
+		})
+	}
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := BulkLoadNewBPlusTree(path, zdb2.Bytes, entries, 0.7)
+	c.Assert(err, IsNil)
+	for i := 0; i < len(entries); i += 2 {
+		c.Assert(tree.DeleteEntry(entries[i]), IsNil)
+	}
+	for i := 1; i < len(entries); i += 2 {
+		iter, err := tree.FindEqual(entries[i].Key)
+		c.Assert(err, IsNil)
+		checkIterator(c, iter, entries[i:i+1])
+	}
+	stats, err := tree.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.NumEntries, Equals, len(entries)/2)
+	c.Assert(stats.LeafKeyBytes < stats.UncompressedLeafKeyBytes, IsTrue)
+	c.Assert(tree.Close(), IsNil)
+	violations, _ := verify(c, path)
+	c.Assert(violations, HasLen, 0)
+}
@@ -5,27 +5,59 @@ import (
 )
 
 const (
-	// Leaf nodes
-	leafNodeHeaderSize = 12
-	leafNodeFooterSize = 1
-	entrySize          = 10
+	// Every node starts with its blockType (uint16), followed by the page LSN
+	// (int64) maintained by wal.File.
+	pageLSNOffset = 2
+
+	// Nodes use a slotted layout: the header is followed by an array of slots,
+	// one for each entry (or router) in key order, which hold the offsets of
+	// the entries themselves.  Entries are packed at the end of the block, and
+	// are variable length since their keys are.
+	slotSize = 2
+
+	// Leaf nodes.  The header ends with the length of the prefix shared by
+	// the node's keys (see keyCompression), and the prefix itself comes right
+	// after it.
+	leafNodeHeaderSize = 25
+	// An entry is its key followed by a RecordID (int32 and uint16).
+	entryRIDSize = 6
 
 	// Internal nodes
-	internalNodeHeaderSize = 12
-	routerSize             = 8
+	internalNodeHeaderSize = 22
+	// A router is its key followed by a blockID (int32).
+	routerBlockIDSize = 4
 )
 
 // Use var instead of const so that tests can modify these values (and check
 // "interesting" cases without taking too long).
 var (
-	blockSize              int = 1 << 16
-	maxLeafNodeEntries     int
-	maxInternalNodeRouters int
+	blockSize int = 1 << 16
+
+	// The number of bytes available for slots and entries (or routers).
+	leafNodeCapacity     int
+	internalNodeCapacity int
+
+	// Keys can't be any longer than this (see writeKey), so that every node
+	// has room for at least three entries or routers; otherwise, nodes
+	// couldn't always be split.
+	maxKeySize int
+
+	// Nodes (other than the root) whose entries or routers take up fewer bytes
+	// than these are rebalanced after a delete.  Two adjacent nodes that are
+	// below the threshold can always be merged.
+	minLeafNodeSize     int
+	minInternalNodeSize int
 )
 
-func setBlockSize(blockSize int) {
-	maxLeafNodeEntries = (blockSize - leafNodeHeaderSize - leafNodeFooterSize) / entrySize
-	maxInternalNodeRouters = (blockSize - internalNodeHeaderSize) / routerSize
+func setBlockSize(newBlockSize int) {
+	blockSize = newBlockSize
+	leafNodeCapacity = blockSize - leafNodeHeaderSize
+	internalNodeCapacity = blockSize - internalNodeHeaderSize
+	maxEntrySize := leafNodeCapacity / 3
+	maxKeySize = maxEntrySize - slotSize - entryRIDSize
+	maxRouterSize := slotSize + maxKeySize + routerBlockIDSize
+	minLeafNodeSize = (leafNodeCapacity - maxEntrySize) / 2
+	minInternalNodeSize = (internalNodeCapacity - maxRouterSize) / 2
 }
 
 func init() {
@@ -36,6 +68,10 @@ type blockType uint16
 
 const (
 	blockType_Unknown blockType = iota
+	// Nodes with fixed-size int32 keys, from before variable-length keys were
+	// supported.  Only ConvertInt32Layout reads them (see int32_layout.go).
+	blockType_Int32LeafNode
+	blockType_Int32InternalNode
 	blockType_LeafNode
 	blockType_InternalNode
 )
@@ -0,0 +1,196 @@
+package index
+
+import (
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// Types of nodes in a B+ tree.
+const (
+	NodeType_Internal = "internal"
+	NodeType_Leaf     = "leaf"
+)
+
+type TreeDump struct {
+	Path      string `json:"path"`
+	NumBlocks int32  `json:"numBlocks"`
+	// The key type stored in the root (or the empty string, if the file is
+	// empty or the root can't be read).
+	KeyType        string `json:"keyType,omitempty"`
+	KeyCompression bool   `json:"keyCompression,omitempty"`
+	// Starting from the root; the last level holds the leaf nodes, in the
+	// order given by their next links (which includes the leaf nodes that are
+	// only reachable through duplicateOverflow).
+	Levels []*LevelDump `json:"levels"`
+}
+
+type LevelDump struct {
+	Level    int `json:"level"`
+	NumNodes int `json:"numNodes"`
+	// The number of routers (for internal nodes) or entries (for leaf nodes).
+	NumKeys int `json:"numKeys"`
+	// The space taken up by the level's routers or entries, divided by the
+	// space available for them in the level's nodes.
+	FillFactor float64     `json:"fillFactor"`
+	Nodes      []*NodeDump `json:"nodes"`
+}
+
+type NodeDump struct {
+	BlockID int32  `json:"blockID"`
+	Type    string `json:"type"`
+	// The number of bytes taken up by the node's slots and routers (or
+	// entries).
+	Size int `json:"size"`
+
+	// Only set for internal nodes.
+	SubtreeHeight    int32         `json:"subtreeHeight,omitempty"`
+	UnderflowBlockID int32         `json:"underflowBlockID,omitempty"`
+	Routers          []*RouterDump `json:"routers,omitempty"`
+
+	// Only set for leaf nodes.  Prefix is the part of the keys that's stored
+	// once for the whole node (see SetKeyCompression).
+	NumEntries        int         `json:"numEntries,omitempty"`
+	Prefix            interface{} `json:"prefix,omitempty"`
+	MinKey            interface{} `json:"minKey,omitempty"`
+	MaxKey            interface{} `json:"maxKey,omitempty"`
+	PrevBlockID       int32       `json:"prevBlockID,omitempty"`
+	NextBlockID       int32       `json:"nextBlockID,omitempty"`
+	DuplicateOverflow bool        `json:"duplicateOverflow,omitempty"`
+
+	// Set if the node couldn't be read.
+	Error string `json:"error,omitempty"`
+}
+
+type RouterDump struct {
+	Key     interface{} `json:"key"`
+	BlockID int32       `json:"blockID"`
+}
+
+// Dump describes every node in the B+ tree at path, level by level.  Nodes
+// that can't be read are still included, with an error message; see Verify
+// for a thorough check.
+//
+// Opening the file recovers it, unless it's already open (in which case the
+// open wal.File is shared; see wal.OpenFile).  The file isn't modified
+// otherwise.
+func Dump(path string) (*TreeDump, error) {
+	bf, err := wal.OpenFile(path, blockSize, pageLSNOffset)
+	if err != nil {
+		return nil, err
+	}
+	defer bf.Close()
+	d := &TreeDump{
+		Path:      path,
+		NumBlocks: bf.NumBlocks,
+	}
+	if bf.NumBlocks == 0 {
+		return d, nil
+	}
+	// Each block is only dumped once, even if the tree is corrupt.
+	visited := make(map[int32]bool)
+	blockIDs := []int32{0}
+	for len(blockIDs) > 0 {
+		level := &LevelDump{Level: len(d.Levels)}
+		d.Levels = append(d.Levels, level)
+		var children []int32
+		for _, blockID := range blockIDs {
+			if visited[blockID] {
+				continue
+			}
+			visited[blockID] = true
+			nd, n := dumpNode(bf, blockID)
+			level.Nodes = append(level.Nodes, nd)
+			switch n := n.(type) {
+			case *internalNode:
+				if blockID == 0 {
+					d.KeyType = n.keyType.String()
+					d.KeyCompression = n.compressKeys
+				}
+				for i := -1; i < len(n.sortedRouters); i++ {
+					children = append(children, n.childBlockIDAtIndex(i))
+				}
+			case *leafNode:
+				// The rest of the leaf nodes are found through the next links.
+				for n.nextBlockID != block_file.InvalidBlockID &&
+					!visited[n.nextBlockID] {
+					blockID := n.nextBlockID
+					visited[blockID] = true
+					var next node
+					nd, next = dumpNode(bf, blockID)
+					level.Nodes = append(level.Nodes, nd)
+					var ok bool
+					n, ok = next.(*leafNode)
+					if !ok {
+						break
+					}
+				}
+			}
+		}
+		level.summarize()
+		blockIDs = children
+	}
+	return d, nil
+}
+
+// Returns the dump of the node at blockID, along with the node itself (or nil,
+// if it couldn't be read).
+func dumpNode(bf *wal.File, blockID int32) (*NodeDump, node) {
+	nd := &NodeDump{BlockID: blockID}
+	if blockID < 0 || blockID >= bf.NumBlocks {
+		nd.Error = "Node is out of bounds"
+		return nd, nil
+	}
+	n, err := readNode(bf, blockID)
+	if err != nil {
+		nd.Error = err.Error()
+		return nd, nil
+	}
+	switch n := n.(type) {
+	case *internalNode:
+		nd.Type = NodeType_Internal
+		nd.Size = n.size()
+		nd.SubtreeHeight = n.subtreeHeight
+		nd.UnderflowBlockID = n.underflowBlockID
+		for _, r := range n.sortedRouters {
+			nd.Routers = append(nd.Routers, &RouterDump{
+				Key:     r.key,
+				BlockID: r.blockID,
+			})
+		}
+	case *leafNode:
+		nd.Type = NodeType_Leaf
+		nd.Size = n.size()
+		nd.NumEntries = len(n.sortedEntries)
+		if p := prefixLength(n.compressKeys, n.sortedEntries); p > 0 {
+			nd.Prefix = trimKeySuffix(n.sortedEntries[0].Key, p)
+		}
+		if nd.NumEntries > 0 {
+			nd.MinKey = n.sortedEntries[0].Key
+			nd.MaxKey = n.sortedEntries[nd.NumEntries-1].Key
+		}
+		nd.PrevBlockID = n.prevBlockID
+		nd.NextBlockID = n.nextBlockID
+		nd.DuplicateOverflow = n.duplicateOverflow
+	}
+	return nd, n
+}
+
+func (level *LevelDump) summarize() {
+	size := 0
+	capacity := 0
+	for _, nd := range level.Nodes {
+		switch nd.Type {
+		case NodeType_Internal:
+			level.NumKeys += len(nd.Routers)
+			capacity += internalNodeCapacity
+		case NodeType_Leaf:
+			level.NumKeys += nd.NumEntries
+			capacity += leafNodeCapacity
+		}
+		size += nd.Size
+	}
+	level.NumNodes = len(level.Nodes)
+	if capacity > 0 {
+		level.FillFactor = float64(size) / float64(capacity)
+	}
+}
@@ -0,0 +1,67 @@
+package index
+
+import (
+	"encoding/json"
+
+	"github.com/dropbox/godropbox/math2/rand2"
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+)
+
+type DumpSuite struct{}
+
+var _ = Suite(&DumpSuite{})
+
+func (s *DumpSuite) TestDump(c *C) {
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, IsNil)
+	testEntries := generateSortedTestEntries(100, 10)
+	shuffled := append([]Entry(nil), testEntries...)
+	rand2.Shuffle(entryShuffle(shuffled))
+	for _, entry := range shuffled {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+	c.Assert(tree.Close(), IsNil)
+
+	d, err := Dump(path)
+	c.Assert(err, IsNil)
+	c.Assert(len(d.Levels) > 2, IsTrue)
+	root := d.Levels[0].Nodes[0]
+	c.Assert(root.BlockID, Equals, int32(0))
+	c.Assert(root.Type, Equals, NodeType_Internal)
+	c.Assert(root.SubtreeHeight, Equals, int32(len(d.Levels)-1))
+
+	// Every node is included exactly once.
+	numNodes := 0
+	for i, level := range d.Levels {
+		c.Assert(level.Level, Equals, i)
+		c.Assert(level.NumNodes, Equals, len(level.Nodes))
+		c.Assert(level.FillFactor > 0, IsTrue)
+		c.Assert(level.FillFactor <= 1, IsTrue)
+		numNodes += level.NumNodes
+	}
+	c.Assert(numNodes, Equals, int(d.NumBlocks))
+
+	// The leaf nodes are listed in the order given by their links.
+	leaves := d.Levels[len(d.Levels)-1]
+	c.Assert(leaves.NumKeys, Equals, len(testEntries))
+	prevBlockID := int32(block_file.InvalidBlockID)
+	for i, nd := range leaves.Nodes {
+		c.Assert(nd.Type, Equals, NodeType_Leaf)
+		c.Assert(nd.PrevBlockID, Equals, prevBlockID)
+		if i > 0 {
+			c.Assert(
+				nd.MinKey.(int32) >= leaves.Nodes[i-1].MaxKey.(int32),
+				IsTrue)
+		}
+		prevBlockID = nd.BlockID
+	}
+	last := leaves.Nodes[len(leaves.Nodes)-1]
+	c.Assert(last.NextBlockID, Equals, int32(block_file.InvalidBlockID))
+	_, err = json.Marshal(d)
+	c.Assert(err, IsNil)
+}
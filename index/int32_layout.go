@@ -0,0 +1,237 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// B+ trees written before variable-length keys were supported have int32 keys,
+// and nodes with fixed-size cells instead of slots:
+//
+//   - An internal node is its blockType, numRouters (uint16), subtreeHeight
+//     and underflowBlockID (int32), followed by each router's key and blockID
+//     (int32).
+//   - A leaf node is its blockType, prevBlockID and nextBlockID (int32), and
+//     numEntries (uint16), followed by each entry's key, PageID (int32) and
+//     SlotID (uint16), and then duplicateOverflow (bool).
+//
+// Trees written after the write-ahead log was added have the page LSN (int64)
+// right after the blockType; the ones written before that (like
+// test_data/original_movies_views.gz) don't.
+//
+// Keys take up more space in the current layout, so these nodes can't be
+// converted one at a time; ConvertInt32Layout rebuilds the whole tree instead.
+
+const (
+	int32ConversionSuffix = ".int32"
+	walSuffix             = ".wal"
+
+	// The size of each node's header (after the blockType and page LSN), and
+	// of each cell.
+	int32HeaderSize = 10
+	int32EntrySize  = 10
+	int32RouterSize = 8
+)
+
+// Where the header of an int32 node starts, after the blockType (and page LSN,
+// if there is one).
+var int32HeaderOffsets = []int{pageLSNOffset + 8, pageLSNOffset}
+
+// ConvertInt32Layout converts the B+ tree at path to the current layout, if its
+// nodes still use the fixed-size int32 layout (see int32_layout.go); otherwise,
+// the tree is left alone.  The B+ tree can't be in use while this is running.
+func ConvertInt32Layout(path string) error {
+	bf, err := wal.OpenFile(path, blockSize, pageLSNOffset)
+	if err != nil {
+		return err
+	}
+	entries, ok, err := readInt32Entries(bf)
+	if err != nil {
+		bf.Close()
+		return err
+	}
+	// Closing the file empties its log.
+	err = bf.Close()
+	if err != nil || !ok {
+		return err
+	}
+
+	// Anything left over from a conversion that didn't finish is discarded.
+	newPath := path + int32ConversionSuffix
+	err = removeFiles(newPath, newPath+walSuffix)
+	if err != nil {
+		return err
+	}
+	var b *BPlusTree
+	if len(entries) == 0 {
+		// Bulk loading requires at least one entry.
+		b, err = OpenBPlusTree(newPath, zdb2.Int32)
+	} else {
+		b, err = BulkLoadNewBPlusTree(newPath, zdb2.Int32, entries, 1)
+	}
+	if err != nil {
+		return err
+	}
+	err = b.Close()
+	if err != nil {
+		return err
+	}
+
+	// Both logs are empty, and a missing log is recreated to match its file.
+	// The old log has to be removed before the new tree replaces the old one,
+	// since it records the old tree's size.
+	err = removeFiles(newPath+walSuffix, path+walSuffix)
+	if err != nil {
+		return err
+	}
+	err = syncDir(path)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(newPath, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// Removes the given files, if they exist.
+func removeFiles(paths ...string) error {
+	for _, p := range paths {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes changes to the entries of the directory containing path durable.
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Returns every entry in the tree (in key order), if its nodes use the int32
+// layout.
+func readInt32Entries(bf *wal.File) ([]Entry, bool, error) {
+	if bf.NumBlocks == 0 {
+		return nil, false, nil
+	}
+	root, err := readBlock(bf, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	if blockType(byteOrder.Uint16(root)) != blockType_Int32InternalNode {
+		return nil, false, nil
+	}
+	// Only the header offset that gives a valid root is used.
+	offset := -1
+	for _, o := range int32HeaderOffsets {
+		if isValidInt32Root(bf, root, o) {
+			offset = o
+			break
+		}
+	}
+	if offset < 0 {
+		return nil, false, errors.New("Cannot read the int32 root node")
+	}
+
+	// Follow the underflow blocks down to the first leaf node...
+	blockID := int32(0)
+	data := root
+	for {
+		if blockType(byteOrder.Uint16(data)) != blockType_Int32InternalNode {
+			return nil, false, errors.Newf(
+				"Block %d isn't an int32 internal node",
+				blockID)
+		}
+		subtreeHeight := int32(byteOrder.Uint32(data[offset+2:]))
+		blockID = int32(byteOrder.Uint32(data[offset+6:]))
+		data, err = readInt32Node(bf, blockID)
+		if err != nil {
+			return nil, false, err
+		}
+		if subtreeHeight <= 1 {
+			break
+		}
+	}
+
+	// ...and then read every leaf node in order.
+	var entries []Entry
+	for numLeafNodes := int32(0); ; numLeafNodes++ {
+		if blockType(byteOrder.Uint16(data)) != blockType_Int32LeafNode {
+			return nil, false, errors.Newf(
+				"Block %d isn't an int32 leaf node",
+				blockID)
+		} else if numLeafNodes == bf.NumBlocks {
+			return nil, false, errors.New("Leaf nodes form a cycle")
+		}
+		nextBlockID := int32(byteOrder.Uint32(data[offset+4:]))
+		numEntries := int(byteOrder.Uint16(data[offset+8:]))
+		i := offset + int32HeaderSize
+		// The entries are followed by duplicateOverflow.
+		if i+numEntries*int32EntrySize >= blockSize {
+			return nil, false, errors.Newf(
+				"Block %d has too many entries (%d)",
+				blockID,
+				numEntries)
+		}
+		for j := 0; j < numEntries; j++ {
+			entries = append(entries, Entry{
+				Key: int32(byteOrder.Uint32(data[i:])),
+				RID: zdb2.RecordID{
+					PageID: int32(byteOrder.Uint32(data[i+4:])),
+					SlotID: byteOrder.Uint16(data[i+8:]),
+				},
+			})
+			i += int32EntrySize
+		}
+		if nextBlockID == block_file.InvalidBlockID {
+			return entries, true, nil
+		}
+		blockID = nextBlockID
+		data, err = readInt32Node(bf, blockID)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// Returns whether the root's header makes sense if it starts at offset.
+func isValidInt32Root(bf *wal.File, root []byte, offset int) bool {
+	numRouters := int(byteOrder.Uint16(root[offset:]))
+	subtreeHeight := int32(byteOrder.Uint32(root[offset+2:]))
+	underflowBlockID := int32(byteOrder.Uint32(root[offset+6:]))
+	return offset+int32HeaderSize+numRouters*int32RouterSize <= blockSize &&
+		subtreeHeight >= 1 &&
+		subtreeHeight < bf.NumBlocks &&
+		underflowBlockID > 0 &&
+		underflowBlockID < bf.NumBlocks
+}
+
+func readInt32Node(bf *wal.File, blockID int32) ([]byte, error) {
+	if blockID <= 0 || blockID >= bf.NumBlocks {
+		return nil, errors.Newf("Invalid blockID %d in int32 node", blockID)
+	}
+	return readBlock(bf, blockID)
+}
+
+// Returns a copy of the block.
+func readBlock(bf *wal.File, blockID int32) ([]byte, error) {
+	frame, err := bf.Pin(blockID)
+	if err != nil {
+		return nil, err
+	}
+	defer bf.Unpin(frame, false)
+	return append([]byte(nil), frame.Data...), nil
+}
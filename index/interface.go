@@ -3,14 +3,58 @@ package index
 import (
 	"io"
 
+	"github.com/dropbox/godropbox/errors"
 	"github.com/robot-dreams/zdb2"
 )
 
+var EntryNotFound = errors.New("Entry not found")
+
+// Every key in a B+ tree has the tree's key type (see zdb2.Type for how values
+// of each type are represented); keys can't be NULL.
 type Entry struct {
-	Key int32
+	Key interface{}
 	RID zdb2.RecordID
 }
 
+// Entries should be compared with Equals rather than ==, since keys of some
+// types (like zdb2.Bytes) aren't comparable.
+func (e Entry) Equals(other Entry) bool {
+	return zdb2.Equal(e.Key, other.Key) && e.RID == other.RID
+}
+
+// A Bound is one end of a range of keys (see BPlusTree.FindRange).  The zero
+// Bound (with a nil Key) leaves that end of the range open.
+type Bound struct {
+	Key       interface{}
+	Inclusive bool
+}
+
+func Inclusive(key interface{}) Bound {
+	return Bound{Key: key, Inclusive: true}
+}
+
+func Exclusive(key interface{}) Bound {
+	return Bound{Key: key, Inclusive: false}
+}
+
+// Returns whether key is within lo, as the lower end of a range.
+func aboveLower(keyType zdb2.Type, lo Bound, key interface{}) bool {
+	if lo.Key == nil {
+		return true
+	}
+	cmp := compareKeys(keyType, key, lo.Key)
+	return cmp > 0 || (cmp == 0 && lo.Inclusive)
+}
+
+// Returns whether key is within hi, as the upper end of a range.
+func belowUpper(keyType zdb2.Type, hi Bound, key interface{}) bool {
+	if hi.Key == nil {
+		return true
+	}
+	cmp := compareKeys(keyType, key, hi.Key)
+	return cmp < 0 || (cmp == 0 && hi.Inclusive)
+}
+
 type Iterator interface {
 	// Returns io.EOF if there are no more entries.
 	Next() (Entry, error)
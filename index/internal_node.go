@@ -3,15 +3,19 @@ package index
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"sort"
 
 	"github.com/dropbox/godropbox/errors"
-	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
 type internalNode struct {
-	bf               *block_file.BlockFile
+	bf               *wal.File
 	blockID          int32
+	keyType          zdb2.Type
+	compressKeys     bool
 	subtreeHeight    int32
 	underflowBlockID int32
 	sortedRouters    []router
@@ -22,6 +26,8 @@ var _ node = (*internalNode)(nil)
 func (in *internalNode) unmarshal(buf *bytes.Reader) error {
 	var numRouters uint16
 	for _, value := range []interface{}{
+		&in.keyType,
+		&in.compressKeys,
 		&numRouters,
 		&in.subtreeHeight,
 		&in.underflowBlockID,
@@ -31,37 +37,83 @@ func (in *internalNode) unmarshal(buf *bytes.Reader) error {
 			return err
 		}
 	}
+	offsets, err := readSlots(buf, int(numRouters))
+	if err != nil {
+		return err
+	}
 	in.sortedRouters = make([]router, numRouters)
-	for i := 0; i < int(numRouters); i++ {
-		for _, value := range []interface{}{
-			&in.sortedRouters[i].key,
-			&in.sortedRouters[i].blockID,
-		} {
-			err := binary.Read(buf, byteOrder, value)
-			if err != nil {
-				return err
-			}
+	for i, offset := range offsets {
+		_, err = buf.Seek(int64(offset), io.SeekStart)
+		if err != nil {
+			return err
+		}
+		r := &in.sortedRouters[i]
+		r.key, err = readKey(buf, in.keyType)
+		if err != nil {
+			return err
+		}
+		err = binary.Read(buf, byteOrder, &r.blockID)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 func (in *internalNode) marshal() []byte {
-	buf := bytes.NewBuffer(make([]byte, 0, blockSize))
+	header := bytes.NewBuffer(make([]byte, 0, internalNodeHeaderSize))
 	for _, value := range []interface{}{
 		blockType_InternalNode,
+		int64(0), // The page LSN is filled in by wal.File.
+		in.keyType,
+		in.compressKeys,
 		uint16(len(in.sortedRouters)),
 		in.subtreeHeight,
 		in.underflowBlockID,
 	} {
 		// err is always nil when writing to a bytes.Buffer.
-		_ = binary.Write(buf, byteOrder, value)
+		_ = binary.Write(header, byteOrder, value)
+	}
+	cells := make([][]byte, len(in.sortedRouters))
+	for i, r := range in.sortedRouters {
+		var cell bytes.Buffer
+		writeKey(&cell, in.keyType, r.key)
+		_ = binary.Write(&cell, byteOrder, r.blockID)
+		cells[i] = cell.Bytes()
+	}
+	return marshalSlotted(header.Bytes(), cells)
+}
+
+// Returns the number of bytes taken up by the slot and the encoded router.
+func routerSize(keyType zdb2.Type, key interface{}) int {
+	return slotSize + keySize(keyType, key) + routerBlockIDSize
+}
+
+func routerSizes(keyType zdb2.Type, routers []router) []int {
+	sizes := make([]int, len(routers))
+	for i, r := range routers {
+		sizes[i] = routerSize(keyType, r.key)
 	}
-	for _, router := range in.sortedRouters {
-		_ = binary.Write(buf, byteOrder, router.key)
-		_ = binary.Write(buf, byteOrder, router.blockID)
+	return sizes
+}
+
+// Returns the number of bytes taken up by the receiver's slots and routers,
+// which can't be more than internalNodeCapacity once the receiver is flushed.
+func (in *internalNode) size() int {
+	total := 0
+	for _, r := range in.sortedRouters {
+		total += routerSize(in.keyType, r.key)
 	}
-	return buf.Bytes()[:blockSize]
+	return total
+}
+
+// Returns whether the receiver would still fit in a block if the key of the
+// router at index i was replaced by key.
+func (in *internalNode) fitsWithKey(i int, key interface{}) bool {
+	size := in.size() -
+		routerSize(in.keyType, in.sortedRouters[i].key) +
+		routerSize(in.keyType, key)
+	return size <= internalNodeCapacity
 }
 
 func (in *internalNode) flush() error {
@@ -99,7 +151,7 @@ func (in *internalNode) split() (*internalNode, *router, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	midpoint := len(in.sortedRouters) / 2
+	midpoint := splitIndex(routerSizes(in.keyType, in.sortedRouters))
 	midpointRouter := in.sortedRouters[midpoint]
 	lSortedRouters := in.sortedRouters[:midpoint]
 	rSortedRouters := in.sortedRouters[midpoint+1:]
@@ -111,6 +163,8 @@ func (in *internalNode) split() (*internalNode, *router, error) {
 	newInternalNode := &internalNode{
 		bf:               in.bf,
 		blockID:          newBlockID,
+		keyType:          in.keyType,
+		compressKeys:     in.compressKeys,
 		subtreeHeight:    in.subtreeHeight,
 		underflowBlockID: midpointRouter.blockID,
 		sortedRouters:    rSortedRouters,
@@ -127,15 +181,15 @@ func (in *internalNode) split() (*internalNode, *router, error) {
 	return newInternalNode, newRouter, nil
 }
 
-func (in *internalNode) findSmallestIndexWithGreaterKey(key int32) int {
+func (in *internalNode) findSmallestIndexWithGreaterKey(key interface{}) int {
 	return sort.Search(
 		len(in.sortedRouters),
 		func(i int) bool {
-			return in.sortedRouters[i].key > key
+			return compareKeys(in.keyType, in.sortedRouters[i].key, key) > 0
 		})
 }
 
-func (in *internalNode) childNodeForKey(key int32) (node, error) {
+func (in *internalNode) childNodeForKey(key interface{}) (node, error) {
 	i := in.findSmallestIndexWithGreaterKey(key)
 	return in.childNodeAtIndex(i - 1)
 }
@@ -185,14 +239,258 @@ func (in *internalNode) addEntry(entry Entry) (*router, error) {
 		// Insert the new router at the correct position.
 		in.sortedRouters[i] = *childRouter
 	}
-	if len(in.sortedRouters) > maxInternalNodeRouters {
+	if in.size() > internalNodeCapacity {
 		return in.splitAndFlush()
 	} else {
 		return nil, in.flush()
 	}
 }
 
-func (in *internalNode) findEqual(key int32) (Iterator, error) {
+func (in *internalNode) deleteEntry(entry Entry) (bool, error) {
+	i := in.findSmallestIndexWithGreaterKey(entry.Key) - 1
+	childNode, err := in.childNodeAtIndex(i)
+	if err != nil {
+		return false, err
+	}
+	underflow, err := childNode.deleteEntry(entry)
+	if err != nil {
+		return false, err
+	}
+
+	// If deleting the entry didn't cause the child node to underflow, then
+	// we're done.
+	if !underflow {
+		return false, nil
+	}
+
+	switch childNode := childNode.(type) {
+	case *internalNode:
+		err = in.rebalanceInternalChild(i, childNode)
+	case *leafNode:
+		err = in.rebalanceLeafChild(i, childNode)
+	}
+	if err != nil {
+		return false, err
+	}
+	return in.size() < minInternalNodeSize, nil
+}
+
+// Fixes an underflow in the leaf node at index i (see childBlockIDAtIndex) by
+// moving entries from a sibling, or by merging with one.  The receiver is
+// flushed to disk before returning, along with every leaf node that changed.
+//
+// Entries can only move between siblings at a key boundary, since all the
+// entries with a given key have to stay on the same side of the router between
+// the siblings.  If there's no such boundary (or the receiver doesn't have room
+// for the router's new key), and the leaf nodes are too full to be merged,
+// then the underflow is left in place.
+//
+// Precondition: ln is the only leaf node in its group (see
+// leafNode.deleteEntry)
+func (in *internalNode) rebalanceLeafChild(i int, ln *leafNode) error {
+	// The left sibling's group ends right before ln.
+	var left, right *leafNode
+	if i >= 0 {
+		n, err := in.childNodeAtIndex(i - 1)
+		if err != nil {
+			return err
+		}
+		left, err = n.(*leafNode).lastInGroup()
+		if err != nil {
+			return err
+		}
+	}
+	if i+1 < len(in.sortedRouters) {
+		n, err := in.childNodeAtIndex(i + 1)
+		if err != nil {
+			return err
+		}
+		right = n.(*leafNode)
+	}
+
+	// Move entries from the end of the left sibling's group...
+	if left != nil {
+		sortedEntries := append(
+			append([]Entry(nil), left.sortedEntries...),
+			ln.sortedEntries...)
+		run := newEntryRun(in.keyType, ln.compressKeys, sortedEntries)
+		j, ok := run.split(
+			1,
+			len(left.sortedEntries)-1,
+			true,
+			func(j, lSize, rSize int) bool {
+				return lSize >= minLeafNodeSize &&
+					rSize <= leafNodeCapacity &&
+					in.fitsWithKey(i, in.separator(sortedEntries, j))
+			})
+		if ok {
+			in.sortedRouters[i].key = in.separator(sortedEntries, j)
+			left.sortedEntries = sortedEntries[:j]
+			ln.sortedEntries = sortedEntries[j:]
+			return flushNodes(left, ln, in)
+		}
+	}
+
+	// ...or from the start of the right sibling's group.
+	if right != nil {
+		sortedEntries := append(
+			append([]Entry(nil), ln.sortedEntries...),
+			right.sortedEntries...)
+		run := newEntryRun(in.keyType, ln.compressKeys, sortedEntries)
+		j, ok := run.split(
+			len(ln.sortedEntries)+1,
+			len(sortedEntries)-1,
+			true,
+			func(j, lSize, rSize int) bool {
+				return lSize <= leafNodeCapacity &&
+					rSize >= minLeafNodeSize &&
+					in.fitsWithKey(i+1, in.separator(sortedEntries, j))
+			})
+		if ok {
+			in.sortedRouters[i+1].key = in.separator(sortedEntries, j)
+			ln.sortedEntries = sortedEntries[:j]
+			right.sortedEntries = sortedEntries[j:]
+			return flushNodes(ln, right, in)
+		}
+	}
+
+	// Otherwise, merge with a sibling, and remove the router for the leaf node
+	// that was merged away.
+	if left != nil && mergedSize(left, ln) <= leafNodeCapacity {
+		err := left.merge(ln)
+		if err != nil {
+			return err
+		}
+		in.removeRouter(i)
+	} else if right != nil && mergedSize(ln, right) <= leafNodeCapacity {
+		err := ln.merge(right)
+		if err != nil {
+			return err
+		}
+		in.removeRouter(i + 1)
+	}
+	return in.flush()
+}
+
+// Returns the key for a router between sortedEntries[:j] and sortedEntries[j:].
+func (in *internalNode) separator(sortedEntries []Entry, j int) interface{} {
+	return separator(
+		in.keyType,
+		in.compressKeys,
+		sortedEntries[j-1].Key,
+		sortedEntries[j].Key)
+}
+
+// Returns the space that the entries in two adjacent leaf nodes would take up
+// in a single leaf node.
+func mergedSize(left, right *leafNode) int {
+	sortedEntries := append(
+		append([]Entry(nil), left.sortedEntries...),
+		right.sortedEntries...)
+	return newEntryRun(left.keyType, left.compressKeys, sortedEntries).
+		size(0, len(sortedEntries))
+}
+
+// Fixes an underflow in the internal node at index i (see childBlockIDAtIndex)
+// by rotating routers from a sibling through the receiver, or by merging with
+// a sibling.  The receiver is flushed to disk before returning, along with
+// every internal node that changed.
+func (in *internalNode) rebalanceInternalChild(i int, child *internalNode) error {
+	var left, right *internalNode
+	if i >= 0 {
+		n, err := in.childNodeAtIndex(i - 1)
+		if err != nil {
+			return err
+		}
+		left = n.(*internalNode)
+	}
+	if i+1 < len(in.sortedRouters) {
+		n, err := in.childNodeAtIndex(i + 1)
+		if err != nil {
+			return err
+		}
+		right = n.(*internalNode)
+	}
+
+	if left != nil &&
+		left.size() > minInternalNodeSize &&
+		in.redistributeRouters(i, left, child) {
+		return flushNodes(left, child, in)
+	} else if right != nil &&
+		right.size() > minInternalNodeSize &&
+		in.redistributeRouters(i+1, child, right) {
+		return flushNodes(child, right, in)
+	}
+
+	// Otherwise, merge with a sibling; the router between them moves down into
+	// the merged node.
+	var err error
+	if left != nil &&
+		left.size()+
+			routerSize(in.keyType, in.sortedRouters[i].key)+
+			child.size() <= internalNodeCapacity {
+		err = left.merge(in.sortedRouters[i].key, child)
+		in.removeRouter(i)
+	} else if right != nil &&
+		child.size()+
+			routerSize(in.keyType, in.sortedRouters[i+1].key)+
+			right.size() <= internalNodeCapacity {
+		err = child.merge(in.sortedRouters[i+1].key, right)
+		in.removeRouter(i + 1)
+	}
+	if err != nil {
+		return err
+	}
+	return in.flush()
+}
+
+// Evens out the space taken up by the routers in two adjacent internal nodes by
+// rotating routers through the receiver (their parent), where i is the index
+// of the receiver's router for right.  Returns false without changing
+// anything if the receiver doesn't have room for that router's new key.
+func (in *internalNode) redistributeRouters(i int, left, right *internalNode) bool {
+	sortedRouters := make(
+		[]router,
+		0,
+		len(left.sortedRouters)+1+len(right.sortedRouters))
+	sortedRouters = append(sortedRouters, left.sortedRouters...)
+	sortedRouters = append(
+		sortedRouters,
+		router{in.sortedRouters[i].key, right.underflowBlockID})
+	sortedRouters = append(sortedRouters, right.sortedRouters...)
+	midpoint := splitIndex(routerSizes(in.keyType, sortedRouters))
+	midpointRouter := sortedRouters[midpoint]
+	if !in.fitsWithKey(i, midpointRouter.key) {
+		return false
+	}
+	left.sortedRouters = sortedRouters[:midpoint]
+	right.underflowBlockID = midpointRouter.blockID
+	right.sortedRouters = sortedRouters[midpoint+1:]
+	in.sortedRouters[i].key = midpointRouter.key
+	return true
+}
+
+// Moves every router in next (the receiver's right sibling) into the receiver,
+// and frees next.  key is the key of the router for next in the parent node.
+//
+// Precondition: the routers fit in the receiver
+func (in *internalNode) merge(key interface{}, next *internalNode) error {
+	in.sortedRouters = append(
+		in.sortedRouters,
+		router{key, next.underflowBlockID})
+	in.sortedRouters = append(in.sortedRouters, next.sortedRouters...)
+	err := in.flush()
+	if err != nil {
+		return err
+	}
+	return freeNode(in.bf, next.blockID)
+}
+
+func (in *internalNode) removeRouter(i int) {
+	in.sortedRouters = append(in.sortedRouters[:i], in.sortedRouters[i+1:]...)
+}
+
+func (in *internalNode) findEqual(key interface{}) (Iterator, error) {
 	childNode, err := in.childNodeForKey(key)
 	if err != nil {
 		return nil, err
@@ -200,7 +498,7 @@ func (in *internalNode) findEqual(key int32) (Iterator, error) {
 	return childNode.findEqual(key)
 }
 
-func (in *internalNode) findGreaterEqual(key int32) (Iterator, error) {
+func (in *internalNode) findGreaterEqual(key interface{}) (Iterator, error) {
 	childNode, err := in.childNodeForKey(key)
 	if err != nil {
 		return nil, err
@@ -208,13 +506,52 @@ func (in *internalNode) findGreaterEqual(key int32) (Iterator, error) {
 	return childNode.findGreaterEqual(key)
 }
 
+func (in *internalNode) findRange(lo, hi Bound) (Iterator, error) {
+	i := -1
+	if lo.Key != nil {
+		i = in.findSmallestIndexWithGreaterKey(lo.Key) - 1
+	}
+	childNode, err := in.childNodeAtIndex(i)
+	if err != nil {
+		return nil, err
+	}
+	return childNode.findRange(lo, hi)
+}
+
+func (in *internalNode) findRangeReverse(lo, hi Bound) (Iterator, error) {
+	i := len(in.sortedRouters) - 1
+	if hi.Key != nil {
+		i = in.findSmallestIndexWithGreaterKey(hi.Key) - 1
+	}
+	childNode, err := in.childNodeAtIndex(i)
+	if err != nil {
+		return nil, err
+	}
+	return childNode.findRangeReverse(lo, hi)
+}
+
+// Returns the leaf node with the smallest keys in the receiver's subtree.
+func (in *internalNode) firstLeafNode() (*leafNode, error) {
+	for {
+		n, err := in.childNodeAtIndex(-1)
+		if err != nil {
+			return nil, err
+		}
+		ln, ok := n.(*leafNode)
+		if ok {
+			return ln, nil
+		}
+		in = n.(*internalNode)
+	}
+}
+
 func (in *internalNode) bulkLoadHelper(
 	leafRouter router,
 	cachedRightmostPath map[int32]*internalNode,
 ) (*router, error) {
 	appendRouter := func(childRouter router) (*router, error) {
 		in.sortedRouters = append(in.sortedRouters, childRouter)
-		if len(in.sortedRouters) > maxInternalNodeRouters {
+		if in.size() > internalNodeCapacity {
 			newInternalNode, newRouter, err := in.split()
 			if err != nil {
 				return nil, err
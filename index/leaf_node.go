@@ -6,12 +6,17 @@ import (
 	"io"
 	"sort"
 
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
 	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
 type leafNode struct {
-	bf                *block_file.BlockFile
+	bf                *wal.File
 	blockID           int32
+	keyType           zdb2.Type
+	compressKeys      bool
 	prevBlockID       int32
 	nextBlockID       int32
 	sortedEntries     []Entry
@@ -22,50 +27,121 @@ var _ node = (*leafNode)(nil)
 
 func (ln *leafNode) unmarshal(buf *bytes.Reader) error {
 	var numEntries uint16
+	var prefixLength uint16
 	for _, value := range []interface{}{
+		&ln.keyType,
+		&ln.compressKeys,
 		&ln.prevBlockID,
 		&ln.nextBlockID,
 		&numEntries,
+		&ln.duplicateOverflow,
+		&prefixLength,
 	} {
 		err := binary.Read(buf, byteOrder, value)
 		if err != nil {
 			return err
 		}
 	}
+	prefix := make([]byte, prefixLength)
+	_, err := io.ReadFull(buf, prefix)
+	if err != nil {
+		return err
+	}
+	offsets, err := readSlots(buf, int(numEntries))
+	if err != nil {
+		return err
+	}
 	ln.sortedEntries = make([]Entry, numEntries)
-	for i := 0; i < int(numEntries); i++ {
+	for i, offset := range offsets {
+		_, err = buf.Seek(int64(offset), io.SeekStart)
+		if err != nil {
+			return err
+		}
+		entry := &ln.sortedEntries[i]
+		entry.Key, err = readKey(buf, ln.keyType)
+		if err != nil {
+			return err
+		}
+		if prefixLength > 0 {
+			entry.Key = addKeyPrefix(ln.keyType, string(prefix), entry.Key)
+		}
 		for _, value := range []interface{}{
-			&ln.sortedEntries[i].Key,
-			&ln.sortedEntries[i].RID.PageID,
-			&ln.sortedEntries[i].RID.SlotID,
+			&entry.RID.PageID,
+			&entry.RID.SlotID,
 		} {
-			err := binary.Read(buf, byteOrder, value)
+			err = binary.Read(buf, byteOrder, value)
 			if err != nil {
 				return err
 			}
 		}
 	}
-	return binary.Read(buf, byteOrder, &ln.duplicateOverflow)
+	return nil
 }
 
 func (ln *leafNode) marshal() []byte {
-	buf := bytes.NewBuffer(make([]byte, 0, blockSize))
+	n := len(ln.sortedEntries)
+	prefixLength := prefixLength(ln.compressKeys, ln.sortedEntries)
+	var prefix string
+	if prefixLength > 0 {
+		prefix = keyString(ln.sortedEntries[0].Key)[:prefixLength]
+	}
+	header := bytes.NewBuffer(
+		make([]byte, 0, leafNodeHeaderSize+prefixLength))
 	for _, value := range []interface{}{
 		blockType_LeafNode,
+		int64(0), // The page LSN is filled in by wal.File.
+		ln.keyType,
+		ln.compressKeys,
 		ln.prevBlockID,
 		ln.nextBlockID,
-		uint16(len(ln.sortedEntries)),
+		uint16(n),
+		ln.duplicateOverflow,
+		uint16(prefixLength),
 	} {
 		// err is always nil when writing to a bytes.Buffer.
-		_ = binary.Write(buf, byteOrder, value)
+		_ = binary.Write(header, byteOrder, value)
 	}
-	for _, entry := range ln.sortedEntries {
-		_ = binary.Write(buf, byteOrder, entry.Key)
-		_ = binary.Write(buf, byteOrder, entry.RID.PageID)
-		_ = binary.Write(buf, byteOrder, entry.RID.SlotID)
+	header.WriteString(prefix)
+	cells := make([][]byte, n)
+	for i, entry := range ln.sortedEntries {
+		var cell bytes.Buffer
+		key := entry.Key
+		if prefixLength > 0 {
+			key = trimKeyPrefix(key, prefixLength)
+		}
+		writeKey(&cell, ln.keyType, key)
+		_ = binary.Write(&cell, byteOrder, entry.RID.PageID)
+		_ = binary.Write(&cell, byteOrder, entry.RID.SlotID)
+		cells[i] = cell.Bytes()
 	}
-	_ = binary.Write(buf, byteOrder, ln.duplicateOverflow)
-	return buf.Bytes()[:blockSize]
+	return marshalSlotted(header.Bytes(), cells)
+}
+
+// Returns the number of bytes taken up by the slot and the encoded entry,
+// without compression.
+func entrySize(keyType zdb2.Type, entry Entry) int {
+	return slotSize + keySize(keyType, entry.Key) + entryRIDSize
+}
+
+func (ln *leafNode) run() *entryRun {
+	return newEntryRun(ln.keyType, ln.compressKeys, ln.sortedEntries)
+}
+
+// Returns the number of bytes taken up by the receiver's prefix, slots and
+// entries, which can't be more than leafNodeCapacity once the receiver is
+// flushed.
+func (ln *leafNode) size() int {
+	return ln.run().size(0, len(ln.sortedEntries))
+}
+
+// Returns the key for a router between the receiver and the leaf node after
+// it, where the first entry in the latter is right.
+func (ln *leafNode) separator(right Entry) interface{} {
+	return separator(
+		ln.keyType,
+		ln.compressKeys,
+		ln.sortedEntries[len(ln.sortedEntries)-1].Key,
+		right.Key)
 }
 
 func (ln *leafNode) flush() error {
@@ -79,11 +155,23 @@ func (ln *leafNode) flush() error {
 //
 // Precondition: ln is full
 func (ln *leafNode) split() (*router, error) {
+	// Splitting can make the entries take up more space in total, since the
+	// keys on each side might share less of a prefix than they do on their own;
+	// but there's always at least one index where both sides fit.
+	midpoint, ok := ln.run().split(
+		1,
+		len(ln.sortedEntries)-1,
+		false,
+		func(_, lSize, rSize int) bool {
+			return lSize <= leafNodeCapacity && rSize <= leafNodeCapacity
+		})
+	if !ok {
+		return nil, errors.Newf("Cannot split leaf node %d", ln.blockID)
+	}
 	newBlockID, err := ln.bf.AllocateBlock()
 	if err != nil {
 		return nil, err
 	}
-	midpoint := len(ln.sortedEntries) / 2
 	lSortedEntries := ln.sortedEntries[:midpoint]
 	rSortedEntries := ln.sortedEntries[midpoint:]
 
@@ -91,6 +179,8 @@ func (ln *leafNode) split() (*router, error) {
 	newLeafNode := &leafNode{
 		bf:                ln.bf,
 		blockID:           newBlockID,
+		keyType:           ln.keyType,
+		compressKeys:      ln.compressKeys,
 		prevBlockID:       ln.blockID,
 		nextBlockID:       ln.nextBlockID,
 		sortedEntries:     rSortedEntries,
@@ -101,12 +191,18 @@ func (ln *leafNode) split() (*router, error) {
 		return nil, err
 	}
 
+	// The leaf node after ln (if any) now comes after the new leaf node.
+	err = newLeafNode.linkNext()
+	if err != nil {
+		return nil, err
+	}
+
 	// Update and flush ln.
 	ln.sortedEntries = lSortedEntries
 	ln.nextBlockID = newBlockID
 	lFinalEntry := lSortedEntries[midpoint-1]
 	rFirstEntry := rSortedEntries[0]
-	if lFinalEntry.Key == rFirstEntry.Key {
+	if compareKeys(ln.keyType, lFinalEntry.Key, rFirstEntry.Key) == 0 {
 		ln.duplicateOverflow = true
 	}
 	err = ln.flush()
@@ -121,25 +217,25 @@ func (ln *leafNode) split() (*router, error) {
 	} else {
 		// Returned router corresponds to new leaf node.
 		return &router{
-			key:     newLeafNode.sortedEntries[0].Key,
+			key:     ln.separator(rFirstEntry),
 			blockID: newBlockID,
 		}, nil
 	}
 }
 
-func (ln *leafNode) findSmallestIndexWithGreaterEqualKey(key int32) int {
+func (ln *leafNode) findSmallestIndexWithGreaterEqualKey(key interface{}) int {
 	return sort.Search(
 		len(ln.sortedEntries),
 		func(i int) bool {
-			return ln.sortedEntries[i].Key >= key
+			return compareKeys(ln.keyType, ln.sortedEntries[i].Key, key) >= 0
 		})
 }
 
-func (ln *leafNode) findSmallestIndexWithGreaterKey(key int32) int {
+func (ln *leafNode) findSmallestIndexWithGreaterKey(key interface{}) int {
 	return sort.Search(
 		len(ln.sortedEntries),
 		func(i int) bool {
-			return ln.sortedEntries[i].Key > key
+			return compareKeys(ln.keyType, ln.sortedEntries[i].Key, key) > 0
 		})
 }
 
@@ -168,7 +264,7 @@ func (ln *leafNode) addEntry(entry Entry) (*router, error) {
 		// Insert the new entry at the correct position.
 		ln.sortedEntries[i] = entry
 	}
-	if len(ln.sortedEntries) > maxLeafNodeEntries {
+	if ln.size() > leafNodeCapacity {
 		return ln.split()
 	} else {
 		return nil, ln.flush()
@@ -190,7 +286,164 @@ func (ln *leafNode) nextLeafNode() (*leafNode, error) {
 	return result.(*leafNode), nil
 }
 
-func (ln *leafNode) findEqual(key int32) (Iterator, error) {
+func (ln *leafNode) prevLeafNode() (*leafNode, error) {
+	if ln.prevBlockID == block_file.InvalidBlockID {
+		return nil, io.EOF
+	}
+	result, err := readNode(ln.bf, ln.prevBlockID)
+	if err != nil {
+		return nil, err
+	}
+	return result.(*leafNode), nil
+}
+
+// Returns the last leaf node in the receiver's group (see deleteEntry).
+func (ln *leafNode) lastInGroup() (*leafNode, error) {
+	for ln.duplicateOverflow {
+		next, err := ln.nextLeafNode()
+		if err != nil {
+			return nil, err
+		}
+		ln = next
+	}
+	return ln, nil
+}
+
+// Points the prevBlockID of the leaf node after ln (if any) back at ln.
+func (ln *leafNode) linkNext() error {
+	next, err := ln.nextLeafNode()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	next.prevBlockID = ln.blockID
+	return next.flush()
+}
+
+// The receiver is the first leaf node in its group: the leaf nodes after it
+// that are only reachable through duplicateOverflow (and aren't pointed to by
+// any router).  The entry can be in any of them.
+//
+// Only the first leaf node can underflow; the others are rebalanced within the
+// group.
+func (ln *leafNode) deleteEntry(entry Entry) (bool, error) {
+	var prev *leafNode
+	current := ln
+	for {
+		i := current.findSmallestIndexWithGreaterEqualKey(entry.Key)
+		for ; i < len(current.sortedEntries); i++ {
+			if compareKeys(
+				ln.keyType,
+				current.sortedEntries[i].Key,
+				entry.Key) != 0 {
+				return false, EntryNotFound
+			}
+			if current.sortedEntries[i].Equals(entry) {
+				current.sortedEntries = append(
+					current.sortedEntries[:i],
+					current.sortedEntries[i+1:]...)
+				return current.rebalanceWithinGroup(ln, prev)
+			}
+		}
+		if !current.duplicateOverflow {
+			return false, EntryNotFound
+		}
+		next, err := current.nextLeafNode()
+		if err != nil {
+			return false, err
+		}
+		prev, current = current, next
+	}
+}
+
+// Fixes an underflow in the receiver (after an entry was removed from it) by
+// merging with or moving entries from another leaf node in the same group.
+// Since the group's keys are only bounded by the routers around it, entries can
+// move between its leaf nodes freely.  first is the first leaf node in the
+// group, and prev is the leaf node before the receiver (or nil, if the
+// receiver is first).  Returns whether first underflowed, which is only
+// possible if it's the only leaf node left in the group.
+func (ln *leafNode) rebalanceWithinGroup(first, prev *leafNode) (bool, error) {
+	var err error
+	if ln.size() >= minLeafNodeSize {
+		err = ln.flush()
+	} else if ln.duplicateOverflow {
+		var next *leafNode
+		next, err = ln.nextLeafNode()
+		if err != nil {
+			return false, err
+		}
+		err = mergeOrRedistribute(ln, next)
+	} else if prev != nil {
+		err = mergeOrRedistribute(prev, ln)
+	} else {
+		err = ln.flush()
+	}
+	if err != nil {
+		return false, err
+	}
+	return !first.duplicateOverflow && first.size() < minLeafNodeSize, nil
+}
+
+// Merges right into left if their entries fit in a single leaf node, and
+// evens out the space taken up by the entries in each otherwise.
+//
+// Precondition: left and right are adjacent leaf nodes in the same group
+func mergeOrRedistribute(left, right *leafNode) error {
+	sortedEntries := append(
+		append([]Entry(nil), left.sortedEntries...),
+		right.sortedEntries...)
+	run := newEntryRun(left.keyType, left.compressKeys, sortedEntries)
+	if run.size(0, len(sortedEntries)) <= leafNodeCapacity {
+		return left.merge(right)
+	}
+	midpoint, ok := run.split(
+		1,
+		len(sortedEntries)-1,
+		false,
+		func(_, lSize, rSize int) bool {
+			return lSize <= leafNodeCapacity && rSize <= leafNodeCapacity
+		})
+	if ok {
+		left.sortedEntries = sortedEntries[:midpoint]
+		right.sortedEntries = sortedEntries[midpoint:]
+	}
+	err := left.flush()
+	if err != nil {
+		return err
+	}
+	return right.flush()
+}
+
+// Moves every entry in next (the leaf node after the receiver) into the
+// receiver, takes over next's group, and frees next.  Both the receiver and
+// the leaf node after next are flushed to disk before returning.
+//
+// Precondition: the entries fit in the receiver
+func (ln *leafNode) merge(next *leafNode) error {
+	ln.sortedEntries = append(ln.sortedEntries, next.sortedEntries...)
+	ln.nextBlockID = next.nextBlockID
+	ln.duplicateOverflow = next.duplicateOverflow
+	err := ln.flush()
+	if err != nil {
+		return err
+	}
+	err = ln.linkNext()
+	if err != nil {
+		return err
+	}
+	return freeNode(ln.bf, next.blockID)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (ln *leafNode) findEqual(key interface{}) (Iterator, error) {
 	position := ln.findSmallestIndexWithGreaterEqualKey(key)
 	if position == len(ln.sortedEntries) {
 		if ln.duplicateOverflow {
@@ -207,12 +460,12 @@ func (ln *leafNode) findEqual(key int32) (Iterator, error) {
 		ln:       ln,
 		position: position,
 		entryPredicate: func(entry Entry) bool {
-			return entry.Key == key
+			return compareKeys(ln.keyType, entry.Key, key) == 0
 		},
 	}, nil
 }
 
-func (ln *leafNode) findGreaterEqual(key int32) (Iterator, error) {
+func (ln *leafNode) findGreaterEqual(key interface{}) (Iterator, error) {
 	position := ln.findSmallestIndexWithGreaterEqualKey(key)
 	if position == len(ln.sortedEntries) {
 		next, err := ln.nextLeafNode()
@@ -229,6 +482,63 @@ func (ln *leafNode) findGreaterEqual(key int32) (Iterator, error) {
 	}, nil
 }
 
+// Precondition: the receiver is the first leaf node that can have keys within
+// lo (so later leaf nodes might have to be checked, if lo is exclusive).
+func (ln *leafNode) findRange(lo, hi Bound) (Iterator, error) {
+	position := sort.Search(
+		len(ln.sortedEntries),
+		func(i int) bool {
+			return aboveLower(ln.keyType, lo, ln.sortedEntries[i].Key)
+		})
+	if position == len(ln.sortedEntries) {
+		next, err := ln.nextLeafNode()
+		if err == io.EOF {
+			return EmptyIterator{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return next.findRange(lo, hi)
+	}
+	return &leafNodeIterator{
+		ln:       ln,
+		position: position,
+		entryPredicate: func(entry Entry) bool {
+			return belowUpper(ln.keyType, hi, entry.Key)
+		},
+	}, nil
+}
+
+// Precondition: the receiver is the first leaf node in the group that has the
+// last key within hi, or the last leaf node if hi is unbounded.
+func (ln *leafNode) findRangeReverse(lo, hi Bound) (Iterator, error) {
+	ln, err := ln.lastInGroup()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		position := sort.Search(
+			len(ln.sortedEntries),
+			func(i int) bool {
+				return !belowUpper(ln.keyType, hi, ln.sortedEntries[i].Key)
+			}) - 1
+		if position >= 0 {
+			return &reverseLeafNodeIterator{
+				ln:       ln,
+				position: position,
+				entryPredicate: func(entry Entry) bool {
+					return aboveLower(ln.keyType, lo, entry.Key)
+				},
+			}, nil
+		}
+		ln, err = ln.prevLeafNode()
+		if err == io.EOF {
+			return EmptyIterator{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
 type leafNodeIterator struct {
 	ln             *leafNode
 	position       int
@@ -252,3 +562,28 @@ func (iter *leafNodeIterator) Next() (Entry, error) {
 		return entry, nil
 	}
 }
+
+// Walks the leaf nodes backwards, through their prevBlockIDs.
+type reverseLeafNodeIterator struct {
+	ln             *leafNode
+	position       int
+	entryPredicate func(Entry) bool
+}
+
+func (iter *reverseLeafNodeIterator) Next() (Entry, error) {
+	for iter.position < 0 {
+		ln, err := iter.ln.prevLeafNode()
+		if err != nil {
+			return Entry{}, err
+		}
+		iter.position = len(ln.sortedEntries) - 1
+		iter.ln = ln
+	}
+	entry := iter.ln.sortedEntries[iter.position]
+	if iter.entryPredicate != nil && !iter.entryPredicate(entry) {
+		return Entry{}, io.EOF
+	} else {
+		iter.position--
+		return entry, nil
+	}
+}
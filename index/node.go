@@ -5,19 +5,20 @@ import (
 	"encoding/binary"
 
 	"github.com/dropbox/godropbox/errors"
-	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/wal"
 )
 
 // A router points to a node whose descendents' entries are all greater than or
 // equal to the given key.
 type router struct {
-	key     int32
+	key     interface{}
 	blockID int32
 }
 
 type node interface {
-	// Precondition: the blockType value (uint16) has already been consumed, so
-	// there are only blockSize - 2 bytes left.
+	// Precondition: the blockType value (uint16) and page LSN (int64) have
+	// already been consumed.  The reader covers the whole block, so that the
+	// entries (or routers) can be found at the offsets given by their slots.
 	unmarshal(buf *bytes.Reader) error
 
 	marshal() []byte
@@ -29,22 +30,38 @@ type node interface {
 	// be non-nil and will correspond to the newly created node.
 	addEntry(Entry) (*router, error)
 
-	findEqual(key int32) (Iterator, error)
+	// deleteEntry will write changes to the block buffer before returning.  If
+	// the node has too few entries or routers afterwards, then it returns true,
+	// and the parent node is responsible for rebalancing it.
+	deleteEntry(Entry) (bool, error)
 
-	findGreaterEqual(key int32) (Iterator, error)
+	findEqual(key interface{}) (Iterator, error)
+
+	findGreaterEqual(key interface{}) (Iterator, error)
+
+	// Returns the entries with keys between lo and hi, in key order.
+	findRange(lo, hi Bound) (Iterator, error)
+
+	// Returns the entries with keys between lo and hi, in reverse key order.
+	findRangeReverse(lo, hi Bound) (Iterator, error)
 }
 
-func readNode(bf *block_file.BlockFile, blockID int32) (node, error) {
-	b := make([]byte, blockSize)
-	err := bf.ReadBlock(b, blockID)
+// Nodes are decoded directly from the buffer pool, so the block only needs to be
+// pinned while readNode is running.
+func readNode(bf *wal.File, blockID int32) (node, error) {
+	frame, err := bf.Pin(blockID)
 	if err != nil {
 		return nil, err
 	}
-	buf := bytes.NewReader(b)
+	defer bf.Unpin(frame, false)
+	buf := bytes.NewReader(frame.Data)
 	var bt blockType
-	err = binary.Read(buf, byteOrder, &bt)
-	if err != nil {
-		return nil, err
+	var pageLSN int64
+	for _, value := range []interface{}{&bt, &pageLSN} {
+		err = binary.Read(buf, byteOrder, value)
+		if err != nil {
+			return nil, err
+		}
 	}
 	var result node
 	switch bt {
@@ -58,6 +75,11 @@ func readNode(bf *block_file.BlockFile, blockID int32) (node, error) {
 			bf:      bf,
 			blockID: blockID,
 		}
+	case blockType_Int32LeafNode, blockType_Int32InternalNode:
+		return nil, errors.Newf(
+			"Block %d uses the fixed-size int32 layout; the B+ tree has to be "+
+				"converted (see ConvertInt32Layout)",
+			blockID)
 	default:
 		return nil, errors.Newf("Unknown blockType %d", bt)
 	}
@@ -67,3 +89,73 @@ func readNode(bf *block_file.BlockFile, blockID int32) (node, error) {
 	}
 	return result, nil
 }
+
+func flushNodes(nodes ...node) error {
+	for _, n := range nodes {
+		err := n.flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nodes that are no longer part of the tree are zeroed, so that they can be
+// told apart from the nodes that are.  Their blocks aren't reused, though; the
+// space is only reclaimed when the tree is rebuilt (see
+// heap_file.RewriteHeapFile).
+func freeNode(bf *wal.File, blockID int32) error {
+	return bf.WriteBlock(make([]byte, blockSize), blockID)
+}
+
+// Returns the offsets stored in a node's slots.
+//
+// Precondition: the node's header has already been consumed.
+func readSlots(buf *bytes.Reader, numSlots int) ([]uint16, error) {
+	offsets := make([]uint16, numSlots)
+	err := binary.Read(buf, byteOrder, offsets)
+	if err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+// Lays out a node in a block: the header comes first, followed by a slot for
+// each cell (an encoded entry or router), and the cells themselves are packed
+// at the end of the block.
+//
+// Precondition: everything fits in a block
+func marshalSlotted(header []byte, cells [][]byte) []byte {
+	b := make([]byte, blockSize)
+	copy(b, header)
+	end := blockSize
+	for i, cell := range cells {
+		end -= len(cell)
+		copy(b[end:], cell)
+		byteOrder.PutUint16(b[len(header)+i*slotSize:], uint16(end))
+	}
+	return b
+}
+
+// Returns the index at which a node with cells of the given sizes should be
+// split, so that the cells before it take up as close to half of the space as
+// possible.  There's at least one cell on each side.
+//
+// Precondition: there are at least two cells
+func splitIndex(sizes []int) int {
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	best := 1
+	prefix := sizes[0]
+	bestDiff := abs(2*prefix - total)
+	for i := 2; i < len(sizes); i++ {
+		prefix += sizes[i-1]
+		if diff := abs(2*prefix - total); diff < bestDiff {
+			best = i
+			bestDiff = diff
+		}
+	}
+	return best
+}
@@ -0,0 +1,86 @@
+package index
+
+import (
+	"io"
+)
+
+// TreeStats describes the shape of a B+ tree, which is mostly determined by
+// how many keys fit in a node; see SetKeyCompression.
+type TreeStats struct {
+	KeyType        string
+	KeyCompression bool
+	// The number of levels, counting both the root and the leaf nodes.
+	Height           int
+	NumInternalNodes int
+	NumLeafNodes     int
+	NumEntries       int
+	// The average number of children of an internal node.
+	AverageFanout float64
+	// The average number of entries in a leaf node.
+	AverageLeafEntries float64
+	// The space taken up by the keys in internal nodes.
+	RouterKeyBytes int
+	// The space taken up by the keys in leaf nodes (including the prefixes
+	// that are stored once per leaf node), followed by the space that the same
+	// keys would take up without compression.
+	LeafKeyBytes             int
+	UncompressedLeafKeyBytes int
+}
+
+// Stats reads every node in the tree, so it can take a while for a large tree.
+func (b *BPlusTree) Stats() (*TreeStats, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s := &TreeStats{
+		KeyType:        b.root.keyType.String(),
+		KeyCompression: b.root.compressKeys,
+		Height:         int(b.root.subtreeHeight) + 1,
+	}
+
+	// Internal nodes, level by level; the children of the last level are leaf
+	// nodes, which are counted below.
+	numChildren := 0
+	level := []*internalNode{b.root}
+	for len(level) > 0 {
+		var next []*internalNode
+		for _, in := range level {
+			s.NumInternalNodes++
+			numChildren += len(in.sortedRouters) + 1
+			for _, r := range in.sortedRouters {
+				s.RouterKeyBytes += keySize(in.keyType, r.key)
+			}
+			if in.subtreeHeight == 1 {
+				continue
+			}
+			for i := -1; i < len(in.sortedRouters); i++ {
+				n, err := in.childNodeAtIndex(i)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, n.(*internalNode))
+			}
+		}
+		level = next
+	}
+	s.AverageFanout = float64(numChildren) / float64(s.NumInternalNodes)
+
+	// Leaf nodes, by following the next links (which also reaches the ones
+	// that are only reachable through duplicateOverflow).
+	ln, err := b.root.firstLeafNode()
+	for err == nil {
+		n := len(ln.sortedEntries)
+		s.NumLeafNodes++
+		s.NumEntries += n
+		s.LeafKeyBytes += ln.size() - n*(slotSize+entryRIDSize)
+		for _, entry := range ln.sortedEntries {
+			s.UncompressedLeafKeyBytes += keySize(ln.keyType, entry.Key)
+		}
+		ln, err = ln.nextLeafNode()
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	s.AverageLeafEntries = float64(s.NumEntries) / float64(s.NumLeafNodes)
+	return s, nil
+}
@@ -1,9 +1,18 @@
 package index
 
-import "github.com/robot-dreams/zdb2/block_file"
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/wal"
+)
 
 func handleRootSplit(
-	bf *block_file.BlockFile,
+	bf *wal.File,
 	root *internalNode,
 	splitRouter router,
 ) (*internalNode, error) {
@@ -22,6 +31,8 @@ func handleRootSplit(
 	newRoot := &internalNode{
 		bf:               bf,
 		blockID:          0,
+		keyType:          root.keyType,
+		compressKeys:     root.compressKeys,
 		subtreeHeight:    root.subtreeHeight + 1,
 		underflowBlockID: newBlockID,
 		sortedRouters:    []router{splitRouter},
@@ -33,8 +44,123 @@ func handleRootSplit(
 	return newRoot, nil
 }
 
-type ByKey []Entry
+// While the root only has a single child that's an internal node, the child
+// is moved into the root (at block 0), which reduces the height of the tree.
+func handleRootCollapse(bf *wal.File, root *internalNode) error {
+	for root.subtreeHeight > 1 && len(root.sortedRouters) == 0 {
+		n, err := root.childNodeAtIndex(-1)
+		if err != nil {
+			return err
+		}
+		child := n.(*internalNode)
+		root.subtreeHeight = child.subtreeHeight
+		root.underflowBlockID = child.underflowBlockID
+		root.sortedRouters = child.sortedRouters
+		err = root.flush()
+		if err != nil {
+			return err
+		}
+		err = freeNode(bf, child.blockID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns -1, 0 or 1 if k1 is less than, equal to, or greater than k2.
+func compareKeys(keyType zdb2.Type, k1, k2 interface{}) int {
+	if zdb2.Less(keyType, k1, k2) {
+		return -1
+	} else if zdb2.Less(keyType, k2, k1) {
+		return 1
+	}
+	return 0
+}
+
+// Keys are encoded like zdb2.WriteValue does, except that the lengths of String
+// and Bytes keys are always stored as a uint16, so that trimming a prefix off a
+// key saves exactly the length of the prefix (see entryRun).
+func writeKey(buf *bytes.Buffer, keyType zdb2.Type, key interface{}) {
+	if !isCompressible(keyType) {
+		// Keys are checked before they're added, so there's no error.
+		_ = zdb2.WriteValue(buf, keyType, key)
+		return
+	}
+	s := keyString(key)
+	// err is always nil when writing to a bytes.Buffer.
+	_ = binary.Write(buf, byteOrder, uint16(len(s)))
+	buf.WriteString(s)
+}
 
-func (b ByKey) Len() int           { return len(b) }
-func (b ByKey) Less(i, j int) bool { return b[i].Key < b[j].Key }
-func (b ByKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func readKey(buf *bytes.Reader, keyType zdb2.Type) (interface{}, error) {
+	if !isCompressible(keyType) {
+		return zdb2.ReadValue(buf, keyType)
+	}
+	var n uint16
+	err := binary.Read(buf, byteOrder, &n)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(buf, b)
+	if err != nil {
+		return nil, err
+	}
+	if keyType == zdb2.String {
+		return string(b), nil
+	}
+	return b, nil
+}
+
+// Returns the number of bytes taken up by the key in a node (see writeKey).
+func keySize(keyType zdb2.Type, key interface{}) int {
+	if isCompressible(keyType) {
+		return 2 + len(keyString(key))
+	}
+	// Keys are checked before they're added to the tree, so there's no error.
+	b, _ := zdb2.SerializeValue(keyType, key)
+	return len(b)
+}
+
+// Returns an error if the key can't be stored in (or looked up in) a B+ tree
+// with the given key type.
+func checkKey(keyType zdb2.Type, key interface{}) error {
+	err := zdb2.CheckValue(keyType, key)
+	if err != nil {
+		return err
+	}
+	if size := keySize(keyType, key); size > maxKeySize {
+		return errors.Newf(
+			"Key is %d bytes long; the maximum is %d",
+			size,
+			maxKeySize)
+	}
+	return nil
+}
+
+// Returns an error if keys of the given type can't be stored in a B+ tree.
+func checkKeyType(keyType zdb2.Type) error {
+	switch keyType {
+	case zdb2.Int32,
+		zdb2.Float64,
+		zdb2.String,
+		zdb2.Int64,
+		zdb2.Bool,
+		zdb2.Bytes,
+		zdb2.Date,
+		zdb2.Timestamp,
+		zdb2.Decimal:
+		return nil
+	default:
+		return errors.Newf("Unsupported key type %v", keyType)
+	}
+}
+
+// SortEntries sorts entries by key, so that they can be bulk loaded.  Entries
+// with the same key stay in the same order.
+func SortEntries(keyType zdb2.Type, entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return zdb2.Less(keyType, entries[i].Key, entries[j].Key)
+	})
+}
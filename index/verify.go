@@ -0,0 +1,357 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+// Verify checks the structure of the B+ tree at path, and calls report with the
+// blockID and a description of each problem that it finds (or with
+// block_file.InvalidBlockID, for problems with the file as a whole):
+//
+//   - the root is an internal node at block 0
+//   - every node has the same key type (and key compression) as the root, and
+//     fits in a block
+//   - each internal node's subtreeHeight is one more than its children's (and
+//     the children of internal nodes with subtreeHeight 1 are leaf nodes)
+//   - each internal node's routers are sorted
+//   - each key is within the bounds given by the routers on the path to it
+//   - the leaf nodes are linked in key order by their prev and next blockIDs,
+//     and each duplicateOverflow flag is followed by a leaf node that's only
+//     reachable through the linked list
+//   - every node is reachable from the root exactly once
+//
+// If visit isn't nil, then it's called with each entry in the tree (in key
+// order), along with the blockID of the leaf node that stores it.
+//
+// The returned error is only non-nil if the file couldn't be checked at all.
+// Opening the file recovers it, unless it's already open (in which case the
+// open wal.File is shared; see wal.OpenFile).  The file isn't modified
+// otherwise.
+func Verify(
+	path string,
+	report func(blockID int32, message string),
+	visit func(blockID int32, entry Entry),
+) error {
+	bf, err := wal.OpenFile(path, blockSize, pageLSNOffset)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+	if bf.NumBlocks == 0 {
+		report(block_file.InvalidBlockID, "File is empty")
+		return nil
+	}
+	v := &verifier{
+		bf:      bf,
+		keyType: zdb2.UnknownType,
+		report:  report,
+		visit:   visit,
+		visited: make(map[int32]bool),
+	}
+	root, ok := v.readNode(0)
+	if !ok {
+		return nil
+	}
+	in, ok := root.(*internalNode)
+	if !ok {
+		v.reportf(0, "Root is a leaf node")
+		return nil
+	}
+	err = checkKeyType(in.keyType)
+	if err != nil {
+		v.reportf(0, "%v", err)
+		return nil
+	}
+	v.keyType = in.keyType
+	v.compressKeys = in.compressKeys
+	v.verifyInternalNode(in, in.subtreeHeight, bounds{})
+	v.verifyLeafLinks()
+	for blockID := int32(1); blockID < bf.NumBlocks; blockID++ {
+		if !v.visited[blockID] && !v.isEmptyBlock(blockID) {
+			v.reportf(blockID, "Node isn't reachable from the root")
+		}
+	}
+	return nil
+}
+
+// Keys in a subtree are in [lower, upper), where a nil bound is unbounded.
+type bounds struct {
+	lower interface{}
+	upper interface{}
+}
+
+func (b bounds) contains(keyType zdb2.Type, key interface{}) bool {
+	return (b.lower == nil || compareKeys(keyType, key, b.lower) >= 0) &&
+		(b.upper == nil || compareKeys(keyType, key, b.upper) < 0)
+}
+
+func (b bounds) String() string {
+	lower, upper := "-inf", "+inf"
+	if b.lower != nil {
+		lower = fmt.Sprint(b.lower)
+	}
+	if b.upper != nil {
+		upper = fmt.Sprint(b.upper)
+	}
+	return fmt.Sprintf("[%v, %v)", lower, upper)
+}
+
+type verifier struct {
+	bf           *wal.File
+	keyType      zdb2.Type
+	compressKeys bool
+	report       func(blockID int32, message string)
+	visit        func(blockID int32, entry Entry)
+	visited      map[int32]bool
+
+	// Every leaf node that was reached, in key order.
+	leaves []*leafNode
+}
+
+func (v *verifier) reportf(blockID int32, format string, args ...interface{}) {
+	v.report(blockID, fmt.Sprintf(format, args...))
+}
+
+// Reads a node that hasn't been reached yet; returns false (after reporting the
+// problem) if that isn't possible.
+func (v *verifier) readNode(blockID int32) (node, bool) {
+	if blockID < 0 || blockID >= v.bf.NumBlocks {
+		v.reportf(blockID, "Node is out of bounds")
+		return nil, false
+	}
+	if v.visited[blockID] {
+		v.reportf(blockID, "Node is reachable more than once")
+		return nil, false
+	}
+	v.visited[blockID] = true
+	n, err := readNode(v.bf, blockID)
+	if err != nil {
+		v.reportf(blockID, "Cannot read node: %v", err)
+		return nil, false
+	}
+	// Keys of the wrong type can't be compared with the others.
+	var keyType zdb2.Type
+	var compressKeys bool
+	switch n := n.(type) {
+	case *internalNode:
+		keyType, compressKeys = n.keyType, n.compressKeys
+	case *leafNode:
+		keyType, compressKeys = n.keyType, n.compressKeys
+	}
+	if v.keyType == zdb2.UnknownType {
+		return n, true
+	}
+	if keyType != v.keyType {
+		v.reportf(
+			blockID,
+			"Node has keys of type %v; expected %v",
+			keyType,
+			v.keyType)
+		return nil, false
+	}
+	if compressKeys != v.compressKeys {
+		// The keys are still readable either way.
+		v.reportf(
+			blockID,
+			"Node has key compression %v; expected %v",
+			compressKeys,
+			v.compressKeys)
+	}
+	return n, true
+}
+
+// Blocks allocated by transactions that were rolled back are left zeroed.
+func (v *verifier) isEmptyBlock(blockID int32) bool {
+	frame, err := v.bf.Pin(blockID)
+	if err != nil {
+		v.reportf(blockID, "Cannot read block: %v", err)
+		return true
+	}
+	defer v.bf.Unpin(frame, false)
+	return blockType(byteOrder.Uint16(frame.Data)) == blockType_Unknown
+}
+
+func (v *verifier) verifyInternalNode(
+	in *internalNode,
+	subtreeHeight int32,
+	b bounds,
+) {
+	if in.subtreeHeight != subtreeHeight || subtreeHeight < 1 {
+		v.reportf(
+			in.blockID,
+			"Internal node has subtreeHeight %d; expected %d",
+			in.subtreeHeight,
+			subtreeHeight)
+		return
+	}
+	if size := in.size(); size > internalNodeCapacity {
+		v.reportf(
+			in.blockID,
+			"Internal node's routers take up %d bytes; expected at most %d",
+			size,
+			internalNodeCapacity)
+	}
+	// If the routers are invalid, then the children are still checked, but
+	// only against the node's own bounds.
+	validRouters := true
+	for i, r := range in.sortedRouters {
+		if i > 0 &&
+			compareKeys(v.keyType, r.key, in.sortedRouters[i-1].key) <= 0 {
+			v.reportf(
+				in.blockID,
+				"Router %d has key %v, which isn't greater than %v",
+				i,
+				r.key,
+				in.sortedRouters[i-1].key)
+			validRouters = false
+			break
+		}
+		if !b.contains(v.keyType, r.key) {
+			v.reportf(
+				in.blockID,
+				"Router %d has key %v; expected key in %v",
+				i,
+				r.key,
+				b)
+			validRouters = false
+			break
+		}
+	}
+	for i := -1; i < len(in.sortedRouters); i++ {
+		childBounds := b
+		if validRouters && i >= 0 {
+			childBounds.lower = in.sortedRouters[i].key
+		}
+		if validRouters && i+1 < len(in.sortedRouters) {
+			childBounds.upper = in.sortedRouters[i+1].key
+		}
+		child, ok := v.readNode(in.childBlockIDAtIndex(i))
+		if !ok {
+			continue
+		}
+		switch child := child.(type) {
+		case *internalNode:
+			if subtreeHeight == 1 {
+				v.reportf(
+					child.blockID,
+					"Expected leaf node below internal node %d",
+					in.blockID)
+				continue
+			}
+			v.verifyInternalNode(child, subtreeHeight-1, childBounds)
+		case *leafNode:
+			if subtreeHeight != 1 {
+				v.reportf(
+					child.blockID,
+					"Expected internal node below internal node %d",
+					in.blockID)
+				continue
+			}
+			v.verifyLeafNode(child, childBounds)
+		}
+	}
+}
+
+// Checks a leaf node reached from its parent, along with any leaf nodes that it
+// overflows into.
+func (v *verifier) verifyLeafNode(ln *leafNode, b bounds) {
+	for {
+		v.leaves = append(v.leaves, ln)
+		if size := ln.size(); size > leafNodeCapacity {
+			v.reportf(
+				ln.blockID,
+				"Leaf node's entries take up %d bytes; expected at most %d",
+				size,
+				leafNodeCapacity)
+		}
+		for i, entry := range ln.sortedEntries {
+			if i > 0 &&
+				compareKeys(
+					v.keyType,
+					entry.Key,
+					ln.sortedEntries[i-1].Key) < 0 {
+				v.reportf(
+					ln.blockID,
+					"Entry %d has key %v, which is less than %v",
+					i,
+					entry.Key,
+					ln.sortedEntries[i-1].Key)
+			}
+			if !b.contains(v.keyType, entry.Key) {
+				v.reportf(
+					ln.blockID,
+					"Entry %d has key %v; expected key in %v",
+					i,
+					entry.Key,
+					b)
+			}
+			if v.visit != nil {
+				v.visit(ln.blockID, entry)
+			}
+		}
+		if !ln.duplicateOverflow {
+			return
+		}
+		if ln.nextBlockID == block_file.InvalidBlockID {
+			v.reportf(
+				ln.blockID,
+				"Leaf node has duplicateOverflow set, but no next leaf node")
+			return
+		}
+		next, ok := v.readNode(ln.nextBlockID)
+		if !ok {
+			return
+		}
+		nextLeaf, ok := next.(*leafNode)
+		if !ok {
+			v.reportf(
+				ln.blockID,
+				"Leaf node overflows into internal node %d",
+				ln.nextBlockID)
+			return
+		}
+		ln = nextLeaf
+	}
+}
+
+// Checks that the leaf nodes are linked in the order that they were reached.
+func (v *verifier) verifyLeafLinks() {
+	expectedPrev := int32(block_file.InvalidBlockID)
+	var prevKey interface{}
+	for i, ln := range v.leaves {
+		expectedNext := int32(block_file.InvalidBlockID)
+		if i+1 < len(v.leaves) {
+			expectedNext = v.leaves[i+1].blockID
+		}
+		if ln.prevBlockID != expectedPrev {
+			v.reportf(
+				ln.blockID,
+				"Leaf node has prevBlockID %d; expected %d",
+				ln.prevBlockID,
+				expectedPrev)
+		}
+		if ln.nextBlockID != expectedNext {
+			v.reportf(
+				ln.blockID,
+				"Leaf node has nextBlockID %d; expected %d",
+				ln.nextBlockID,
+				expectedNext)
+		}
+		if n := len(ln.sortedEntries); n > 0 {
+			if prevKey != nil &&
+				compareKeys(v.keyType, ln.sortedEntries[0].Key, prevKey) < 0 {
+				v.reportf(
+					ln.blockID,
+					"Leaf node starts with key %v, which is less than %v",
+					ln.sortedEntries[0].Key,
+					prevKey)
+			}
+			prevKey = ln.sortedEntries[n-1].Key
+		}
+		expectedPrev = ln.blockID
+	}
+}
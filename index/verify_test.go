@@ -0,0 +1,131 @@
+package index
+
+import (
+	"github.com/dropbox/godropbox/math2/rand2"
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+type VerifySuite struct{}
+
+var _ = Suite(&VerifySuite{})
+
+type violation struct {
+	blockID int32
+	message string
+}
+
+func verify(c *C, path string) ([]violation, []Entry) {
+	var violations []violation
+	var entries []Entry
+	err := Verify(
+		path,
+		func(blockID int32, message string) {
+			violations = append(violations, violation{blockID, message})
+		},
+		func(blockID int32, entry Entry) {
+			entries = append(entries, entry)
+		})
+	c.Assert(err, IsNil)
+	return violations, entries
+}
+
+// Replaces the node at blockID by the result of calling f on it.
+func corruptNode(c *C, path string, blockID int32, f func(node)) {
+	bf, err := wal.OpenFile(path, blockSize, pageLSNOffset)
+	c.Assert(err, IsNil)
+	n, err := readNode(bf, blockID)
+	c.Assert(err, IsNil)
+	f(n)
+	c.Assert(bf.Begin(), IsNil)
+	c.Assert(n.flush(), IsNil)
+	c.Assert(bf.Commit(), IsNil)
+	c.Assert(bf.Close(), IsNil)
+}
+
+func (s *VerifySuite) TestVerify(c *C) {
+	path := c.MkDir() + "/b_plus_tree_test"
+	tree, err := OpenBPlusTree(path, zdb2.Int32)
+	c.Assert(err, IsNil)
+	testEntries := generateSortedTestEntries(100, 10)
+	shuffled := append([]Entry(nil), testEntries...)
+	rand2.Shuffle(entryShuffle(shuffled))
+	for _, entry := range shuffled {
+		c.Assert(tree.AddEntry(entry), IsNil)
+	}
+	c.Assert(tree.Close(), IsNil)
+
+	violations, entries := verify(c, path)
+	c.Assert(violations, HasLen, 0)
+	c.Assert(entries, HasLen, len(testEntries))
+	for i, entry := range entries {
+		c.Assert(entry.Key, Equals, testEntries[i].Key)
+	}
+
+	// Find a leaf node, and its parent.
+	bf, err := wal.OpenFile(path, blockSize, pageLSNOffset)
+	c.Assert(err, IsNil)
+	n, err := readNode(bf, 0)
+	c.Assert(err, IsNil)
+	var parent *internalNode
+	for {
+		in, ok := n.(*internalNode)
+		if !ok {
+			break
+		}
+		parent = in
+		n, err = in.childNodeAtIndex(-1)
+		c.Assert(err, IsNil)
+	}
+	leaf := n.(*leafNode)
+	c.Assert(bf.Close(), IsNil)
+
+	// Link the leaf node back to the next one.
+	corruptNode(c, path, leaf.blockID, func(n node) {
+		n.(*leafNode).prevBlockID = leaf.nextBlockID
+	})
+	violations, _ = verify(c, path)
+	c.Assert(violations, HasLen, 1)
+	c.Assert(violations[0].blockID, Equals, leaf.blockID)
+	corruptNode(c, path, leaf.blockID, func(n node) {
+		n.(*leafNode).prevBlockID = leaf.prevBlockID
+	})
+
+	// Keys have to be within the parent's bounds.
+	corruptNode(c, path, leaf.blockID, func(n node) {
+		ln := n.(*leafNode)
+		ln.sortedEntries[len(ln.sortedEntries)-1].Key = int32(1000000)
+	})
+	violations, _ = verify(c, path)
+	c.Assert(len(violations) >= 1, IsTrue)
+	c.Assert(violations[0].blockID, Equals, leaf.blockID)
+	corruptNode(c, path, leaf.blockID, func(n node) {
+		n.(*leafNode).sortedEntries = leaf.sortedEntries
+	})
+
+	// Routers have to be sorted, and subtree heights have to be consistent.
+	c.Assert(len(parent.sortedRouters) >= 2, IsTrue)
+	corruptNode(c, path, parent.blockID, func(n node) {
+		routers := n.(*internalNode).sortedRouters
+		routers[0].key, routers[1].key = routers[1].key, routers[0].key
+	})
+	violations, _ = verify(c, path)
+	c.Assert(violations, HasLen, 1)
+	c.Assert(violations[0].blockID, Equals, parent.blockID)
+	corruptNode(c, path, parent.blockID, func(n node) {
+		in := n.(*internalNode)
+		in.sortedRouters = parent.sortedRouters
+		in.subtreeHeight++
+	})
+	violations, _ = verify(c, path)
+	c.Assert(len(violations) >= 1, IsTrue)
+	c.Assert(violations[0].blockID, Equals, parent.blockID)
+	corruptNode(c, path, parent.blockID, func(n node) {
+		n.(*internalNode).subtreeHeight--
+	})
+	violations, _ = verify(c, path)
+	c.Assert(violations, HasLen, 0)
+}
@@ -1,5 +1,9 @@
 package zdb2
 
+import (
+	"fmt"
+)
+
 type Type uint8
 
 const (
@@ -7,11 +11,59 @@ const (
 	Int32
 	Float64
 	String
+	Int64
+	Bool
+	Bytes
+	Date
+	Timestamp
+	Decimal
 )
 
+var typeNames = map[Type]string{
+	Int32:     "Int32",
+	Float64:   "Float64",
+	String:    "String",
+	Int64:     "Int64",
+	Bool:      "Bool",
+	Bytes:     "Bytes",
+	Date:      "Date",
+	Timestamp: "Timestamp",
+	Decimal:   "Decimal",
+}
+
+func (t Type) String() string {
+	name, ok := typeNames[t]
+	if !ok {
+		return fmt.Sprintf("Type(%d)", uint8(t))
+	}
+	return name
+}
+
+// Values of each Type are represented by:
+//
+//     Int32:     int32
+//     Float64:   float64
+//     String:    string
+//     Int64:     int64
+//     Bool:      bool
+//     Bytes:     []byte
+//     Date:      time.Time (midnight UTC)
+//     Timestamp: time.Time (UTC, truncated to the microsecond)
+//     Decimal:   DecimalValue
+//
+// Values should be compared with Equal rather than ==, since []byte isn't
+// comparable, and equal times or decimals can have different representations.
+
 type Field struct {
 	Name string
 	Type Type
+	// Nullable fields can hold NULL, which is represented by nil.
+	Nullable bool
+	// Decimal fields hold values with at most Precision digits, Scale of which
+	// are after the decimal point; values are stored with exactly Scale digits
+	// after the decimal point (see CoerceValue).  Both are 0 for other types.
+	Precision uint8
+	Scale     uint8
 }
 
 type TableHeader struct {
@@ -27,9 +79,7 @@ func (r1 Record) Equals(r2 Record) bool {
 		return false
 	}
 	for i := range r1 {
-		v1 := r1[i]
-		v2 := r2[i]
-		if v1 != v2 {
+		if !Equal(r1[i], r2[i]) {
 			return false
 		}
 	}
@@ -48,3 +98,10 @@ type Iterator interface {
 	Next() (Record, error)
 	Close() error
 }
+
+// A RecordIterator iterates over the records in a heap file, and can also
+// return the RecordID of each record.
+type RecordIterator interface {
+	Iterator
+	NextWithID() (Record, RecordID, error)
+}
@@ -1,15 +1,20 @@
 package lock_mgr
 
 import (
+	"sort"
 	"time"
 )
 
-const deadlockDetectorPeriod = 1 * time.Second
-
-func (lm *lockManager) startDeadlockDetector() {
+func (lm *lockManager) startDeadlockDetector(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
 	for {
-		<-time.After(deadlockDetectorPeriod)
-		lm.findAndMarkDeadlock()
+		select {
+		case <-lm.stop:
+			return
+		case <-ticker.C:
+			lm.findAndMarkDeadlock()
+		}
 	}
 }
 
@@ -17,56 +22,128 @@ func (lm *lockManager) findAndMarkDeadlock() {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
+	lm.resolveDeadlocks()
+}
+
+// Aborts a victim from each cycle in the wait-for graph (until there are no
+// cycles left), and returns the victims.
+//
+// Precondition: lm.mu is held
+func (lm *lockManager) resolveDeadlocks() []string {
+	var victims []string
 	waitGraph := lm.buildWaitGraph()
-	clientID, ok := findCycleNode(waitGraph)
-	if ok {
-		lm.clientToPendingRequest[clientID].deadlockDetected = true
-		lm.clientToPendingRequest[clientID].cond.Signal()
+	for {
+		cycle := findCycle(waitGraph)
+		if cycle == nil {
+			return victims
+		}
+		victim := lm.chooseVictim(cycle)
+		victims = append(victims, victim)
+
+		r := lm.clientToPendingRequest[victim]
+		lm.lockIDToLock[r.lockID].abort(r, Deadlock)
+
+		// The victim stops waiting, so it can't be part of any other cycle.
+		delete(waitGraph, victim)
+	}
+}
+
+// Returns the client to abort for breaking the given cycle: the youngest one,
+// or if there's a tie, the one holding the fewest locks (with the clientID as
+// the final tie breaker, so that the choice is deterministic).
+func (lm *lockManager) chooseVictim(cycle []string) string {
+	victim := cycle[0]
+	for _, clientID := range cycle[1:] {
+		if lm.betterVictim(clientID, victim) {
+			victim = clientID
+		}
 	}
+	return victim
 }
 
+func (lm *lockManager) betterVictim(c1 string, c2 string) bool {
+	t1, t2 := lm.clientToTimestamp[c1], lm.clientToTimestamp[c2]
+	if t1 != t2 {
+		return t1 > t2
+	}
+	n1, n2 := len(lm.clientToHeldLockIDs[c1]), len(lm.clientToHeldLockIDs[c2])
+	if n1 != n2 {
+		return n1 < n2
+	}
+	return c1 < c2
+}
+
+// The wait-for graph has an edge from c1 to c2 if c1 has a pending request that
+// can't be granted until c2 either releases a lock that it holds, or has its
+// own request granted (and later released); see lock.waitsFor.
+//
+// Adjacency lists are sorted, so that cycle detection is deterministic.
 func (lm *lockManager) buildWaitGraph() map[string][]string {
 	result := make(map[string][]string)
 	for _, lock := range lm.lockIDToLock {
-		for _, holder := range lock.holders {
-			for _, pending := range lock.pending {
-				result[pending.clientID] = append(
-					result[pending.clientID],
-					holder.clientID)
+		for i, clientIDs := range lock.waitsFor() {
+			// Each client has at most one pending request.
+			if len(clientIDs) > 0 {
+				result[lock.pending[i].clientID] = clientIDs
 			}
 		}
 	}
 	return result
 }
 
-func findCycleNode(graph map[string][]string) (string, bool) {
-	visited := make(map[string]bool)
+// Returns the nodes of some cycle in the graph (in order), or nil if the graph
+// is acyclic.
+func findCycle(graph map[string][]string) []string {
+	nodes := make([]string, 0, len(graph))
 	for node := range graph {
-		if visited[node] {
-			continue
-		}
-		cycleNode, ok := findCycleNodeRecursive(node, graph, visited)
-		if ok {
-			return cycleNode, ok
-		}
+		nodes = append(nodes, node)
 	}
-	return "", false
-}
+	sort.Strings(nodes)
 
-func findCycleNodeRecursive(
-	node string,
-	graph map[string][]string,
-	visited map[string]bool,
-) (string, bool) {
-	if visited[node] {
-		return node, true
+	// Nodes on the current DFS path are "active"; nodes whose descendants
+	// have all been explored are "done", and can't be part of a new cycle.
+	const (
+		unvisited = iota
+		active
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(node string) []string
+	visit = func(node string) []string {
+		state[node] = active
+		path = append(path, node)
+		for _, neighbor := range graph[node] {
+			// Nodes without outgoing edges (including deadlock victims that
+			// were removed) can't be part of a cycle.
+			if _, ok := graph[neighbor]; !ok {
+				continue
+			}
+			switch state[neighbor] {
+			case active:
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == neighbor {
+						return append([]string(nil), path[i:]...)
+					}
+				}
+			case unvisited:
+				cycle := visit(neighbor)
+				if cycle != nil {
+					return cycle
+				}
+			}
+		}
+		state[node] = done
+		path = path[:len(path)-1]
+		return nil
 	}
-	visited[node] = true
-	for _, neighbor := range graph[node] {
-		cycleNode, ok := findCycleNodeRecursive(neighbor, graph, visited)
-		if ok {
-			return cycleNode, ok
+	for _, node := range nodes {
+		if state[node] == unvisited {
+			cycle := visit(node)
+			if cycle != nil {
+				return cycle
+			}
 		}
 	}
-	return "", false
+	return nil
 }
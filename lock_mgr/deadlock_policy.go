@@ -0,0 +1,108 @@
+package lock_mgr
+
+import (
+	"time"
+)
+
+// DeadlockPolicy determines how a lockManager deals with deadlocks.  In every
+// case, a client whose request is aborted to break (or prevent) a deadlock gets
+// Deadlock from Acquire, and it should call ReleaseAll before trying again.
+//
+// The prevention policies compare the timestamps that clients are assigned when
+// they first try to acquire a lock (a smaller timestamp means an older client).
+// A client that restarts after ReleaseAll gets a new timestamp, so a client
+// that keeps getting aborted isn't guaranteed to make progress.
+type DeadlockPolicy int
+
+const (
+	// A background goroutine periodically searches the wait-for graph for
+	// cycles, and aborts a victim from each one.
+	DeadlockPolicy_Detection DeadlockPolicy = iota
+
+	// An older client waits for younger clients, but a younger client that
+	// would have to wait for an older client is aborted instead.
+	DeadlockPolicy_WaitDie
+
+	// A younger client waits for older clients, but an older client that would
+	// have to wait for a younger client "wounds" the younger client instead:
+	// the younger client's pending request (if any) is aborted, as is every
+	// request that it makes until it calls ReleaseAll.  The older client still
+	// waits until the younger client releases its locks.
+	DeadlockPolicy_WoundWait
+)
+
+func (p DeadlockPolicy) String() string {
+	switch p {
+	case DeadlockPolicy_Detection:
+		return "Detection"
+	case DeadlockPolicy_WaitDie:
+		return "WaitDie"
+	case DeadlockPolicy_WoundWait:
+		return "WoundWait"
+	default:
+		return "Unknown"
+	}
+}
+
+const DefaultDetectionPeriod = 1 * time.Second
+
+type Options struct {
+	DeadlockPolicy DeadlockPolicy
+
+	// How often the deadlock detector runs; only used with
+	// DeadlockPolicy_Detection.  Defaults to DefaultDetectionPeriod if zero.
+	DetectionPeriod time.Duration
+}
+
+// Called right after a request is enqueued without being granted; the request
+// might be aborted (or cause other requests to be aborted) so that waiting for
+// it can't lead to a deadlock.
+//
+// It's enough to check each request once: the clients that a pending request
+// waits for can only change when requests ahead of it are granted or aborted,
+// which never adds a new client to wait for.
+//
+// Precondition: lm.mu is held
+func (lm *lockManager) preventDeadlock(l *lock, r *request) {
+	if lm.policy == DeadlockPolicy_Detection {
+		return
+	}
+	var clientIDs []string
+	for i, pending := range l.pending {
+		if pending == r {
+			clientIDs = l.waitsFor()[i]
+			break
+		}
+	}
+	timestamp := lm.clientToTimestamp[r.clientID]
+	switch lm.policy {
+	case DeadlockPolicy_WaitDie:
+		for _, clientID := range clientIDs {
+			if lm.clientToTimestamp[clientID] < timestamp {
+				l.abort(r, Deadlock)
+				return
+			}
+		}
+	case DeadlockPolicy_WoundWait:
+		for _, clientID := range clientIDs {
+			if lm.clientToTimestamp[clientID] > timestamp {
+				lm.wound(clientID)
+			}
+		}
+	}
+}
+
+// Precondition: lm.mu is held
+func (lm *lockManager) wound(clientID string) {
+	if _, ok := lm.woundedClients[clientID]; ok {
+		return
+	}
+	lm.woundedClients[clientID] = struct{}{}
+	if r, ok := lm.clientToPendingRequest[clientID]; ok {
+		lm.lockIDToLock[r.lockID].abort(r, Deadlock)
+	} else {
+		// Victims with pending requests are counted once the request is
+		// resolved.
+		lm.counters.NumDeadlockVictims++
+	}
+}
@@ -0,0 +1,133 @@
+package lock_mgr
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+)
+
+func (s *LockManagerSuite) TestDetectionPeriod(c *C) {
+	lm := NewLockManagerWithOptions(Options{
+		DeadlockPolicy:  DeadlockPolicy_Detection,
+		DetectionPeriod: 10 * time.Millisecond,
+	})
+	defer lm.Stop()
+	c.Assert(lm.Acquire("c1", "l1", true), IsNil)
+	c.Assert(lm.Acquire("c2", "l2", true), IsNil)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- lm.Acquire("c1", "l2", true)
+	}()
+	waitForPending(c, lm, 1)
+
+	// The detector should abort the younger client well before the default
+	// period is up.
+	start := time.Now()
+	c.Assert(lm.Acquire("c2", "l1", true), Equals, Deadlock)
+	c.Assert(time.Since(start) < DefaultDetectionPeriod, IsTrue)
+	lm.ReleaseAll("c2")
+	c.Assert(<-errChan, IsNil)
+
+	// Stopping more than once is harmless.
+	lm.Stop()
+	lm.Stop()
+}
+
+func (s *LockManagerSuite) TestWaitDie(c *C) {
+	lm := NewLockManagerWithOptions(Options{
+		DeadlockPolicy: DeadlockPolicy_WaitDie,
+	})
+	c.Assert(lm.Acquire("old", "l1", true), IsNil)
+	c.Assert(lm.Acquire("young", "l2", true), IsNil)
+
+	// A younger client dies instead of waiting for an older client.
+	c.Assert(lm.Acquire("young", "l1", false), Equals, Deadlock)
+
+	// An older client waits for a younger client.
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- lm.Acquire("old", "l2", false)
+	}()
+	waitForPending(c, lm, 1)
+	lm.ReleaseAll("young")
+	c.Assert(<-errChan, IsNil)
+
+	// Younger clients also die instead of waiting behind an older client's
+	// pending request.
+	c.Assert(lm.Acquire("younger", "l3", false), IsNil)
+	go func() {
+		errChan <- lm.Acquire("old", "l3", true)
+	}()
+	waitForPending(c, lm, 1)
+	c.Assert(lm.Acquire("youngest", "l3", false), Equals, Deadlock)
+	lm.ReleaseAll("younger")
+	c.Assert(<-errChan, IsNil)
+}
+
+func (s *LockManagerSuite) TestWoundWait(c *C) {
+	lm := NewLockManagerWithOptions(Options{
+		DeadlockPolicy: DeadlockPolicy_WoundWait,
+	})
+	c.Assert(lm.Acquire("old", "l1", true), IsNil)
+	c.Assert(lm.Acquire("young", "l2", true), IsNil)
+
+	// A younger client waits for an older client...
+	youngErrChan := make(chan error, 1)
+	go func() {
+		youngErrChan <- lm.Acquire("young", "l1", false)
+	}()
+	waitForPending(c, lm, 1)
+
+	// ... until the older client needs one of its locks.
+	oldErrChan := make(chan error, 1)
+	go func() {
+		oldErrChan <- lm.Acquire("old", "l2", false)
+	}()
+	c.Assert(<-youngErrChan, Equals, Deadlock)
+	waitForPending(c, lm, 1)
+
+	// The wounded client can't acquire any more locks until it releases the
+	// ones it holds.
+	ok, err := lm.TryAcquire("young", "l3", false)
+	c.Assert(err, Equals, Deadlock)
+	c.Assert(ok, IsFalse)
+	lm.ReleaseAll("young")
+	c.Assert(<-oldErrChan, IsNil)
+	c.Assert(lm.Acquire("young", "l3", false), IsNil)
+}
+
+func (s *LockManagerSuite) TestDeadlockPreventionStress(c *C) {
+	for _, policy := range []DeadlockPolicy{
+		DeadlockPolicy_WaitDie,
+		DeadlockPolicy_WoundWait,
+	} {
+		lm := NewLockManagerWithOptions(Options{
+			DeadlockPolicy: policy,
+		})
+
+		// Without a deadlock detector, a single deadlock would prevent the
+		// workload from finishing; make sure that there aren't even any
+		// temporary deadlocks.
+		done := make(chan struct{})
+		checkerDone := make(chan struct{})
+		go func() {
+			defer close(checkerDone)
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+				}
+				lm.mu.Lock()
+				c.Check(deadlockedClients(lm), HasLen, 0, Commentf("%v", policy))
+				lm.mu.Unlock()
+			}
+		}()
+
+		runDeadlockWorkload(c, lm, 8, 5, 100)
+		close(done)
+		<-checkerDone
+	}
+}
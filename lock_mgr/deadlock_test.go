@@ -0,0 +1,321 @@
+package lock_mgr
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+)
+
+// Blocks until exactly n clients are waiting for a lock.
+func waitForPending(c *C, lm *lockManager, n int) {
+	deadline := time.Now().Add(testDeadlockDetectionTimeout)
+	for time.Now().Before(deadline) {
+		lm.mu.Lock()
+		numPending := len(lm.clientToPendingRequest)
+		lm.mu.Unlock()
+		if numPending == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatalf("Expected %d pending requests", n)
+}
+
+func (s *LockManagerSuite) TestWaitGraph(c *C) {
+	lm := newLockManager()
+	c.Assert(lm.Acquire("c1", "l1", true), IsNil)
+	go lm.Acquire("c2", "l1", false)
+	waitForPending(c, lm, 1)
+	go lm.Acquire("c3", "l1", false)
+	waitForPending(c, lm, 2)
+	go lm.Acquire("c4", "l1", true)
+	waitForPending(c, lm, 3)
+
+	lm.mu.Lock()
+	// Shared requests only wait for the exclusive holder, but the exclusive
+	// request also waits for the shared requests ahead of it.
+	c.Assert(lm.buildWaitGraph(), DeepEquals, map[string][]string{
+		"c2": {"c1"},
+		"c3": {"c1"},
+		"c4": {"c1", "c2", "c3"},
+	})
+	lm.mu.Unlock()
+
+	lm.ReleaseAll("c1")
+	waitForPending(c, lm, 1)
+	lm.mu.Lock()
+	c.Assert(lm.buildWaitGraph(), DeepEquals, map[string][]string{
+		"c4": {"c2", "c3"},
+	})
+	lm.mu.Unlock()
+
+	// A request that's compatible with everything can still wait behind a
+	// blocked request.
+	ctx := context.Background()
+	c.Assert(lm.AcquireMode(ctx, "c5", "l2", Shared), IsNil)
+	go lm.AcquireMode(ctx, "c6", "l2", IntentionExclusive)
+	waitForPending(c, lm, 2)
+	go lm.AcquireMode(ctx, "c7", "l2", IntentionShared)
+	waitForPending(c, lm, 3)
+	lm.mu.Lock()
+	c.Assert(lm.buildWaitGraph(), DeepEquals, map[string][]string{
+		"c4": {"c2", "c3"},
+		"c6": {"c5"},
+		"c7": {"c6"},
+	})
+	lm.mu.Unlock()
+}
+
+func (s *LockManagerSuite) TestUpgradeWaitGraph(c *C) {
+	lm := newLockManager()
+	c.Assert(lm.Acquire("c1", "l1", false), IsNil)
+	c.Assert(lm.Acquire("c2", "l1", false), IsNil)
+	go lm.Acquire("c3", "l1", true)
+	waitForPending(c, lm, 1)
+	go lm.Acquire("c1", "l1", true)
+	waitForPending(c, lm, 2)
+
+	// The upgrade is queued ahead of c3, so it only waits for the other shared
+	// holder, rather than for c3 (which would be a deadlock).
+	lm.mu.Lock()
+	c.Assert(lm.lockIDToLock["l1"].pending[0].clientID, Equals, "c1")
+	c.Assert(lm.buildWaitGraph(), DeepEquals, map[string][]string{
+		"c1": {"c2"},
+		"c3": {"c1", "c2"},
+	})
+	lm.mu.Unlock()
+
+	lm.ReleaseAll("c2")
+	waitForPending(c, lm, 1)
+	lm.mu.Lock()
+	c.Assert(lm.lockIDToLock["l1"].holders[0].clientID, Equals, "c1")
+	c.Assert(lm.lockIDToLock["l1"].holders[0].mode, Equals, Exclusive)
+	c.Assert(lm.buildWaitGraph(), DeepEquals, map[string][]string{
+		"c3": {"c1"},
+	})
+	lm.mu.Unlock()
+	lm.ReleaseAll("c1")
+	waitForPending(c, lm, 0)
+}
+
+func (s *LockManagerSuite) TestFindCycle(c *C) {
+	// Reaching a node along two different paths isn't a cycle.
+	c.Assert(findCycle(map[string][]string{
+		"a": {"b", "c"},
+		"b": {"d"},
+		"c": {"d"},
+	}), IsNil)
+
+	c.Assert(findCycle(map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"d", "b"},
+	}), DeepEquals, []string{"b", "c"})
+}
+
+func (s *LockManagerSuite) TestUpgradeDeadlock(c *C) {
+	lm := newLockManager()
+	c.Assert(lm.Acquire("c1", "l1", false), IsNil)
+	c.Assert(lm.Acquire("c2", "l1", false), IsNil)
+
+	// If both shared holders try to upgrade, then neither can proceed.
+	errChans := map[string]chan error{
+		"c1": make(chan error, 1),
+		"c2": make(chan error, 1),
+	}
+	for i, clientID := range []string{"c1", "c2"} {
+		go func(clientID string) {
+			errChans[clientID] <- lm.Acquire(clientID, "l1", true)
+		}(clientID)
+		waitForPending(c, lm, i+1)
+	}
+
+	// c2 is younger, so it should be chosen as the victim.
+	lm.findAndMarkDeadlock()
+	c.Assert(<-errChans["c2"], Equals, Deadlock)
+	lm.ReleaseAll("c2")
+	c.Assert(<-errChans["c1"], IsNil)
+	c.Assert(lm.lockIDToLock["l1"].holders, HasLen, 1)
+	c.Assert(lm.lockIDToLock["l1"].holders[0].mode, Equals, Exclusive)
+}
+
+func (s *LockManagerSuite) TestVictimPolicy(c *C) {
+	lm := newLockManager()
+	lm.clientToTimestamp = map[string]int64{
+		"c1": 1,
+		"c2": 3,
+		"c3": 3,
+		"c4": 2,
+	}
+	lm.clientToHeldLockIDs = map[string]map[string]struct{}{
+		"c1": {"l1": {}},
+		"c2": {"l2": {}, "l3": {}},
+		"c3": {"l4": {}},
+		"c4": {},
+	}
+
+	// The youngest client is chosen.
+	c.Assert(lm.chooseVictim([]string{"c1", "c4"}), Equals, "c4")
+
+	// Ties are broken by the number of locks held.
+	c.Assert(lm.chooseVictim([]string{"c1", "c2", "c3", "c4"}), Equals, "c3")
+}
+
+// Returns the clients that can never be granted their pending requests, even
+// if every client that isn't waiting were to release all of its locks.  This is
+// computed by simulating the lock manager, without using the wait-for graph.
+//
+// Precondition: lm.mu is held
+func deadlockedClients(lm *lockManager) map[string]bool {
+	type simulatedLock struct {
+		holders []request
+		pending []request
+	}
+	var locks []*simulatedLock
+	for _, l := range lm.lockIDToLock {
+		sl := &simulatedLock{}
+		for _, r := range l.holders {
+			sl.holders = append(sl.holders, *r)
+		}
+		for _, r := range l.pending {
+			sl.pending = append(sl.pending, *r)
+		}
+		locks = append(locks, sl)
+	}
+	waiting := func() map[string]bool {
+		result := make(map[string]bool)
+		for _, sl := range locks {
+			for _, r := range sl.pending {
+				result[r.clientID] = true
+			}
+		}
+		return result
+	}
+	for {
+		changed := false
+		w := waiting()
+		for _, sl := range locks {
+			var holders []request
+			for _, r := range sl.holders {
+				if w[r.clientID] {
+					holders = append(holders, r)
+				} else {
+					changed = true
+				}
+			}
+			sl.holders = holders
+		}
+		for _, sl := range locks {
+		grantLoop:
+			for len(sl.pending) > 0 {
+				r := sl.pending[0]
+				for _, holder := range sl.holders {
+					if conflicts(&r, &holder) {
+						break grantLoop
+					}
+				}
+				sl.pending = sl.pending[1:]
+				if r.upgrade {
+					for i := range sl.holders {
+						if sl.holders[i].clientID == r.clientID {
+							sl.holders[i].mode = r.mode
+						}
+					}
+				} else {
+					sl.holders = append(sl.holders, r)
+				}
+				changed = true
+			}
+		}
+		if !changed {
+			return waiting()
+		}
+	}
+}
+
+func (s *LockManagerSuite) TestDeadlockStress(c *C) {
+	lm := newLockManager()
+	numClients := 8
+	numLocks := 5
+	numTxnsPerClient := 100
+
+	// Stands in for the deadlock detector, checking every decision against
+	// deadlockedClients.
+	done := make(chan struct{})
+	detectorDone := make(chan struct{})
+	numVictims := 0
+	go func() {
+		defer close(detectorDone)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			lm.mu.Lock()
+			deadlocked := deadlockedClients(lm)
+			victims := lm.resolveDeadlocks()
+			numVictims += len(victims)
+			// No false positives.
+			for _, victim := range victims {
+				c.Check(deadlocked[victim], IsTrue)
+			}
+			// No missed deadlocks.
+			c.Check(deadlockedClients(lm), HasLen, 0)
+			lm.mu.Unlock()
+		}
+	}()
+
+	runDeadlockWorkload(c, lm, numClients, numLocks, numTxnsPerClient)
+	close(done)
+	<-detectorDone
+	c.Logf("Resolved %d deadlocks", numVictims)
+}
+
+// Runs transactions from numClients concurrent clients, each of which acquires
+// a few random locks before releasing them all (or giving up on Deadlock).
+func runDeadlockWorkload(
+	c *C,
+	lm *lockManager,
+	numClients int,
+	numLocks int,
+	numTxnsPerClient int,
+) {
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < numTxnsPerClient; j++ {
+				clientID := fmt.Sprintf("c%d-%d", i, j)
+				for k := r.Intn(4); k >= 0; k-- {
+					lockID := fmt.Sprintf("l%d", r.Intn(numLocks))
+					err := lm.Acquire(clientID, lockID, r.Intn(2) == 0)
+					if err == Deadlock {
+						break
+					}
+					c.Check(err, IsNil)
+					time.Sleep(time.Duration(r.Intn(100)) * time.Microsecond)
+				}
+				lm.ReleaseAll(clientID)
+			}
+		}(i)
+	}
+	allDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDone)
+	}()
+	select {
+	case <-allDone:
+	case <-time.After(30 * time.Second):
+		c.Fatal("Clients didn't finish; some deadlock wasn't resolved")
+	}
+}
@@ -0,0 +1,263 @@
+package lock_mgr
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/robot-dreams/zdb2"
+)
+
+type Granularity uint8
+
+const (
+	Granularity_Database Granularity = iota
+	Granularity_Table
+	Granularity_Page
+	Granularity_Record
+)
+
+// A Resource is a node in the lock hierarchy:
+//
+//	database -> table (i.e. heap file) -> page -> record
+//
+// Only the fields needed for the Resource's granularity are used.
+type Resource struct {
+	Granularity Granularity
+	Table       string
+	PageID      int32
+	SlotID      uint16
+}
+
+func DatabaseResource() Resource {
+	return Resource{Granularity: Granularity_Database}
+}
+
+func TableResource(table string) Resource {
+	return Resource{
+		Granularity: Granularity_Table,
+		Table:       table,
+	}
+}
+
+// Indexes are locked like tables (so that scans can be protected from
+// phantoms), using the path of the index file.
+func IndexResource(path string) Resource {
+	return TableResource(path)
+}
+
+func PageResource(table string, pageID int32) Resource {
+	return Resource{
+		Granularity: Granularity_Page,
+		Table:       table,
+		PageID:      pageID,
+	}
+}
+
+func RecordResource(table string, recordID zdb2.RecordID) Resource {
+	return Resource{
+		Granularity: Granularity_Record,
+		Table:       table,
+		PageID:      recordID.PageID,
+		SlotID:      recordID.SlotID,
+	}
+}
+
+func (r Resource) LockID() string {
+	switch r.Granularity {
+	case Granularity_Database:
+		return "database"
+	case Granularity_Table:
+		return fmt.Sprintf("table:%v", r.Table)
+	case Granularity_Page:
+		return fmt.Sprintf("page:%v:%d", r.Table, r.PageID)
+	default:
+		return fmt.Sprintf("record:%v:%d:%d", r.Table, r.PageID, r.SlotID)
+	}
+}
+
+// Returns the Resource's ancestors, starting from the database.
+func (r Resource) ancestors() []Resource {
+	var result []Resource
+	if r.Granularity > Granularity_Database {
+		result = append(result, DatabaseResource())
+	}
+	if r.Granularity > Granularity_Table {
+		result = append(result, TableResource(r.Table))
+	}
+	if r.Granularity > Granularity_Page {
+		result = append(result, PageResource(r.Table, r.PageID))
+	}
+	return result
+}
+
+// If a client holds more than this many record locks in a single table, then
+// they're replaced by a single table lock.
+const DefaultEscalationThreshold = 1000
+
+// Locks acquired by a client (via Lock) that are below the table level.
+type tableLocks struct {
+	numRecords int
+	lockIDs    map[string]struct{}
+}
+
+// SetEscalationThreshold changes the number of record locks a client can hold
+// in a single table before they're escalated; 0 disables escalation.
+func (lm *lockManager) SetEscalationThreshold(n int) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.escalationThreshold = n
+}
+
+// Lock acquires a lock on the given Resource, after acquiring the intention
+// locks required on each of its ancestors (from the top down).  If the client
+// already holds a lock on an ancestor that implicitly covers the Resource (e.g.
+// a table lock in shared mode, for reading a record), then nothing is done.
+//
+// Errors are the same as for AcquireContext; any intention locks acquired
+// before the error are kept.
+func (lm *lockManager) Lock(
+	ctx context.Context,
+	clientID string,
+	resource Resource,
+	mode LockMode,
+) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if lm.isCovered(clientID, resource, mode) {
+		return nil
+	}
+	if resource.Granularity == Granularity_Record && lm.escalationThreshold > 0 {
+		tl := lm.clientToTableLocks[clientID][resource.Table]
+		if tl != nil && tl.numRecords >= lm.escalationThreshold {
+			return lm.escalate(ctx, clientID, resource.Table, mode)
+		}
+	}
+	for _, ancestor := range resource.ancestors() {
+		err := lm.acquireLocked(
+			ctx,
+			clientID,
+			ancestor.LockID(),
+			mode.intention())
+		if err != nil {
+			return err
+		}
+		if ancestor.Granularity == Granularity_Page {
+			lm.trackTableLock(clientID, ancestor)
+		}
+	}
+	err := lm.acquireLocked(ctx, clientID, resource.LockID(), mode)
+	if err != nil {
+		return err
+	}
+	if resource.Granularity > Granularity_Table {
+		lm.trackTableLock(clientID, resource)
+	}
+	return nil
+}
+
+// Returns the mode in which the client holds the given lock.
+//
+// Precondition: lm.mu is held
+func (lm *lockManager) heldMode(
+	clientID string,
+	lockID string,
+) (LockMode, bool) {
+	if _, ok := lm.clientToHeldLockIDs[clientID][lockID]; !ok {
+		return 0, false
+	}
+	for _, holder := range lm.lockIDToLock[lockID].holders {
+		if holder.clientID == clientID {
+			return holder.mode, true
+		}
+	}
+	return 0, false
+}
+
+// Returns whether the client already has permission to access the Resource in
+// the given mode, either explicitly or because of a lock on some ancestor.
+//
+// Precondition: lm.mu is held
+func (lm *lockManager) isCovered(
+	clientID string,
+	resource Resource,
+	mode LockMode,
+) bool {
+	heldMode, ok := lm.heldMode(clientID, resource.LockID())
+	if ok && covers(heldMode, mode) {
+		return true
+	}
+	// Locking a node in S, SIX or X mode implicitly locks all of its
+	// descendants in S, S or X mode respectively.
+	for _, ancestor := range resource.ancestors() {
+		heldMode, ok := lm.heldMode(clientID, ancestor.LockID())
+		if !ok {
+			continue
+		}
+		switch heldMode {
+		case Exclusive:
+			return true
+		case Shared, SharedIntentionExclusive:
+			if !mode.isWrite() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Precondition: lm.mu is held
+func (lm *lockManager) trackTableLock(clientID string, resource Resource) {
+	if _, ok := lm.clientToTableLocks[clientID]; !ok {
+		lm.clientToTableLocks[clientID] = make(map[string]*tableLocks)
+	}
+	tl, ok := lm.clientToTableLocks[clientID][resource.Table]
+	if !ok {
+		tl = &tableLocks{
+			lockIDs: make(map[string]struct{}),
+		}
+		lm.clientToTableLocks[clientID][resource.Table] = tl
+	}
+	lockID := resource.LockID()
+	if _, ok := tl.lockIDs[lockID]; ok {
+		return
+	}
+	tl.lockIDs[lockID] = struct{}{}
+	if resource.Granularity == Granularity_Record {
+		tl.numRecords++
+	}
+}
+
+// Replaces the client's page and record locks in the given table with a
+// single table lock (in exclusive mode if the client has written to the table,
+// or is about to, and in shared mode otherwise).
+//
+// Precondition: lm.mu is held
+func (lm *lockManager) escalate(
+	ctx context.Context,
+	clientID string,
+	table string,
+	mode LockMode,
+) error {
+	tableResource := TableResource(table)
+	tableMode, _ := lm.heldMode(clientID, tableResource.LockID())
+	escalatedMode := Shared
+	if mode.isWrite() || tableMode.isWrite() {
+		escalatedMode = Exclusive
+	}
+	err := lm.acquireLocked(
+		ctx,
+		clientID,
+		tableResource.LockID(),
+		escalatedMode)
+	if err != nil {
+		return err
+	}
+	for lockID := range lm.clientToTableLocks[clientID][table].lockIDs {
+		lm.lockIDToLock[lockID].release(clientID)
+		delete(lm.clientToHeldLockIDs[clientID], lockID)
+	}
+	delete(lm.clientToTableLocks[clientID], table)
+	return nil
+}
@@ -0,0 +1,122 @@
+package lock_mgr
+
+import (
+	"context"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2"
+)
+
+func (s *LockManagerSuite) TestLockModes(c *C) {
+	modes := []LockMode{
+		IntentionShared,
+		IntentionExclusive,
+		Shared,
+		SharedIntentionExclusive,
+		Exclusive,
+	}
+	for _, m1 := range modes {
+		for _, m2 := range modes {
+			// The compatibility matrix is symmetric.
+			c.Assert(compatible[m1][m2], Equals, compatible[m2][m1])
+
+			// The supremum covers both modes, and it's the weakest such mode.
+			sup := supremum(m1, m2)
+			c.Assert(covers(sup, m1), IsTrue)
+			c.Assert(covers(sup, m2), IsTrue)
+			for _, m := range modes {
+				if covers(m, m1) && covers(m, m2) {
+					c.Assert(covers(m, sup), IsTrue)
+				}
+			}
+		}
+	}
+	c.Assert(supremum(Shared, IntentionExclusive), Equals, SharedIntentionExclusive)
+}
+
+// Returns the lock held by the client on the given resource, or "" if there's
+// no such lock.
+func heldModeString(lm *lockManager, clientID string, resource Resource) string {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	mode, ok := lm.heldMode(clientID, resource.LockID())
+	if !ok {
+		return ""
+	}
+	return mode.String()
+}
+
+func (s *LockManagerSuite) TestHierarchy(c *C) {
+	lm := newLockManager()
+	ctx := context.Background()
+	recordID := zdb2.RecordID{PageID: 1, SlotID: 2}
+	record := RecordResource("movies", recordID)
+	page := PageResource("movies", 1)
+	table := TableResource("movies")
+
+	// Writing a record requires intention locks on every ancestor.
+	c.Assert(lm.Lock(ctx, "c1", record, Exclusive), IsNil)
+	c.Assert(heldModeString(lm, "c1", DatabaseResource()), Equals, "IX")
+	c.Assert(heldModeString(lm, "c1", table), Equals, "IX")
+	c.Assert(heldModeString(lm, "c1", page), Equals, "IX")
+	c.Assert(heldModeString(lm, "c1", record), Equals, "X")
+
+	// Reading another record in the same table doesn't conflict.
+	otherRecord := RecordResource("movies", zdb2.RecordID{PageID: 1, SlotID: 3})
+	c.Assert(lm.Lock(ctx, "c2", otherRecord, Shared), IsNil)
+	c.Assert(heldModeString(lm, "c2", table), Equals, "IS")
+
+	// A table scan conflicts with the writer, but not with the reader.
+	ok, err := lm.TryAcquire("c3", table.LockID(), false)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	lm.ReleaseAll("c1")
+	c.Assert(lm.Lock(ctx, "c3", table, Shared), IsNil)
+
+	// A table lock in shared mode covers reading every record in the table.
+	c.Assert(lm.Lock(ctx, "c3", record, Shared), IsNil)
+	c.Assert(heldModeString(lm, "c3", record), Equals, "")
+
+	// Writing a record after scanning the table requires SIX on the table.
+	lm.ReleaseAll("c2")
+	c.Assert(lm.Lock(ctx, "c3", record, Exclusive), IsNil)
+	c.Assert(heldModeString(lm, "c3", table), Equals, "SIX")
+	c.Assert(heldModeString(lm, "c3", record), Equals, "X")
+}
+
+func (s *LockManagerSuite) TestEscalation(c *C) {
+	lm := newLockManager()
+	lm.SetEscalationThreshold(10)
+	ctx := context.Background()
+	table := TableResource("movies")
+	for i := 0; i < 10; i++ {
+		recordID := zdb2.RecordID{PageID: int32(i % 2), SlotID: uint16(i)}
+		c.Assert(lm.Lock(ctx, "c1", RecordResource("movies", recordID), Shared), IsNil)
+	}
+	c.Assert(heldModeString(lm, "c1", table), Equals, "IS")
+
+	// Reading one more record replaces the page and record locks with a
+	// table lock.
+	recordID := zdb2.RecordID{PageID: 2, SlotID: 0}
+	c.Assert(lm.Lock(ctx, "c1", RecordResource("movies", recordID), Shared), IsNil)
+	c.Assert(heldModeString(lm, "c1", table), Equals, "S")
+	lm.mu.Lock()
+	// Only the database and table locks are left.
+	c.Assert(lm.clientToHeldLockIDs["c1"], HasLen, 2)
+	lm.mu.Unlock()
+
+	// Writes in a table with escalated locks need an exclusive table lock.
+	c.Assert(lm.Lock(ctx, "c1", RecordResource("movies", recordID), Exclusive), IsNil)
+	c.Assert(heldModeString(lm, "c1", table), Equals, "SIX")
+	for i := 0; i < 10; i++ {
+		recordID := zdb2.RecordID{PageID: 0, SlotID: uint16(i)}
+		c.Assert(lm.Lock(ctx, "c1", RecordResource("movies", recordID), Exclusive), IsNil)
+	}
+	c.Assert(heldModeString(lm, "c1", table), Equals, "X")
+	lm.mu.Lock()
+	c.Assert(lm.clientToHeldLockIDs["c1"], HasLen, 2)
+	lm.mu.Unlock()
+}
@@ -1,129 +1,200 @@
 package lock_mgr
 
 import (
+	"sort"
 	"sync"
 )
 
 type request struct {
-	clientID         string
-	exclusive        bool
-	cond             *sync.Cond
-	deadlockDetected bool
+	clientID string
+	lockID   string
+	mode     LockMode
+
+	// Whether the client already holds the lock in a weaker mode, and is trying
+	// to upgrade to the request's mode.
+	upgrade bool
+
+	cond    *sync.Cond
+	granted bool
+
+	// Set if the request was aborted before it could be granted (e.g. because
+	// it was chosen as a deadlock victim or timed out).
+	err error
 }
 
 func newRequest(
 	clientID string,
-	exclusive bool,
+	lockID string,
+	mode LockMode,
 	mu *sync.Mutex,
 ) *request {
 	return &request{
-		clientID:         clientID,
-		exclusive:        exclusive,
-		cond:             sync.NewCond(mu),
-		deadlockDetected: false,
+		clientID: clientID,
+		lockID:   lockID,
+		mode:     mode,
+		cond:     sync.NewCond(mu),
+		granted:  false,
 	}
 }
 
+// Returns whether the two requests can't both be granted at the same time.
+func conflicts(r1 *request, r2 *request) bool {
+	return r1.clientID != r2.clientID && !compatible[r1.mode][r2.mode]
+}
+
 type lock struct {
 	lockID string
 
 	// Invariants:
-	//     If len(holders) > 0, then every element has exclusive == false
+	//     The modes of all elements are pairwise compatible
 	//     Each clientID appears at most once
 	holders []*request
 
-	// Invariant:
+	// Requests are granted in FIFO order, except that upgrades are queued
+	// ahead of every request that isn't an upgrade; otherwise, an upgrade could
+	// wait behind a request that's blocked by the lock that the upgrading client
+	// already holds.
+	//
+	// Invariants:
 	//     Each clientID appears at most once
+	//     Upgrades come before every request that isn't an upgrade
 	pending []*request
 }
 
-func (l *lock) acquire(r *request) error {
+// Blocks until an enqueued request is either granted or aborted.
+func (l *lock) wait(r *request) error {
+	for !r.granted {
+		if r.err != nil {
+			return r.err
+		}
+		r.cond.Wait()
+	}
+	return nil
+}
+
+// Returns whether the request was granted immediately; if not, then it's
+// removed from the queue.
+func (l *lock) tryAcquire(r *request) bool {
+	l.enqueue(r)
+	if !r.granted {
+		l.abort(r, nil)
+	}
+	return r.granted
+}
+
+// Adds the request to the queue (unless the client already holds the lock in a
+// sufficient mode, in which case the request is granted right away).
+func (l *lock) enqueue(r *request) {
 	// If the client already holds this lock, then we either do nothing, or try
-	// to upgrade from shared to xxclusive.
+	// to upgrade to a stronger mode.
 	for _, holder := range l.holders {
 		if r.clientID == holder.clientID {
-			if r.exclusive && !holder.exclusive {
-				return l.upgrade(r)
+			if covers(holder.mode, r.mode) {
+				r.granted = true
+				return
 			}
-			return nil
+			r.mode = supremum(holder.mode, r.mode)
+			r.upgrade = true
+			break
 		}
 	}
 
-	// The client doesn't hold this lock yet, so we actually try to acquire it.
-	l.pending = append(l.pending, r)
-	for l.pending[0] != r || !l.canAcquire(r.exclusive) {
-		r.cond.Wait()
-		if r.deadlockDetected {
-			l.handleDeadlock(r.clientID)
-			return Deadlock
+	i := len(l.pending)
+	if r.upgrade {
+		i = 0
+		for i < len(l.pending) && l.pending[i].upgrade {
+			i++
 		}
 	}
-	l.pending = l.pending[1:]
-	l.holders = append(l.holders, r)
-	return nil
+	l.pending = append(l.pending, nil)
+	copy(l.pending[i+1:], l.pending[i:])
+	l.pending[i] = r
+	l.grantPendingRequests()
 }
 
-// Precondition:
-//     r.clientID holds the lock in shared mode
-//     r.exclusive == true
-func (l *lock) upgrade(r *request) error {
-	l.pending = append(l.pending, r)
-	for l.pending[0] != r || len(l.holders) > 1 {
-		r.cond.Wait()
-		if r.deadlockDetected {
-			l.handleDeadlock(r.clientID)
-			return Deadlock
+// Grants as many requests as possible from the front of the queue.
+func (l *lock) grantPendingRequests() {
+	for len(l.pending) > 0 {
+		r := l.pending[0]
+		for _, holder := range l.holders {
+			if conflicts(r, holder) {
+				return
+			}
+		}
+		l.pending = l.pending[1:]
+		if r.upgrade {
+			for _, holder := range l.holders {
+				if holder.clientID == r.clientID {
+					holder.mode = r.mode
+				}
+			}
+		} else {
+			l.holders = append(l.holders, r)
 		}
+		r.granted = true
+		r.cond.Signal()
 	}
-	l.pending = l.pending[1:]
-	l.holders[0].exclusive = true
-	return nil
 }
 
-func (l *lock) handleDeadlock(clientID string) {
-	removeClientRequests(&l.pending, clientID)
-	l.signalPendingRequests()
+// Removes a pending request from the queue, and wakes up its client (which
+// will see err).  Requests that were waiting behind it might now be grantable.
+func (l *lock) abort(r *request, err error) {
+	r.err = err
+	removeClientRequests(&l.pending, r.clientID)
+	l.grantPendingRequests()
+	r.cond.Signal()
 }
 
-func removeClientRequests(requests *[]*request, clientID string) {
-	for i := 0; i < len(*requests); i++ {
-		if (*requests)[i].clientID == clientID {
-			(*requests) = append((*requests)[:i], (*requests)[i+1:]...)
+// Returns the clientIDs that each pending request is waiting for, sorted.  Since
+// requests are granted in queue order (where upgrades are queued ahead of other
+// requests), a pending request waits for:
+//
+//   - every holder whose mode conflicts with it
+//   - every request ahead of it in the queue whose mode conflicts with it
+//   - every request ahead of it in the queue that's waiting for some client
+//     that it wouldn't otherwise be waiting for (e.g. an IS request behind an
+//     IX request that's blocked by an S holder)
+func (l *lock) waitsFor() [][]string {
+	result := make([][]string, len(l.pending))
+	for i, r := range l.pending {
+		clientIDs := make(map[string]struct{})
+		for _, holder := range l.holders {
+			if conflicts(r, holder) {
+				clientIDs[holder.clientID] = struct{}{}
+			}
 		}
-	}
-}
-
-func (l *lock) signalPendingRequests() {
-	if len(l.pending) == 0 {
-		return
-	} else if l.pending[0].exclusive {
-		canAcquire := len(l.holders) == 0
-		canUpgrade := len(l.holders) == 1 &&
-			l.pending[0].clientID == l.holders[0].clientID
-		if canAcquire || canUpgrade {
-			l.pending[0].cond.Signal()
+		for _, ahead := range l.pending[:i] {
+			if conflicts(r, ahead) {
+				clientIDs[ahead.clientID] = struct{}{}
+			}
 		}
-	} else {
-		if len(l.holders) > 0 {
-			return
+		for j, ahead := range l.pending[:i] {
+			for _, clientID := range result[j] {
+				if _, ok := clientIDs[clientID]; !ok {
+					clientIDs[ahead.clientID] = struct{}{}
+					break
+				}
+			}
 		}
-		for i := 0; i < len(l.pending) && !l.pending[i].exclusive; i++ {
-			l.pending[i].cond.Signal()
+		for clientID := range clientIDs {
+			result[i] = append(result[i], clientID)
 		}
+		sort.Strings(result[i])
 	}
+	return result
 }
 
-// Returns whether a new client (that doesn't already hold the lock in any mode)
-// can acquire the lock in the given mode.
-func (l *lock) canAcquire(exclusive bool) bool {
-	if len(l.holders) == 0 {
-		return true
-	} else {
-		return !exclusive && !l.holders[0].exclusive
+func removeClientRequests(requests *[]*request, clientID string) {
+	result := (*requests)[:0]
+	for _, r := range *requests {
+		if r.clientID != clientID {
+			result = append(result, r)
+		}
 	}
+	*requests = result
 }
 
 func (l *lock) release(clientID string) {
 	removeClientRequests(&l.holders, clientID)
-	l.signalPendingRequests()
+	l.grantPendingRequests()
 }
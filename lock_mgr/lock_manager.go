@@ -1,59 +1,262 @@
 package lock_mgr
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/dropbox/godropbox/errors"
 )
 
-var Deadlock = errors.New("Deadlock detected!")
+var (
+	Deadlock = errors.New("Deadlock detected!")
+	Timeout  = errors.New("Timed out waiting for lock")
+)
 
 type lockManager struct {
 	mu                     *sync.Mutex
 	lockIDToLock           map[string]*lock
 	clientToHeldLockIDs    map[string]map[string]struct{}
 	clientToPendingRequest map[string]*request
+
+	// Each client is assigned a timestamp when it first tries to acquire a
+	// lock, and keeps it until it releases all of its locks; a larger
+	// timestamp means a younger client.
+	clientToTimestamp map[string]int64
+	nextTimestamp     int64
+
+	// Only used for locks acquired via Lock.
+	clientToTableLocks  map[string]map[string]*tableLocks
+	escalationThreshold int
+
+	policy DeadlockPolicy
+
+	// Only used with DeadlockPolicy_WoundWait.
+	woundedClients map[string]struct{}
+
+	counters Counters
+
+	// Closed by Stop.
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
+// NewLockManager returns a lockManager that periodically runs a deadlock
+// detector, which can be stopped by calling Stop.
 func NewLockManager() *lockManager {
-	lm := &lockManager{
+	return NewLockManagerWithOptions(Options{})
+}
+
+func NewLockManagerWithOptions(options Options) *lockManager {
+	lm := newLockManager()
+	lm.policy = options.DeadlockPolicy
+	if lm.policy == DeadlockPolicy_Detection {
+		period := options.DetectionPeriod
+		if period == 0 {
+			period = DefaultDetectionPeriod
+		}
+		go lm.startDeadlockDetector(period)
+	}
+	return lm
+}
+
+// Returns a lockManager without a deadlock detector.
+func newLockManager() *lockManager {
+	return &lockManager{
 		mu:                     &sync.Mutex{},
 		lockIDToLock:           make(map[string]*lock),
 		clientToHeldLockIDs:    make(map[string]map[string]struct{}),
 		clientToPendingRequest: make(map[string]*request),
+		clientToTimestamp:      make(map[string]int64),
+		clientToTableLocks:     make(map[string]map[string]*tableLocks),
+		escalationThreshold:    DefaultEscalationThreshold,
+		woundedClients:         make(map[string]struct{}),
+		stop:                   make(chan struct{}),
 	}
-	go lm.startDeadlockDetector()
-	return lm
 }
 
+// Stop shuts down the deadlock detector (if there is one); it's safe to call
+// Stop more than once.
+func (lm *lockManager) Stop() {
+	lm.stopOnce.Do(func() {
+		close(lm.stop)
+	})
+}
+
+// Acquire blocks until the lock is granted.  If the client is chosen as the
+// victim for breaking a deadlock, then Deadlock will be returned; the client
+// keeps every lock that it already held, and it should call ReleaseAll (i.e.
+// abort) before trying again.
 func (lm *lockManager) Acquire(
 	clientID string,
 	lockID string,
 	exclusive bool,
+) error {
+	return lm.AcquireContext(context.Background(), clientID, lockID, exclusive)
+}
+
+// AcquireWithTimeout is like Acquire, except that it gives up (and returns
+// Timeout) if the lock can't be granted within the given duration.
+func (lm *lockManager) AcquireWithTimeout(
+	clientID string,
+	lockID string,
+	exclusive bool,
+	timeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return lm.AcquireContext(ctx, clientID, lockID, exclusive)
+}
+
+// AcquireContext is like Acquire, except that it gives up if ctx is done
+// before the lock can be granted; the result is Timeout if ctx's deadline
+// expired, or ctx.Err() otherwise.  Either way, the client keeps every lock
+// that it already held.
+func (lm *lockManager) AcquireContext(
+	ctx context.Context,
+	clientID string,
+	lockID string,
+	exclusive bool,
+) error {
+	return lm.AcquireMode(ctx, clientID, lockID, modeForExclusive(exclusive))
+}
+
+// AcquireMode is like AcquireContext, but supports every LockMode.  No
+// intention locks are acquired on the lock's behalf; see Lock for that.
+func (lm *lockManager) AcquireMode(
+	ctx context.Context,
+	clientID string,
+	lockID string,
+	mode LockMode,
 ) error {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
+	return lm.acquireLocked(ctx, clientID, lockID, mode)
+}
+
+// Precondition: lm.mu is held
+func (lm *lockManager) acquireLocked(
+	ctx context.Context,
+	clientID string,
+	lockID string,
+	mode LockMode,
+) error {
+	err := ctx.Err()
+	if err != nil {
+		return contextError(err)
+	}
+	l, r, err := lm.newPendingRequest(clientID, lockID, mode)
+	if err != nil {
+		return err
+	}
+	if ctx.Done() != nil {
+		// Aborts the request if ctx is done before the request is resolved.
+		resolved := make(chan struct{})
+		defer close(resolved)
+		go func() {
+			select {
+			case <-ctx.Done():
+				lm.mu.Lock()
+				defer lm.mu.Unlock()
+
+				if !r.granted && r.err == nil {
+					l.abort(r, contextError(ctx.Err()))
+				}
+			case <-resolved:
+			}
+		}()
+	}
+	l.enqueue(r)
+	if !r.granted {
+		lm.counters.NumWaits++
+		start := time.Now()
+		defer func() {
+			lm.counters.WaitTime += time.Since(start)
+		}()
+		lm.preventDeadlock(l, r)
+	}
+	err = l.wait(r)
+	return lm.finishRequest(r, err)
+}
+
+// TryAcquire acquires the lock only if it can be granted immediately; the
+// result indicates whether the lock was acquired.
+func (lm *lockManager) TryAcquire(
+	clientID string,
+	lockID string,
+	exclusive bool,
+) (bool, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	l, r, err := lm.newPendingRequest(
+		clientID,
+		lockID,
+		modeForExclusive(exclusive))
+	if err != nil {
+		return false, err
+	}
+	l.tryAcquire(r)
+	err = lm.finishRequest(r, nil)
+	if err != nil {
+		return false, err
+	}
+	return r.granted, nil
+}
+
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return Timeout
+	}
+	return err
+}
+
+// Precondition: lm.mu is held
+func (lm *lockManager) newPendingRequest(
+	clientID string,
+	lockID string,
+	mode LockMode,
+) (*lock, *request, error) {
 	// A client can only have one pending request at a time.
 	if r, ok := lm.clientToPendingRequest[clientID]; ok {
-		return errors.Newf(
+		return nil, nil, errors.Newf(
 			"Client %v already has a pending request %+v",
 			clientID,
 			r)
 	}
+	if _, ok := lm.woundedClients[clientID]; ok {
+		return nil, nil, Deadlock
+	}
 
+	if _, ok := lm.clientToTimestamp[clientID]; !ok {
+		lm.clientToTimestamp[clientID] = lm.nextTimestamp
+		lm.nextTimestamp++
+	}
 	l := lm.getOrCreateLock(lockID)
-	r := newRequest(clientID, exclusive, lm.mu)
+	r := newRequest(clientID, lockID, mode, lm.mu)
 	lm.clientToPendingRequest[clientID] = r
-	err := l.acquire(r)
+	return l, r, nil
+}
 
-	// We clear the pending request as soon as l.acquire returns, whether or not
-	// the acquire was successful.
-	delete(lm.clientToPendingRequest, clientID)
+// Precondition: lm.mu is held
+func (lm *lockManager) finishRequest(r *request, err error) error {
+	// We clear the pending request as soon as it's resolved, whether or not it
+	// was granted.
+	delete(lm.clientToPendingRequest, r.clientID)
+	if err == Deadlock {
+		lm.counters.NumDeadlockVictims++
+	}
 	if err != nil {
 		return err
 	}
-	lm.markHeldLockID(clientID, lockID)
+	if r.granted {
+		lm.counters.NumAcquisitions++
+		if r.upgrade {
+			lm.counters.NumUpgrades++
+		}
+		lm.markHeldLockID(r.clientID, r.lockID)
+	}
 	return nil
 }
 
@@ -77,8 +280,13 @@ func (lm *lockManager) ReleaseAll(clientID string) {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
-	for lock := range lm.clientToHeldLockIDs[clientID] {
-		lm.lockIDToLock[lock].release(clientID)
+	for lockID := range lm.clientToHeldLockIDs[clientID] {
+		lm.lockIDToLock[lockID].release(clientID)
 	}
 	delete(lm.clientToHeldLockIDs, clientID)
+	delete(lm.clientToTableLocks, clientID)
+	delete(lm.woundedClients, clientID)
+	if _, ok := lm.clientToPendingRequest[clientID]; !ok {
+		delete(lm.clientToTimestamp, clientID)
+	}
 }
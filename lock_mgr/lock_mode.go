@@ -0,0 +1,94 @@
+package lock_mgr
+
+// Lock modes for multi-granularity locking.  A client that wants to lock a
+// node in shared (or exclusive) mode must first lock each of the node's
+// ancestors in intention shared (or intention exclusive) mode.
+type LockMode uint8
+
+const (
+	IntentionShared LockMode = iota
+	IntentionExclusive
+	Shared
+	// Lets the client read the whole subtree, and also lock descendants for
+	// writing.
+	SharedIntentionExclusive
+	Exclusive
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case IntentionShared:
+		return "IS"
+	case IntentionExclusive:
+		return "IX"
+	case Shared:
+		return "S"
+	case SharedIntentionExclusive:
+		return "SIX"
+	case Exclusive:
+		return "X"
+	default:
+		return "?"
+	}
+}
+
+func modeForExclusive(exclusive bool) LockMode {
+	if exclusive {
+		return Exclusive
+	}
+	return Shared
+}
+
+// compatible[m1][m2] is true if one client can hold a lock in mode m1 while
+// another client holds the same lock in mode m2.
+var compatible = [5][5]bool{
+	// IS    IX     S      SIX    X
+	{true, true, true, true, false},     // IS
+	{true, true, false, false, false},   // IX
+	{true, false, true, false, false},   // S
+	{true, false, false, false, false},  // SIX
+	{false, false, false, false, false}, // X
+}
+
+// Returns whether holding a lock in mode m1 grants every permission that
+// holding it in mode m2 would grant.
+func covers(m1 LockMode, m2 LockMode) bool {
+	switch m1 {
+	case Exclusive:
+		return true
+	case SharedIntentionExclusive:
+		return m2 != Exclusive
+	case Shared, IntentionExclusive:
+		return m2 == m1 || m2 == IntentionShared
+	default:
+		return m2 == m1
+	}
+}
+
+// Returns the weakest mode that covers both m1 and m2.
+func supremum(m1 LockMode, m2 LockMode) LockMode {
+	if covers(m1, m2) {
+		return m1
+	} else if covers(m2, m1) {
+		return m2
+	}
+	// The only incomparable pair is (S, IX).
+	return SharedIntentionExclusive
+}
+
+// Returns whether the mode allows writing (to the node itself, or to some of
+// its descendants).
+func (m LockMode) isWrite() bool {
+	return m == IntentionExclusive ||
+		m == SharedIntentionExclusive ||
+		m == Exclusive
+}
+
+// Returns the mode that's required for each ancestor of a node being locked in
+// the given mode.
+func (m LockMode) intention() LockMode {
+	if m.isWrite() {
+		return IntentionExclusive
+	}
+	return IntentionShared
+}
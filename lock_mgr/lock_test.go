@@ -1,9 +1,12 @@
 package lock_mgr
 
 import (
+	"context"
 	"time"
 
 	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
 )
 
 type LockManagerSuite struct{}
@@ -141,8 +144,83 @@ func (s *LockManagerSuite) TestLockUpgrade(c *C) {
 	lm.ReleaseAll("c1")
 	time.Sleep(testLockTimeout)
 
-	// Lock upgrade will block if another client is in line.
+	// Lock upgrade goes ahead of other clients in line, since they might be
+	// waiting for the lock that the upgrading client already holds.
 	assertLockBehavior(c, lm, "c1", "l1", false, false)
 	assertLockBehavior(c, lm, "c2", "l1", true, true)
-	assertLockBehavior(c, lm, "c1", "l1", true, true)
+	assertLockBehavior(c, lm, "c1", "l1", true, false)
+	c.Assert(lm.lockIDToLock["l1"].holders, HasLen, 1)
+	c.Assert(lm.lockIDToLock["l1"].holders[0].mode, Equals, Exclusive)
+}
+
+func (s *LockManagerSuite) TestTimeout(c *C) {
+	lm := newLockManager()
+	c.Assert(lm.Acquire("c1", "l1", false), IsNil)
+
+	// c3 is waiting behind c2 (even though its request is compatible with
+	// c1's), so it should be granted as soon as c2 gives up.
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- lm.AcquireWithTimeout("c2", "l1", true, testLockTimeout)
+	}()
+	waitForPending(c, lm, 1)
+	go lm.Acquire("c3", "l1", false)
+	waitForPending(c, lm, 2)
+	c.Assert(<-errChan, Equals, Timeout)
+	waitForPending(c, lm, 0)
+
+	lm.mu.Lock()
+	c.Assert(lm.lockIDToLock["l1"].holders, HasLen, 2)
+	c.Assert(lm.lockIDToLock["l1"].pending, HasLen, 0)
+	lm.mu.Unlock()
+
+	// A deadline that has already expired fails right away, even if the lock
+	// is available.
+	c.Assert(lm.AcquireWithTimeout("c2", "l1", false, 0), Equals, Timeout)
+	c.Assert(lm.AcquireWithTimeout("c2", "l1", false, time.Hour), IsNil)
+}
+
+func (s *LockManagerSuite) TestContextCancel(c *C) {
+	lm := newLockManager()
+	c.Assert(lm.Acquire("c1", "l1", true), IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- lm.AcquireContext(ctx, "c2", "l1", true)
+	}()
+	waitForPending(c, lm, 1)
+	cancel()
+	c.Assert(<-errChan, Equals, context.Canceled)
+
+	// The canceled request shouldn't be granted later.
+	lm.ReleaseAll("c1")
+	lm.mu.Lock()
+	c.Assert(lm.lockIDToLock["l1"].holders, HasLen, 0)
+	c.Assert(lm.clientToHeldLockIDs["c2"], HasLen, 0)
+	lm.mu.Unlock()
+}
+
+func (s *LockManagerSuite) TestTryAcquire(c *C) {
+	lm := newLockManager()
+	ok, err := lm.TryAcquire("c1", "l1", false)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	ok, err = lm.TryAcquire("c2", "l1", false)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+
+	// Neither client can upgrade while the other holds a shared lock.
+	ok, err = lm.TryAcquire("c1", "l1", true)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	ok, err = lm.TryAcquire("c3", "l1", true)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	lm.ReleaseAll("c2")
+	ok, err = lm.TryAcquire("c1", "l1", true)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(lm.lockIDToLock["l1"].pending, HasLen, 0)
 }
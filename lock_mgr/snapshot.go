@@ -0,0 +1,141 @@
+package lock_mgr
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Counters are cumulative over the lifetime of a lockManager.
+type Counters struct {
+	// Requests that were granted, including re-entrant requests for locks that
+	// were already held.
+	NumAcquisitions int64
+
+	// Requests that couldn't be granted right away, and the total time spent
+	// waiting for them to be granted or aborted.
+	NumWaits int64
+	WaitTime time.Duration
+
+	// Requests that were granted by strengthening the mode of a lock that was
+	// already held.
+	NumUpgrades int64
+
+	// Clients that were aborted to break or prevent a deadlock.
+	NumDeadlockVictims int64
+}
+
+type RequestInfo struct {
+	ClientID string
+	Mode     LockMode
+
+	// Whether the client already holds the lock in a weaker mode; only set for
+	// waiters.
+	Upgrade bool
+}
+
+type LockInfo struct {
+	LockID  string
+	Holders []RequestInfo
+
+	// In the order that they'll be granted.
+	Waiters []RequestInfo
+}
+
+// A Snapshot describes the state of a lockManager at a single point in time.
+type Snapshot struct {
+	// Sorted by LockID; locks without any holders or waiters are omitted.
+	Locks []LockInfo
+
+	// The IDs of the locks held by each client, sorted.
+	ClientToHeldLockIDs map[string][]string
+
+	// Maps each waiting client to the (sorted) clients that it's waiting for.
+	WaitForGraph map[string][]string
+
+	Counters Counters
+}
+
+func (lm *lockManager) Snapshot() Snapshot {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	snapshot := Snapshot{
+		ClientToHeldLockIDs: make(map[string][]string),
+		WaitForGraph:        lm.buildWaitGraph(),
+		Counters:            lm.counters,
+	}
+	for _, l := range lm.lockIDToLock {
+		if len(l.holders) == 0 && len(l.pending) == 0 {
+			continue
+		}
+		lockInfo := LockInfo{
+			LockID: l.lockID,
+		}
+		for _, r := range l.holders {
+			lockInfo.Holders = append(lockInfo.Holders, RequestInfo{
+				ClientID: r.clientID,
+				Mode:     r.mode,
+			})
+		}
+		for _, r := range l.pending {
+			lockInfo.Waiters = append(lockInfo.Waiters, RequestInfo{
+				ClientID: r.clientID,
+				Mode:     r.mode,
+				Upgrade:  r.upgrade,
+			})
+		}
+		snapshot.Locks = append(snapshot.Locks, lockInfo)
+	}
+	sort.Slice(snapshot.Locks, func(i int, j int) bool {
+		return snapshot.Locks[i].LockID < snapshot.Locks[j].LockID
+	})
+	for clientID, lockIDs := range lm.clientToHeldLockIDs {
+		if len(lockIDs) == 0 {
+			continue
+		}
+		for lockID := range lockIDs {
+			snapshot.ClientToHeldLockIDs[clientID] = append(
+				snapshot.ClientToHeldLockIDs[clientID],
+				lockID)
+		}
+		sort.Strings(snapshot.ClientToHeldLockIDs[clientID])
+	}
+	return snapshot
+}
+
+// WaitForGraphDOT renders the wait-for graph in the Graphviz DOT language; each
+// edge is labeled with the lock (and mode) that the waiting client requested.
+func (s *Snapshot) WaitForGraphDOT() string {
+	clientToWaitingLabel := make(map[string]string)
+	for _, lockInfo := range s.Locks {
+		for _, waiter := range lockInfo.Waiters {
+			clientToWaitingLabel[waiter.ClientID] = fmt.Sprintf(
+				"%v (%v)",
+				lockInfo.LockID,
+				waiter.Mode)
+		}
+	}
+	clientIDs := make([]string, 0, len(s.WaitForGraph))
+	for clientID := range s.WaitForGraph {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph WaitFor {\n")
+	for _, from := range clientIDs {
+		for _, to := range s.WaitForGraph[from] {
+			fmt.Fprintf(
+				&buf,
+				"\t%v -> %v [label=%v];\n",
+				strconv.Quote(from),
+				strconv.Quote(to),
+				strconv.Quote(clientToWaitingLabel[from]))
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
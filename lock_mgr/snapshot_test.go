@@ -0,0 +1,105 @@
+package lock_mgr
+
+import (
+	"context"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+)
+
+func (s *LockManagerSuite) TestSnapshot(c *C) {
+	lm := newLockManager()
+	ctx := context.Background()
+	c.Assert(lm.Acquire("c1", "l1", false), IsNil)
+	c.Assert(lm.Acquire("c2", "l1", false), IsNil)
+	c.Assert(lm.AcquireMode(ctx, "c2", "l2", IntentionExclusive), IsNil)
+	errChan := make(chan error, 2)
+	go func() {
+		// Upgrade from S to X.
+		errChan <- lm.Acquire("c1", "l1", true)
+	}()
+	waitForPending(c, lm, 1)
+	go func() {
+		errChan <- lm.Acquire("c3", "l2", false)
+	}()
+	waitForPending(c, lm, 2)
+
+	snapshot := lm.Snapshot()
+	c.Assert(snapshot.Locks, DeepEquals, []LockInfo{
+		{
+			LockID: "l1",
+			Holders: []RequestInfo{
+				{ClientID: "c1", Mode: Shared},
+				{ClientID: "c2", Mode: Shared},
+			},
+			Waiters: []RequestInfo{
+				{ClientID: "c1", Mode: Exclusive, Upgrade: true},
+			},
+		},
+		{
+			LockID: "l2",
+			Holders: []RequestInfo{
+				{ClientID: "c2", Mode: IntentionExclusive},
+			},
+			Waiters: []RequestInfo{
+				{ClientID: "c3", Mode: Shared},
+			},
+		},
+	})
+	c.Assert(snapshot.ClientToHeldLockIDs, DeepEquals, map[string][]string{
+		"c1": {"l1"},
+		"c2": {"l1", "l2"},
+	})
+	c.Assert(snapshot.WaitForGraph, DeepEquals, map[string][]string{
+		"c1": {"c2"},
+		"c3": {"c2"},
+	})
+	c.Assert(snapshot.WaitForGraphDOT(), Equals, `digraph WaitFor {
+	"c1" -> "c2" [label="l1 (X)"];
+	"c3" -> "c2" [label="l2 (S)"];
+}
+`)
+	c.Assert(snapshot.Counters.NumAcquisitions, Equals, int64(3))
+	c.Assert(snapshot.Counters.NumWaits, Equals, int64(2))
+	c.Assert(snapshot.Counters.NumUpgrades, Equals, int64(0))
+
+	// Releasing c2's locks resolves both waits (c1 by upgrading its lock).
+	lm.ReleaseAll("c2")
+	c.Assert(<-errChan, IsNil)
+	c.Assert(<-errChan, IsNil)
+	snapshot = lm.Snapshot()
+	c.Assert(snapshot.WaitForGraph, HasLen, 0)
+	c.Assert(snapshot.ClientToHeldLockIDs, DeepEquals, map[string][]string{
+		"c1": {"l1"},
+		"c3": {"l2"},
+	})
+	c.Assert(snapshot.Counters.NumAcquisitions, Equals, int64(5))
+	c.Assert(snapshot.Counters.NumUpgrades, Equals, int64(1))
+	c.Assert(snapshot.Counters.WaitTime > 0, IsTrue)
+	c.Assert(snapshot.Counters.NumDeadlockVictims, Equals, int64(0))
+
+	// Deadlock victims are counted too.
+	c.Assert(lm.Acquire("c3", "l3", true), IsNil)
+	go func() {
+		errChan <- lm.Acquire("c1", "l3", true)
+	}()
+	waitForPending(c, lm, 1)
+	go func() {
+		errChan <- lm.Acquire("c3", "l1", true)
+	}()
+	waitForPending(c, lm, 2)
+	lm.mu.Lock()
+	c.Assert(lm.resolveDeadlocks(), DeepEquals, []string{"c3"})
+	lm.mu.Unlock()
+	c.Assert(<-errChan, Equals, Deadlock)
+	lm.ReleaseAll("c3")
+	c.Assert(<-errChan, IsNil)
+	c.Assert(lm.Snapshot().Counters.NumDeadlockVictims, Equals, int64(1))
+
+	// Nothing is left once every client has released its locks.
+	lm.ReleaseAll("c1")
+	snapshot = lm.Snapshot()
+	c.Assert(snapshot.Locks, HasLen, 0)
+	c.Assert(snapshot.ClientToHeldLockIDs, HasLen, 0)
+}
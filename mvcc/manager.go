@@ -0,0 +1,234 @@
+package mvcc
+
+import (
+	"os"
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+)
+
+var (
+	TransactionDone = errors.New("Transaction has already committed or aborted")
+	NotVisible      = errors.New("Record version isn't visible")
+	WriteConflict   = errors.New(
+		"Record was modified by a concurrent transaction")
+)
+
+// Each record version stores the TxnID of the transaction that created it, and
+// the TxnID of the transaction that deleted it (if any).
+type TxnID int64
+
+const (
+	// Marks a version that hasn't been deleted.
+	InvalidTxnID TxnID = 0
+
+	// Marks a version that was created (or deleted) by a transaction that
+	// committed before every current and future snapshot was taken; its status
+	// no longer has to be looked up.
+	FrozenTxnID TxnID = 1
+
+	firstNormalTxnID TxnID = 2
+)
+
+type Status byte
+
+const (
+	// Transactions that were in progress when the Manager was last closed
+	// (e.g. because of a crash) are treated as aborted.
+	Status_InProgress Status = iota
+	Status_Committed
+	Status_Aborted
+)
+
+func (s Status) String() string {
+	switch s {
+	case Status_InProgress:
+		return "InProgress"
+	case Status_Committed:
+		return "Committed"
+	case Status_Aborted:
+		return "Aborted"
+	default:
+		return "Unknown"
+	}
+}
+
+// Manager hands out TxnIDs and snapshots, and keeps track of which transactions
+// have committed.  Each transaction's status is stored as a single byte in a
+// commit log file (at offset TxnID); a commit is durable once Commit returns.
+type Manager struct {
+	mu   sync.Mutex
+	clog *os.File
+
+	// statuses[txnID] mirrors the commit log.
+	statuses []Status
+
+	// The oldest TxnID that each active transaction's snapshot might consider
+	// to be in progress.
+	active map[TxnID]TxnID
+}
+
+func OpenManager(path string) (*Manager, error) {
+	clog, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := clog.Stat()
+	if err != nil {
+		clog.Close()
+		return nil, err
+	}
+	b := make([]byte, stat.Size())
+	_, err = clog.ReadAt(b, 0)
+	if err != nil && len(b) > 0 {
+		clog.Close()
+		return nil, err
+	}
+	m := &Manager{
+		clog:   clog,
+		active: make(map[TxnID]TxnID),
+	}
+	for _, status := range b {
+		m.statuses = append(m.statuses, Status(status))
+	}
+	for len(m.statuses) < int(firstNormalTxnID) {
+		m.statuses = append(m.statuses, Status_Committed)
+	}
+	for txnID, status := range m.statuses {
+		if status == Status_InProgress {
+			m.statuses[txnID] = Status_Aborted
+		}
+	}
+	err = m.writeStatuses(0, m.statuses)
+	if err != nil {
+		clog.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manager) writeStatuses(txnID TxnID, statuses []Status) error {
+	b := make([]byte, len(statuses))
+	for i, status := range statuses {
+		b[i] = byte(status)
+	}
+	_, err := m.clog.WriteAt(b, int64(txnID))
+	if err != nil {
+		return err
+	}
+	return m.clog.Sync()
+}
+
+// Begin starts a new transaction, whose snapshot includes the changes made by
+// every transaction that has already committed.
+func (m *Manager) Begin() (*Txn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	txnID := TxnID(len(m.statuses))
+	// The TxnID has to be durable before it's stored in any record version;
+	// otherwise it could be reused after a crash.
+	err := m.writeStatuses(txnID, []Status{Status_InProgress})
+	if err != nil {
+		return nil, err
+	}
+	m.statuses = append(m.statuses, Status_InProgress)
+
+	s := &Snapshot{
+		m:      m,
+		txnID:  txnID,
+		xmin:   txnID,
+		xmax:   txnID,
+		active: make(map[TxnID]struct{}, len(m.active)),
+	}
+	for activeTxnID := range m.active {
+		s.active[activeTxnID] = struct{}{}
+		if activeTxnID < s.xmin {
+			s.xmin = activeTxnID
+		}
+	}
+	m.active[txnID] = s.xmin
+	return &Txn{
+		m:        m,
+		txnID:    txnID,
+		snapshot: s,
+	}, nil
+}
+
+func (m *Manager) Status(txnID TxnID) Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if txnID < 0 || int(txnID) >= len(m.statuses) {
+		return Status_Aborted
+	}
+	return m.statuses[txnID]
+}
+
+// Horizon returns a TxnID such that every transaction that committed with a
+// smaller TxnID is visible to every current and future snapshot.
+func (m *Manager) Horizon() TxnID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	horizon := TxnID(len(m.statuses))
+	for _, xmin := range m.active {
+		if xmin < horizon {
+			horizon = xmin
+		}
+	}
+	return horizon
+}
+
+func (m *Manager) finish(txnID TxnID, status Status) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.active, txnID)
+	m.statuses[txnID] = status
+	if status == Status_Committed {
+		return m.writeStatuses(txnID, []Status{status})
+	}
+	// There's no need to wait for an abort to be durable, since transactions
+	// that are still in progress after a crash are treated as aborted.
+	_, err := m.clog.WriteAt([]byte{byte(status)}, int64(txnID))
+	return err
+}
+
+func (m *Manager) Close() error {
+	return m.clog.Close()
+}
+
+// A Txn must only be used by one goroutine at a time.
+type Txn struct {
+	m        *Manager
+	txnID    TxnID
+	snapshot *Snapshot
+	done     bool
+}
+
+func (t *Txn) ID() TxnID {
+	return t.txnID
+}
+
+func (t *Txn) Snapshot() *Snapshot {
+	return t.snapshot
+}
+
+func (t *Txn) Commit() error {
+	if t.done {
+		return TransactionDone
+	}
+	t.done = true
+	return t.m.finish(t.txnID, Status_Committed)
+}
+
+// Abort discards the transaction's changes; the record versions that it created
+// become invisible right away, and are reclaimed by the next vacuum.
+func (t *Txn) Abort() error {
+	if t.done {
+		return TransactionDone
+	}
+	t.done = true
+	return t.m.finish(t.txnID, Status_Aborted)
+}
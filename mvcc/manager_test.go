@@ -0,0 +1,96 @@
+package mvcc
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+)
+
+type ManagerSuite struct{}
+
+var _ = Suite(&ManagerSuite{})
+
+func (s *ManagerSuite) TestVisibility(c *C) {
+	m, err := OpenManager(c.MkDir() + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+
+	t1, err := m.Begin()
+	c.Assert(err, IsNil)
+	t2, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(t1.Commit(), IsNil)
+	t3, err := m.Begin()
+	c.Assert(err, IsNil)
+
+	// t1 committed before t3 started, but after t2 started.
+	s2, s3 := t2.Snapshot(), t3.Snapshot()
+	c.Assert(s2.IsVisible(t1.ID(), InvalidTxnID), IsFalse)
+	c.Assert(s3.IsVisible(t1.ID(), InvalidTxnID), IsTrue)
+
+	// Each transaction sees its own changes, but not uncommitted changes made
+	// by other transactions.
+	c.Assert(s2.IsVisible(t2.ID(), InvalidTxnID), IsTrue)
+	c.Assert(s3.IsVisible(t2.ID(), InvalidTxnID), IsFalse)
+	c.Assert(s3.IsVisible(t1.ID(), t3.ID()), IsFalse)
+	c.Assert(s3.IsVisible(t1.ID(), t2.ID()), IsTrue)
+	c.Assert(s3.IsVisible(FrozenTxnID, InvalidTxnID), IsTrue)
+	c.Assert(s3.IsVisible(FrozenTxnID, FrozenTxnID), IsFalse)
+
+	// Deleting a version that was already deleted by a concurrent transaction
+	// only works if that transaction aborts.
+	c.Assert(s3.CheckDelete(t1.ID(), InvalidTxnID), IsNil)
+	c.Assert(s3.CheckDelete(t1.ID(), t2.ID()), Equals, WriteConflict)
+	c.Assert(s3.CheckDelete(t2.ID(), InvalidTxnID), Equals, NotVisible)
+	c.Assert(s3.CheckDelete(t1.ID(), t3.ID()), Equals, NotVisible)
+	c.Assert(t2.Abort(), IsNil)
+	c.Assert(s3.CheckDelete(t1.ID(), t2.ID()), IsNil)
+
+	c.Assert(t2.Commit(), Equals, TransactionDone)
+	c.Assert(t3.Commit(), IsNil)
+}
+
+func (s *ManagerSuite) TestHorizon(c *C) {
+	m, err := OpenManager(c.MkDir() + "/clog")
+	c.Assert(err, IsNil)
+	defer m.Close()
+
+	t1, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(m.Horizon(), Equals, t1.ID())
+	t2, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(t1.Commit(), IsNil)
+
+	// t2's snapshot still considers t1 to be in progress.
+	c.Assert(m.Horizon(), Equals, t1.ID())
+	c.Assert(t2.Commit(), IsNil)
+	c.Assert(m.Horizon(), Equals, t2.ID()+1)
+}
+
+func (s *ManagerSuite) TestReopen(c *C) {
+	path := c.MkDir() + "/clog"
+	m, err := OpenManager(path)
+	c.Assert(err, IsNil)
+	committed, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(committed.Commit(), IsNil)
+	aborted, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(aborted.Abort(), IsNil)
+	inProgress, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(m.Close(), IsNil)
+
+	// Transactions that didn't finish are treated as aborted, and TxnIDs are
+	// never reused.
+	m, err = OpenManager(path)
+	c.Assert(err, IsNil)
+	defer m.Close()
+	c.Assert(m.Status(committed.ID()), Equals, Status_Committed)
+	c.Assert(m.Status(aborted.ID()), Equals, Status_Aborted)
+	c.Assert(m.Status(inProgress.ID()), Equals, Status_Aborted)
+	txn, err := m.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(txn.ID(), Equals, inProgress.ID()+1)
+}
@@ -0,0 +1,64 @@
+package mvcc
+
+// A Snapshot determines which record versions a transaction can see: those
+// created by transactions that committed before the snapshot was taken (or by
+// the transaction itself), and not deleted by any such transaction.
+type Snapshot struct {
+	m     *Manager
+	txnID TxnID
+
+	// Every transaction with a TxnID smaller than xmin had finished when the
+	// snapshot was taken, and every transaction with a TxnID of at least xmax
+	// hadn't started yet.
+	xmin TxnID
+	xmax TxnID
+
+	// Transactions that were in progress when the snapshot was taken.
+	active map[TxnID]struct{}
+}
+
+// Returns whether the changes made by the given transaction are visible.
+func (s *Snapshot) sees(txnID TxnID) bool {
+	if txnID == s.txnID || txnID == FrozenTxnID {
+		return true
+	}
+	if txnID >= s.xmax {
+		return false
+	}
+	if _, ok := s.active[txnID]; ok {
+		return false
+	}
+	return s.m.Status(txnID) == Status_Committed
+}
+
+// IsVisible returns whether a record version created by xmin and deleted by
+// xmax (or InvalidTxnID if it hasn't been deleted) is visible.
+func (s *Snapshot) IsVisible(xmin TxnID, xmax TxnID) bool {
+	if !s.sees(xmin) {
+		return false
+	}
+	return xmax == InvalidTxnID || !s.sees(xmax)
+}
+
+// CheckDelete returns nil if the snapshot's transaction can delete a record
+// version created by xmin and deleted by xmax (or InvalidTxnID if it hasn't
+// been deleted).  The result is NotVisible if the version isn't visible, or
+// WriteConflict if it was deleted by a concurrent transaction that hasn't
+// aborted.
+func (s *Snapshot) CheckDelete(xmin TxnID, xmax TxnID) error {
+	if !s.IsVisible(xmin, xmax) {
+		return NotVisible
+	}
+	if xmax == InvalidTxnID {
+		return nil
+	}
+	// Only an abort makes the version available again.
+	if s.m.Status(xmax) == Status_Aborted {
+		return nil
+	}
+	return WriteConflict
+}
+
+func (s *Snapshot) TxnID() TxnID {
+	return s.txnID
+}
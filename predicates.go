@@ -1,37 +1,123 @@
 package zdb2
 
-import (
-	"strings"
+// A Truth is the result of a Condition under SQL's three-valued logic, where
+// comparisons involving NULL are neither true nor false, but Unknown.
+type Truth int8
 
-	"github.com/dropbox/godropbox/errors"
+// The values are ordered so that AND is the minimum and OR is the maximum.
+const (
+	False Truth = iota
+	Unknown
+	True
 )
 
-func FieldEquals(t *TableHeader, fieldName string, value interface{}) Predicate {
-	fieldPosition, _ := MustFieldPositionAndType(t, fieldName)
+func (a Truth) And(b Truth) Truth {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+func (a Truth) Or(b Truth) Truth {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+func (a Truth) Not() Truth {
+	return True - a
+}
+
+// A Condition is a predicate that follows SQL's three-valued logic.
+type Condition func(Record) Truth
+
+// Predicate returns a Predicate that only accepts records for which c is True,
+// like a WHERE clause.
+func (c Condition) Predicate() Predicate {
 	return func(record Record) bool {
-		return record[fieldPosition] == value
+		return c(record) == True
 	}
 }
 
-func FieldLess(t *TableHeader, fieldName string, value interface{}) Predicate {
-	fieldPosition, fieldType := MustFieldPositionAndType(t, fieldName)
-	switch fieldType {
-	case Int32:
-		x := value.(int32)
-		return func(record Record) bool {
-			return record[fieldPosition].(int32) < x
+func (c1 Condition) And(c2 Condition) Condition {
+	return func(record Record) Truth {
+		return c1(record).And(c2(record))
+	}
+}
+
+func (c1 Condition) Or(c2 Condition) Condition {
+	return func(record Record) Truth {
+		return c1(record).Or(c2(record))
+	}
+}
+
+func (c Condition) Not() Condition {
+	return func(record Record) Truth {
+		return c(record).Not()
+	}
+}
+
+func truthOf(b bool) Truth {
+	if b {
+		return True
+	}
+	return False
+}
+
+// FieldIsNull is never Unknown.
+func FieldIsNull(t *TableHeader, fieldName string) Condition {
+	fieldPosition, _ := MustFieldPositionAndType(t, fieldName)
+	return func(record Record) Truth {
+		return truthOf(record[fieldPosition] == nil)
+	}
+}
+
+// FieldEqualsCondition is Unknown if either the field or value is NULL.
+func FieldEqualsCondition(
+	t *TableHeader,
+	fieldName string,
+	value interface{},
+) Condition {
+	fieldPosition, _ := MustFieldPositionAndType(t, fieldName)
+	return func(record Record) Truth {
+		v := record[fieldPosition]
+		if v == nil || value == nil {
+			return Unknown
 		}
-	case Float64:
-		x := value.(float64)
-		return func(record Record) bool {
-			return record[fieldPosition].(float64) < x
+		return truthOf(Equal(v, value))
+	}
+}
+
+// FieldLessCondition is Unknown if either the field or value is NULL.
+func FieldLessCondition(
+	t *TableHeader,
+	fieldName string,
+	value interface{},
+) Condition {
+	fieldPosition, fieldType := MustFieldPositionAndType(t, fieldName)
+	if value == nil {
+		return func(record Record) Truth {
+			return Unknown
 		}
-	case String:
-		s := value.(string)
-		return func(record Record) bool {
-			return strings.Compare(record[fieldPosition].(string), s) < 0
+	}
+	err := CheckValue(fieldType, value)
+	if err != nil {
+		panic(err)
+	}
+	return func(record Record) Truth {
+		v := record[fieldPosition]
+		if v == nil {
+			return Unknown
 		}
-	default:
-		panic(errors.Newf("Unsupported type %v", fieldType))
+		return truthOf(Less(fieldType, v, value))
 	}
 }
+
+func FieldEquals(t *TableHeader, fieldName string, value interface{}) Predicate {
+	return FieldEqualsCondition(t, fieldName, value).Predicate()
+}
+
+func FieldLess(t *TableHeader, fieldName string, value interface{}) Predicate {
+	return FieldLessCondition(t, fieldName, value).Predicate()
+}
@@ -14,8 +14,8 @@ func (s *PredicatesSuite) TestMustFieldPositionAndType(c *C) {
 	t := &TableHeader{
 		Name: "users",
 		Fields: []*Field{
-			{"id", Int32},
-			{"name", String},
+			{"id", Int32, false, 0, 0},
+			{"name", String, false, 0, 0},
 		},
 	}
 	equals := FieldEquals(t, "id", int32(5))
@@ -25,3 +25,38 @@ func (s *PredicatesSuite) TestMustFieldPositionAndType(c *C) {
 	c.Assert(less(Record{int32(5), "Susan Calvin"}), IsTrue)
 	c.Assert(less(Record{int32(6), "Daneel Olivaw"}), IsFalse)
 }
+
+func (s *PredicatesSuite) TestThreeValuedLogic(c *C) {
+	t := &TableHeader{
+		Name: "users",
+		Fields: []*Field{
+			{"id", Int32, false, 0, 0},
+			{"age", Int32, true, 0, 0},
+		},
+	}
+	unknown := Record{int32(1), nil}
+	known := Record{int32(2), int32(30)}
+
+	// Comparisons with NULL are Unknown, and so is their negation.
+	equals := FieldEqualsCondition(t, "age", int32(30))
+	c.Assert(equals(unknown), Equals, Unknown)
+	c.Assert(equals(known), Equals, True)
+	c.Assert(equals.Not()(unknown), Equals, Unknown)
+	c.Assert(equals.Not().Predicate()(unknown), IsFalse)
+	c.Assert(FieldEquals(t, "age", nil)(unknown), IsFalse)
+	less := FieldLessCondition(t, "age", int32(18))
+	c.Assert(less(unknown), Equals, Unknown)
+	c.Assert(less(known), Equals, False)
+	c.Assert(FieldLess(t, "age", int32(40))(unknown), IsFalse)
+
+	isNull := FieldIsNull(t, "age")
+	c.Assert(isNull(unknown), Equals, True)
+	c.Assert(isNull.Not()(known), Equals, True)
+
+	// Unknown AND False is False, and Unknown OR True is True.
+	isOne := FieldEqualsCondition(t, "id", int32(1))
+	c.Assert(less.And(isOne.Not())(unknown), Equals, False)
+	c.Assert(less.And(isOne)(unknown), Equals, Unknown)
+	c.Assert(less.Or(isOne)(unknown), Equals, True)
+	c.Assert(less.Or(isOne.Not())(unknown), Equals, Unknown)
+}
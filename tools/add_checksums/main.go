@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robot-dreams/zdb2/heap_file"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+// Converts heap files and indexes created before block checksums were added,
+// so that corrupt blocks are detected when they're read.  Files that already
+// have checksums are left alone.  None of the files can be in use while this is
+// running.
+func main() {
+	var flagHeapFiles string
+	var flagIndexFiles string
+	flag.StringVar(&flagHeapFiles, "heap_files", "", "comma-separated paths to tables to convert (heap files)")
+	flag.StringVar(&flagIndexFiles, "index_files", "", "comma-separated paths to indexes to convert (B+ trees)")
+	flag.Parse()
+	if flagHeapFiles == "" && flagIndexFiles == "" {
+		log.Fatal("heap_files or index_files flag must be provided")
+	}
+
+	start := time.Now()
+	for _, path := range splitPaths(flagHeapFiles) {
+		err := heap_file.AddChecksums(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Converted heap file %v\n", path)
+	}
+	for _, path := range splitPaths(flagIndexFiles) {
+		err := index.AddChecksums(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Converted index %v\n", path)
+	}
+	fmt.Printf("Done after %v\n", time.Since(start))
+}
+
+func splitPaths(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/robot-dreams/zdb2/heap_file"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+// Prints the contents of a heap file (its schema, and a summary of each page
+// in the given range, including the decoded records) or a B+ tree (each node,
+// level by level, with the leaf chain last).  With the json flag, the output
+// is a single JSON object instead.  The file can't be in use while this is
+// running.
+func main() {
+	var flagHeapFile string
+	var flagIndexFile string
+	var flagFirstPage int
+	var flagLastPage int
+	var flagJSON bool
+	flag.StringVar(&flagHeapFile, "heap_file", "", "path to table to dump (heap file)")
+	flag.StringVar(&flagIndexFile, "index_file", "", "path to index to dump (B+ tree)")
+	flag.IntVar(&flagFirstPage, "first_page", 0, "first page of the heap file to dump")
+	flag.IntVar(&flagLastPage, "last_page", -1, "last page of the heap file to dump (-1 for the last page in the file)")
+	flag.BoolVar(&flagJSON, "json", false, "output JSON instead of text")
+	flag.Parse()
+	if (flagHeapFile == "") == (flagIndexFile == "") {
+		log.Fatal("Exactly one of heap_file or index_file flags must be provided")
+	}
+
+	var dump interface{}
+	var err error
+	if flagHeapFile != "" {
+		dump, err = heap_file.Dump(
+			flagHeapFile,
+			int32(flagFirstPage),
+			int32(flagLastPage))
+	} else {
+		dump, err = index.Dump(flagIndexFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flagJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		err = e.Encode(dump)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	switch dump := dump.(type) {
+	case *heap_file.FileDump:
+		printFileDump(dump)
+	case *index.TreeDump:
+		printTreeDump(dump)
+	}
+}
+
+func printFileDump(d *heap_file.FileDump) {
+	fmt.Printf("Heap file %v\n", d.Path)
+	fmt.Printf("  format version: %d\n", d.FormatVersion)
+	fmt.Printf("  schema version: %d\n", d.SchemaVersion)
+	for _, column := range d.Columns {
+		nullable := ""
+		if column.Nullable {
+			nullable = " (nullable)"
+		}
+		fmt.Printf("  column %v: %v%v\n", column.Name, column.Type, nullable)
+	}
+	dirty := ""
+	if d.Dirty {
+		dirty = " (dirty)"
+	}
+	fmt.Printf("  records: %d%v\n", d.NumRecords, dirty)
+	fmt.Printf("  pages: %d (heap pages start at %d)\n", d.NumPages, d.FirstHeapPage)
+	for _, pd := range d.Pages {
+		fmt.Printf("Page %d: %v", pd.PageID, pd.Kind)
+		switch pd.Kind {
+		case heap_file.PageKind_Heap:
+			fmt.Printf(
+				", schema version %d, %d slots (%d tombstones), %d bytes free (%d after compaction)",
+				pd.SchemaVersion,
+				pd.NumSlots,
+				pd.NumTombstones,
+				pd.FreeSpace,
+				pd.AvailableSpace)
+		case heap_file.PageKind_Overflow:
+			fmt.Printf(
+				", %d bytes, next page %d",
+				pd.OverflowLength,
+				pd.NextOverflowPage)
+		}
+		fmt.Println()
+		if pd.Error != "" {
+			fmt.Printf("  error: %v\n", pd.Error)
+		}
+		for _, sd := range pd.Slots {
+			printSlotDump(sd)
+		}
+	}
+}
+
+func printSlotDump(sd *heap_file.SlotDump) {
+	var flags []string
+	if sd.Moved {
+		flags = append(flags, "moved")
+	}
+	if sd.Toasted {
+		flags = append(flags, "toasted")
+	}
+	fmt.Printf(
+		"  slot %d: %v, offset %d, %d bytes",
+		sd.SlotID,
+		sd.State,
+		sd.Offset,
+		sd.Size)
+	if len(flags) > 0 {
+		fmt.Printf(" (%v)", strings.Join(flags, ", "))
+	}
+	if sd.ForwardTo != nil {
+		fmt.Printf(", forwarded to %+v", *sd.ForwardTo)
+	}
+	if sd.Xmin != 0 || sd.Xmax != 0 {
+		fmt.Printf(", xmin %d, xmax %d", sd.Xmin, sd.Xmax)
+	}
+	if sd.Record != nil {
+		values := make([]string, len(sd.Record))
+		for i, value := range sd.Record {
+			if value == nil {
+				values[i] = "NULL"
+			} else {
+				values[i] = fmt.Sprintf("%v", value)
+			}
+		}
+		fmt.Printf(": (%v)", strings.Join(values, ", "))
+	}
+	fmt.Println()
+	if sd.Error != "" {
+		fmt.Printf("    error: %v\n", sd.Error)
+	}
+}
+
+func printTreeDump(d *index.TreeDump) {
+	fmt.Printf("B+ tree %v\n", d.Path)
+	fmt.Printf("  key type: %v\n", d.KeyType)
+	fmt.Printf("  key compression: %v\n", d.KeyCompression)
+	fmt.Printf("  blocks: %d\n", d.NumBlocks)
+	for _, level := range d.Levels {
+		fmt.Printf(
+			"Level %d: %d nodes, %d keys, fill factor %.3f\n",
+			level.Level,
+			level.NumNodes,
+			level.NumKeys,
+			level.FillFactor)
+		for _, nd := range level.Nodes {
+			printNodeDump(nd)
+		}
+	}
+	if len(d.Levels) > 0 {
+		leaves := d.Levels[len(d.Levels)-1].Nodes
+		chain := make([]string, len(leaves))
+		for i, nd := range leaves {
+			chain[i] = fmt.Sprint(nd.BlockID)
+		}
+		fmt.Printf("Leaf chain: %v\n", strings.Join(chain, " -> "))
+	}
+}
+
+func printNodeDump(nd *index.NodeDump) {
+	switch nd.Type {
+	case index.NodeType_Internal:
+		routers := []string{fmt.Sprintf("-> %d", nd.UnderflowBlockID)}
+		for _, r := range nd.Routers {
+			routers = append(routers, fmt.Sprintf("%v -> %d", r.Key, r.BlockID))
+		}
+		fmt.Printf(
+			"  block %d: internal, subtree height %d, %d routers (%d bytes): %v\n",
+			nd.BlockID,
+			nd.SubtreeHeight,
+			len(nd.Routers),
+			nd.Size,
+			strings.Join(routers, ", "))
+	case index.NodeType_Leaf:
+		keys := "no keys"
+		if nd.MinKey != nil {
+			keys = fmt.Sprintf("keys [%v, %v]", nd.MinKey, nd.MaxKey)
+		}
+		if nd.Prefix != nil {
+			keys += fmt.Sprintf(", prefix %v", nd.Prefix)
+		}
+		duplicateOverflow := ""
+		if nd.DuplicateOverflow {
+			duplicateOverflow = ", duplicate overflow"
+		}
+		fmt.Printf(
+			"  block %d: leaf, %d entries (%d bytes), %v, prev %d, next %d%v\n",
+			nd.BlockID,
+			nd.NumEntries,
+			nd.Size,
+			keys,
+			nd.PrevBlockID,
+			nd.NextBlockID,
+			duplicateOverflow)
+	default:
+		fmt.Printf("  block %d: error: %v\n", nd.BlockID, nd.Error)
+	}
+}
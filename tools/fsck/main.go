@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/robot-dreams/zdb2/fsck"
+)
+
+// Checks the structure of a heap file and/or B+ tree indexes, and prints each
+// problem found (with the block where it was found).  With cross_check, each
+// index is also checked against the heap file.  Exits with status 1 if any
+// problems were found.  None of the files can be in use while this is running.
+func main() {
+	var flagHeapFile string
+	var flagIndexFiles string
+	var flagCrossCheck bool
+	flag.StringVar(&flagHeapFile, "heap_file", "", "path to table to check (heap file)")
+	flag.StringVar(&flagIndexFiles, "index_files", "", "comma-separated paths to indexes to check (B+ trees)")
+	flag.BoolVar(&flagCrossCheck, "cross_check", false, "check that the indexes and the heap file refer to the same records")
+	flag.Parse()
+	if flagHeapFile == "" && flagIndexFiles == "" {
+		log.Fatal("heap_file or index_files flag must be provided")
+	}
+	if flagCrossCheck && flagHeapFile == "" {
+		log.Fatal("cross_check requires heap_file")
+	}
+	var indexFiles []string
+	if flagIndexFiles != "" {
+		indexFiles = strings.Split(flagIndexFiles, ",")
+	}
+
+	var violations []fsck.Violation
+	if flagHeapFile != "" {
+		v, err := fsck.CheckHeapFile(flagHeapFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		violations = append(violations, v...)
+	}
+	for _, indexFile := range indexFiles {
+		var v []fsck.Violation
+		var err error
+		if flagCrossCheck {
+			v, err = fsck.CheckIndex(flagHeapFile, indexFile)
+		} else {
+			v, err = fsck.CheckBPlusTree(indexFile)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		violations = append(violations, v...)
+	}
+
+	for _, v := range violations {
+		fmt.Println(v)
+	}
+	if len(violations) > 0 {
+		fmt.Printf("Found %d problems\n", len(violations))
+		os.Exit(1)
+	}
+	fmt.Println("No problems found")
+}
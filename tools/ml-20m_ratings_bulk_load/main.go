@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"sort"
+	"strings"
 	"time"
 
 	"net/http"
@@ -24,9 +24,11 @@ func main() {
 	var flagInput string
 	var flagHeapFile string
 	var flagIndexFile string
+	var flagKeyFields string
 	flag.StringVar(&flagInput, "input", "", "path to input ratings table (csv)")
 	flag.StringVar(&flagHeapFile, "heap_file", "", "path to output ratings table (heap file)")
 	flag.StringVar(&flagIndexFile, "index_file", "", "path to output ratings index (B+ tree)")
+	flag.StringVar(&flagKeyFields, "key_fields", "movieId", "comma-separated fields to index; more than one makes a composite key")
 	flag.Parse()
 	if flagInput == "" || flagHeapFile == "" || flagIndexFile == "" {
 		log.Fatal("input, heap_file, and index_file flags must all be provided")
@@ -34,13 +36,35 @@ func main() {
 	t := &zdb2.TableHeader{
 		Name: "ratings",
 		Fields: []*zdb2.Field{
-			{"userId", zdb2.Int32},
-			{"movieId", zdb2.Int32},
-			{"rating", zdb2.Float64},
-			{"timestamp", zdb2.Int32},
+			{"userId", zdb2.Int32, false, 0, 0},
+			{"movieId", zdb2.Int32, false, 0, 0},
+			{"rating", zdb2.Float64, false, 0, 0},
+			{"timestamp", zdb2.Timestamp, false, 0, 0},
 		},
 	}
 
+	// A single field is indexed as it is; more than one field is indexed with a
+	// composite key, which is stored as Bytes.
+	keyFields := strings.Split(flagKeyFields, ",")
+	var keyType zdb2.Type
+	var getKey func(zdb2.Record) (interface{}, error)
+	if len(keyFields) == 1 {
+		var position int
+		position, keyType = zdb2.MustFieldPositionAndType(t, keyFields[0])
+		getKey = func(record zdb2.Record) (interface{}, error) {
+			return record[position], nil
+		}
+	} else {
+		compositeKey, err := index.NewCompositeKey(t, keyFields...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyType = zdb2.Bytes
+		getKey = func(record zdb2.Record) (interface{}, error) {
+			return compositeKey.Key(record)
+		}
+	}
+
 	fmt.Println("Starting timer...")
 	start := time.Now()
 	csvScan, err := executor.NewCSVScan(flagInput, t)
@@ -70,10 +94,14 @@ func main() {
 		} else if err != nil {
 			log.Fatal(err)
 		}
+		key, err := getKey(record)
+		if err != nil {
+			log.Fatal(err)
+		}
 		entries = append(
 			entries,
 			index.Entry{
-				Key: record[1].(int32),
+				Key: key,
 				RID: recordID,
 			})
 	}
@@ -83,14 +111,18 @@ func main() {
 
 	fmt.Println("Resetting timer...")
 	start = time.Now()
-	sort.Sort(index.ByKey(entries))
+	index.SortEntries(keyType, entries)
 	fmt.Printf(
 		"Done sorting index entries after %v\n",
 		time.Since(start))
 
 	fmt.Println("Resetting timer...")
 	start = time.Now()
-	bpt, err := index.BulkLoadNewBPlusTree(flagIndexFile, entries, 1)
+	bpt, err := index.BulkLoadNewBPlusTree(
+		flagIndexFile,
+		keyType,
+		entries,
+		1)
 	if err != nil {
 		log.Fatal(err)
 	}
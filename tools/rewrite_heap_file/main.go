@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/robot-dreams/zdb2/heap_file"
+)
+
+// Rewrites a heap file (e.g. the ratings table loaded by
+// ml-20m_ratings_bulk_load) into a densely packed copy, and rebuilds its
+// indexes to match.  None of the files can be in use while this is running.
+func main() {
+	var flagHeapFile string
+	var flagIndexFiles string
+	var flagMappingFile string
+	flag.StringVar(&flagHeapFile, "heap_file", "", "path to table to rewrite (heap file)")
+	flag.StringVar(&flagIndexFiles, "index_files", "", "comma-separated paths to indexes on the table (B+ trees)")
+	flag.StringVar(&flagMappingFile, "mapping_file", "", "optional path to output the old -> new RecordID mapping (csv)")
+	flag.Parse()
+	if flagHeapFile == "" {
+		log.Fatal("heap_file flag must be provided")
+	}
+	var indexFiles []string
+	if flagIndexFiles != "" {
+		indexFiles = strings.Split(flagIndexFiles, ",")
+	}
+
+	fmt.Println("Starting timer...")
+	start := time.Now()
+	oldSize := totalSize(append([]string{flagHeapFile}, indexFiles...))
+	mapping, err := heap_file.RewriteHeapFile(flagHeapFile, indexFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newSize := totalSize(append([]string{flagHeapFile}, indexFiles...))
+	fmt.Printf(
+		"Done rewriting %d records (%d -> %d bytes) after %v\n",
+		mapping.Len(),
+		oldSize,
+		newSize,
+		time.Since(start))
+
+	if flagMappingFile == "" {
+		return
+	}
+	fmt.Println("Resetting timer...")
+	start = time.Now()
+	f, err := os.Create(flagMappingFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "oldPageID,oldSlotID,newPageID,newSlotID")
+	for i := 0; i < mapping.Len(); i++ {
+		oldRecordID, newRecordID := mapping.At(i)
+		fmt.Fprintf(
+			w,
+			"%d,%d,%d,%d\n",
+			oldRecordID.PageID,
+			oldRecordID.SlotID,
+			newRecordID.PageID,
+			newRecordID.SlotID)
+	}
+	err = w.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf(
+		"Done writing RecordID mapping %v after %v\n",
+		flagMappingFile,
+		time.Since(start))
+}
+
+func totalSize(paths []string) int64 {
+	var size int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
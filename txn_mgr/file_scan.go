@@ -0,0 +1,36 @@
+package txn_mgr
+
+import (
+	"github.com/robot-dreams/zdb2"
+)
+
+// fileScan returns every record in a heap file, except for records that the
+// transaction has deleted (but not yet committed).  Closing the scan doesn't
+// close the heap file.
+type fileScan struct {
+	t    *Transaction
+	hf   HeapFile
+	iter zdb2.RecordIterator
+}
+
+var _ zdb2.Iterator = (*fileScan)(nil)
+
+func (s *fileScan) TableHeader() *zdb2.TableHeader {
+	return s.iter.TableHeader()
+}
+
+func (s *fileScan) Next() (zdb2.Record, error) {
+	for {
+		record, recordID, err := s.iter.NextWithID()
+		if err != nil {
+			return nil, err
+		}
+		if !s.t.isDeleted(s.hf, recordID) {
+			return record, nil
+		}
+	}
+}
+
+func (s *fileScan) Close() error {
+	return s.iter.Close()
+}
@@ -0,0 +1,81 @@
+package txn_mgr
+
+import (
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+	"github.com/robot-dreams/zdb2/lock_mgr"
+)
+
+// indexScan returns the records referenced by an index, after locking the
+// whole index in shared mode (which protects the scanned range from phantoms),
+// and acquiring a shared lock on each record before reading it.  Closing the
+// scan doesn't close the index or the heap file.
+type indexScan struct {
+	t    *Transaction
+	hf   HeapFile
+	iter index.Iterator
+}
+
+var _ zdb2.Iterator = (*indexScan)(nil)
+
+func (t *Transaction) NewIndexScanEqual(
+	bpt *index.BPlusTree,
+	hf HeapFile,
+	key interface{},
+) (*indexScan, error) {
+	return t.newIndexScan(bpt, hf, key, bpt.FindEqual)
+}
+
+func (t *Transaction) NewIndexScanGreaterEqual(
+	bpt *index.BPlusTree,
+	hf HeapFile,
+	key interface{},
+) (*indexScan, error) {
+	return t.newIndexScan(bpt, hf, key, bpt.FindGreaterEqual)
+}
+
+func (t *Transaction) newIndexScan(
+	bpt *index.BPlusTree,
+	hf HeapFile,
+	key interface{},
+	findFunc func(interface{}) (index.Iterator, error),
+) (*indexScan, error) {
+	err := t.lock(lock_mgr.IndexResource(bpt.Path()), lock_mgr.Shared)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := findFunc(key)
+	if err != nil {
+		return nil, err
+	}
+	return &indexScan{
+		t:    t,
+		hf:   hf,
+		iter: iter,
+	}, nil
+}
+
+func (s *indexScan) TableHeader() *zdb2.TableHeader {
+	return s.hf.TableHeader()
+}
+
+// Entries for deleted records are skipped.
+func (s *indexScan) Next() (zdb2.Record, error) {
+	for {
+		entry, err := s.iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		record, err := s.t.Get(s.hf, entry.RID)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			return record, nil
+		}
+	}
+}
+
+func (s *indexScan) Close() error {
+	return nil
+}
@@ -0,0 +1,316 @@
+package txn_mgr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+)
+
+// The inserts made by each transaction (and the index entries that it adds)
+// are durable as soon as they're applied, so a TransactionManager opened with
+// OpenTransactionManager logs them, along with the outcome of each
+// transaction.  When the log is reopened after a crash, the inserts of every
+// transaction without an outcome are rolled back.
+//
+// Each record is synced before the change that it describes is committed, so
+// the log can mention changes that were never made (which are skipped during
+// recovery), but a change is never made without being logged.  Once no
+// transactions are active, the log is truncated.
+type logRecordType byte
+
+const (
+	logRecordType_Insert logRecordType = iota + 1
+	logRecordType_AddEntry
+	logRecordType_Commit
+	logRecordType_Abort
+)
+
+type logRecord struct {
+	type_ logRecordType
+	txnID int64
+
+	// For inserts, the path of the heap file; for entries, the path of the
+	// index.
+	path     string
+	recordID zdb2.RecordID
+
+	// The entry's key, as serialized by zdb2.SerializeValue.
+	key []byte
+}
+
+// Returns a string that's the same for records that change the same record (or
+// index entry).
+func (r *logRecord) target() string {
+	var buf bytes.Buffer
+	r.encodeTarget(&buf)
+	return buf.String()
+}
+
+func (r *logRecord) encode() []byte {
+	var buf bytes.Buffer
+	// err is always nil when writing to a bytes.Buffer.
+	_ = binary.Write(&buf, zdb2.ByteOrder, r.type_)
+	_ = binary.Write(&buf, zdb2.ByteOrder, r.txnID)
+	if r.type_ == logRecordType_Insert || r.type_ == logRecordType_AddEntry {
+		r.encodeTarget(&buf)
+	}
+	return buf.Bytes()
+}
+
+func (r *logRecord) encodeTarget(buf *bytes.Buffer) {
+	writeBytes(buf, []byte(r.path))
+	_ = binary.Write(buf, zdb2.ByteOrder, r.recordID.PageID)
+	_ = binary.Write(buf, zdb2.ByteOrder, r.recordID.SlotID)
+	if r.type_ == logRecordType_AddEntry {
+		writeBytes(buf, r.key)
+	}
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	_ = binary.Write(buf, zdb2.ByteOrder, uint32(len(b)))
+	buf.Write(b)
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	var n uint32
+	err := binary.Read(r, zdb2.ByteOrder, &n)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func readLogRecord(r io.Reader) (*logRecord, error) {
+	record := &logRecord{}
+	err := binary.Read(r, zdb2.ByteOrder, &record.type_)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(r, zdb2.ByteOrder, &record.txnID)
+	if err != nil {
+		return nil, err
+	}
+	switch record.type_ {
+	case logRecordType_Commit, logRecordType_Abort:
+		return record, nil
+	case logRecordType_Insert, logRecordType_AddEntry:
+	default:
+		return nil, errors.Newf("Invalid log record type %d", record.type_)
+	}
+	path, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	record.path = string(path)
+	err = binary.Read(r, zdb2.ByteOrder, &record.recordID.PageID)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(r, zdb2.ByteOrder, &record.recordID.SlotID)
+	if err != nil {
+		return nil, err
+	}
+	if record.type_ == logRecordType_AddEntry {
+		record.key, err = readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// Reads every complete record in the log; a record that was only partially
+// written before a crash is ignored.
+func readLog(f *os.File) ([]*logRecord, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	var records []*logRecord
+	for {
+		record, err := readLogRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+type txnLog struct {
+	mu        sync.Mutex
+	f         *os.File
+	numActive int
+}
+
+func (l *txnLog) append(record *logRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := l.f.Write(record.encode())
+	if err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *txnLog) begin() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.numActive++
+}
+
+// Called once a transaction's outcome has been logged; truncates the log if
+// that was the last active transaction.
+func (l *txnLog) end() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.numActive--
+	if l.numActive > 0 {
+		return nil
+	}
+	return l.truncate()
+}
+
+// Precondition: l.mu is held
+func (l *txnLog) truncate() error {
+	err := l.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// OpenTransactionManager is like NewTransactionManager, but it logs the
+// inserts of each transaction to the file at logPath (see log.go).  If the log
+// isn't empty, then the inserts of the transactions that were active when it
+// was last closed are rolled back first; every heap file and index that they
+// used must be passed in.  Heap files that are shared with such a transaction
+// manager should only be modified via transactions.
+func OpenTransactionManager(
+	lm LockManager,
+	logPath string,
+	hfs []HeapFile,
+	bpts []*index.BPlusTree,
+) (*TransactionManager, error) {
+	f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &txnLog{f: f}
+	records, err := readLog(f)
+	if err == nil {
+		err = rollBackActive(records, hfs, bpts)
+	}
+	if err == nil {
+		err = l.truncate()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	tm := NewTransactionManager(lm)
+	tm.log = l
+	return tm, nil
+}
+
+// Rolls back the inserts (and added entries) of every transaction without an
+// outcome, in reverse order.  A RecordID (or entry) can be reused once the
+// change has been rolled back, so only the last change to each one is rolled
+// back.
+func rollBackActive(
+	records []*logRecord,
+	hfs []HeapFile,
+	bpts []*index.BPlusTree,
+) error {
+	finished := make(map[int64]bool)
+	last := make(map[string]int)
+	for i, record := range records {
+		switch record.type_ {
+		case logRecordType_Commit, logRecordType_Abort:
+			finished[record.txnID] = true
+		default:
+			last[record.target()] = i
+		}
+	}
+	hfsByPath := make(map[string]HeapFile)
+	for _, hf := range hfs {
+		hfsByPath[hf.Path()] = hf
+	}
+	bptsByPath := make(map[string]*index.BPlusTree)
+	for _, bpt := range bpts {
+		bptsByPath[bpt.Path()] = bpt
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if finished[record.txnID] || last[record.target()] != i {
+			continue
+		}
+		var err error
+		if record.type_ == logRecordType_Insert {
+			hf, ok := hfsByPath[record.path]
+			if !ok {
+				return errors.Newf(
+					"Heap file %v is needed to recover transaction %d",
+					record.path,
+					record.txnID)
+			}
+			err = rollBackInsert(hf, record.recordID)
+		} else {
+			bpt, ok := bptsByPath[record.path]
+			if !ok {
+				return errors.Newf(
+					"Index %v is needed to recover transaction %d",
+					record.path,
+					record.txnID)
+			}
+			err = rollBackAddEntry(bpt, record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The insert might have been rolled back by the heap file already.
+func rollBackInsert(hf HeapFile, recordID zdb2.RecordID) error {
+	ok, err := hf.HasRecordID(recordID)
+	if err != nil || !ok {
+		return err
+	}
+	return hf.Delete(recordID)
+}
+
+// The entry might never have been added.
+func rollBackAddEntry(bpt *index.BPlusTree, record *logRecord) error {
+	key, err := zdb2.ReadValue(bytes.NewReader(record.key), bpt.KeyType())
+	if err != nil {
+		return err
+	}
+	err = bpt.DeleteEntry(index.Entry{Key: key, RID: record.recordID})
+	if err == index.EntryNotFound {
+		return nil
+	}
+	return err
+}
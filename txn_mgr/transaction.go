@@ -0,0 +1,456 @@
+package txn_mgr
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/index"
+	"github.com/robot-dreams/zdb2/lock_mgr"
+)
+
+var (
+	TransactionDone = errors.New("Transaction has already committed or aborted")
+	RecordNotFound  = errors.New("Record not found")
+)
+
+// LockManager is satisfied by the lock manager from the lock_mgr package.
+type LockManager interface {
+	Lock(
+		ctx context.Context,
+		clientID string,
+		resource lock_mgr.Resource,
+		mode lock_mgr.LockMode,
+	) error
+	ReleaseAll(clientID string)
+}
+
+// HeapFile is satisfied by the heap files from the heap_file package.
+type HeapFile interface {
+	Path() string
+	TableHeader() *zdb2.TableHeader
+	Insert(record zdb2.Record) (zdb2.RecordID, error)
+	InsertLogged(
+		record zdb2.Record,
+		logInsert func(zdb2.RecordID) error,
+	) (zdb2.RecordID, error)
+	HasRecordID(recordID zdb2.RecordID) (bool, error)
+	Delete(recordID zdb2.RecordID) error
+	DeleteAll(recordIDs []zdb2.RecordID) error
+	Undelete(recordID zdb2.RecordID) error
+	Get(recordID zdb2.RecordID) (zdb2.Record, error)
+	Scan() zdb2.RecordIterator
+}
+
+type TransactionManager struct {
+	lm LockManager
+
+	// Only set for transaction managers opened via OpenTransactionManager.
+	log *txnLog
+
+	mu        sync.Mutex
+	nextTxnID int64
+}
+
+func NewTransactionManager(lm LockManager) *TransactionManager {
+	return &TransactionManager{
+		lm:        lm,
+		nextTxnID: 1,
+	}
+}
+
+func (tm *TransactionManager) Begin() *Transaction {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	txnID := tm.nextTxnID
+	tm.nextTxnID++
+	if tm.log != nil {
+		tm.log.begin()
+	}
+	return &Transaction{
+		tm:       tm,
+		txnID:    txnID,
+		clientID: "txn-" + strconv.FormatInt(txnID, 10),
+	}
+}
+
+// Close closes the log, if there is one; no transactions should be active.
+func (tm *TransactionManager) Close() error {
+	if tm.log == nil {
+		return nil
+	}
+	return tm.log.f.Close()
+}
+
+type recordRef struct {
+	hf       HeapFile
+	recordID zdb2.RecordID
+}
+
+type entryRef struct {
+	bpt   *index.BPlusTree
+	entry index.Entry
+}
+
+// Transaction provides isolation for reads and writes against heap files via
+// strict two-phase locking: a shared lock is acquired on each record before
+// it's read, an exclusive lock is acquired on each record before it's
+// modified, and every lock is held until the transaction commits or aborts.
+//
+// Locks are taken at multiple granularities: reading or writing a record also
+// takes intention locks on its page, its table, and the database, while a scan
+// locks the whole table in shared mode (which also protects it from
+// phantoms).  Likewise, an index scan locks the whole index in shared mode,
+// while adding or deleting an index entry locks the index in intention
+// exclusive mode (which conflicts with shared mode).  Once a transaction has
+// locked enough records in a single table, its record locks are escalated to a
+// single table lock.
+//
+// Deletes aren't applied to the heap file until the transaction commits, since
+// the heap file might reuse a deleted record's space right away (which would
+// make the delete impossible to roll back).  Likewise, index entries added by
+// the transaction are removed if it aborts, and index entries deleted by the
+// transaction are only removed when it commits.
+//
+// If any method returns lock_mgr.Deadlock, then the transaction should be
+// aborted.  A Transaction should only be used by one goroutine at a time.
+type Transaction struct {
+	tm       *TransactionManager
+	txnID    int64
+	clientID string
+
+	// Records inserted by the transaction, which have to be deleted if it
+	// aborts.
+	inserted []recordRef
+
+	// Records deleted by the transaction, which are only deleted from their
+	// heap files when it commits.
+	deleted map[recordRef]struct{}
+
+	// Index entries added by the transaction, which have to be deleted if it
+	// aborts.
+	addedEntries []entryRef
+
+	// Index entries deleted by the transaction, which are only deleted from
+	// their indexes when it commits.
+	deletedEntries []entryRef
+
+	done bool
+}
+
+func (t *Transaction) ID() int64 {
+	return t.txnID
+}
+
+func (t *Transaction) lock(
+	resource lock_mgr.Resource,
+	mode lock_mgr.LockMode,
+) error {
+	if t.done {
+		return TransactionDone
+	}
+	return t.tm.lm.Lock(context.Background(), t.clientID, resource, mode)
+}
+
+// Appends a record to the transaction manager's log, if it has one.
+func (t *Transaction) logChange(record *logRecord) error {
+	if t.tm.log == nil {
+		return nil
+	}
+	record.txnID = t.txnID
+	return t.tm.log.append(record)
+}
+
+func (t *Transaction) lockRecord(
+	hf HeapFile,
+	recordID zdb2.RecordID,
+	mode lock_mgr.LockMode,
+) error {
+	return t.lock(lock_mgr.RecordResource(hf.Path(), recordID), mode)
+}
+
+// Get returns (nil, nil) if the record has been deleted, just like the
+// underlying heap file.
+func (t *Transaction) Get(
+	hf HeapFile,
+	recordID zdb2.RecordID,
+) (zdb2.Record, error) {
+	err := t.lockRecord(hf, recordID, lock_mgr.Shared)
+	if err != nil {
+		return nil, err
+	}
+	if t.isDeleted(hf, recordID) {
+		return nil, nil
+	}
+	return hf.Get(recordID)
+}
+
+func (t *Transaction) isDeleted(hf HeapFile, recordID zdb2.RecordID) bool {
+	_, ok := t.deleted[recordRef{hf, recordID}]
+	return ok
+}
+
+// NewFileScan returns an iterator over every record in the heap file, after
+// locking the whole table in shared mode.
+func (t *Transaction) NewFileScan(hf HeapFile) (zdb2.Iterator, error) {
+	err := t.lock(lock_mgr.TableResource(hf.Path()), lock_mgr.Shared)
+	if err != nil {
+		return nil, err
+	}
+	return &fileScan{
+		t:    t,
+		hf:   hf,
+		iter: hf.Scan(),
+	}, nil
+}
+
+func (t *Transaction) Insert(
+	hf HeapFile,
+	record zdb2.Record,
+) (zdb2.RecordID, error) {
+	// Scans of the table have to finish before the new record can be added;
+	// otherwise they might miss it.
+	err := t.lock(
+		lock_mgr.TableResource(hf.Path()),
+		lock_mgr.IntentionExclusive)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	logInsert := func(recordID zdb2.RecordID) error {
+		return t.logChange(&logRecord{
+			type_:    logRecordType_Insert,
+			path:     hf.Path(),
+			recordID: recordID,
+		})
+	}
+	recordID, err := hf.InsertLogged(record, logInsert)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	// The insert has to be rolled back even if locking fails below.
+	t.inserted = append(t.inserted, recordRef{hf, recordID})
+	// No other transaction can know about the new record yet, so this only
+	// blocks if the transaction's record locks are escalated.
+	err = t.lockRecord(hf, recordID, lock_mgr.Exclusive)
+	if err != nil {
+		return zdb2.RecordID{}, err
+	}
+	return recordID, nil
+}
+
+func (t *Transaction) Delete(hf HeapFile, recordID zdb2.RecordID) error {
+	err := t.lockRecord(hf, recordID, lock_mgr.Exclusive)
+	if err != nil {
+		return err
+	}
+	record, err := t.Get(hf, recordID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return RecordNotFound
+	}
+	if t.deleted == nil {
+		t.deleted = make(map[recordRef]struct{})
+	}
+	t.deleted[recordRef{hf, recordID}] = struct{}{}
+	return nil
+}
+
+// AddEntry adds an entry to an index for a record that's already locked in
+// exclusive mode by the transaction (e.g. one that it just inserted).  The
+// entry is removed again if the transaction aborts, since the RecordID of the
+// aborted insert can be reused for another record.
+func (t *Transaction) AddEntry(
+	bpt *index.BPlusTree,
+	hf HeapFile,
+	entry index.Entry,
+) error {
+	err := t.lockEntry(bpt, hf, entry)
+	if err != nil {
+		return err
+	}
+	key, err := zdb2.SerializeValue(bpt.KeyType(), entry.Key)
+	if err != nil {
+		return err
+	}
+	err = t.logChange(&logRecord{
+		type_:    logRecordType_AddEntry,
+		path:     bpt.Path(),
+		recordID: entry.RID,
+		key:      key,
+	})
+	if err != nil {
+		return err
+	}
+	err = bpt.AddEntry(entry)
+	if err != nil {
+		return err
+	}
+	t.addedEntries = append(t.addedEntries, entryRef{bpt, entry})
+	return nil
+}
+
+// DeleteEntry removes an entry from an index when the transaction commits,
+// which should be done along with deleting its record (so that the entry can't
+// refer to another record once the RecordID is reused).  Until then, readers
+// skip the entry if the record has been deleted by the transaction.
+func (t *Transaction) DeleteEntry(
+	bpt *index.BPlusTree,
+	hf HeapFile,
+	entry index.Entry,
+) error {
+	err := t.lockEntry(bpt, hf, entry)
+	if err != nil {
+		return err
+	}
+	t.deletedEntries = append(t.deletedEntries, entryRef{bpt, entry})
+	return nil
+}
+
+// Index scans lock the whole index in shared mode, so changing an entry has to
+// wait for them to finish.
+func (t *Transaction) lockEntry(
+	bpt *index.BPlusTree,
+	hf HeapFile,
+	entry index.Entry,
+) error {
+	err := t.lock(
+		lock_mgr.IndexResource(bpt.Path()),
+		lock_mgr.IntentionExclusive)
+	if err != nil {
+		return err
+	}
+	return t.lockRecord(hf, entry.RID, lock_mgr.Exclusive)
+}
+
+// Commit applies the transaction's deletes, and then releases every lock held
+// by the transaction.
+//
+// The deletes from each heap file are applied as a single transaction in its
+// write-ahead log, so they're all-or-nothing.  If any of the deletes fail,
+// then the deletes that were already applied are undone, and the transaction
+// stays active (so it can still be aborted).  Heap files (and indexes) have
+// separate logs, though, so a crash in the middle of a commit that spans more
+// than one of them can leave some of the deletes applied.  Index entries are
+// deleted after the records they refer to, so such a crash can leave behind
+// entries for deleted records, but never records that are missing from an
+// index.
+//
+// Each individual insert is durable as soon as it's applied.  If the
+// transaction manager has a log (see OpenTransactionManager), then the inserts
+// of a transaction that didn't commit are rolled back when the log is
+// reopened after a crash; otherwise, they survive the crash.
+func (t *Transaction) Commit() error {
+	if t.done {
+		return TransactionDone
+	}
+	var hfs []HeapFile
+	byHeapFile := make(map[HeapFile][]zdb2.RecordID)
+	for ref := range t.deleted {
+		if _, ok := byHeapFile[ref.hf]; !ok {
+			hfs = append(hfs, ref.hf)
+		}
+		byHeapFile[ref.hf] = append(byHeapFile[ref.hf], ref.recordID)
+	}
+	for i, hf := range hfs {
+		err := hf.DeleteAll(byHeapFile[hf])
+		if err != nil {
+			return t.undoCommit(err, hfs[:i], byHeapFile, 0)
+		}
+	}
+	for i, ref := range t.deletedEntries {
+		err := ref.bpt.DeleteEntry(ref.entry)
+		if err != nil {
+			return t.undoCommit(err, hfs, byHeapFile, i)
+		}
+	}
+	err := t.logChange(&logRecord{type_: logRecordType_Commit})
+	if err != nil {
+		return t.undoCommit(err, hfs, byHeapFile, len(t.deletedEntries))
+	}
+	return t.finish(true)
+}
+
+// Restores the first numEntries deleted entries, and the deleted records in
+// the given heap files, after Commit fails with err.  Returns err unless the
+// undo fails as well.
+func (t *Transaction) undoCommit(
+	err error,
+	hfs []HeapFile,
+	byHeapFile map[HeapFile][]zdb2.RecordID,
+	numEntries int,
+) error {
+	for i := numEntries - 1; i >= 0; i-- {
+		ref := t.deletedEntries[i]
+		undoErr := ref.bpt.AddEntry(ref.entry)
+		if undoErr != nil {
+			return undoErr
+		}
+	}
+	for _, hf := range hfs {
+		for _, recordID := range byHeapFile[hf] {
+			undoErr := hf.Undelete(recordID)
+			if undoErr != nil {
+				return undoErr
+			}
+		}
+	}
+	return err
+}
+
+// Abort rolls back every insert made by the transaction, along with any index
+// entries that it added (its deletes were never applied), and then releases
+// every lock held by the transaction.  If the rollback fails partway, then the
+// transaction is still finished; with a log, the rest of the rollback happens
+// when the log is reopened.
+func (t *Transaction) Abort() error {
+	if t.done {
+		return TransactionDone
+	}
+	err := t.rollBack()
+	if err == nil {
+		err = t.logChange(&logRecord{type_: logRecordType_Abort})
+	}
+	finishErr := t.finish(err == nil)
+	if err != nil {
+		return err
+	}
+	return finishErr
+}
+
+func (t *Transaction) rollBack() error {
+	for i := len(t.addedEntries) - 1; i >= 0; i-- {
+		ref := t.addedEntries[i]
+		err := ref.bpt.DeleteEntry(ref.entry)
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(t.inserted) - 1; i >= 0; i-- {
+		ref := t.inserted[i]
+		err := ref.hf.Delete(ref.recordID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Releases the transaction's locks; if its outcome was logged, then the log
+// can be truncated once no other transactions are active.
+func (t *Transaction) finish(logged bool) error {
+	t.done = true
+	t.inserted = nil
+	t.deleted = nil
+	t.addedEntries = nil
+	t.deletedEntries = nil
+	t.tm.lm.ReleaseAll(t.clientID)
+	if t.tm.log == nil || !logged {
+		return nil
+	}
+	return t.tm.log.end()
+}
@@ -0,0 +1,517 @@
+package txn_mgr
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+	"github.com/robot-dreams/zdb2/heap_file"
+	"github.com/robot-dreams/zdb2/index"
+	"github.com/robot-dreams/zdb2/lock_mgr"
+	"github.com/robot-dreams/zdb2/wal"
+)
+
+type TransactionSuite struct{}
+
+var _ = Suite(&TransactionSuite{})
+
+var t = &zdb2.TableHeader{
+	Name: "movies",
+	Fields: []*zdb2.Field{
+		{"title", zdb2.String, false, 0, 0},
+		{"views", zdb2.Int32, false, 0, 0},
+	},
+}
+
+func newTestHeapFile(c *C) HeapFile {
+	hf, err := heap_file.NewHeapFile(c.MkDir()+"/txn_mgr_test", t)
+	c.Assert(err, IsNil)
+	return hf
+}
+
+func (s *TransactionSuite) TestAbort(c *C) {
+	hf := newTestHeapFile(c)
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+
+	txn := tm.Begin()
+	var recordIDs []zdb2.RecordID
+	for i := 0; i < 3; i++ {
+		recordID, err := txn.Insert(hf, zdb2.Record{"Gattaca", int32(i)})
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	c.Assert(txn.Commit(), IsNil)
+
+	txn = tm.Begin()
+	c.Assert(txn.Delete(hf, recordIDs[0]), IsNil)
+	// Deleting the same record twice should fail.
+	c.Assert(txn.Delete(hf, recordIDs[0]), Equals, RecordNotFound)
+	newRecordID, err := txn.Insert(hf, zdb2.Record{"Hackers", int32(3)})
+	c.Assert(err, IsNil)
+	record, err := txn.Get(hf, recordIDs[0])
+	c.Assert(err, IsNil)
+	c.Assert(record, IsNil)
+	c.Assert(txn.Abort(), IsNil)
+
+	// Neither the delete nor the insert should be visible.
+	txn = tm.Begin()
+	for i, recordID := range recordIDs {
+		record, err := txn.Get(hf, recordID)
+		c.Assert(err, IsNil)
+		c.Assert(record, DeepEquals, zdb2.Record{"Gattaca", int32(i)})
+	}
+	record, err = txn.Get(hf, newRecordID)
+	c.Assert(err, IsNil)
+	c.Assert(record, IsNil)
+	c.Assert(txn.Commit(), IsNil)
+
+	// A finished transaction can't be reused.
+	_, err = txn.Get(hf, newRecordID)
+	c.Assert(err, Equals, TransactionDone)
+	c.Assert(txn.Commit(), Equals, TransactionDone)
+	c.Assert(txn.Abort(), Equals, TransactionDone)
+}
+
+func (s *TransactionSuite) TestIsolation(c *C) {
+	hf := newTestHeapFile(c)
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+
+	txn := tm.Begin()
+	recordID, err := txn.Insert(hf, zdb2.Record{"Gattaca", int32(0)})
+	c.Assert(err, IsNil)
+	c.Assert(txn.Commit(), IsNil)
+
+	writer := tm.Begin()
+	c.Assert(writer.Delete(hf, recordID), IsNil)
+
+	// The reader shouldn't see the delete until the writer commits.
+	done := make(chan zdb2.Record)
+	go func() {
+		reader := tm.Begin()
+		record, err := reader.Get(hf, recordID)
+		c.Check(err, IsNil)
+		c.Check(reader.Commit(), IsNil)
+		done <- record
+	}()
+	select {
+	case <-done:
+		c.Fatal("Reader didn't block on the writer's exclusive lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Assert(writer.Commit(), IsNil)
+	c.Assert(<-done, IsNil)
+}
+
+func (s *TransactionSuite) TestFileScan(c *C) {
+	hf := newTestHeapFile(c)
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+
+	txn := tm.Begin()
+	recordID, err := txn.Insert(hf, zdb2.Record{"Gattaca", int32(0)})
+	c.Assert(err, IsNil)
+	c.Assert(txn.Commit(), IsNil)
+
+	reader := tm.Begin()
+	scan, err := reader.NewFileScan(hf)
+	c.Assert(err, IsNil)
+
+	// The reader's table lock should prevent phantoms.
+	done := make(chan struct{})
+	go func() {
+		writer := tm.Begin()
+		_, err := writer.Insert(hf, zdb2.Record{"Hackers", int32(1)})
+		c.Check(err, IsNil)
+		c.Check(writer.Commit(), IsNil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		c.Fatal("Writer didn't block on the reader's table lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		{"Gattaca", int32(0)},
+	})
+	c.Assert(reader.Commit(), IsNil)
+	<-done
+
+	reader = tm.Begin()
+	scan, err = reader.NewFileScan(hf)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		{"Gattaca", int32(0)},
+		{"Hackers", int32(1)},
+	})
+	c.Assert(reader.Commit(), IsNil)
+
+	// A transaction's scans don't see the records that it deleted, even though
+	// the deletes aren't applied until it commits.
+	txn = tm.Begin()
+	c.Assert(txn.Delete(hf, recordID), IsNil)
+	scan, err = txn.NewFileScan(hf)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		{"Hackers", int32(1)},
+	})
+	c.Assert(txn.Commit(), IsNil)
+	record, err := hf.Get(recordID)
+	c.Assert(err, IsNil)
+	c.Assert(record, IsNil)
+}
+
+func (s *TransactionSuite) TestConcurrentTransactions(c *C) {
+	hf := newTestHeapFile(c)
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+
+	numGoroutines := 8
+	numRecordsPerTxn := 100
+	recordIDs := make([][]zdb2.RecordID, numGoroutines)
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			txn := tm.Begin()
+			for j := 0; j < numRecordsPerTxn; j++ {
+				recordID, err := txn.Insert(
+					hf,
+					zdb2.Record{"Inside Out", int32(i)})
+				c.Check(err, IsNil)
+				recordIDs[i] = append(recordIDs[i], recordID)
+			}
+			// Each transaction deletes half of its own records.
+			for j := 0; j < numRecordsPerTxn; j += 2 {
+				c.Check(txn.Delete(hf, recordIDs[i][j]), IsNil)
+			}
+			if i%2 == 0 {
+				c.Check(txn.Commit(), IsNil)
+			} else {
+				c.Check(txn.Abort(), IsNil)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	txn := tm.Begin()
+	defer txn.Commit()
+	for i := 0; i < numGoroutines; i++ {
+		for j, recordID := range recordIDs[i] {
+			record, err := txn.Get(hf, recordID)
+			c.Assert(err, IsNil)
+			committed := i%2 == 0
+			deleted := j%2 == 0
+			if committed && !deleted {
+				c.Assert(record, DeepEquals, zdb2.Record{"Inside Out", int32(i)})
+			} else {
+				c.Assert(record, IsNil)
+			}
+		}
+	}
+}
+
+// Returns the number of entries in an index of non-negative int32 keys.
+func numEntries(c *C, bpt *index.BPlusTree) int {
+	iter, err := bpt.FindGreaterEqual(int32(0))
+	c.Assert(err, IsNil)
+	n := 0
+	for {
+		_, err := iter.Next()
+		if err == io.EOF {
+			return n
+		}
+		c.Assert(err, IsNil)
+		n++
+	}
+}
+
+func (s *TransactionSuite) TestIndexScan(c *C) {
+	hf := newTestHeapFile(c)
+	bpt, err := index.OpenBPlusTree(
+		c.MkDir()+"/txn_mgr_test_index",
+		zdb2.Int32)
+	c.Assert(err, IsNil)
+	defer bpt.Close()
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+
+	insert := func(txn *Transaction, views int32) {
+		record := zdb2.Record{"Leon: The Professional", views}
+		recordID, err := txn.Insert(hf, record)
+		c.Assert(err, IsNil)
+		err = txn.AddEntry(bpt, hf, index.Entry{Key: views, RID: recordID})
+		c.Assert(err, IsNil)
+	}
+	txn := tm.Begin()
+	insert(txn, 1)
+	insert(txn, 2)
+	c.Assert(txn.Commit(), IsNil)
+	txn = tm.Begin()
+	insert(txn, 2)
+	insert(txn, 3)
+	c.Assert(txn.Abort(), IsNil)
+
+	// The entries for the aborted inserts were removed.
+	c.Assert(numEntries(c, bpt), Equals, 2)
+	txn = tm.Begin()
+	scan, err := txn.NewIndexScanGreaterEqual(bpt, hf, int32(0))
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		{"Leon: The Professional", int32(1)},
+		{"Leon: The Professional", int32(2)},
+	})
+	scan, err = txn.NewIndexScanEqual(bpt, hf, int32(2))
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		{"Leon: The Professional", int32(2)},
+	})
+
+	// Deleted entries are skipped right away, but only removed on commit.
+	iter, err := bpt.FindEqual(int32(1))
+	c.Assert(err, IsNil)
+	entry, err := iter.Next()
+	c.Assert(err, IsNil)
+	c.Assert(txn.Delete(hf, entry.RID), IsNil)
+	c.Assert(txn.DeleteEntry(bpt, hf, entry), IsNil)
+	scan, err = txn.NewIndexScanGreaterEqual(bpt, hf, int32(0))
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		{"Leon: The Professional", int32(2)},
+	})
+	c.Assert(numEntries(c, bpt), Equals, 2)
+	c.Assert(txn.Commit(), IsNil)
+	c.Assert(numEntries(c, bpt), Equals, 1)
+}
+
+func (s *TransactionSuite) TestIndexScanPhantoms(c *C) {
+	hf := newTestHeapFile(c)
+	bpt, err := index.OpenBPlusTree(
+		c.MkDir()+"/txn_mgr_test_index",
+		zdb2.Int32)
+	c.Assert(err, IsNil)
+	defer bpt.Close()
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+
+	reader := tm.Begin()
+	scan, err := reader.NewIndexScanEqual(bpt, hf, int32(1))
+	c.Assert(err, IsNil)
+
+	// The reader's index lock should prevent the writer from adding an entry
+	// that the scan would have returned.
+	done := make(chan struct{})
+	go func() {
+		writer := tm.Begin()
+		recordID, err := writer.Insert(hf, zdb2.Record{"Hackers", int32(1)})
+		c.Check(err, IsNil)
+		entry := index.Entry{Key: int32(1), RID: recordID}
+		err = writer.AddEntry(bpt, hf, entry)
+		c.Check(err, IsNil)
+		c.Check(writer.Commit(), IsNil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		c.Fatal("Writer didn't block on the reader's index lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	zdb2.CheckIterator(c, scan, nil)
+	scan, err = reader.NewIndexScanEqual(bpt, hf, int32(1))
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, nil)
+	c.Assert(reader.Commit(), IsNil)
+	<-done
+
+	reader = tm.Begin()
+	scan, err = reader.NewIndexScanEqual(bpt, hf, int32(1))
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		{"Hackers", int32(1)},
+	})
+	c.Assert(reader.Commit(), IsNil)
+}
+
+// Fails every DeleteAll, as if the heap file couldn't be written.
+type failingHeapFile struct {
+	HeapFile
+}
+
+func (hf failingHeapFile) DeleteAll(recordIDs []zdb2.RecordID) error {
+	return errors.New("Cannot delete records")
+}
+
+func (s *TransactionSuite) TestCommitFailure(c *C) {
+	hf1 := newTestHeapFile(c)
+	hf2 := failingHeapFile{newTestHeapFile(c)}
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+
+	txn := tm.Begin()
+	var recordIDs []zdb2.RecordID
+	for _, hf := range []HeapFile{hf1, hf2} {
+		recordID, err := txn.Insert(hf, zdb2.Record{"Gattaca", int32(0)})
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	c.Assert(txn.Commit(), IsNil)
+
+	// The delete that was already applied to the first heap file is undone
+	// when the second heap file fails.
+	txn = tm.Begin()
+	c.Assert(txn.Delete(hf1, recordIDs[0]), IsNil)
+	c.Assert(txn.Delete(hf2, recordIDs[1]), IsNil)
+	c.Assert(txn.Commit(), NotNil)
+	c.Assert(txn.Abort(), IsNil)
+	for i, hf := range []HeapFile{hf1, hf2} {
+		record, err := hf.Get(recordIDs[i])
+		c.Assert(err, IsNil)
+		c.Assert(record, DeepEquals, zdb2.Record{"Gattaca", int32(0)})
+	}
+}
+
+func (s *TransactionSuite) TestCommitCrash(c *C) {
+	defaultPool := buffer_pool.Default()
+	defer buffer_pool.SetDefault(defaultPool)
+	defer wal.ClearCrashPoints()
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(4, buffer_pool.NewLRU()))
+
+	hf := newTestHeapFile(c)
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+	txn := tm.Begin()
+	var expectedRecords []zdb2.Record
+	var recordIDs []zdb2.RecordID
+	for i := 0; i < 1000; i++ {
+		record := zdb2.Record{"Hackers", int32(i)}
+		recordID, err := txn.Insert(hf, record)
+		c.Assert(err, IsNil)
+		expectedRecords = append(expectedRecords, record)
+		recordIDs = append(recordIDs, recordID)
+	}
+	c.Assert(txn.Commit(), IsNil)
+
+	// Crash partway through committing a transaction that deleted every other
+	// record; none of the deletes should survive.
+	txn = tm.Begin()
+	for i := 0; i < len(recordIDs); i += 2 {
+		c.Assert(txn.Delete(hf, recordIDs[i]), IsNil)
+	}
+	wal.SetCrashPoint(wal.CrashPoint_Append, 100)
+	func() {
+		defer func() {
+			c.Assert(recover(), Equals, wal.Crash)
+		}()
+		_ = txn.Commit()
+	}()
+	// Throw away all cached pages.
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(4, buffer_pool.NewLRU()))
+
+	scan, err := heap_file.NewFileScan(hf.Path())
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, expectedRecords)
+}
+
+func (s *TransactionSuite) TestCommitEntryFailure(c *C) {
+	hf := newTestHeapFile(c)
+	bpt, err := index.OpenBPlusTree(
+		c.MkDir()+"/txn_mgr_test_index",
+		zdb2.Int32)
+	c.Assert(err, IsNil)
+	defer bpt.Close()
+	tm := NewTransactionManager(lock_mgr.NewLockManager())
+
+	txn := tm.Begin()
+	var recordIDs []zdb2.RecordID
+	for i := 0; i < 2; i++ {
+		recordID, err := txn.Insert(hf, zdb2.Record{"Gattaca", int32(i)})
+		c.Assert(err, IsNil)
+		err = txn.AddEntry(bpt, hf, index.Entry{Key: int32(i), RID: recordID})
+		c.Assert(err, IsNil)
+		recordIDs = append(recordIDs, recordID)
+	}
+	c.Assert(txn.Commit(), IsNil)
+
+	// The second entry doesn't exist, so the commit fails after the first
+	// entry has been deleted; every delete should be undone, and the
+	// transaction should still be active.
+	txn = tm.Begin()
+	c.Assert(txn.Delete(hf, recordIDs[0]), IsNil)
+	c.Assert(
+		txn.DeleteEntry(bpt, hf, index.Entry{Key: int32(0), RID: recordIDs[0]}),
+		IsNil)
+	c.Assert(
+		txn.DeleteEntry(bpt, hf, index.Entry{Key: int32(2), RID: recordIDs[0]}),
+		IsNil)
+	c.Assert(txn.Commit(), Equals, index.EntryNotFound)
+	c.Assert(numEntries(c, bpt), Equals, 2)
+	record, err := hf.Get(recordIDs[0])
+	c.Assert(err, IsNil)
+	c.Assert(record, DeepEquals, zdb2.Record{"Gattaca", int32(0)})
+	c.Assert(txn.Abort(), IsNil)
+}
+
+func (s *TransactionSuite) TestRecovery(c *C) {
+	dir := c.MkDir()
+	hf, err := heap_file.NewHeapFile(dir+"/txn_mgr_test", t)
+	c.Assert(err, IsNil)
+	defer hf.Close()
+	bpt, err := index.OpenBPlusTree(dir+"/txn_mgr_test_index", zdb2.Int32)
+	c.Assert(err, IsNil)
+	defer bpt.Close()
+	logPath := dir + "/txn_mgr_test_log"
+	tm, err := OpenTransactionManager(
+		lock_mgr.NewLockManager(),
+		logPath,
+		[]HeapFile{hf},
+		[]*index.BPlusTree{bpt})
+	c.Assert(err, IsNil)
+
+	insert := func(txn *Transaction, views int32) zdb2.RecordID {
+		record := zdb2.Record{"Leon: The Professional", views}
+		recordID, err := txn.Insert(hf, record)
+		c.Assert(err, IsNil)
+		err = txn.AddEntry(bpt, hf, index.Entry{Key: views, RID: recordID})
+		c.Assert(err, IsNil)
+		return recordID
+	}
+	committed := tm.Begin()
+	insert(committed, 1)
+	aborted := tm.Begin()
+	insert(aborted, 2)
+	c.Assert(aborted.Abort(), IsNil)
+	active := tm.Begin()
+	insert(active, 3)
+	insert(active, 4)
+	c.Assert(committed.Commit(), IsNil)
+
+	// Crash while the last transaction is still active.
+	c.Assert(tm.Close(), IsNil)
+	tm, err = OpenTransactionManager(
+		lock_mgr.NewLockManager(),
+		logPath,
+		nil,
+		nil)
+	c.Assert(err, NotNil)
+	tm, err = OpenTransactionManager(
+		lock_mgr.NewLockManager(),
+		logPath,
+		[]HeapFile{hf},
+		[]*index.BPlusTree{bpt})
+	c.Assert(err, IsNil)
+	defer tm.Close()
+
+	c.Assert(numEntries(c, bpt), Equals, 1)
+	txn := tm.Begin()
+	scan, err := txn.NewFileScan(hf)
+	c.Assert(err, IsNil)
+	zdb2.CheckIterator(c, scan, []zdb2.Record{
+		{"Leon: The Professional", int32(1)},
+	})
+	c.Assert(txn.Commit(), IsNil)
+
+	// The log is truncated once no transactions are active.
+	stat, err := os.Stat(logPath)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Size(), Equals, int64(0))
+}
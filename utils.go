@@ -1,10 +1,13 @@
 package zdb2
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dropbox/godropbox/errors"
 	. "github.com/dropbox/godropbox/gocheck2"
@@ -23,6 +26,10 @@ func CoerceToFloat64(type_ Type, value interface{}) float64 {
 			panic(err)
 		}
 		return x
+	case Int64:
+		return float64(value.(int64))
+	case Decimal:
+		return value.(DecimalValue).Float64()
 	default:
 		panic(errors.Newf("Unsupported type %v", type_))
 	}
@@ -36,11 +43,127 @@ func Less(type_ Type, v1 interface{}, v2 interface{}) bool {
 		return v1.(float64) < v2.(float64)
 	case String:
 		return strings.Compare(v1.(string), v2.(string)) < 0
+	case Int64:
+		return v1.(int64) < v2.(int64)
+	case Bool:
+		return !v1.(bool) && v2.(bool)
+	case Bytes:
+		return bytes.Compare(v1.([]byte), v2.([]byte)) < 0
+	case Date, Timestamp:
+		return v1.(time.Time).Before(v2.(time.Time))
+	case Decimal:
+		return v1.(DecimalValue).Cmp(v2.(DecimalValue)) < 0
 	default:
 		panic(errors.Newf("Unsupported type %v", type_))
 	}
 }
 
+// Equal returns true if v1 and v2 are equal values of the same type (or are
+// both NULL).
+func Equal(v1 interface{}, v2 interface{}) bool {
+	switch x := v1.(type) {
+	case []byte:
+		y, ok := v2.([]byte)
+		return ok && bytes.Equal(x, y)
+	case time.Time:
+		y, ok := v2.(time.Time)
+		return ok && x.Equal(y)
+	case DecimalValue:
+		y, ok := v2.(DecimalValue)
+		return ok && x.Cmp(y) == 0
+	default:
+		return v1 == v2
+	}
+}
+
+// CheckValue returns an error if value can't be stored in a field of the given
+// type.
+func CheckValue(type_ Type, value interface{}) error {
+	var ok bool
+	switch type_ {
+	case Int32:
+		_, ok = value.(int32)
+	case Float64:
+		_, ok = value.(float64)
+	case String:
+		_, ok = value.(string)
+	case Int64:
+		_, ok = value.(int64)
+	case Bool:
+		_, ok = value.(bool)
+	case Bytes:
+		_, ok = value.([]byte)
+	case Date, Timestamp:
+		_, ok = value.(time.Time)
+	case Decimal:
+		var d DecimalValue
+		d, ok = value.(DecimalValue)
+		ok = ok && d.Scale <= MaxDecimalScale
+	default:
+		return errors.Newf("Unsupported type %v", type_)
+	}
+	if !ok {
+		return errors.Newf("Invalid value %#v for type %v", value, type_)
+	}
+	return nil
+}
+
+// CheckField returns an error unless f has a valid precision and scale for its
+// type.
+func CheckField(f *Field) error {
+	if f.Type != Decimal {
+		if f.Precision != 0 || f.Scale != 0 {
+			return errors.Newf(
+				"Field %v of type %v cannot have a precision or scale",
+				f.Name,
+				f.Type)
+		}
+		return nil
+	}
+	if f.Precision == 0 ||
+		f.Precision > MaxDecimalPrecision ||
+		f.Scale > f.Precision {
+		return errors.Newf(
+			"Invalid precision %d and scale %d for decimal field %v",
+			f.Precision,
+			f.Scale,
+			f.Name)
+	}
+	return nil
+}
+
+// CoerceValue returns value as it's stored in the field f, or an error if it
+// can't be stored in f.  Decimals are rescaled to f's scale, so that equal
+// values of the field always have the same representation.
+func CoerceValue(f *Field, value interface{}) (interface{}, error) {
+	if value == nil {
+		if !f.Nullable {
+			return nil, errors.Newf("Field %v is not nullable", f.Name)
+		}
+		return nil, nil
+	}
+	err := CheckValue(f.Type, value)
+	if err != nil {
+		return nil, err
+	}
+	if f.Type != Decimal {
+		return value, nil
+	}
+	d, err := value.(DecimalValue).Rescale(f.Scale)
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(math.Pow10(int(f.Precision)))
+	if d.Unscaled >= limit || d.Unscaled <= -limit {
+		return nil, errors.Newf(
+			"%v has more than %d digits, so it can't be stored in field %v",
+			d,
+			f.Precision,
+			f.Name)
+	}
+	return d, nil
+}
+
 func JoinedRecord(r1, r2 Record) Record {
 	result := make(Record, 0, len(r1)+len(r2))
 	result = append(result, r1...)
@@ -60,6 +183,15 @@ func JoinedHeader(
 	if !hasField(t2, joinField2) {
 		return nil, errors.Newf("%v does not have field %v", *t2, joinField2)
 	}
+	// Equal decimals are only represented the same way if they have the same
+	// scale.
+	f1, f2 := mustField(t1, joinField1), mustField(t2, joinField2)
+	if f1.Type == Decimal && f2.Type == Decimal && f1.Scale != f2.Scale {
+		return nil, errors.Newf(
+			"Cannot join decimal fields %v and %v with different scales",
+			joinField1,
+			joinField2)
+	}
 	joinedName := fmt.Sprintf(
 		"join(%s.%s = %s.%s)", t1.Name, joinField1, t2.Name, joinField2)
 	return &TableHeader{
@@ -82,16 +214,18 @@ func hasField(t *TableHeader, fieldName string) bool {
 func qualifiedFields(t *TableHeader) []*Field {
 	result := make([]*Field, 0, len(t.Fields))
 	for _, field := range t.Fields {
-		result = append(
-			result,
-			&Field{
-				Name: t.Name + "." + field.Name,
-				Type: field.Type,
-			})
+		qualified := *field
+		qualified.Name = t.Name + "." + field.Name
+		result = append(result, &qualified)
 	}
 	return result
 }
 
+func mustField(t *TableHeader, fieldName string) *Field {
+	i, _ := MustFieldPositionAndType(t, fieldName)
+	return t.Fields[i]
+}
+
 func MustFieldPositionAndType(t *TableHeader, fieldName string) (int, Type) {
 	for i, field := range t.Fields {
 		if field.Name == fieldName {
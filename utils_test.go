@@ -12,16 +12,16 @@ func (s *UtilsSuite) TestJoinedHeader(c *C) {
 	t1 := &TableHeader{
 		Name: "users",
 		Fields: []*Field{
-			{"id", Int32},
-			{"name", String},
+			{"id", Int32, false, 0, 0},
+			{"name", String, false, 0, 0},
 		},
 	}
 	t2 := &TableHeader{
 		Name: "logins",
 		Fields: []*Field{
-			{"user_id", Int32},
-			{"timestamp", Int32},
-			{"client", String},
+			{"user_id", Int32, false, 0, 0},
+			{"timestamp", Int32, false, 0, 0},
+			{"client", String, false, 0, 0},
 		},
 	}
 	joined, err := JoinedHeader(t1, t2, "id", "user_id")
@@ -32,11 +32,11 @@ func (s *UtilsSuite) TestJoinedHeader(c *C) {
 		&TableHeader{
 			Name: "join(users.id = logins.user_id)",
 			Fields: []*Field{
-				{"users.id", Int32},
-				{"users.name", String},
-				{"logins.user_id", Int32},
-				{"logins.timestamp", Int32},
-				{"logins.client", String},
+				{"users.id", Int32, false, 0, 0},
+				{"users.name", String, false, 0, 0},
+				{"logins.user_id", Int32, false, 0, 0},
+				{"logins.timestamp", Int32, false, 0, 0},
+				{"logins.client", String, false, 0, 0},
 			},
 		})
 }
@@ -45,8 +45,8 @@ func (s *UtilsSuite) TestMustFieldPositionAndType(c *C) {
 	t := &TableHeader{
 		Name: "users",
 		Fields: []*Field{
-			{"id", Int32},
-			{"name", String},
+			{"id", Int32, false, 0, 0},
+			{"name", String, false, 0, 0},
 		},
 	}
 	position, type_ := MustFieldPositionAndType(t, "id")
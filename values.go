@@ -0,0 +1,191 @@
+package zdb2
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dropbox/godropbox/errors"
+)
+
+// Dates are stored as a number of days since 1970-01-01.
+const secondsPerDay = 24 * 60 * 60
+
+const dateLayout = "2006-01-02"
+
+// NewDate returns midnight (UTC) on the given day.
+func NewDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func ParseDate(s string) (time.Time, error) {
+	return time.Parse(dateLayout, s)
+}
+
+func dateToDays(t time.Time) int32 {
+	year, month, day := t.Date()
+	return int32(NewDate(year, month, day).Unix() / secondsPerDay)
+}
+
+func daysToDate(days int32) time.Time {
+	return time.Unix(int64(days)*secondsPerDay, 0).UTC()
+}
+
+// Timestamps are stored as a number of microseconds since the Unix epoch, so
+// they're truncated to the microsecond.
+func NewTimestamp(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond).UTC()
+}
+
+// ParseTimestamp accepts either RFC 3339 timestamps or a number of seconds since
+// the Unix epoch (like the timestamps in the MovieLens datasets).
+func ParseTimestamp(s string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return NewTimestamp(t), nil
+}
+
+func timestampToMicros(t time.Time) int64 {
+	return t.Unix()*1e6 + int64(t.Nanosecond()/1e3)
+}
+
+func microsToTimestamp(micros int64) time.Time {
+	seconds := micros / 1e6
+	micros %= 1e6
+	// Round down for timestamps before 1970.
+	if micros < 0 {
+		seconds--
+		micros += 1e6
+	}
+	return time.Unix(seconds, micros*1e3).UTC()
+}
+
+// A DecimalValue is an exact fixed-point number, equal to Unscaled / 10^Scale.
+// For example, 12.50 is DecimalValue{1250, 2}.  Values with different scales
+// can be equal (like 12.50 and 12.5).
+type DecimalValue struct {
+	Unscaled int64
+	Scale    uint8
+}
+
+// The number of digits after the decimal point is limited, since an int64 can
+// only hold 18 decimal digits.
+const MaxDecimalScale = 18
+
+// Likewise, decimal fields can have at most 18 digits in total.
+const MaxDecimalPrecision = 18
+
+func ParseDecimal(s string) (DecimalValue, error) {
+	digits := s
+	var scale int
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		digits = s[:i] + s[i+1:]
+		scale = len(s) - i - 1
+	}
+	if scale > MaxDecimalScale {
+		return DecimalValue{}, errors.Newf(
+			"Too many digits after the decimal point in %v",
+			s)
+	}
+	unscaled, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || strings.Contains(digits, ".") {
+		return DecimalValue{}, errors.Newf("Invalid decimal %v", s)
+	}
+	return DecimalValue{
+		Unscaled: unscaled,
+		Scale:    uint8(scale),
+	}, nil
+}
+
+func (d DecimalValue) String() string {
+	s := new(big.Int).Abs(big.NewInt(d.Unscaled)).String()
+	scale := int(d.Scale)
+	if len(s) <= scale {
+		s = strings.Repeat("0", scale-len(s)+1) + s
+	}
+	if scale > 0 {
+		s = s[:len(s)-scale] + "." + s[len(s)-scale:]
+	}
+	if d.Unscaled < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// Returns d * 10^MaxDecimalScale, so that values with different scales can be
+// compared without overflow.
+func (d DecimalValue) rescaled() *big.Int {
+	x := big.NewInt(d.Unscaled)
+	exp := big.NewInt(int64(MaxDecimalScale - int(d.Scale)))
+	return x.Mul(x, exp.Exp(big.NewInt(10), exp, nil))
+}
+
+// Cmp returns -1, 0 or 1 if d is less than, equal to, or greater than e.
+func (d DecimalValue) Cmp(e DecimalValue) int {
+	if d.Scale == e.Scale {
+		switch {
+		case d.Unscaled < e.Unscaled:
+			return -1
+		case d.Unscaled > e.Unscaled:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return d.rescaled().Cmp(e.rescaled())
+}
+
+// Rescale returns the value equal to d with the given number of digits after
+// the decimal point, or an error if there's no such value that fits in an
+// int64.
+func (d DecimalValue) Rescale(scale uint8) (DecimalValue, error) {
+	e := d
+	for e.Scale > scale {
+		if e.Unscaled%10 != 0 {
+			return DecimalValue{}, errors.Newf(
+				"%v has more than %d digits after the decimal point",
+				d,
+				scale)
+		}
+		e.Unscaled /= 10
+		e.Scale--
+	}
+	for e.Scale < scale {
+		if e.Unscaled > math.MaxInt64/10 || e.Unscaled < math.MinInt64/10 {
+			return DecimalValue{}, errors.Newf(
+				"%v is too large for %d digits after the decimal point",
+				d,
+				scale)
+		}
+		e.Unscaled *= 10
+		e.Scale++
+	}
+	return e, nil
+}
+
+// Normalize removes trailing zeros after the decimal point, so that equal
+// values have the same representation.
+func (d DecimalValue) Normalize() DecimalValue {
+	for d.Scale > 0 && d.Unscaled%10 == 0 {
+		d.Unscaled /= 10
+		d.Scale--
+	}
+	return d
+}
+
+// Float64 returns the float64 closest to d.
+func (d DecimalValue) Float64() float64 {
+	x, err := strconv.ParseFloat(d.String(), 64)
+	if err != nil {
+		panic(err)
+	}
+	return x
+}
@@ -0,0 +1,233 @@
+package zdb2
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+)
+
+type ValuesSuite struct{}
+
+var _ = Suite(&ValuesSuite{})
+
+func (s *ValuesSuite) TestDecimal(c *C) {
+	for _, tc := range []struct {
+		s        string
+		expected DecimalValue
+		str      string
+	}{
+		{"12.50", DecimalValue{1250, 2}, "12.50"},
+		{"-0.05", DecimalValue{-5, 2}, "-0.05"},
+		{"-.5", DecimalValue{-5, 1}, "-0.5"},
+		{"42", DecimalValue{42, 0}, "42"},
+		{"42.", DecimalValue{42, 0}, "42"},
+		{
+			"-9.223372036854775808",
+			DecimalValue{-9223372036854775808, 18},
+			"-9.223372036854775808",
+		},
+	} {
+		d, err := ParseDecimal(tc.s)
+		c.Assert(err, IsNil)
+		c.Assert(d, Equals, tc.expected)
+		c.Assert(d.String(), Equals, tc.str)
+	}
+	for _, s := range []string{"", ".", "1.2.3", "1e5", "0.1234567890123456789"} {
+		_, err := ParseDecimal(s)
+		c.Assert(err, NotNil)
+	}
+
+	// Comparisons are exact, even when the scales differ.
+	a := DecimalValue{1250, 2}
+	b := DecimalValue{125, 1}
+	c.Assert(a.Cmp(b), Equals, 0)
+	c.Assert(Equal(a, b), IsTrue)
+	c.Assert(a.Normalize(), Equals, b)
+	c.Assert(Less(Decimal, DecimalValue{1, 18}, DecimalValue{0, 0}), IsFalse)
+	c.Assert(Less(Decimal, DecimalValue{0, 0}, DecimalValue{1, 18}), IsTrue)
+	huge := DecimalValue{9223372036854775807, 0}
+	c.Assert(huge.Cmp(DecimalValue{9223372036854775807, 1}), Equals, 1)
+	c.Assert(CoerceToFloat64(Decimal, DecimalValue{-5, 2}), Equals, -0.05)
+}
+
+func (s *ValuesSuite) TestDecimalFields(c *C) {
+	d, err := DecimalValue{15, 1}.Rescale(3)
+	c.Assert(err, IsNil)
+	c.Assert(d, Equals, DecimalValue{1500, 3})
+	d, err = d.Rescale(0)
+	c.Assert(err, NotNil)
+	d, err = DecimalValue{-1500, 3}.Rescale(1)
+	c.Assert(err, IsNil)
+	c.Assert(d, Equals, DecimalValue{-15, 1})
+	_, err = DecimalValue{-1, 0}.Rescale(MaxDecimalScale + 1)
+	c.Assert(err, NotNil)
+
+	f := &Field{"price", Decimal, true, 5, 2}
+	c.Assert(CheckField(f), IsNil)
+	for _, value := range []interface{}{
+		DecimalValue{15, 1},
+		DecimalValue{150, 2},
+		DecimalValue{150000, 5},
+	} {
+		coerced, err := CoerceValue(f, value)
+		c.Assert(err, IsNil)
+		c.Assert(coerced, Equals, DecimalValue{150, 2})
+	}
+	coerced, err := CoerceValue(f, DecimalValue{-99999, 2})
+	c.Assert(err, IsNil)
+	c.Assert(coerced, Equals, DecimalValue{-99999, 2})
+	coerced, err = CoerceValue(f, nil)
+	c.Assert(err, IsNil)
+	c.Assert(coerced, IsNil)
+	// Values need more digits after the decimal point, or in total.
+	for _, value := range []interface{}{
+		DecimalValue{1, 3},
+		DecimalValue{1000, 0},
+		DecimalValue{-100000, 2},
+		1.5,
+	} {
+		_, err = CoerceValue(f, value)
+		c.Assert(err, NotNil)
+	}
+	_, err = CoerceValue(&Field{"price", Decimal, false, 5, 2}, nil)
+	c.Assert(err, NotNil)
+
+	// The precision and scale only apply to decimal fields, and are stored
+	// with them.
+	for _, f := range []*Field{
+		{"price", Decimal, false, 0, 0},
+		{"price", Decimal, false, MaxDecimalPrecision + 1, 2},
+		{"price", Decimal, false, 2, 3},
+		{"id", Int32, false, 5, 0},
+	} {
+		c.Assert(CheckField(f), NotNil)
+		c.Assert(WriteField(&bytes.Buffer{}, f), NotNil)
+	}
+	var buf bytes.Buffer
+	c.Assert(WriteField(&buf, f), IsNil)
+	actual, err := ReadField(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(actual, DeepEquals, f)
+	t := &TableHeader{Name: "prices", Fields: []*Field{f}}
+	c.Assert(t.WriteRecord(&buf, Record{DecimalValue{1, 3}}), NotNil)
+}
+
+func (s *ValuesSuite) TestTimes(c *C) {
+	date, err := ParseDate("1969-07-20")
+	c.Assert(err, IsNil)
+	c.Assert(date.Equal(NewDate(1969, time.July, 20)), IsTrue)
+	c.Assert(dateToDays(date), Equals, int32(-165))
+	c.Assert(daysToDate(-165), Equals, date)
+
+	// Timestamps can be given as seconds since the epoch.
+	ts, err := ParseTimestamp("1112486027")
+	c.Assert(err, IsNil)
+	c.Assert(ts.Equal(time.Date(2005, 4, 2, 23, 53, 47, 0, time.UTC)), IsTrue)
+	ts, err = ParseTimestamp("1969-12-31T23:59:59.9999995Z")
+	c.Assert(err, IsNil)
+	c.Assert(timestampToMicros(ts), Equals, int64(-1))
+	c.Assert(microsToTimestamp(-1), Equals, ts)
+	_, err = ParseTimestamp("yesterday")
+	c.Assert(err, NotNil)
+}
+
+func (s *ValuesSuite) TestEncoding(c *C) {
+	t := &TableHeader{
+		Name: "accounts",
+		Fields: []*Field{
+			{"id", Int64, false, 0, 0},
+			{"active", Bool, false, 0, 0},
+			{"key", Bytes, true, 0, 0},
+			{"opened", Date, false, 0, 0},
+			{"last_login", Timestamp, true, 0, 0},
+			{"balance", Decimal, false, 10, 2},
+		},
+	}
+	records := []Record{
+		{
+			int64(1) << 40,
+			true,
+			[]byte{0xde, 0xad, 0xbe, 0xef},
+			NewDate(2018, time.February, 1),
+			NewTimestamp(time.Date(2018, 2, 1, 9, 30, 0, 123456789, time.UTC)),
+			DecimalValue{-12345, 2},
+		},
+		{
+			int64(-1),
+			false,
+			nil,
+			NewDate(1970, time.January, 1),
+			nil,
+			DecimalValue{0, 0},
+		},
+	}
+	var buf bytes.Buffer
+	c.Assert(WriteTableHeader(&buf, t), IsNil)
+	for _, record := range records {
+		for i, value := range record {
+			if value != nil {
+				c.Assert(CheckValue(t.Fields[i].Type, value), IsNil)
+			}
+		}
+		c.Assert(t.WriteRecord(&buf, record), IsNil)
+	}
+	actual, err := ReadTableHeader(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(actual, DeepEquals, t)
+	for _, record := range records {
+		actual, err := t.ReadRecord(&buf)
+		c.Assert(err, IsNil)
+		c.Assert(actual.Equals(record), IsTrue)
+		// Decimals are stored with their field's scale.
+		c.Assert(actual[5].(DecimalValue).Scale, Equals, uint8(2))
+	}
+	// Timestamps are truncated to the microsecond.
+	c.Assert(
+		records[0][4].(time.Time).Nanosecond(),
+		Equals,
+		123456000)
+
+	c.Assert(Less(Bool, false, true), IsTrue)
+	c.Assert(Less(Bool, true, true), IsFalse)
+	c.Assert(Less(Bytes, []byte{1}, []byte{1, 0}), IsTrue)
+	c.Assert(CheckValue(Int64, int32(1)), NotNil)
+	c.Assert(CheckValue(Decimal, DecimalValue{1, 19}), NotNil)
+}
+
+func (s *ValuesSuite) TestLongValues(c *C) {
+	t := &TableHeader{
+		Name: "documents",
+		Fields: []*Field{
+			{"body", String, false, 0, 0},
+			{"attachment", Bytes, false, 0, 0},
+		},
+	}
+	record := Record{
+		strings.Repeat("lorem ipsum ", 1000),
+		bytes.Repeat([]byte{0xff}, 70000),
+	}
+	var buf bytes.Buffer
+	c.Assert(t.WriteRecord(&buf, record), IsNil)
+	actual, err := t.ReadRecord(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(actual.Equals(record), IsTrue)
+
+	// Lengths used to be stored in a single byte.
+	err = t.WriteRecordInFormat(&buf, record, RecordFormat_ShortLengths)
+	c.Assert(err, NotNil)
+	short := Record{"lorem ipsum", []byte{0xff}}
+	buf.Reset()
+	err = t.WriteRecordInFormat(&buf, short, RecordFormat_ShortLengths)
+	c.Assert(err, IsNil)
+	c.Assert(buf.Len(), Equals, 14)
+	actual, err = t.ReadRecordInFormat(&buf, RecordFormat_ShortLengths)
+	c.Assert(err, IsNil)
+	c.Assert(actual.Equals(short), IsTrue)
+
+	// Names are still limited to 255 bytes.
+	c.Assert(WriteString(&buf, strings.Repeat("a", 256)), NotNil)
+}
@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+)
+
+// Crash is the value passed to panic when an injected crash point is reached.
+// Tests simulate a crash by recovering from the panic and then abandoning all
+// in-memory state (including the buffer pool) before reopening the files.
+var Crash = errors.New("Injected crash")
+
+const (
+	// Reached after each record is appended to the log buffer.
+	CrashPoint_Append = "append"
+
+	// Reached just before a commit record is appended.
+	CrashPoint_Commit = "commit"
+
+	// Reached after the log has been flushed for a dirty page, but before the
+	// page itself is written back.
+	CrashPoint_WriteBack = "write_back"
+)
+
+var (
+	crashMu        sync.Mutex
+	crashCountdown = make(map[string]int)
+)
+
+// SetCrashPoint arranges for the n-th subsequent visit (counting from 1) to the
+// given crash point to panic with Crash.  It should only be used in tests.
+func SetCrashPoint(point string, n int) {
+	crashMu.Lock()
+	defer crashMu.Unlock()
+
+	crashCountdown[point] = n
+}
+
+func ClearCrashPoints() {
+	crashMu.Lock()
+	defer crashMu.Unlock()
+
+	crashCountdown = make(map[string]int)
+}
+
+func crashPoint(point string) {
+	crashMu.Lock()
+	n, ok := crashCountdown[point]
+	if ok {
+		n--
+		if n <= 0 {
+			delete(crashCountdown, point)
+		} else {
+			crashCountdown[point] = n
+		}
+	}
+	crashMu.Unlock()
+	if ok && n <= 0 {
+		panic(Crash)
+	}
+}
@@ -0,0 +1,467 @@
+package wal
+
+import (
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/robot-dreams/zdb2/block_file"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+)
+
+// If the log grows beyond this size, then it will be truncated (after writing
+// back every dirty block) the next time no transactions are active.
+var maxLogSize int64 = 1 << 26
+
+// Changes within this many bytes of each other are logged as a single segment.
+const maxSegmentGap = 8
+
+// File is a buffer_pool.File whose changes are protected by a write-ahead log
+// stored alongside it (at path + ".wal").  Every change must happen inside a
+// transaction started by Begin; once Commit returns, the transaction's changes
+// will survive a crash, and if a crash happens before then, the changes will be
+// rolled back the next time the file is opened.
+//
+// Each block stores the LSN of the last log record that modified it (its
+// "page LSN") as a little endian int64 at pageLSNOffset; the rest of the block
+// format is up to the caller.
+//
+// A File supports a single writer; callers are responsible for serializing
+// calls that modify the File.
+//
+// Opening a file that's already open returns the same File (and only the first
+// open recovers the file), since a second log for the same file would replay
+// or truncate records that the first one still depends on.  The file is closed
+// once every open has been matched by a call to Close.
+type File struct {
+	*buffer_pool.File
+	bp            *buffer_pool.BufferPool
+	log           *Log
+	pageLSNOffset int
+	logging       bool
+	numOpens      int
+
+	nextTxnID   TxnID
+	activeTxnID TxnID
+
+	// Records for the active transaction, in case it needs to be rolled back.
+	activeRecords []*logRecord
+}
+
+// The buffer pool shares a BlockFile between every open of the same file, so
+// it identifies the File that's already open for it (if any).
+var (
+	openFilesMu sync.Mutex
+	openFiles   = make(map[*block_file.BlockFile]*File)
+)
+
+func OpenFile(path string, blockSize int, pageLSNOffset int) (*File, error) {
+	openFilesMu.Lock()
+	defer openFilesMu.Unlock()
+
+	bp := buffer_pool.Default()
+	bf, err := buffer_pool.OpenFile(bp, path, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := openFiles[bf.BlockFile]; ok {
+		// f already holds a reference to the BlockFile.
+		err = bf.Close()
+		if err != nil {
+			return nil, err
+		}
+		if f.pageLSNOffset != pageLSNOffset {
+			return nil, errors.Newf(
+				"%v is already open with page LSN offset %d; got %d",
+				path,
+				f.pageLSNOffset,
+				pageLSNOffset)
+		}
+		f.numOpens++
+		return f, nil
+	}
+	log, records, err := openLog(path+".wal", bf.NumBlocks)
+	if err != nil {
+		bf.Close()
+		return nil, err
+	}
+	f := &File{
+		File:          bf,
+		bp:            bp,
+		log:           log,
+		pageLSNOffset: pageLSNOffset,
+		logging:       true,
+		numOpens:      1,
+		nextTxnID:     1,
+	}
+	bp.SetWriteBackHook(bf.BlockFile, f.beforeWriteBack)
+	err = f.recover(records)
+	if err != nil {
+		return nil, err
+	}
+	openFiles[bf.BlockFile] = f
+	return f, nil
+}
+
+func (f *File) beforeWriteBack(data []byte) error {
+	err := f.log.flush(f.pageLSN(data))
+	if err != nil {
+		return err
+	}
+	crashPoint(CrashPoint_WriteBack)
+	return nil
+}
+
+func (f *File) pageLSN(data []byte) LSN {
+	return LSN(byteOrder.Uint64(data[f.pageLSNOffset:]))
+}
+
+func (f *File) setPageLSN(data []byte, lsn LSN) {
+	byteOrder.PutUint64(data[f.pageLSNOffset:], uint64(lsn))
+}
+
+// SetLogging turns logging on or off.  While logging is off, changes aren't
+// recoverable; this is meant for bulk loading a new file, which should be
+// discarded if a crash happens before it's closed.
+func (f *File) SetLogging(logging bool) error {
+	if f.activeTxnID != 0 {
+		return errors.New("Cannot change logging mode during a transaction")
+	}
+	if f.logging == logging {
+		return nil
+	}
+	if logging {
+		// Make the unlogged changes durable before anything else is logged.
+		err := f.Checkpoint()
+		if err != nil {
+			return err
+		}
+	}
+	f.logging = logging
+	return nil
+}
+
+func (f *File) Logging() bool {
+	return f.logging
+}
+
+func (f *File) appendRecord(r *logRecord) (LSN, error) {
+	if len(f.activeRecords) > 0 {
+		r.prevLSN = f.activeRecords[len(f.activeRecords)-1].lsn
+	}
+	r.txnID = f.activeTxnID
+	lsn, err := f.log.append(r)
+	if err != nil {
+		return 0, err
+	}
+	f.activeRecords = append(f.activeRecords, r)
+	return lsn, nil
+}
+
+func (f *File) Begin() error {
+	if f.activeTxnID != 0 {
+		return errors.Newf("Transaction %d is already active", f.activeTxnID)
+	}
+	f.activeTxnID = f.nextTxnID
+	f.nextTxnID++
+	if !f.logging {
+		return nil
+	}
+	_, err := f.appendRecord(&logRecord{type_: recordType_Begin})
+	return err
+}
+
+func (f *File) checkActive() error {
+	if f.activeTxnID == 0 {
+		return errors.New("No active transaction")
+	}
+	return nil
+}
+
+func (f *File) endTxn() {
+	f.activeTxnID = 0
+	f.activeRecords = nil
+}
+
+// Commit makes the active transaction's changes durable.
+func (f *File) Commit() error {
+	err := f.checkActive()
+	if err != nil {
+		return err
+	}
+	if !f.logging {
+		f.endTxn()
+		return nil
+	}
+	crashPoint(CrashPoint_Commit)
+	lsn, err := f.appendRecord(&logRecord{type_: recordType_Commit})
+	if err != nil {
+		return err
+	}
+	err = f.log.flush(lsn)
+	if err != nil {
+		return err
+	}
+	_, err = f.appendRecord(&logRecord{type_: recordType_End})
+	if err != nil {
+		return err
+	}
+	f.endTxn()
+	if f.log.size > maxLogSize {
+		return f.Checkpoint()
+	}
+	return nil
+}
+
+// Abort rolls back every change made by the active transaction.  Blocks
+// allocated by the transaction remain allocated, but are restored to their
+// initial (zeroed) contents.
+func (f *File) Abort() error {
+	err := f.checkActive()
+	if err != nil {
+		return err
+	}
+	if !f.logging {
+		f.endTxn()
+		return errors.New("Cannot roll back a transaction while logging is off")
+	}
+	_, err = f.appendRecord(&logRecord{type_: recordType_Abort})
+	if err != nil {
+		return err
+	}
+	byLSN := make(map[LSN]*logRecord, len(f.activeRecords))
+	for _, r := range f.activeRecords {
+		byLSN[r.lsn] = r
+	}
+	for lsn := f.activeRecords[len(f.activeRecords)-1].lsn; lsn != 0; {
+		r := byLSN[lsn]
+		lsn, err = f.undo(r)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = f.appendRecord(&logRecord{type_: recordType_End})
+	if err != nil {
+		return err
+	}
+	f.endTxn()
+	return nil
+}
+
+// Undoes a single record on behalf of the active transaction, and returns the
+// LSN of the next record that should be undone (or 0 if there are none left).
+func (f *File) undo(r *logRecord) (LSN, error) {
+	switch r.type_ {
+	case recordType_Update:
+		clr := &logRecord{
+			type_:       recordType_CLR,
+			blockID:     r.blockID,
+			segments:    make([]segment, len(r.segments)),
+			undoNextLSN: r.prevLSN,
+		}
+		for i, s := range r.segments {
+			clr.segments[i] = segment{
+				offset: s.offset,
+				after:  s.before,
+			}
+		}
+		frame, err := f.Pin(r.blockID)
+		if err != nil {
+			return 0, err
+		}
+		lsn, err := f.appendRecord(clr)
+		if err != nil {
+			f.Unpin(frame, false)
+			return 0, err
+		}
+		applySegments(frame.Data, clr.segments)
+		f.setPageLSN(frame.Data, lsn)
+		f.Unpin(frame, true)
+		return r.prevLSN, nil
+	case recordType_CLR:
+		return r.undoNextLSN, nil
+	default:
+		return r.prevLSN, nil
+	}
+}
+
+// LogUpdate records the changes made to a pinned frame, given its contents
+// before the changes were made, and stamps the frame with the new page LSN.
+// The caller is still responsible for unpinning the frame (as dirty).
+func (f *File) LogUpdate(frame *buffer_pool.Frame, before []byte) error {
+	if !f.logging {
+		return nil
+	}
+	err := f.checkActive()
+	if err != nil {
+		return err
+	}
+	segments := diff(before, frame.Data)
+	if len(segments) == 0 {
+		return nil
+	}
+	lsn, err := f.appendRecord(&logRecord{
+		type_:    recordType_Update,
+		blockID:  frame.BlockID(),
+		segments: segments,
+	})
+	if err != nil {
+		return err
+	}
+	f.setPageLSN(frame.Data, lsn)
+	return nil
+}
+
+// Allocate returns a pinned, zeroed Frame for a newly allocated block.
+func (f *File) Allocate() (*buffer_pool.Frame, error) {
+	if f.logging {
+		err := f.checkActive()
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.appendRecord(&logRecord{
+			type_:   recordType_Allocate,
+			blockID: f.NumBlocks,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f.File.Allocate()
+}
+
+func (f *File) AllocateBlock() (int32, error) {
+	frame, err := f.Allocate()
+	if err != nil {
+		return block_file.InvalidBlockID, err
+	}
+	blockID := frame.BlockID()
+	f.Unpin(frame, true)
+	return blockID, nil
+}
+
+// WriteBlock replaces the contents of the given block, except for the page
+// LSN (which is maintained by the File).
+func (f *File) WriteBlock(b []byte, blockID int32) error {
+	frame, err := f.Pin(blockID)
+	if err != nil {
+		return err
+	}
+	copy(
+		b[f.pageLSNOffset:f.pageLSNOffset+8],
+		frame.Data[f.pageLSNOffset:f.pageLSNOffset+8])
+	before := make([]byte, len(frame.Data))
+	copy(before, frame.Data)
+	copy(frame.Data, b)
+	err = f.LogUpdate(frame, before)
+	f.Unpin(frame, true)
+	return err
+}
+
+// Checkpoint writes back every dirty block and then truncates the log.  It can
+// only be called when no transaction is active.
+func (f *File) Checkpoint() error {
+	if f.activeTxnID != 0 {
+		return errors.New("Cannot checkpoint during a transaction")
+	}
+	err := f.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return f.log.reset(f.log.nextLSN, f.NumBlocks)
+}
+
+// Close releases one open of the file; the last one to be released aborts the
+// active transaction (if any), takes a checkpoint, and closes the file.
+func (f *File) Close() error {
+	openFilesMu.Lock()
+	defer openFilesMu.Unlock()
+
+	if f.numOpens == 0 {
+		return nil
+	}
+	if f.numOpens > 1 {
+		f.numOpens--
+		return nil
+	}
+	if f.activeTxnID != 0 {
+		err := f.Abort()
+		if err != nil {
+			return err
+		}
+	}
+	if !f.logging || !f.log.isEmpty() {
+		err := f.Checkpoint()
+		if err != nil {
+			return err
+		}
+	}
+	err := f.File.Close()
+	if err != nil {
+		return err
+	}
+	f.numOpens = 0
+	delete(openFiles, f.BlockFile)
+	return f.log.close()
+}
+
+// Returns the ranges of bytes that differ between before and after.
+//
+// Precondition: len(before) == len(after)
+func diff(before []byte, after []byte) []segment {
+	var segments []segment
+	i := 0
+	for i < len(after) {
+		if before[i] == after[i] {
+			i++
+			continue
+		}
+		start := i
+		end := i + 1
+		// The segment ends once we see maxSegmentGap unchanged bytes in a row.
+		for j := end; j < len(after) && j < end+maxSegmentGap; j++ {
+			if before[j] != after[j] {
+				end = j + 1
+			}
+		}
+		segments = append(segments, segment{
+			offset: int32(start),
+			before: append([]byte(nil), before[start:end]...),
+			after:  append([]byte(nil), after[start:end]...),
+		})
+		i = end
+	}
+	return segments
+}
+
+func applySegments(data []byte, segments []segment) {
+	for _, s := range segments {
+		copy(data[s.offset:], s.after)
+	}
+}
+
+// AddChecksums converts the file at path (which can't be in use) to store a
+// checksum with each block; see block_file.AddChecksums.  Any changes in the
+// log are applied first, so that the log doesn't need to be converted.
+func AddChecksums(path string, blockSize int, pageLSNOffset int) error {
+	f, err := OpenFile(path, blockSize, pageLSNOffset)
+	if err != nil {
+		return err
+	}
+	openFilesMu.Lock()
+	inUse := f.numOpens > 1
+	openFilesMu.Unlock()
+	if inUse {
+		f.Close()
+		return errors.Newf("Cannot add checksums to %v while it's open", path)
+	}
+	// Opening the file recovers it, and closing it empties the log.
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return block_file.AddChecksums(path, blockSize)
+}
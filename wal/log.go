@@ -0,0 +1,372 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+)
+
+var byteOrder = binary.LittleEndian
+
+// Log sequence numbers increase monotonically for the lifetime of a log, even
+// across truncation; 0 is never assigned to a record.
+type LSN int64
+
+type TxnID int64
+
+type recordType uint8
+
+const (
+	recordType_Unknown recordType = iota
+	recordType_Begin
+	recordType_Update
+	recordType_Allocate
+	recordType_Commit
+	recordType_Abort
+	recordType_CLR
+	recordType_End
+)
+
+// A segment is a contiguous range of bytes within a block that was changed by
+// an update.
+type segment struct {
+	offset int32
+	before []byte
+	after  []byte
+}
+
+type logRecord struct {
+	lsn     LSN
+	prevLSN LSN
+	txnID   TxnID
+	type_   recordType
+
+	// Only used by update, allocate and CLR records.
+	blockID int32
+
+	// Only used by update and CLR records; for CLRs, only the after images are
+	// populated.
+	segments []segment
+
+	// Only used by CLRs: the next record of the same transaction that still
+	// needs to be undone.
+	undoNextLSN LSN
+}
+
+func (r *logRecord) marshal() []byte {
+	var buf bytes.Buffer
+	for _, value := range []interface{}{
+		r.lsn,
+		r.prevLSN,
+		r.txnID,
+		r.type_,
+		r.blockID,
+		r.undoNextLSN,
+		uint16(len(r.segments)),
+	} {
+		// err is always nil when writing to a bytes.Buffer.
+		_ = binary.Write(&buf, byteOrder, value)
+	}
+	for _, s := range r.segments {
+		_ = binary.Write(&buf, byteOrder, s.offset)
+		_ = binary.Write(&buf, byteOrder, uint32(len(s.after)))
+		buf.Write(s.after)
+		if r.type_ == recordType_Update {
+			buf.Write(s.before)
+		}
+	}
+	return buf.Bytes()
+}
+
+func unmarshalLogRecord(b []byte) (*logRecord, error) {
+	r := &logRecord{}
+	buf := bytes.NewReader(b)
+	var numSegments uint16
+	for _, value := range []interface{}{
+		&r.lsn,
+		&r.prevLSN,
+		&r.txnID,
+		&r.type_,
+		&r.blockID,
+		&r.undoNextLSN,
+		&numSegments,
+	} {
+		err := binary.Read(buf, byteOrder, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.segments = make([]segment, numSegments)
+	for i := range r.segments {
+		s := &r.segments[i]
+		var n uint32
+		for _, value := range []interface{}{&s.offset, &n} {
+			err := binary.Read(buf, byteOrder, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.after = make([]byte, n)
+		_, err := io.ReadFull(buf, s.after)
+		if err != nil {
+			return nil, err
+		}
+		if r.type_ == recordType_Update {
+			s.before = make([]byte, n)
+			_, err = io.ReadFull(buf, s.before)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// The log file starts with a fixed size header, followed by a sequence of
+// records, each of which is framed as:
+//
+//	length (uint32) | CRC-32 of payload (uint32) | payload
+//
+// A record that's incomplete or fails its checksum marks the end of the log
+// (e.g. it was torn by a crash in the middle of a write).
+const (
+	logMagic      uint32 = 0x7a64624c
+	logHeaderSize        = 16
+	frameSize            = 8
+)
+
+type logHeader struct {
+	// LSN of the first record in the log.
+	firstLSN LSN
+
+	// Number of blocks in the data file as of the last checkpoint.  Blocks
+	// beyond this point that weren't allocated by a committed transaction are
+	// discarded during recovery.
+	checkpointNumBlocks int32
+}
+
+type Log struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	w      *bufio.Writer
+	header logHeader
+
+	// Every record with lsn < flushedLSN is guaranteed to be on disk.
+	nextLSN    LSN
+	flushedLSN LSN
+	size       int64
+}
+
+// Returns the opened Log together with all of the records it contains.  If no
+// log exists at the given path, then a new one is created with the given
+// checkpointNumBlocks.
+func openLog(path string, checkpointNumBlocks int32) (*Log, []*logRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	l := &Log{
+		path: path,
+		f:    f,
+	}
+	if stat.Size() == 0 {
+		// The empty file is replaced (via rename) by reset.
+		err = l.reset(1, checkpointNumBlocks)
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, nil, nil
+	}
+	records, err := l.readAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, records, nil
+}
+
+func (l *Log) readAll() ([]*logRecord, error) {
+	_, err := l.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(l.f)
+	var magic uint32
+	for _, value := range []interface{}{
+		&magic,
+		&l.header.firstLSN,
+		&l.header.checkpointNumBlocks,
+	} {
+		err := binary.Read(r, byteOrder, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid log header in %v", l.path)
+		}
+	}
+	if magic != logMagic {
+		return nil, errors.Newf("%v is not a valid log file", l.path)
+	}
+	var records []*logRecord
+	offset := int64(logHeaderSize)
+	l.nextLSN = l.header.firstLSN
+	for {
+		var length, checksum uint32
+		err := binary.Read(r, byteOrder, &length)
+		if err == nil {
+			err = binary.Read(r, byteOrder, &checksum)
+		}
+		if err != nil {
+			break
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(r, payload)
+		if err != nil || crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		record, err := unmarshalLogRecord(payload)
+		if err != nil || record.lsn != l.nextLSN {
+			break
+		}
+		records = append(records, record)
+		offset += frameSize + int64(length)
+		l.nextLSN++
+	}
+	// Discard any torn record at the end, so new records are appended right
+	// after the last valid one.
+	err = l.f.Truncate(offset)
+	if err != nil {
+		return nil, err
+	}
+	_, err = l.f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	l.w = bufio.NewWriter(l.f)
+	l.flushedLSN = l.nextLSN
+	l.size = offset
+	return records, nil
+}
+
+// Assigns an LSN to the record and appends it to the log buffer; the record
+// isn't guaranteed to be on disk until flush is called.
+func (l *Log) append(r *logRecord) (LSN, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.lsn = l.nextLSN
+	payload := r.marshal()
+	for _, value := range []interface{}{
+		uint32(len(payload)),
+		crc32.ChecksumIEEE(payload),
+	} {
+		err := binary.Write(l.w, byteOrder, value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := l.w.Write(payload)
+	if err != nil {
+		return 0, err
+	}
+	l.nextLSN++
+	l.size += frameSize + int64(len(payload))
+	crashPoint(CrashPoint_Append)
+	return r.lsn, nil
+}
+
+// Makes sure that every record with LSN <= lsn is on disk.
+func (l *Log) flush(lsn LSN) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lsn < l.flushedLSN {
+		return nil
+	}
+	err := l.w.Flush()
+	if err != nil {
+		return err
+	}
+	err = l.f.Sync()
+	if err != nil {
+		return err
+	}
+	l.flushedLSN = l.nextLSN
+	return nil
+}
+
+// Discards every record in the log; LSNs assigned afterwards will start at
+// firstLSN.
+//
+// The new log is written to a temporary file and then renamed into place, so a
+// crash can never leave behind a log that has lost its header.
+func (l *Log) reset(firstLSN LSN, checkpointNumBlocks int32) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, value := range []interface{}{
+		logMagic,
+		firstLSN,
+		checkpointNumBlocks,
+	} {
+		_ = binary.Write(&buf, byteOrder, value)
+	}
+	b := make([]byte, logHeaderSize)
+	copy(b, buf.Bytes())
+	tmpPath := l.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, l.path)
+	if err != nil {
+		return err
+	}
+	if l.f != nil {
+		// Any buffered records are being discarded anyway.
+		_ = l.f.Close()
+	}
+	l.f = f
+	l.header = logHeader{
+		firstLSN:            firstLSN,
+		checkpointNumBlocks: checkpointNumBlocks,
+	}
+	l.w = bufio.NewWriter(l.f)
+	l.nextLSN = firstLSN
+	l.flushedLSN = firstLSN
+	l.size = logHeaderSize
+	return nil
+}
+
+// Returns whether any records have been appended since the last reset.
+func (l *Log) isEmpty() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.nextLSN == l.header.firstLSN
+}
+
+func (l *Log) close() error {
+	err := l.w.Flush()
+	if err != nil {
+		return err
+	}
+	return l.f.Close()
+}
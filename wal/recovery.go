@@ -0,0 +1,169 @@
+package wal
+
+import (
+	"github.com/dropbox/godropbox/errors"
+)
+
+type txnState struct {
+	lastLSN   LSN
+	committed bool
+}
+
+// recover brings the file back to a consistent state after a crash, following
+// the three passes of ARIES:
+//
+//   - Analysis determines which transactions were still in flight (the
+//     "losers") when the log ends
+//
+//   - Redo repeats history by reapplying every logged change that didn't make it
+//     to disk (as determined by comparing each block's page LSN with the LSN of
+//     the log record)
+//
+//   - Undo rolls back the losers, writing compensation log records (CLRs) so
+//     that a crash during recovery never undoes the same change twice
+//
+// Since the log is truncated after every checkpoint (and every checkpoint
+// writes back all dirty blocks), recovery always starts from the beginning of
+// the log.  Once recovery is done, we take a checkpoint, so the log is empty
+// again.
+func (f *File) recover(records []*logRecord) error {
+	// Analysis.
+	txns := make(map[TxnID]*txnState)
+	byLSN := make(map[LSN]*logRecord, len(records))
+	for _, r := range records {
+		byLSN[r.lsn] = r
+		if r.txnID >= f.nextTxnID {
+			f.nextTxnID = r.txnID + 1
+		}
+		if r.type_ == recordType_End {
+			delete(txns, r.txnID)
+			continue
+		}
+		txn, ok := txns[r.txnID]
+		if !ok {
+			txn = &txnState{}
+			txns[r.txnID] = txn
+		}
+		txn.lastLSN = r.lsn
+		if r.type_ == recordType_Commit {
+			txn.committed = true
+		}
+	}
+
+	// Redo.
+	for _, r := range records {
+		switch r.type_ {
+		case recordType_Allocate, recordType_Update, recordType_CLR:
+			err := f.ensureAllocated(r.blockID)
+			if err != nil {
+				return err
+			}
+		}
+		if r.type_ != recordType_Update && r.type_ != recordType_CLR {
+			continue
+		}
+		frame, err := f.Pin(r.blockID)
+		if err != nil {
+			return err
+		}
+		if f.pageLSN(frame.Data) >= r.lsn {
+			f.Unpin(frame, false)
+			continue
+		}
+		applySegments(frame.Data, r.segments)
+		f.setPageLSN(frame.Data, r.lsn)
+		f.Unpin(frame, true)
+	}
+
+	// Undo.  Each loser is rolled back one record at a time, always choosing
+	// the record with the largest LSN among all losers.
+	for txnID, txn := range txns {
+		if txn.committed {
+			f.activeTxnID = txnID
+			f.activeRecords = []*logRecord{byLSN[txn.lastLSN]}
+			_, err := f.appendRecord(&logRecord{type_: recordType_End})
+			if err != nil {
+				return err
+			}
+			delete(txns, txnID)
+		}
+	}
+	toUndo := make(map[TxnID]LSN, len(txns))
+	for txnID, txn := range txns {
+		toUndo[txnID] = txn.lastLSN
+	}
+	for len(toUndo) > 0 {
+		var txnID TxnID
+		var lsn LSN
+		for id, nextLSN := range toUndo {
+			if nextLSN > lsn {
+				txnID = id
+				lsn = nextLSN
+			}
+		}
+		r, ok := byLSN[lsn]
+		if !ok {
+			return errors.Newf("LSN %d is missing from the log", lsn)
+		}
+		f.activeTxnID = txnID
+		f.activeRecords = []*logRecord{byLSN[txns[txnID].lastLSN]}
+		nextLSN, err := f.undo(r)
+		if err != nil {
+			return err
+		}
+		txns[txnID].lastLSN = f.activeRecords[len(f.activeRecords)-1].lsn
+		byLSN[txns[txnID].lastLSN] = f.activeRecords[len(f.activeRecords)-1]
+		if nextLSN == 0 {
+			_, err = f.appendRecord(&logRecord{type_: recordType_End})
+			if err != nil {
+				return err
+			}
+			delete(toUndo, txnID)
+		} else {
+			toUndo[txnID] = nextLSN
+		}
+	}
+	f.endTxn()
+
+	// Blocks at the end of the file that were allocated after the last
+	// checkpoint, but not by a committed transaction, are discarded.
+	numBlocks := f.log.header.checkpointNumBlocks
+	for _, r := range records {
+		_, isLoser := txns[r.txnID]
+		if !isLoser && r.type_ == recordType_Allocate && r.blockID >= numBlocks {
+			numBlocks = r.blockID + 1
+		}
+	}
+	if len(records) == 0 && f.NumBlocks <= numBlocks {
+		return nil
+	}
+	err := f.Flush()
+	if err != nil {
+		return err
+	}
+	if f.NumBlocks > numBlocks {
+		err = f.bp.DropFile(f.BlockFile)
+		if err != nil {
+			return err
+		}
+		err = f.BlockFile.Truncate(numBlocks)
+		if err != nil {
+			return err
+		}
+		// DropFile also removed the write-back hook.
+		f.bp.SetWriteBackHook(f.BlockFile, f.beforeWriteBack)
+	}
+	return f.Checkpoint()
+}
+
+// Redo might refer to blocks that were allocated before the crash, but were
+// then discarded because the file's new size never made it to disk.
+func (f *File) ensureAllocated(blockID int32) error {
+	for f.NumBlocks <= blockID {
+		_, err := f.File.AllocateBlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package wal
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/dropbox/godropbox/gocheck2"
+	"github.com/robot-dreams/zdb2/buffer_pool"
+)
+
+type WALSuite struct {
+	defaultPool *buffer_pool.BufferPool
+}
+
+var _ = Suite(&WALSuite{})
+
+const (
+	testBlockSize     = 1 << 6
+	testPageLSNOffset = testBlockSize - 8
+)
+
+func (s *WALSuite) SetUpTest(c *C) {
+	s.defaultPool = buffer_pool.Default()
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(4, buffer_pool.NewLRU()))
+}
+
+func (s *WALSuite) TearDownTest(c *C) {
+	ClearCrashPoints()
+	buffer_pool.SetDefault(s.defaultPool)
+}
+
+// Simulates a crash by abandoning every cached block (without writing any of
+// them back).
+func simulateCrash() {
+	buffer_pool.SetDefault(buffer_pool.NewBufferPool(4, buffer_pool.NewLRU()))
+}
+
+func openTestFile(c *C, path string) *File {
+	f, err := OpenFile(path, testBlockSize, testPageLSNOffset)
+	c.Assert(err, IsNil)
+	return f
+}
+
+func writeByte(c *C, f *File, blockID int32, value byte) {
+	b := make([]byte, testBlockSize)
+	err := f.ReadBlock(b, blockID)
+	c.Assert(err, IsNil)
+	b[0] = value
+	err = f.WriteBlock(b, blockID)
+	c.Assert(err, IsNil)
+}
+
+func readByte(c *C, f *File, blockID int32) byte {
+	b := make([]byte, testBlockSize)
+	err := f.ReadBlock(b, blockID)
+	c.Assert(err, IsNil)
+	return b[0]
+}
+
+func (s *WALSuite) TestDiff(c *C) {
+	before := make([]byte, 64)
+	after := make([]byte, 64)
+	after[1] = 1
+	after[5] = 1
+	after[40] = 1
+	segments := diff(before, after)
+	c.Assert(segments, HasLen, 2)
+	c.Assert(segments[0].offset, Equals, int32(1))
+	c.Assert(segments[0].after, DeepEquals, []byte{1, 0, 0, 0, 1})
+	c.Assert(segments[1].offset, Equals, int32(40))
+
+	applied := make([]byte, 64)
+	applySegments(applied, segments)
+	c.Assert(applied, DeepEquals, after)
+}
+
+func (s *WALSuite) TestCommittedSurvivesCrash(c *C) {
+	path := c.MkDir() + "/wal_test"
+	f := openTestFile(c, path)
+	for i := 0; i < 10; i++ {
+		c.Assert(f.Begin(), IsNil)
+		blockID, err := f.AllocateBlock()
+		c.Assert(err, IsNil)
+		writeByte(c, f, blockID, byte(i+1))
+		c.Assert(f.Commit(), IsNil)
+	}
+	simulateCrash()
+
+	f = openTestFile(c, path)
+	defer f.Close()
+	c.Assert(f.NumBlocks, Equals, int32(10))
+	for i := int32(0); i < 10; i++ {
+		c.Assert(readByte(c, f, i), Equals, byte(i+1))
+	}
+	c.Assert(f.log.isEmpty(), IsTrue)
+}
+
+func (s *WALSuite) TestUncommittedRolledBack(c *C) {
+	path := c.MkDir() + "/wal_test"
+	f := openTestFile(c, path)
+	c.Assert(f.Begin(), IsNil)
+	blockID, err := f.AllocateBlock()
+	c.Assert(err, IsNil)
+	writeByte(c, f, blockID, 1)
+	c.Assert(f.Commit(), IsNil)
+
+	c.Assert(f.Begin(), IsNil)
+	writeByte(c, f, blockID, 2)
+	for i := 0; i < 10; i++ {
+		newBlockID, err := f.AllocateBlock()
+		c.Assert(err, IsNil)
+		writeByte(c, f, newBlockID, 3)
+	}
+	// Make sure the uncommitted changes reach the disk.
+	c.Assert(f.Flush(), IsNil)
+	simulateCrash()
+
+	f = openTestFile(c, path)
+	c.Assert(f.NumBlocks, Equals, int32(1))
+	c.Assert(readByte(c, f, blockID), Equals, byte(1))
+	c.Assert(f.Close(), IsNil)
+
+	// A crash right after recovery shouldn't lose anything either.
+	f = openTestFile(c, path)
+	defer f.Close()
+	c.Assert(readByte(c, f, blockID), Equals, byte(1))
+}
+
+func (s *WALSuite) TestAbort(c *C) {
+	path := c.MkDir() + "/wal_test"
+	f := openTestFile(c, path)
+	c.Assert(f.Begin(), IsNil)
+	blockID, err := f.AllocateBlock()
+	c.Assert(err, IsNil)
+	writeByte(c, f, blockID, 1)
+	c.Assert(f.Commit(), IsNil)
+
+	c.Assert(f.Begin(), IsNil)
+	writeByte(c, f, blockID, 2)
+	writeByte(c, f, blockID, 3)
+	c.Assert(f.Abort(), IsNil)
+	c.Assert(readByte(c, f, blockID), Equals, byte(1))
+
+	// The CLRs written during the abort must not be undone again.
+	c.Assert(f.Flush(), IsNil)
+	simulateCrash()
+	f = openTestFile(c, path)
+	defer f.Close()
+	c.Assert(readByte(c, f, blockID), Equals, byte(1))
+}
+
+func (s *WALSuite) TestNoChangesOutsideTransaction(c *C) {
+	f := openTestFile(c, c.MkDir()+"/wal_test")
+	defer f.Close()
+	_, err := f.AllocateBlock()
+	c.Assert(err, NotNil)
+}
+
+func (s *WALSuite) TestUnlogged(c *C) {
+	path := c.MkDir() + "/wal_test"
+	f := openTestFile(c, path)
+	c.Assert(f.SetLogging(false), IsNil)
+	c.Assert(f.Begin(), IsNil)
+	for i := 0; i < 10; i++ {
+		blockID, err := f.AllocateBlock()
+		c.Assert(err, IsNil)
+		writeByte(c, f, blockID, byte(i+1))
+	}
+	c.Assert(f.Commit(), IsNil)
+	c.Assert(f.log.isEmpty(), IsTrue)
+	c.Assert(f.Close(), IsNil)
+
+	f = openTestFile(c, path)
+	defer f.Close()
+	c.Assert(f.NumBlocks, Equals, int32(10))
+	for i := int32(0); i < 10; i++ {
+		c.Assert(readByte(c, f, i), Equals, byte(i+1))
+	}
+}
+
+func (s *WALSuite) TestTornLogTail(c *C) {
+	path := c.MkDir() + "/wal_test"
+	f := openTestFile(c, path)
+	c.Assert(f.Begin(), IsNil)
+	blockID, err := f.AllocateBlock()
+	c.Assert(err, IsNil)
+	writeByte(c, f, blockID, 1)
+	c.Assert(f.Commit(), IsNil)
+	c.Assert(f.log.flush(f.log.nextLSN), IsNil)
+	simulateCrash()
+
+	logFile, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	_, err = logFile.Write([]byte{100, 0, 0, 0, 1, 2, 3})
+	c.Assert(err, IsNil)
+	c.Assert(logFile.Close(), IsNil)
+
+	f = openTestFile(c, path)
+	defer f.Close()
+	c.Assert(readByte(c, f, blockID), Equals, byte(1))
+}
+
+func (s *WALSuite) TestOpenTwice(c *C) {
+	path := c.MkDir() + "/wal_test"
+	f := openTestFile(c, path)
+	c.Assert(f.Begin(), IsNil)
+	blockID, err := f.AllocateBlock()
+	c.Assert(err, IsNil)
+	writeByte(c, f, blockID, 1)
+	c.Assert(f.Commit(), IsNil)
+
+	// Opening the file again doesn't recover it (or truncate its log) while
+	// it's still open.
+	other := openTestFile(c, path)
+	c.Assert(other, Equals, f)
+	c.Assert(readByte(c, other, blockID), Equals, byte(1))
+	c.Assert(AddChecksums(path, testBlockSize, testPageLSNOffset), NotNil)
+	c.Assert(other.Close(), IsNil)
+	c.Assert(f.Begin(), IsNil)
+	writeByte(c, f, blockID, 2)
+	c.Assert(f.Commit(), IsNil)
+
+	simulateCrash()
+	f = openTestFile(c, path)
+	c.Assert(f.NumBlocks, Equals, int32(1))
+	c.Assert(readByte(c, f, blockID), Equals, byte(2))
+	c.Assert(f.Close(), IsNil)
+}
+
+func (s *WALSuite) TestCrashPoints(c *C) {
+	path := c.MkDir() + "/wal_test"
+	committed := 0
+	for _, point := range []string{
+		CrashPoint_Append,
+		CrashPoint_Commit,
+		CrashPoint_WriteBack,
+	} {
+		for n := 1; n <= 20; n += 3 {
+			f := openTestFile(c, path)
+			// The transaction that was interrupted might have been durable
+			// already (if the crash happened after the commit record was
+			// flushed).
+			c.Assert(
+				f.NumBlocks == int32(committed) ||
+					f.NumBlocks == int32(committed+1),
+				IsTrue)
+			committed = int(f.NumBlocks)
+			for i := int32(0); i < f.NumBlocks; i++ {
+				c.Assert(readByte(c, f, i), Equals, byte(i+1))
+			}
+			SetCrashPoint(point, n)
+			func() {
+				defer func() {
+					r := recover()
+					c.Assert(r, Equals, Crash)
+				}()
+				for i := 0; i < 1000; i++ {
+					c.Assert(f.Begin(), IsNil)
+					blockID, err := f.AllocateBlock()
+					c.Assert(err, IsNil)
+					writeByte(c, f, blockID, byte(blockID+1))
+					c.Assert(f.Commit(), IsNil)
+					committed++
+				}
+				c.Fatalf("Crash point %v was never reached", point)
+			}()
+			ClearCrashPoints()
+			simulateCrash()
+		}
+	}
+}